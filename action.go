@@ -15,6 +15,7 @@ import (
 
 	"github.com/mediocregopher/radix/v3/resp"
 	"github.com/mediocregopher/radix/v3/resp/resp2"
+	"github.com/mediocregopher/radix/v3/resp/resp3"
 )
 
 // Action performs a task using a Conn.
@@ -66,9 +67,10 @@ var noKeyCmds = map[string]bool{
 	"WAIT":      true,
 	"SCAN":      true,
 
-	"EVAL":    true,
-	"EVALSHA": true,
-	"SCRIPT":  true,
+	"EVAL":     true,
+	"EVALSHA":  true,
+	"SCRIPT":   true,
+	"FUNCTION": true,
 
 	"BGREWRITEAOF": true,
 	"BGSAVE":       true,
@@ -212,6 +214,21 @@ func findStreamsKeys(args []string) []string {
 	return nil
 }
 
+// findFCallKeys returns the keys of an FCALL or FCALL_RO command, given the
+// arguments following the command name.
+func findFCallKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys <= 0 {
+		return nil
+	} else if numKeys > len(args)-2 {
+		numKeys = len(args) - 2
+	}
+	return args[2 : 2+numKeys]
+}
+
 func (c *cmdAction) Keys() []string {
 	if c.flat {
 		return c.flatKey[:]
@@ -229,6 +246,8 @@ func (c *cmdAction) Keys() []string {
 		return c.args[1:2]
 	} else if cmd == "XREAD" || cmd == "XREADGROUP" { // antirez why you still do this
 		return findStreamsKeys(c.args)
+	} else if cmd == "FCALL" || cmd == "FCALL_RO" {
+		return findFCallKeys(c.args)
 	} else if noKeyCmds[cmd] || len(c.args) == 0 {
 		return nil
 	}
@@ -273,6 +292,20 @@ func (c *cmdAction) UnmarshalRESP(br *bufio.Reader) error {
 	return nil
 }
 
+func (c *cmdAction) unmarshalRESP3(br *bufio.Reader) error {
+	var err error
+	if u, ok := c.rcv.(resp.Unmarshaler); ok && !isRESP3Unmarshaler(u) {
+		err = unmarshalDowngraded(br, u)
+	} else {
+		err = resp3.Any{I: c.rcv}.UnmarshalRESP(br)
+	}
+	if err != nil {
+		return err
+	}
+	cmdActionPool.Put(c)
+	return nil
+}
+
 func (c *cmdAction) Run(conn Conn) error {
 	if err := conn.Encode(c); err != nil {
 		return err
@@ -280,6 +313,33 @@ func (c *cmdAction) Run(conn Conn) error {
 	return conn.Decode(c)
 }
 
+// actionCmd returns the name of the command which the Action performs, and the
+// number of arguments passed to it, if it's known.
+func actionCmd(a Action) (string, int) {
+	switch a := a.(type) {
+	case *cmdAction:
+		if a.flat {
+			return a.cmd, 1 + (resp2.Any{I: a.flatArgs}).NumElems()
+		}
+		return a.cmd, len(a.args)
+	case *evalAction:
+		n := 2 + len(a.keys)
+		if a.flat {
+			n += (resp2.Any{I: a.flatArgs}).NumElems()
+		} else {
+			n += len(a.args)
+		}
+		return string(evalsha), n
+	case *fcallAction:
+		if a.ro {
+			return string(fcallRO), 2 + len(a.keys) + len(a.args)
+		}
+		return string(fcall), 2 + len(a.keys) + len(a.args)
+	default:
+		return "", 0
+	}
+}
+
 func (c *cmdAction) String() string {
 	return cmdString(c)
 }
@@ -510,10 +570,14 @@ type pipeline []CmdAction
 //
 // Run will not be called on any of the passed in CmdActions.
 //
+// When used with Cluster all of the commands' keys must belong to the same
+// slot. Cluster.DoPipeline can be used to pipeline commands whose keys belong to
+// different slots.
+//
 // NOTE that, while a Pipeline performs all commands on a single Conn, it
 // shouldn't be used by itself for MULTI/EXEC transactions, because if there's
-// an error it won't discard the incomplete transaction. Use WithConn or
-// EvalScript for transactional functionality instead.
+// an error it won't discard the incomplete transaction. Use Transaction,
+// WithConn or EvalScript for transactional functionality instead.
 func Pipeline(cmds ...CmdAction) Action {
 	return pipeline(cmds)
 }
@@ -608,7 +672,7 @@ type withConn struct {
 //
 // NOTE that WithConn only ensures all inner Actions are performed on the same
 // Conn, it doesn't make them transactional. Use MULTI/WATCH/EXEC within a
-// WithConn for transactions, or use EvalScript
+// WithConn for transactions, or use Transaction or EvalScript
 func WithConn(key string, fn func(Conn) error) Action {
 	return &withConn{[1]string{key}, fn}
 }
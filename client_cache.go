@@ -0,0 +1,648 @@
+package radix
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+	"github.com/mediocregopher/radix/v3/resp/resp3"
+)
+
+// clientCacheInvalidateChannel is the channel redis publishes invalidation
+// messages on when tracking is redirected to a RESP2 connection.
+const clientCacheInvalidateChannel = "__redis__:invalidate"
+
+var defaultClientCacheCmds = []string{
+	"GET", "GETRANGE", "STRLEN", "GETBIT", "BITCOUNT", "TYPE",
+	"HGET", "HGETALL", "HMGET", "HKEYS", "HVALS", "HLEN", "HEXISTS", "HSTRLEN",
+	"LINDEX", "LLEN", "LRANGE",
+	"SCARD", "SISMEMBER", "SMEMBERS",
+	"ZCARD", "ZCOUNT", "ZRANGE", "ZRANGEBYSCORE", "ZRANK", "ZREVRANGE",
+	"ZREVRANK", "ZSCORE",
+}
+
+type clientCacheOpts struct {
+	size     int
+	poolSize int
+	poolOpts []PoolOpt
+	bcast    bool
+	prefixes []string
+	cmds     map[string]bool
+	errCh    chan<- error
+}
+
+// ClientCacheOpt is an optional behavior which can be applied to the
+// NewClientCache function to effect a ClientCache's behavior.
+type ClientCacheOpt func(*clientCacheOpts)
+
+// ClientCacheSize sets the maximum number of replies which will be kept in the
+// cache. Once the cache is full the least recently used reply is evicted to
+// make room for a new one.
+func ClientCacheSize(size int) ClientCacheOpt {
+	return func(opts *clientCacheOpts) {
+		opts.size = size
+	}
+}
+
+// ClientCachePool sets the size of the Pool which the ClientCache creates to
+// perform Actions, along with any options it should be created with. If
+// PoolConnFunc is one of the options then its ConnFunc will also be used to
+// create the ClientCache's invalidation connection.
+func ClientCachePool(size int, opts ...PoolOpt) ClientCacheOpt {
+	return func(ccOpts *clientCacheOpts) {
+		ccOpts.poolSize = size
+		ccOpts.poolOpts = opts
+	}
+}
+
+// ClientCacheBroadcast enables redis' broadcasting tracking mode (BCAST). In
+// this mode redis sends an invalidation for every changed key starting with
+// one of the given prefixes, rather than remembering which keys each
+// connection has read. Only replies for keys matching one of the prefixes are
+// cached. If no prefixes are given then all keys are matched.
+//
+// NOTE that each connection in the Pool registers the prefixes separately, so
+// redis may send the same invalidation more than once.
+func ClientCacheBroadcast(prefixes ...string) ClientCacheOpt {
+	return func(opts *clientCacheOpts) {
+		opts.bcast = true
+		opts.prefixes = prefixes
+	}
+}
+
+// ClientCacheCommands sets the commands whose replies will be cached,
+// replacing the default set. Only read-only commands whose first argument is
+// their only key should be given.
+func ClientCacheCommands(cmds ...string) ClientCacheOpt {
+	return func(opts *clientCacheOpts) {
+		opts.cmds = map[string]bool{}
+		for _, cmd := range cmds {
+			opts.cmds[strings.ToUpper(cmd)] = true
+		}
+	}
+}
+
+// ClientCacheErrCh takes a channel which asynchronous errors encountered by the
+// ClientCache, e.g. those from its invalidation connection, can be read off
+// of. If the channel blocks the error will be dropped.
+//
+// The channel is never closed by the ClientCache, so it may be shared with
+// other components. Once Close has returned no more errors will be written to
+// it.
+func ClientCacheErrCh(errCh chan<- error) ClientCacheOpt {
+	return func(opts *clientCacheOpts) {
+		opts.errCh = errCh
+	}
+}
+
+type clientCacheEntry struct {
+	cacheKey, key string
+	rm            resp2.RawMessage
+}
+
+// clientCachePending tracks the replies for a key which are currently being
+// read from redis, so that an invalidation arriving before they can be stored
+// isn't missed.
+type clientCachePending struct {
+	n           int
+	invalidated bool
+}
+
+// clientCacheConn wraps the Conns of a ClientCache's Pool, recording which
+// invalidation connection, if any, tracking on the Conn is redirected to.
+type clientCacheConn struct {
+	Conn
+	gen uint64
+}
+
+// clientCacheInvalidator is a connection which a ClientCache is receiving
+// invalidation messages over.
+type clientCacheInvalidator struct {
+	id    string
+	errCh chan error
+	close func()
+}
+
+// ClientCache is a Client which keeps a bounded, local cache of the replies to
+// read-only commands (GET, HGETALL, etc...) performed through it. It uses
+// redis' server-assisted client side caching (CLIENT TRACKING, available
+// since redis 6.0) to evict replies as soon as the keys they were read from
+// are changed.
+//
+// A ClientCache creates its own Pool, and a dedicated connection which redis
+// sends invalidation messages to. Tracking is enabled on each connection of
+// the Pool, redirected to that dedicated connection, the first time it is used
+// to read a reply which will be cached. If the dedicated connection uses RESP3
+// (see DialHello) then invalidations are read off of it as push messages,
+// otherwise it is used as a PubSubConn subscribed to redis' invalidation
+// channel.
+//
+// Only Actions created by Cmd or FlatCmd for one of the cached commands are
+// served from the cache, all other Actions are passed through to the Pool.
+// Error replies are never cached. If the dedicated connection is lost the
+// cache is emptied, and Actions are passed through until a new connection has
+// been made.
+type ClientCache struct {
+	opts          clientCacheOpts
+	network, addr string
+	cf            ConnFunc
+	pool          *Pool
+
+	l          sync.Mutex
+	gen        uint64
+	redirectID string // empty when there is no invalidation connection
+	lru        *list.List
+	entries    map[string]*list.Element
+	byKey      map[string]map[string]struct{}
+	pending    map[string]*clientCachePending
+
+	closeOnce sync.Once
+	closeErr  error
+	closeCh   chan struct{}
+	doneCh    chan struct{}
+}
+
+var _ ContextClient = new(ClientCache)
+
+// NewClientCache creates a ClientCache for the redis instance at the given
+// address. It will return an error if the Pool or the invalidation connection
+// can't be created.
+//
+// NewClientCache takes in a number of options which can overwrite its default
+// behavior. The default options NewClientCache uses are:
+//
+//	ClientCacheSize(10000)
+//	ClientCachePool(4)
+//
+// By default GET, HGET, HGETALL, LRANGE, SMEMBERS, ZRANGE, ZSCORE and a number
+// of other single key read commands are cached.
+func NewClientCache(network, addr string, opts ...ClientCacheOpt) (*ClientCache, error) {
+	cc := &ClientCache{
+		network: network,
+		addr:    addr,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		byKey:   map[string]map[string]struct{}{},
+		pending: map[string]*clientCachePending{},
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+
+	defaultClientCacheOpts := []ClientCacheOpt{
+		ClientCacheSize(10000),
+		ClientCachePool(4),
+		ClientCacheCommands(defaultClientCacheCmds...),
+	}
+
+	for _, opt := range append(defaultClientCacheOpts, opts...) {
+		opt(&(cc.opts))
+	}
+
+	// the ConnFunc given to the Pool, if any, is used for the invalidation
+	// connection as well, and is wrapped for the Pool itself.
+	po := poolOpts{cf: DefaultConnFunc}
+	for _, opt := range cc.opts.poolOpts {
+		opt(&po)
+	}
+	cc.cf = po.cf
+
+	inv, err := cc.dialInvalidator()
+	if err != nil {
+		return nil, err
+	}
+	cc.setRedirect(inv.id)
+
+	poolOpts := make([]PoolOpt, 0, len(cc.opts.poolOpts)+1)
+	poolOpts = append(poolOpts, cc.opts.poolOpts...)
+	poolOpts = append(poolOpts, PoolConnFunc(cc.connFunc))
+	if cc.pool, err = NewPool(network, addr, cc.opts.poolSize, poolOpts...); err != nil {
+		inv.close()
+		return nil, err
+	}
+
+	go cc.spin(inv)
+	return cc, nil
+}
+
+func (cc *ClientCache) connFunc(network, addr string) (Conn, error) {
+	c, err := cc.cf(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &clientCacheConn{Conn: c}, nil
+}
+
+func (cc *ClientCache) err(err error) {
+	if cc.opts.errCh == nil {
+		return
+	}
+	select {
+	case cc.opts.errCh <- err:
+	default:
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func (cc *ClientCache) dialInvalidator() (*clientCacheInvalidator, error) {
+	conn, err := cc.cf(cc.network, cc.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var id string
+	if err := conn.Do(Cmd(&id, "CLIENT", "ID")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if info, ok := ConnHelloInfo(conn); ok && info.Proto == 3 {
+		return cc.pushInvalidator(conn, id), nil
+	}
+	return cc.pubSubInvalidator(conn, id)
+}
+
+func (cc *ClientCache) pubSubInvalidator(conn Conn, id string) (*clientCacheInvalidator, error) {
+	errCh := make(chan error, 1)
+	msgCh := make(chan PubSubMessage)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for m := range msgCh {
+			cc.invalidateMessage(m)
+		}
+	}()
+
+	ps := newPubSub(conn, errCh)
+	inv := &clientCacheInvalidator{
+		id:    id,
+		errCh: errCh,
+		close: func() {
+			ps.Close()
+			close(msgCh)
+			<-doneCh
+		},
+	}
+
+	if err := ps.Subscribe(msgCh, clientCacheInvalidateChannel); err != nil {
+		inv.close()
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (cc *ClientCache) pushInvalidator(conn Conn, id string) *clientCacheInvalidator {
+	errCh := make(chan error, 1)
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for {
+			var rm resp3.RawMessage
+			err := conn.Decode(&rm)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			} else if err != nil {
+				errCh <- err
+				return
+			}
+			cc.invalidatePush(rm)
+		}
+	}()
+
+	// Like PubSubConn, periodically call PING so the connection has a
+	// keepalive on the application level. The replies are discarded by the
+	// reading go-routine.
+	go func() {
+		t := time.NewTicker(5 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := conn.Encode(Cmd(nil, "PING")); err != nil {
+					return
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	return &clientCacheInvalidator{
+		id:    id,
+		errCh: errCh,
+		close: func() {
+			close(stopCh)
+			conn.Close()
+			<-doneCh
+		},
+	}
+}
+
+// invalidateMessage handles an invalidation published to a RESP2 connection,
+// whose Message will either be the raw RESP of the array of invalidated keys,
+// or nil if the whole database was flushed.
+func (cc *ClientCache) invalidateMessage(m PubSubMessage) {
+	var keys []string
+	if rm := resp2.RawMessage(m.Message); m.Message != nil && !rm.IsNil() {
+		if err := rm.UnmarshalInto(resp2.Any{I: &keys}); err != nil {
+			cc.err(errors.Errorf("malformed invalidation message: %w", err))
+			keys = nil
+		}
+	}
+	cc.invalidate(keys)
+}
+
+// invalidatePush handles a message read off of a RESP3 invalidation
+// connection. Anything other than an invalidate push message is ignored.
+func (cc *ClientCache) invalidatePush(rm resp3.RawMessage) {
+	if !bytes.HasPrefix(rm, resp3.PushPrefix) {
+		return
+	}
+
+	br := bufio.NewReader(bytes.NewReader(rm))
+	var ph resp3.PushHeader
+	var kind resp3.BlobString
+	if err := ph.UnmarshalRESP(br); err != nil {
+		cc.err(err)
+		return
+	} else if ph.N != 2 {
+		return
+	} else if err := kind.UnmarshalRESP(br); err != nil {
+		cc.err(err)
+		return
+	} else if kind.S != "invalidate" {
+		return
+	}
+
+	var keys []string
+	if err := (resp3.Any{I: &keys}).UnmarshalRESP(br); err != nil {
+		cc.err(errors.Errorf("malformed invalidation message: %w", err))
+		keys = nil
+	}
+	cc.invalidate(keys)
+}
+
+// invalidate removes all cached replies for the given keys. If keys is nil
+// then the whole cache is emptied.
+func (cc *ClientCache) invalidate(keys []string) {
+	cc.l.Lock()
+	defer cc.l.Unlock()
+
+	if keys == nil {
+		cc.flush()
+		return
+	}
+
+	for _, key := range keys {
+		for cacheKey := range cc.byKey[key] {
+			cc.remove(cc.entries[cacheKey])
+		}
+		if p := cc.pending[key]; p != nil {
+			p.invalidated = true
+		}
+	}
+}
+
+// NOTE l _must_ be held to use flush
+func (cc *ClientCache) flush() {
+	cc.lru.Init()
+	cc.entries = map[string]*list.Element{}
+	cc.byKey = map[string]map[string]struct{}{}
+	for _, p := range cc.pending {
+		p.invalidated = true
+	}
+}
+
+// NOTE l _must_ be held to use remove
+func (cc *ClientCache) remove(el *list.Element) {
+	e := cc.lru.Remove(el).(*clientCacheEntry)
+	delete(cc.entries, e.cacheKey)
+	if cacheKeys := cc.byKey[e.key]; cacheKeys != nil {
+		delete(cacheKeys, e.cacheKey)
+		if len(cacheKeys) == 0 {
+			delete(cc.byKey, e.key)
+		}
+	}
+}
+
+// NOTE l _must_ be held to use store
+func (cc *ClientCache) store(cacheKey, key string, rm resp2.RawMessage) {
+	if _, ok := cc.entries[cacheKey]; ok {
+		return
+	}
+
+	cc.entries[cacheKey] = cc.lru.PushFront(&clientCacheEntry{
+		cacheKey: cacheKey,
+		key:      key,
+		rm:       rm,
+	})
+	if cc.byKey[key] == nil {
+		cc.byKey[key] = map[string]struct{}{}
+	}
+	cc.byKey[key][cacheKey] = struct{}{}
+
+	for cc.lru.Len() > cc.opts.size {
+		cc.remove(cc.lru.Back())
+	}
+}
+
+// setRedirect is called whenever the invalidation connection changes. id will
+// be empty if there currently isn't one.
+func (cc *ClientCache) setRedirect(id string) {
+	cc.l.Lock()
+	defer cc.l.Unlock()
+	cc.gen++
+	cc.redirectID = id
+	cc.flush()
+}
+
+func (cc *ClientCache) spin(inv *clientCacheInvalidator) {
+	defer close(cc.doneCh)
+	for {
+		select {
+		case err := <-inv.errCh:
+			if err != nil {
+				cc.err(err)
+			}
+			inv.close()
+			cc.setRedirect("")
+			if inv = cc.reconnect(); inv == nil {
+				return
+			}
+		case <-cc.closeCh:
+			inv.close()
+			return
+		}
+	}
+}
+
+// reconnect returns nil if the ClientCache was closed before a new
+// invalidation connection could be made.
+func (cc *ClientCache) reconnect() *clientCacheInvalidator {
+	for {
+		inv, err := cc.dialInvalidator()
+		if err == nil {
+			cc.setRedirect(inv.id)
+			return inv
+		}
+		cc.err(err)
+
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-cc.closeCh:
+			return nil
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func (cc *ClientCache) cacheable(key string) bool {
+	if !cc.opts.bcast || len(cc.opts.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range cc.opts.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// track makes sure that tracking on the given Conn, which must have been
+// created by the Pool, is redirected to the invalidation connection of the
+// given generation.
+func (cc *ClientCache) track(conn Conn, gen uint64, redirectID string) error {
+	inner := conn
+	if ioc, ok := inner.(*ioErrConn); ok {
+		inner = ioc.Conn
+	}
+	tc, ok := inner.(*clientCacheConn)
+	if !ok {
+		return errors.New("connection was not created by the ClientCache")
+	} else if tc.gen == gen {
+		return nil
+	}
+
+	if tc.gen > 0 {
+		if err := conn.Do(Cmd(nil, "CLIENT", "TRACKING", "OFF")); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"TRACKING", "ON", "REDIRECT", redirectID}
+	if cc.opts.bcast {
+		args = append(args, "BCAST")
+		for _, prefix := range cc.opts.prefixes {
+			args = append(args, "PREFIX", prefix)
+		}
+	}
+	if err := conn.Do(Cmd(nil, "CLIENT", args...)); err != nil {
+		return err
+	}
+	tc.gen = gen
+	return nil
+}
+
+// Do implements the method for the Client interface. Cached replies are
+// unmarshaled into the receiver of the Action the same way a reply read from
+// redis would be.
+func (cc *ClientCache) Do(a Action) error {
+	return cc.DoContext(context.Background(), a)
+}
+
+// DoContext implements the method for the ContextClient interface. Actions
+// served from the cache return without checking the context.
+func (cc *ClientCache) DoContext(ctx context.Context, a Action) error {
+	cmd, ok := a.(*cmdAction)
+	if !ok || !cc.opts.cmds[strings.ToUpper(cmd.cmd)] {
+		return cc.pool.DoContext(ctx, a)
+	}
+
+	keys := cmd.Keys()
+	if len(keys) != 1 || !cc.cacheable(keys[0]) {
+		return cc.pool.DoContext(ctx, a)
+	}
+	key := keys[0]
+
+	// the command's own encoding is used as its key in the cache, and is what
+	// gets written to redis when the reply isn't cached.
+	buf := new(bytes.Buffer)
+	if err := cmd.MarshalRESP(buf); err != nil {
+		return err
+	}
+	cacheKey := buf.String()
+
+	cc.l.Lock()
+	if el, ok := cc.entries[cacheKey]; ok {
+		cc.lru.MoveToFront(el)
+		rm := el.Value.(*clientCacheEntry).rm
+		cc.l.Unlock()
+		return cc.unmarshal(cmd, rm)
+	} else if cc.redirectID == "" {
+		cc.l.Unlock()
+		return cc.pool.DoContext(ctx, a)
+	}
+
+	gen, redirectID := cc.gen, cc.redirectID
+	p := cc.pending[key]
+	if p == nil {
+		p = new(clientCachePending)
+		cc.pending[key] = p
+	}
+	p.n++
+	cc.l.Unlock()
+
+	var rm resp2.RawMessage
+	err := cc.pool.DoContext(ctx, WithConn(key, func(conn Conn) error {
+		if err := cc.track(conn, gen, redirectID); err != nil {
+			return err
+		} else if err := conn.Encode(resp2.RawMessage(cacheKey)); err != nil {
+			return err
+		}
+		return conn.Decode(&rm)
+	}))
+
+	cc.l.Lock()
+	if p.n--; p.n == 0 {
+		delete(cc.pending, key)
+	}
+	if err == nil && !p.invalidated && gen == cc.gen &&
+		!bytes.HasPrefix(rm, resp2.ErrorPrefix) {
+		cc.store(cacheKey, key, rm)
+	}
+	cc.l.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return cc.unmarshal(cmd, rm)
+}
+
+func (cc *ClientCache) unmarshal(cmd *cmdAction, rm resp2.RawMessage) error {
+	if err := rm.UnmarshalInto(resp2.Any{I: cmd.rcv}); err != nil {
+		return err
+	}
+	cmdActionPool.Put(cmd)
+	return nil
+}
+
+// Close implements the method for the Client interface. It closes the
+// invalidation connection and the Pool.
+func (cc *ClientCache) Close() error {
+	cc.closeOnce.Do(func() {
+		close(cc.closeCh)
+		<-cc.doneCh
+		cc.closeErr = cc.pool.Close()
+	})
+	return cc.closeErr
+}
@@ -0,0 +1,265 @@
+package radix
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+	"github.com/mediocregopher/radix/v3/resp/resp3"
+)
+
+// clientCacheStub fakes a redis instance which supports CLIENT TRACKING, by
+// sending an invalidation for every SET to every connection which tracking has
+// been redirected to.
+type clientCacheStub struct {
+	l        sync.Mutex
+	m        map[string]string
+	gets     int
+	conns    map[string]Conn
+	tracking map[string][]string
+}
+
+func newClientCacheStub() *clientCacheStub {
+	return &clientCacheStub{
+		m:        map[string]string{},
+		conns:    map[string]Conn{},
+		tracking: map[string][]string{},
+	}
+}
+
+func (s *clientCacheStub) connFunc(network, addr string) (Conn, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	id := strconv.Itoa(len(s.conns) + 1)
+	s.conns[id] = Stub(network, addr, func(args []string) interface{} {
+		return s.handle(id, args)
+	})
+	return s.conns[id], nil
+}
+
+func (s *clientCacheStub) handle(id string, args []string) interface{} {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "PONG"
+	case "CLIENT":
+		if strings.ToUpper(args[1]) == "ID" {
+			return id
+		}
+		s.tracking[id] = args[2:]
+		return "OK"
+	case "SUBSCRIBE":
+		return []interface{}{"subscribe", args[1], 1}
+	case "INVALIDATE":
+		// only sent by the stub itself, to a redirect target
+		var keys interface{}
+		if len(args) > 1 {
+			keys = args[1:]
+		}
+		return resp2.Any{I: []interface{}{"message", clientCacheInvalidateChannel, keys}}
+	case "GET":
+		s.gets++
+		if v, ok := s.m[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		s.m[args[1]] = args[2]
+		s.invalidate(args[1:2]...)
+		return "OK"
+	case "FLUSHALL":
+		s.m = map[string]string{}
+		s.invalidate()
+		return "OK"
+	default:
+		return errors.Errorf("unknown command %q", args)
+	}
+}
+
+// NOTE l _must_ be held to use invalidate
+func (s *clientCacheStub) invalidate(keys ...string) {
+	redirects := map[string]bool{}
+	for _, trackingArgs := range s.tracking {
+		if len(trackingArgs) > 2 && trackingArgs[0] == "ON" {
+			redirects[trackingArgs[2]] = true
+		}
+	}
+	for redirectID := range redirects {
+		conn := s.conns[redirectID]
+		go func() {
+			if err := conn.Encode(Cmd(nil, "INVALIDATE", keys...)); err != nil {
+				panic(err)
+			}
+		}()
+	}
+}
+
+func (s *clientCacheStub) numGets() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.gets
+}
+
+func testClientCache(t *T, s *clientCacheStub, opts ...ClientCacheOpt) *ClientCache {
+	opts = append([]ClientCacheOpt{
+		ClientCachePool(1, PoolConnFunc(s.connFunc), PoolPipelineWindow(0, 0)),
+	}, opts...)
+	cc, err := NewClientCache("tcp", "127.0.0.1:6379", opts...)
+	require.Nil(t, err)
+	return cc
+}
+
+func waitClientCacheInvalidated(t *T, cc *ClientCache, key string) {
+	for i := 0; i < 100; i++ {
+		cc.l.Lock()
+		_, ok := cc.byKey[key]
+		cc.l.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("key %q was never invalidated", key)
+}
+
+func TestClientCache(t *T) {
+	s := newClientCacheStub()
+	cc := testClientCache(t, s)
+	defer cc.Close()
+
+	get := func(key string) string {
+		var v string
+		require.Nil(t, cc.Do(Cmd(&v, "GET", key)))
+		return v
+	}
+
+	require.Nil(t, cc.Do(Cmd(nil, "SET", "foo", "bar")))
+	assert.Equal(t, "bar", get("foo"))
+	assert.Equal(t, "bar", get("foo"))
+	assert.Equal(t, 1, s.numGets())
+
+	// FlatCmd shares the cache entry of the equivalent Cmd
+	var v string
+	require.Nil(t, cc.Do(FlatCmd(&v, "GET", "foo")))
+	assert.Equal(t, "bar", v)
+	assert.Equal(t, 1, s.numGets())
+
+	// the pool's connection redirects tracking to the invalidation connection,
+	// which was dialed first
+	s.l.Lock()
+	assert.Equal(t, []string{"ON", "REDIRECT", "1"}, s.tracking["2"])
+	s.l.Unlock()
+
+	require.Nil(t, cc.Do(Cmd(nil, "SET", "foo", "baz")))
+	waitClientCacheInvalidated(t, cc, "foo")
+	assert.Equal(t, "baz", get("foo"))
+	assert.Equal(t, "baz", get("foo"))
+	assert.Equal(t, 2, s.numGets())
+
+	// nil replies are cached too
+	var mn MaybeNil
+	require.Nil(t, cc.Do(Cmd(&mn, "GET", "bar")))
+	assert.True(t, mn.Nil)
+	require.Nil(t, cc.Do(Cmd(&mn, "GET", "bar")))
+	assert.Equal(t, 3, s.numGets())
+
+	// a nil invalidation empties the whole cache
+	require.Nil(t, cc.Do(Cmd(nil, "FLUSHALL")))
+	waitClientCacheInvalidated(t, cc, "foo")
+	waitClientCacheInvalidated(t, cc, "bar")
+	assert.Equal(t, "", get("foo"))
+	assert.Equal(t, 4, s.numGets())
+}
+
+func TestClientCacheSize(t *T) {
+	s := newClientCacheStub()
+	cc := testClientCache(t, s, ClientCacheSize(2))
+	defer cc.Close()
+
+	get := func(key string) {
+		require.Nil(t, cc.Do(Cmd(nil, "GET", key)))
+	}
+
+	get("a")
+	get("b")
+	get("a")
+	assert.Equal(t, 2, s.numGets())
+
+	// b is the least recently used, and so is evicted
+	get("c")
+	get("a")
+	assert.Equal(t, 3, s.numGets())
+	get("b")
+	assert.Equal(t, 4, s.numGets())
+}
+
+func TestClientCacheBroadcast(t *T) {
+	s := newClientCacheStub()
+	cc := testClientCache(t, s, ClientCacheBroadcast("foo:", "bar:"))
+	defer cc.Close()
+
+	get := func(key string) {
+		require.Nil(t, cc.Do(Cmd(nil, "GET", key)))
+	}
+
+	get("foo:a")
+	get("foo:a")
+	assert.Equal(t, 1, s.numGets())
+
+	s.l.Lock()
+	assert.Equal(t,
+		[]string{"ON", "REDIRECT", "1", "BCAST", "PREFIX", "foo:", "PREFIX", "bar:"},
+		s.tracking["2"])
+	s.l.Unlock()
+
+	// keys not matching a prefix aren't cached
+	get("baz:a")
+	get("baz:a")
+	assert.Equal(t, 3, s.numGets())
+
+	require.Nil(t, cc.Do(Cmd(nil, "SET", "foo:a", "1")))
+	waitClientCacheInvalidated(t, cc, "foo:a")
+	get("foo:a")
+	assert.Equal(t, 4, s.numGets())
+}
+
+func TestClientCacheInvalidatePush(t *T) {
+	s := newClientCacheStub()
+	cc := testClientCache(t, s)
+	defer cc.Close()
+
+	for _, key := range []string{"foo", "bar", "baz"} {
+		require.Nil(t, cc.Do(Cmd(nil, "GET", key)))
+	}
+
+	hasKey := func(key string) bool {
+		cc.l.Lock()
+		defer cc.l.Unlock()
+		_, ok := cc.byKey[key]
+		return ok
+	}
+
+	// replies to the keepalive PING are ignored
+	cc.invalidatePush(resp3.RawMessage("+PONG\r\n"))
+	assert.True(t, hasKey("foo"))
+
+	cc.invalidatePush(resp3.RawMessage(">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n"))
+	assert.False(t, hasKey("foo"))
+	assert.True(t, hasKey("bar"))
+
+	cc.invalidatePush(resp3.RawMessage(">3\r\n$7\r\nmessage\r\n$3\r\nbar\r\n$3\r\nbaz\r\n"))
+	assert.True(t, hasKey("bar"))
+
+	cc.invalidatePush(resp3.RawMessage(">2\r\n$10\r\ninvalidate\r\n_\r\n"))
+	assert.False(t, hasKey("bar"))
+	assert.False(t, hasKey("baz"))
+}
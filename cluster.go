@@ -1,7 +1,11 @@
 package radix
 
 import (
+	"context"
+	"io"
+	"net"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -61,6 +65,8 @@ type clusterOpts struct {
 	clusterDownWait time.Duration
 	syncEvery       time.Duration
 	ct              trace.ClusterTrace
+	rs              ReplicaSelector
+	sr              *ScriptRegistry
 }
 
 // ClusterOpt is an optional behavior which can be applied to the NewCluster
@@ -102,6 +108,33 @@ func ClusterOnDownDelayActionsBy(d time.Duration) ClusterOpt {
 	}
 }
 
+// ClusterReplicaSelector tells the Cluster to use the given ReplicaSelector when
+// choosing which of a slot's secondaries DoSecondary should perform an Action
+// on.
+func ClusterReplicaSelector(rs ReplicaSelector) ClusterOpt {
+	return func(co *clusterOpts) {
+		co.rs = rs
+	}
+}
+
+// ClusterScriptRegistry tells the Cluster to load the scripts registered in the
+// given ScriptRegistry onto every node which is added to its topology,
+// including all nodes during initialization. Errors encountered while loading
+// scripts are written to the Cluster's ErrCh.
+//
+// The scripts are loaded in the background, so that a slow node doesn't delay
+// topology updates, and loading onto each node is given up to 10 seconds.
+//
+// Note that this won't reload scripts onto a node whose script cache is
+// flushed while it remains in the topology. Wrapping the ClientFunc given to
+// ClusterPoolFunc, or the ConnFunc used by it, with the ScriptRegistry covers
+// that case.
+func ClusterScriptRegistry(sr *ScriptRegistry) ClusterOpt {
+	return func(co *clusterOpts) {
+		co.sr = sr
+	}
+}
+
 // ClusterWithTrace tells the Cluster to trace itself with the given
 // ClusterTrace. Note that ClusterTrace will block every point that you set to
 // trace.
@@ -129,10 +162,30 @@ type Cluster struct {
 	pools          map[string]Client
 	primTopo, topo ClusterTopo
 	secondaries    map[string]map[string]ClusterNode
-
-	closeCh   chan struct{}
-	closeWG   sync.WaitGroup
-	closeOnce sync.Once
+	secondaryAddrs map[string][]string // primary addr -> sorted secondary addrs
+
+	// secondaries which have encountered a network error during DoSecondary,
+	// they will not be used by DoSecondary again until they are found
+	// responding to PING by the check following a sync
+	unhealthy map[string]bool
+
+	// written to, without blocking, after every sync to have the unhealthy
+	// secondaries checked in the background, see checkUnhealthyLoop.
+	checkUnhealthyCh chan struct{}
+
+	// notified after every sync. Used by ShardedPubSub to follow slot
+	// migrations.
+	syncNotifier notifier
+
+	// closeCtx is cancelled by Close, and is used to interrupt work done in
+	// the background. Work started after initialization must only call
+	// closeWG.Add while holding l and if closeCtx isn't cancelled yet, see
+	// syncScripts.
+	closeCtx    context.Context
+	closeCancel context.CancelFunc
+	closeCh     chan struct{}
+	closeWG     sync.WaitGroup
+	closeOnce   sync.Once
 
 	// Any errors encountered internally will be written to this channel. If
 	// nothing is reading the channel the errors will be dropped. The channel
@@ -166,19 +219,23 @@ var DefaultClusterConnFunc = func(network, addr string) (Conn, error) {
 //     ClusterPoolFunc(DefaultClientFunc)
 //     ClusterSyncEvery(5 * time.Second)
 //     ClusterOnDownDelayActionsBy(100 * time.Millisecond)
+//     ClusterReplicaSelector(RandomReplicaSelector())
 //
 func NewCluster(clusterAddrs []string, opts ...ClusterOpt) (*Cluster, error) {
 	c := &Cluster{
-		syncDedupe: newDedupe(),
-		pools:      map[string]Client{},
-		closeCh:    make(chan struct{}),
-		ErrCh:      make(chan error, 1),
+		syncDedupe:       newDedupe(),
+		pools:            map[string]Client{},
+		checkUnhealthyCh: make(chan struct{}, 1),
+		closeCh:          make(chan struct{}),
+		ErrCh:            make(chan error, 1),
 	}
+	c.closeCtx, c.closeCancel = context.WithCancel(context.Background())
 
 	defaultClusterOpts := []ClusterOpt{
 		ClusterPoolFunc(DefaultClientFunc),
 		ClusterSyncEvery(5 * time.Second),
 		ClusterOnDownDelayActionsBy(100 * time.Millisecond),
+		ClusterReplicaSelector(RandomReplicaSelector()),
 	}
 
 	for _, opt := range append(defaultClusterOpts, opts...) {
@@ -201,6 +258,7 @@ func NewCluster(clusterAddrs []string, opts ...ClusterOpt) (*Cluster, error) {
 	}
 
 	if err := c.Sync(); err != nil {
+		c.closeCancel()
 		for _, p := range c.pools {
 			p.Close()
 		}
@@ -208,6 +266,7 @@ func NewCluster(clusterAddrs []string, opts ...ClusterOpt) (*Cluster, error) {
 	}
 
 	c.syncEvery(c.co.syncEvery)
+	c.checkUnhealthyLoop()
 
 	return c, nil
 }
@@ -241,8 +300,16 @@ func (c *Cluster) rpool(addr string) (Client, error) {
 	c.l.RLock()
 	defer c.l.RUnlock()
 	if addr == "" {
-		for _, p := range c.pools {
-			return p, nil
+		// prefer nodes which haven't encountered a network error
+		var unhealthyPool Client
+		for addr, p := range c.pools {
+			if !c.unhealthy[addr] {
+				return p, nil
+			}
+			unhealthyPool = p
+		}
+		if unhealthyPool != nil {
+			return unhealthyPool, nil
 		}
 		return nil, errors.New("no pools available")
 	} else if p, ok := c.pools[addr]; ok {
@@ -409,13 +476,17 @@ func (c *Cluster) sync(p Client) error {
 	c.traceTopoChanged(c.topo, tt)
 
 	var toclose []Client
+	var prevTopo ClusterTopo
+	secondaryAddrs := map[string]bool{}
 	func() {
 		c.l.Lock()
 		defer c.l.Unlock()
+		prevTopo = c.topo
 		c.topo = tt
 		c.primTopo = tt.Primaries()
 
 		c.secondaries = make(map[string]map[string]ClusterNode, len(c.primTopo))
+		c.secondaryAddrs = make(map[string][]string, len(c.primTopo))
 		for _, node := range c.topo {
 			if node.SecondaryOfAddr != "" {
 				m := c.secondaries[node.SecondaryOfAddr]
@@ -424,10 +495,20 @@ func (c *Cluster) sync(p Client) error {
 					c.secondaries[node.SecondaryOfAddr] = m
 				}
 				m[node.Addr] = node
+				c.secondaryAddrs[node.SecondaryOfAddr] = append(c.secondaryAddrs[node.SecondaryOfAddr], node.Addr)
+				secondaryAddrs[node.Addr] = true
 			}
 		}
-
+		for _, addrs := range c.secondaryAddrs {
+			sort.Strings(addrs)
+		}
 		tm := tt.Map()
+		for addr := range c.unhealthy {
+			if _, ok := tm[addr]; !ok {
+				delete(c.unhealthy, addr)
+			}
+		}
+
 		for addr, p := range c.pools {
 			if _, ok := tm[addr]; !ok {
 				toclose = append(toclose, p)
@@ -440,9 +521,67 @@ func (c *Cluster) sync(p Client) error {
 		p.Close()
 	}
 
+	syncReplicaSelector(c.co.rs, secondaryAddrs)
+
+	if c.co.sr != nil {
+		c.syncScripts(prevTopo, tt)
+	}
+
+	select {
+	case c.checkUnhealthyCh <- struct{}{}:
+	default:
+	}
+
+	c.syncNotifier.notify()
 	return nil
 }
 
+// scriptLoadTimeout is how long syncScripts waits for the scripts to be loaded
+// onto each node.
+const scriptLoadTimeout = 10 * time.Second
+
+// loads the ScriptRegistry's scripts onto every node which is in newTopo but
+// not prevTopo. The nodes are loaded concurrently in the background.
+func (c *Cluster) syncScripts(prevTopo, newTopo ClusterTopo) {
+	prevTopoMap, newTopoMap := prevTopo.Map(), newTopo.Map()
+	for addr := range prevTopoMap {
+		if _, ok := newTopoMap[addr]; !ok {
+			c.co.sr.forget(addr)
+		}
+	}
+
+	var addrs []string
+	for addr := range newTopoMap {
+		if _, ok := prevTopoMap[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	c.l.Lock()
+	if len(addrs) == 0 || c.closeCtx.Err() != nil {
+		c.l.Unlock()
+		return
+	}
+	c.closeWG.Add(len(addrs))
+	c.l.Unlock()
+
+	for _, addr := range addrs {
+		go func(addr string) {
+			defer c.closeWG.Done()
+			ctx, cancel := context.WithTimeout(c.closeCtx, scriptLoadTimeout)
+			defer cancel()
+
+			p, err := c.pool(addr)
+			if err == nil {
+				err = c.co.sr.loadContext(ctx, addr, p)
+			}
+			if err != nil && c.closeCtx.Err() == nil {
+				c.err(err)
+			}
+		}(addr)
+	}
+}
+
 func (c *Cluster) syncEvery(d time.Duration) {
 	c.closeWG.Add(1)
 	go func() {
@@ -477,14 +616,105 @@ func (c *Cluster) addrForKey(key string) string {
 	return ""
 }
 
-func (c *Cluster) secondaryAddrForKey(key string) string {
+// returns the address of the secondary chosen by the ReplicaSelector and true,
+// or the address of the primary and false if there aren't any healthy
+// secondaries.
+func (c *Cluster) secondaryAddrForKey(key string) (string, bool) {
 	c.l.RLock()
-	defer c.l.RUnlock()
 	primAddr := c.addrForKey(key)
-	for addr := range c.secondaries[primAddr] {
-		return addr
+	addrs := c.secondaryAddrs[primAddr]
+	if len(c.unhealthy) > 0 {
+		healthyAddrs := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if !c.unhealthy[addr] {
+				healthyAddrs = append(healthyAddrs, addr)
+			}
+		}
+		addrs = healthyAddrs
+	}
+	c.l.RUnlock()
+
+	if len(addrs) == 0 {
+		return primAddr, false
+	}
+	return c.co.rs.Select(addrs), true
+}
+
+func (c *Cluster) setUnhealthy(addr string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.unhealthy == nil {
+		c.unhealthy = map[string]bool{}
+	}
+	c.unhealthy[addr] = true
+}
+
+// unhealthyPingTimeout is how long checkUnhealthy waits for each unhealthy
+// secondary to respond to PING.
+const unhealthyPingTimeout = time.Second
+
+// checkUnhealthyLoop runs checkUnhealthy in the background whenever a sync
+// writes to checkUnhealthyCh, so that secondaries which don't respond can't
+// delay syncs.
+func (c *Cluster) checkUnhealthyLoop() {
+	c.closeWG.Add(1)
+	go func() {
+		defer c.closeWG.Done()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-c.closeCh
+			cancel()
+		}()
+
+		for {
+			select {
+			case <-c.checkUnhealthyCh:
+				c.checkUnhealthy(ctx)
+			case <-c.closeCh:
+				return
+			}
+		}
+	}()
+}
+
+// checkUnhealthy pings each unhealthy secondary concurrently, and marks those
+// which respond within unhealthyPingTimeout as healthy again.
+func (c *Cluster) checkUnhealthy(ctx context.Context) {
+	c.l.RLock()
+	addrs := make([]string, 0, len(c.unhealthy))
+	for addr := range c.unhealthy {
+		addrs = append(addrs, addr)
+	}
+	c.l.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		p, err := c.rpool(addr)
+		if p == nil || err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr string, p Client) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, unhealthyPingTimeout)
+			defer cancel()
+			if err := DoContext(ctx, p, Cmd(nil, "PING")); err != nil {
+				return
+			}
+			c.l.Lock()
+			delete(c.unhealthy, addr)
+			c.l.Unlock()
+		}(addr, p)
 	}
-	return primAddr
+	wg.Wait()
+}
+
+func isNetErr(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
 
 type askConn struct {
@@ -516,7 +746,30 @@ const doAttempts = 5
 //
 // This method handles MOVED and ASK errors automatically in most cases, see
 // ClusterCanRetryAction's docs for more.
+//
+// The multi-key commands MGET, MSET, DEL, EXISTS and UNLINK, when created using
+// Cmd, may be given keys which belong to different slots. Such a command is
+// split into one command per slot, these are performed in parallel across the
+// cluster's primaries, and their replies are combined as if a single command
+// had been performed: MGET's values are returned in the order of the original
+// keys, and the integer replies of DEL, EXISTS and UNLINK are summed. The split
+// command is not atomic, and if any of its parts fail the first error is
+// returned, though other parts may have succeeded.
 func (c *Cluster) Do(a Action) error {
+	return c.DoContext(context.Background(), a)
+}
+
+// DoContext implements the method for the ContextClient interface. It behaves
+// like Do, except that the Action will be abandoned once the context is done,
+// whether it is being performed, waiting out a CLUSTERDOWN state (see
+// ClusterOnDownDelayActionsBy), or being redirected to a different node.
+func (c *Cluster) DoContext(ctx context.Context, a Action) error {
+	if ca, pieces, ok := splitCrossSlot(a); ok {
+		return c.doCrossSlot(ca, pieces, func(a Action) error {
+			return c.DoContext(ctx, a)
+		})
+	}
+
 	var addr, key string
 	keys := a.Keys()
 	if len(keys) == 0 {
@@ -528,10 +781,11 @@ func (c *Cluster) Do(a Action) error {
 		addr = c.addrForKey(key)
 	}
 
-	return c.doInner(a, addr, key, false, doAttempts)
+	return c.doInner(ctx, a, addr, key, false, doAttempts)
 }
 
-// DoSecondary is like Do but executes the Action on a random secondary for the affected keys.
+// DoSecondary is like Do but executes the Action on a secondary for the affected keys.
+// The secondary is chosen by the ReplicaSelector given with ClusterReplicaSelector.
 //
 // For DoSecondary to work, all connections must be created in read-only mode, by using a
 // custom ClusterPoolFunc that executes the READONLY command on each new connection.
@@ -539,8 +793,32 @@ func (c *Cluster) Do(a Action) error {
 // See ClusterPoolFunc for an example using the global DefaultClusterConnFunc.
 //
 // If the Action can not be handled by a secondary the Action will be send to the primary instead.
+// A secondary which returns a network error will not be used again until it's
+// found responding to PING after a synchronization (see ClusterSyncEvery), and if none
+// of the secondaries for the affected keys are usable the Action will be sent to
+// the primary.
 func (c *Cluster) DoSecondary(a Action) error {
+	return c.DoSecondaryContext(context.Background(), a)
+}
+
+// DoSecondaryContext is like DoSecondary, but takes a context like DoContext.
+//
+// Of the multi-key commands which Do splits up by slot only the parts of MGET
+// and EXISTS are performed on secondaries, the parts of MSET, DEL and UNLINK
+// are performed on the primaries.
+func (c *Cluster) DoSecondaryContext(ctx context.Context, a Action) error {
+	if ca, pieces, ok := splitCrossSlot(a); ok && crossSlotReadCmds[strings.ToUpper(ca.cmd)] {
+		return c.doCrossSlot(ca, pieces, func(a Action) error {
+			return c.DoSecondaryContext(ctx, a)
+		})
+	} else if ok {
+		return c.doCrossSlot(ca, pieces, func(a Action) error {
+			return c.DoContext(ctx, a)
+		})
+	}
+
 	var addr, key string
+	var secondary bool
 	keys := a.Keys()
 	if len(keys) == 0 {
 		// that's ok, key will then just be ""
@@ -548,17 +826,27 @@ func (c *Cluster) DoSecondary(a Action) error {
 		return err
 	} else {
 		key = keys[0]
-		addr = c.secondaryAddrForKey(key)
+		addr, secondary = c.secondaryAddrForKey(key)
+	}
+
+	if !secondary {
+		return c.doInner(ctx, a, addr, key, false, doAttempts)
 	}
 
-	return c.doInner(a, addr, key, false, doAttempts)
+	start := time.Now()
+	err := c.doInner(ctx, a, addr, key, false, doAttempts)
+	c.co.rs.Done(addr, time.Since(start), err)
+	if isNetErr(err) {
+		c.setUnhealthy(addr)
+	}
+	return err
 }
 
 func (c *Cluster) getClusterDownSince() int64 {
 	return atomic.LoadInt64(&c.lastClusterdown)
 }
 
-func (c *Cluster) setClusterDown(down bool) (changed bool) {
+func (c *Cluster) setClusterDown(addr string, down bool) (changed bool) {
 	// There is a race when calling this method concurrently when the cluster
 	// healed after being down.
 	//
@@ -614,7 +902,7 @@ func (c *Cluster) setClusterDown(down bool) (changed bool) {
 	changed = (prevVal == 0 && newVal != 0) || (prevVal != 0 && newVal == 0)
 
 	if changed && c.co.ct.StateChange != nil {
-		c.co.ct.StateChange(trace.ClusterStateChange{IsDown: down})
+		c.co.ct.StateChange(trace.ClusterStateChange{IsDown: down, Addr: addr})
 	}
 
 	return changed
@@ -633,13 +921,20 @@ func (c *Cluster) traceRedirected(addr, key string, moved, ask bool, count int,
 	}
 }
 
-func (c *Cluster) doInner(a Action, addr, key string, ask bool, attempts int) error {
+func (c *Cluster) doInner(ctx context.Context, a Action, addr, key string, ask bool, attempts int) error {
 	if downSince := c.getClusterDownSince(); downSince > 0 && c.co.clusterDownWait > 0 {
 		// only wait when the last command was not too long, because
 		// otherwise the chance it high that the cluster already healed
 		elapsed := (time.Now().UnixNano() / 1000 / 1000) - downSince
 		if elapsed < int64(c.co.clusterDownWait/time.Millisecond) {
-			time.Sleep(c.co.clusterDownWait)
+			t := getTimer(c.co.clusterDownWait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				putTimer(t)
+				return ctx.Err()
+			}
+			putTimer(t)
 		}
 	}
 
@@ -656,13 +951,13 @@ func (c *Cluster) doInner(a Action, addr, key string, ask bool, attempts int) er
 	thisA := a
 	if ask {
 		thisA = WithConn(key, func(conn Conn) error {
-			return askConn{conn}.Do(a)
+			return runAction(ctx, askConn{conn}, a)
 		})
 	}
 
-	err = p.Do(thisA)
+	err = DoContext(ctx, p, thisA)
 	if err == nil {
-		c.setClusterDown(false)
+		c.setClusterDown(addr, false)
 		return nil
 	}
 
@@ -674,9 +969,9 @@ func (c *Cluster) doInner(a Action, addr, key string, ask bool, attempts int) er
 	msg := respErr.Error()
 
 	clusterDown := strings.HasPrefix(msg, "CLUSTERDOWN ")
-	clusterDownChanged := c.setClusterDown(clusterDown)
+	clusterDownChanged := c.setClusterDown(addr, clusterDown)
 	if clusterDown && c.co.clusterDownWait > 0 && clusterDownChanged {
-		return c.doInner(a, addr, key, ask, 1)
+		return c.doInner(ctx, a, addr, key, ask, 1)
 	}
 
 	// if the error was a MOVED or ASK we can potentially retry
@@ -712,9 +1007,11 @@ func (c *Cluster) doInner(a Action, addr, key string, ask bool, attempts int) er
 	c.traceRedirected(ogAddr, key, moved, ask, doAttempts-attempts+1, attempts <= 1)
 	if attempts--; attempts <= 0 {
 		return errors.New("cluster action redirected too many times")
+	} else if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	return c.doInner(a, addr, key, ask, attempts)
+	return c.doInner(ctx, a, addr, key, ask, attempts)
 }
 
 // Close cleans up all goroutines spawned by Cluster and closes all of its
@@ -722,6 +1019,10 @@ func (c *Cluster) doInner(a Action, addr, key string, ask bool, attempts int) er
 func (c *Cluster) Close() error {
 	closeErr := errClientClosed
 	c.closeOnce.Do(func() {
+		c.l.Lock()
+		c.closeCancel()
+		c.l.Unlock()
+
 		close(c.closeCh)
 		c.closeWG.Wait()
 		close(c.ErrCh)
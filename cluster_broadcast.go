@@ -0,0 +1,173 @@
+package radix
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type broadcastOpts struct {
+	allNodes bool
+}
+
+// BroadcastOpt is an optional behavior which can be applied to the Cluster
+// Broadcast methods to effect their behavior.
+type BroadcastOpt func(*broadcastOpts)
+
+// BroadcastAllNodes causes the Action to be performed on every node in the
+// cluster, secondaries included, rather than only on the primaries.
+func BroadcastAllNodes() BroadcastOpt {
+	return func(bo *broadcastOpts) {
+		bo.allNodes = true
+	}
+}
+
+// ClusterBroadcastError is returned by the Cluster Broadcast methods when the
+// Action failed on one or more nodes.
+type ClusterBroadcastError struct {
+	// Errs contains the error returned by each node which failed, keyed by
+	// the node's address.
+	Errs map[string]error
+}
+
+func (e *ClusterBroadcastError) Error() string {
+	addrs := make([]string, 0, len(e.Errs))
+	for addr := range e.Errs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	errStrs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		errStrs[i] = fmt.Sprintf("%s: %v", addr, e.Errs[addr])
+	}
+	return fmt.Sprintf("broadcast failed on %d node(s): %s", len(addrs), strings.Join(errStrs, ", "))
+}
+
+// Broadcast performs an Action on every primary in the cluster in parallel,
+// e.g. for commands like SCRIPT LOAD, FLUSHDB or CONFIG SET which apply to a
+// single node. The BroadcastAllNodes option may be given to also perform it on
+// every secondary.
+//
+// fn is called once for each node, with the node's address, and must return a
+// new Action each time, since Actions generally can't be performed more than
+// once. fn may be called concurrently.
+//
+// If the Action fails on any nodes a *ClusterBroadcastError is returned,
+// containing the error of each of them. The Action will still have been
+// performed on the other nodes.
+func (c *Cluster) Broadcast(ctx context.Context, fn func(addr string) Action, opts ...BroadcastOpt) error {
+	var bo broadcastOpts
+	for _, opt := range opts {
+		opt(&bo)
+	}
+
+	topo := c.Topo()
+	if !bo.allNodes {
+		topo = topo.Primaries()
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errL sync.Mutex
+		errs = map[string]error{}
+	)
+	for _, node := range topo {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			p, err := c.pool(addr)
+			if err == nil {
+				err = DoContext(ctx, p, fn(addr))
+			}
+			if err != nil {
+				errL.Lock()
+				errs[addr] = err
+				errL.Unlock()
+			}
+		}(node.Addr)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return &ClusterBroadcastError{Errs: errs}
+	}
+	return nil
+}
+
+// broadcastCmd performs the given command on every node as per the given opts
+// using Broadcast, with each node's reply being unmarshaled into the receiver
+// returned by newRcv. It returns the receivers of the nodes which succeeded.
+func (c *Cluster) broadcastCmd(
+	ctx context.Context, newRcv func() interface{}, cmd string, args []string, opts []BroadcastOpt,
+) (map[string]interface{}, error) {
+	var l sync.Mutex
+	rcvs := map[string]interface{}{}
+	err := c.Broadcast(ctx, func(addr string) Action {
+		rcv := newRcv()
+		l.Lock()
+		rcvs[addr] = rcv
+		l.Unlock()
+		return Cmd(rcv, cmd, args...)
+	}, opts...)
+
+	if bErr, ok := err.(*ClusterBroadcastError); ok {
+		for addr := range bErr.Errs {
+			delete(rcvs, addr)
+		}
+	}
+	return rcvs, err
+}
+
+// BroadcastSum performs the given command on every node using Broadcast, and
+// returns the sum of the integer replies, e.g. for DBSIZE.
+//
+// If the command fails on some nodes the sum of the replies from the others is
+// returned along with a *ClusterBroadcastError.
+func (c *Cluster) BroadcastSum(ctx context.Context, cmd string, args []string, opts ...BroadcastOpt) (int64, error) {
+	rcvs, err := c.broadcastCmd(ctx, func() interface{} { return new(int64) }, cmd, args, opts)
+	var sum int64
+	for _, rcv := range rcvs {
+		sum += *(rcv.(*int64))
+	}
+	return sum, err
+}
+
+// BroadcastConcat performs the given command on every node using Broadcast, and
+// returns the concatenation of the array replies, e.g. for KEYS. The elements
+// are ordered by the address of the node they came from, but are otherwise in
+// the order each node returned them.
+//
+// If the command fails on some nodes the replies from the others are returned
+// along with a *ClusterBroadcastError.
+func (c *Cluster) BroadcastConcat(ctx context.Context, cmd string, args []string, opts ...BroadcastOpt) ([]string, error) {
+	rcvs, err := c.broadcastCmd(ctx, func() interface{} { return new([]string) }, cmd, args, opts)
+	addrs := make([]string, 0, len(rcvs))
+	for addr := range rcvs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var res []string
+	for _, addr := range addrs {
+		res = append(res, *(rcvs[addr].(*[]string))...)
+	}
+	return res, err
+}
+
+// BroadcastMap performs the given command on every node using Broadcast, and
+// returns each node's reply keyed by the node's address. Each reply is
+// unmarshaled as if into an interface{}, see the package docs.
+//
+// If the command fails on some nodes the replies from the others are returned
+// along with a *ClusterBroadcastError.
+func (c *Cluster) BroadcastMap(ctx context.Context, cmd string, args []string, opts ...BroadcastOpt) (map[string]interface{}, error) {
+	rcvs, err := c.broadcastCmd(ctx, func() interface{} { return new(interface{}) }, cmd, args, opts)
+	res := make(map[string]interface{}, len(rcvs))
+	for addr, rcv := range rcvs {
+		res[addr] = *(rcv.(*interface{}))
+	}
+	return res, err
+}
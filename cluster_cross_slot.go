@@ -0,0 +1,169 @@
+package radix
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// crossSlotCmds are the multi-key commands which Cluster will split up by slot
+// when their keys don't all belong to the same slot. The value is the number of
+// arguments given per key, e.g. MSET takes a key and a value.
+var crossSlotCmds = map[string]int{
+	"MGET":   1,
+	"MSET":   2,
+	"DEL":    1,
+	"EXISTS": 1,
+	"UNLINK": 1,
+}
+
+// crossSlotReadCmds are the commands of crossSlotCmds which only read, and so
+// whose pieces may be performed on replicas.
+var crossSlotReadCmds = map[string]bool{
+	"MGET":   true,
+	"EXISTS": true,
+}
+
+// crossSlotArray is used to receive the array reply of each piece of an MGET.
+// It implements resp.Unmarshaler so that RESP3 replies are downgraded before
+// being stored.
+type crossSlotArray []resp2.RawMessage
+
+func (csa *crossSlotArray) UnmarshalRESP(br *bufio.Reader) error {
+	return resp2.Any{I: (*[]resp2.RawMessage)(csa)}.UnmarshalRESP(br)
+}
+
+// crossSlotPiece is the part of a cross-slot command whose keys belong to a
+// single slot.
+type crossSlotPiece struct {
+	key  string // the first key, used for routing
+	idxs []int  // the index of each of the piece's keys in the original command
+	args []string
+
+	arr crossSlotArray
+	n   int64
+}
+
+// splitCrossSlot splits the given Action into pieces, one per slot, if it's a
+// command listed in crossSlotCmds whose keys belong to more than one slot.
+// Otherwise it returns false. The returned cmdAction is the given Action, which
+// doCrossSlot releases once it's done with it.
+func splitCrossSlot(a Action) (*cmdAction, []*crossSlotPiece, bool) {
+	ca, ok := a.(*cmdAction)
+	if !ok || ca.flat {
+		return nil, nil, false
+	}
+
+	stride, ok := crossSlotCmds[strings.ToUpper(ca.cmd)]
+	if !ok || len(ca.args) == 0 || len(ca.args)%stride != 0 {
+		return nil, nil, false
+	}
+
+	var pieces []*crossSlotPiece
+	bySlot := map[uint16]*crossSlotPiece{}
+	for i := 0; i < len(ca.args); i += stride {
+		key := ca.args[i]
+		slot := ClusterSlot([]byte(key))
+		p, ok := bySlot[slot]
+		if !ok {
+			p = &crossSlotPiece{key: key}
+			bySlot[slot] = p
+			pieces = append(pieces, p)
+		}
+		p.idxs = append(p.idxs, i/stride)
+		p.args = append(p.args, ca.args[i:i+stride]...)
+	}
+
+	if len(pieces) < 2 {
+		return nil, nil, false
+	}
+	return ca, pieces, true
+}
+
+// doCrossSlot performs each piece of a cross-slot command using the given do
+// function. Pieces whose slots belong to the same primary are performed one
+// after the other, while different primaries are handled in parallel. Once all
+// pieces are done their replies are combined and unmarshaled into the original
+// command's receiver, and the original command is released back into
+// cmdActionPool, like it would be by its own UnmarshalRESP.
+func (c *Cluster) doCrossSlot(ca *cmdAction, pieces []*crossSlotPiece, do func(Action) error) error {
+	cmd := strings.ToUpper(ca.cmd)
+	byAddr := map[string][]*crossSlotPiece{}
+	for _, p := range pieces {
+		addr := c.addrForKey(p.key)
+		byAddr[addr] = append(byAddr[addr], p)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		errL   sync.Mutex
+		retErr error
+	)
+	for _, addrPieces := range byAddr {
+		wg.Add(1)
+		go func(addrPieces []*crossSlotPiece) {
+			defer wg.Done()
+			for _, p := range addrPieces {
+				var rcv interface{}
+				switch cmd {
+				case "MGET":
+					rcv = &p.arr
+				case "DEL", "EXISTS", "UNLINK":
+					rcv = &p.n
+				}
+				if err := do(Cmd(rcv, ca.cmd, p.args...)); err != nil {
+					errL.Lock()
+					if retErr == nil {
+						retErr = err
+					}
+					errL.Unlock()
+				}
+			}
+		}(addrPieces)
+	}
+	wg.Wait()
+	if retErr != nil {
+		return retErr
+	} else if ca.rcv == nil {
+		cmdActionPool.Put(ca)
+		return nil
+	}
+
+	var reply resp.Marshaler
+	switch cmd {
+	case "MGET":
+		arr := make([]resp.Marshaler, len(ca.args))
+		for _, p := range pieces {
+			if len(p.arr) != len(p.idxs) {
+				return errors.Errorf("expected %d elements in MGET reply, got %d", len(p.idxs), len(p.arr))
+			}
+			for i, idx := range p.idxs {
+				arr[idx] = p.arr[i]
+			}
+		}
+		reply = resp2.Array{A: arr}
+	case "MSET":
+		reply = resp2.SimpleString{S: "OK"}
+	default:
+		var n int64
+		for _, p := range pieces {
+			n += p.n
+		}
+		reply = resp2.Int{I: n}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := reply.MarshalRESP(buf); err != nil {
+		return err
+	} else if err := (resp2.Any{I: ca.rcv}).UnmarshalRESP(bufio.NewReader(buf)); err != nil {
+		return err
+	}
+	cmdActionPool.Put(ca)
+	return nil
+}
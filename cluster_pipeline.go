@@ -0,0 +1,254 @@
+package radix
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// ClusterPipelineError is returned by Cluster.DoPipeline when one or more of the
+// pipelined commands failed.
+type ClusterPipelineError struct {
+	// Errs contains the error of each of the commands passed into DoPipeline,
+	// in the same order. Commands which succeeded have a nil error.
+	Errs []error
+}
+
+func (e *ClusterPipelineError) first() (int, error) {
+	for i, err := range e.Errs {
+		if err != nil {
+			return i, err
+		}
+	}
+	return -1, nil
+}
+
+func (e *ClusterPipelineError) Error() string {
+	var n int
+	for _, err := range e.Errs {
+		if err != nil {
+			n++
+		}
+	}
+	i, err := e.first()
+	return fmt.Sprintf("%d of %d pipelined commands failed, first (command %d): %v", n, len(e.Errs), i, err)
+}
+
+// Unwrap returns the error of the first command which failed.
+func (e *ClusterPipelineError) Unwrap() error {
+	_, err := e.first()
+	return err
+}
+
+// clusterPipelineBatch is the part of a cluster pipeline which is sent to a
+// single node. Unlike pipeline it records the error of each command, and only
+// stops early if the Conn fails.
+type clusterPipelineBatch struct {
+	cmds []CmdAction
+	ask  []bool // whether to send ASKING before each command
+	errs []error
+}
+
+func (b *clusterPipelineBatch) add(cmd CmdAction, ask bool) {
+	b.cmds = append(b.cmds, cmd)
+	b.ask = append(b.ask, ask)
+}
+
+func (b *clusterPipelineBatch) Keys() []string {
+	return nil
+}
+
+func (b *clusterPipelineBatch) MarshalRESP(w io.Writer) error {
+	for i, cmd := range b.cmds {
+		if b.ask[i] {
+			if err := Cmd(nil, "ASKING").MarshalRESP(w); err != nil {
+				return err
+			}
+		}
+		if err := cmd.MarshalRESP(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *clusterPipelineBatch) fail(i int, err error) error {
+	for ; i < len(b.errs); i++ {
+		b.errs[i] = err
+	}
+	return err
+}
+
+func (b *clusterPipelineBatch) Run(conn Conn) error {
+	b.errs = make([]error, len(b.cmds))
+	if err := conn.Encode(b); err != nil {
+		return b.fail(0, err)
+	}
+
+	// errors which leave the Conn usable, like error replies or replies which
+	// don't fit their receiver, are recorded for their command, and the
+	// remaining replies are still read.
+	for i, cmd := range b.cmds {
+		if b.ask[i] {
+			if err := conn.Decode(resp2.Any{}); errors.As(err, new(resp.ErrDiscarded)) {
+				b.errs[i] = err
+			} else if err != nil {
+				return b.fail(i, err)
+			}
+		}
+		if err := conn.Decode(cmd); errors.As(err, new(resp.ErrDiscarded)) {
+			if b.errs[i] == nil {
+				b.errs[i] = err
+			}
+		} else if err != nil {
+			return b.fail(i, err)
+		}
+	}
+	return nil
+}
+
+// clusterPipelineCmd tracks a command passed into DoPipeline through however
+// many redirects it takes.
+type clusterPipelineCmd struct {
+	idx  int
+	key  string
+	addr string
+	ask  bool
+}
+
+// DoPipeline performs the given commands as pipelines, grouping them by the
+// node which serves their keys. A pipeline is sent to each node concurrently,
+// each in a single write and read, as with Pipeline. This makes DoPipeline
+// suitable for performing large numbers of commands on unrelated keys, which
+// can't be done with Pipeline since all of its commands must belong to the
+// same slot.
+//
+// Each command's keys must belong to a single slot. Commands which return a
+// MOVED or ASK error are retried on the node given in the error, again using a
+// pipeline per node, as long as they are ClusterCanRetryActions, and a MOVED
+// error prompts a Sync.
+//
+// Commands are not performed in any particular order, and a command failing
+// doesn't prevent the others from being performed. If any commands fail a
+// *ClusterPipelineError is returned, which contains the error of each command.
+//
+// Run will not be called on any of the passed in CmdActions.
+func (c *Cluster) DoPipeline(ctx context.Context, cmds ...CmdAction) error {
+	errs := make([]error, len(cmds))
+	pending := make([]clusterPipelineCmd, 0, len(cmds))
+	for i, cmd := range cmds {
+		var key string
+		if keys := cmd.Keys(); len(keys) == 0 {
+			// that's ok, key will then just be ""
+		} else if err := assertKeysSlot(keys); err != nil {
+			errs[i] = err
+			continue
+		} else {
+			key = keys[0]
+		}
+		pending = append(pending, clusterPipelineCmd{idx: i, key: key, addr: c.addrForKey(key)})
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if err := ctx.Err(); err != nil {
+			for _, pc := range pending {
+				errs[pc.idx] = err
+			}
+			break
+		}
+
+		byAddr := map[string][]clusterPipelineCmd{}
+		for _, pc := range pending {
+			byAddr[pc.addr] = append(byAddr[pc.addr], pc)
+		}
+
+		var wg sync.WaitGroup
+		for addr, pcs := range byAddr {
+			wg.Add(1)
+			go func(addr string, pcs []clusterPipelineCmd) {
+				defer wg.Done()
+				b := new(clusterPipelineBatch)
+				for _, pc := range pcs {
+					b.add(cmds[pc.idx], pc.ask)
+				}
+
+				p, err := c.pool(addr)
+				if err == nil {
+					err = DoContext(ctx, p, b)
+				}
+				for i, pc := range pcs {
+					if b.errs != nil {
+						errs[pc.idx] = b.errs[i]
+					} else {
+						errs[pc.idx] = err
+					}
+				}
+			}(addr, pcs)
+		}
+		wg.Wait()
+
+		var moved bool
+		pending = pending[:0]
+		for _, pcs := range byAddr {
+			for _, pc := range pcs {
+				if next, ok := c.pipelineRedirect(cmds[pc.idx], pc, errs[pc.idx], attempt); ok {
+					moved = moved || !next.ask
+					pending = append(pending, next)
+				}
+			}
+		}
+
+		if moved {
+			if err := c.Sync(); err != nil {
+				for _, pc := range pending {
+					errs[pc.idx] = err
+				}
+				break
+			}
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return &ClusterPipelineError{Errs: errs}
+		}
+	}
+	return nil
+}
+
+// pipelineRedirect returns the command to retry if the given error is a MOVED
+// or ASK error which can be followed.
+func (c *Cluster) pipelineRedirect(cmd CmdAction, pc clusterPipelineCmd, err error, attempt int) (clusterPipelineCmd, bool) {
+	var respErr resp2.Error
+	if !errors.As(err, &respErr) {
+		return pc, false
+	}
+
+	msg := respErr.Error()
+	moved := strings.HasPrefix(msg, "MOVED ")
+	ask := strings.HasPrefix(msg, "ASK ")
+	if !moved && !ask {
+		return pc, false
+	} else if ccra, ok := cmd.(ClusterCanRetryAction); !ok || !ccra.ClusterCanRetry() {
+		return pc, false
+	}
+
+	msgParts := strings.Split(msg, " ")
+	if len(msgParts) < 3 {
+		return pc, false
+	}
+
+	final := attempt >= doAttempts
+	c.traceRedirected(pc.addr, pc.key, moved, ask, attempt, final)
+	if final {
+		return pc, false
+	}
+	return clusterPipelineCmd{idx: pc.idx, key: pc.key, addr: msgParts[2], ask: ask}, true
+}
@@ -127,9 +127,14 @@ func (s *clusterNodeStub) withKeys(keys []string, asking, readonly bool, fn func
 }
 
 func (s *clusterNodeStub) newConn() Conn {
+	// the Conn may be used concurrently as a Client, so the flags are protected
+	// by a lock
+	var l sync.Mutex
 	asking := false // flag we hold onto in between commands
 	readonly := false
 	return Stub("tcp", s.addr, func(args []string) interface{} {
+		l.Lock()
+		defer l.Unlock()
 		cmd := strings.ToUpper(args[0])
 
 		// If the cmd is not ASKING we need to unset the flag at the _end_ of
@@ -159,12 +164,104 @@ func (s *clusterNodeStub) newConn() Conn {
 				}
 				return ss
 			})
+		case "MSET":
+			ks := make([]string, 0, len(args)/2)
+			for i := 1; i < len(args); i += 2 {
+				ks = append(ks, args[i])
+			}
+			return s.withKeys(ks, asking, readonly, func(slot clusterSlotStub) interface{} {
+				for i := 1; i+1 < len(args); i += 2 {
+					slot.kv[args[i]] = args[i+1]
+				}
+				return resp2.SimpleString{S: "OK"}
+			})
+		case "DEL", "UNLINK", "EXISTS":
+			ks := args[1:]
+			return s.withKeys(ks, asking, readonly, func(slot clusterSlotStub) interface{} {
+				var n int
+				for _, k := range ks {
+					if _, ok := slot.kv[k]; ok {
+						n++
+						if cmd != "EXISTS" {
+							delete(slot.kv, k)
+						}
+					}
+				}
+				return n
+			})
 		case "SET":
 			k := args[1]
 			return s.withKey(k, asking, readonly, func(slot clusterSlotStub) interface{} {
 				slot.kv[k] = args[2]
 				return resp2.SimpleString{S: "OK"}
 			})
+		case "XREAD":
+			// streams are stubbed as having a single entry, whose ID is the
+			// value of the stream's key. IDs are compared as strings, so they
+			// should be the same length.
+			ks := findStreamsKeys(args[1:])
+			ids := args[len(args)-len(ks):]
+			return s.withKeys(ks, asking, readonly, func(slot clusterSlotStub) interface{} {
+				res := []interface{}{}
+				for i, k := range ks {
+					if id, ok := slot.kv[k]; ok && id > ids[i] {
+						entry := []interface{}{id, []string{"key", k}}
+						res = append(res, []interface{}{k, []interface{}{entry}})
+					}
+				}
+				return res
+			})
+		case "XREADGROUP":
+			// a consumer group is stubbed as the ID of the last entry
+			// delivered to it, see streamGroupStubKey. Only new entries can
+			// be read, pending entries are not tracked.
+			group := args[2]
+			ks := findStreamsKeys(args[1:])
+			ids := args[len(args)-len(ks):]
+			return s.withKeys(ks, asking, readonly, func(slot clusterSlotStub) interface{} {
+				res := []interface{}{}
+				for i, k := range ks {
+					last, ok := slot.kv[streamGroupStubKey(k, group)]
+					if !ok {
+						return resp2.Error{E: errors.Errorf("NOGROUP No such key '%s' or consumer group '%s'", k, group)}
+					} else if ids[i] != ">" {
+						res = append(res, []interface{}{k, []interface{}{}})
+					} else if id, ok := slot.kv[k]; ok && id > last {
+						slot.kv[streamGroupStubKey(k, group)] = id
+						entry := []interface{}{id, []string{"key", k}}
+						res = append(res, []interface{}{k, []interface{}{entry}})
+					}
+				}
+				return res
+			})
+		case "XGROUP":
+			if strings.ToUpper(args[1]) != "CREATE" {
+				break
+			}
+			k, group, id := args[2], args[3], args[4]
+			return s.withKey(k, asking, readonly, func(slot clusterSlotStub) interface{} {
+				if _, ok := slot.kv[streamGroupStubKey(k, group)]; ok {
+					return resp2.Error{E: errors.New("BUSYGROUP Consumer Group name already exists")}
+				} else if id == "$" {
+					id = slot.kv[k]
+				}
+				slot.kv[streamGroupStubKey(k, group)] = id
+				return resp2.SimpleString{S: "OK"}
+			})
+		case "XACK":
+			k := args[1]
+			return s.withKey(k, asking, readonly, func(slot clusterSlotStub) interface{} {
+				return len(args) - 3
+			})
+		case "XREVRANGE":
+			k := args[1]
+			return s.withKey(k, asking, readonly, func(slot clusterSlotStub) interface{} {
+				res := []interface{}{}
+				if id, ok := slot.kv[k]; ok {
+					res = append(res, []interface{}{id, []string{"key", k}})
+				}
+				return res
+			})
 		case "EVALSHA":
 			return resp2.Error{E: errors.New("NOSCRIPT: clusterNodeStub does not support EVALSHA")}
 		case "EVAL":
@@ -183,6 +280,10 @@ func (s *clusterNodeStub) newConn() Conn {
 			})
 		case "PING":
 			return resp2.SimpleString{S: "PONG"}
+		case "SCRIPT":
+			if strings.ToUpper(args[1]) == "LOAD" {
+				return NewEvalScript(0, args[2]).sum
+			}
 		case "CLUSTER":
 			switch strings.ToUpper(args[1]) {
 			case "SLOTS":
@@ -193,6 +294,19 @@ func (s *clusterNodeStub) newConn() Conn {
 			return resp2.SimpleString{S: "OK"}
 		case "ADDR":
 			return s.addr
+		case "DBSIZE", "KEYS":
+			var keys []string
+			s.clusterDatasetStub.Lock()
+			for _, slot := range s.clusterDatasetStub.slots {
+				for key := range slot.kv {
+					keys = append(keys, key)
+				}
+			}
+			s.clusterDatasetStub.Unlock()
+			if cmd == "DBSIZE" {
+				return len(keys)
+			}
+			return keys
 		case "SCAN":
 			if cur := args[1]; cur == "0" {
 				var keys []string
@@ -218,6 +332,12 @@ func (s *clusterNodeStub) newConn() Conn {
 	})
 }
 
+// streamGroupStubKey returns the key under which the given consumer group of
+// the stream is stored in a clusterSlotStub.
+func streamGroupStubKey(stream, group string) string {
+	return stream + "\x00" + group
+}
+
 func (s *clusterNodeStub) Close() error {
 	*s = clusterNodeStub{}
 	return nil
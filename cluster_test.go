@@ -1,12 +1,17 @@
 package radix
 
 import (
+	"context"
+	"net"
+	"sync/atomic"
 	. "testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
 
+	"github.com/mediocregopher/radix/v3/resp"
 	"github.com/mediocregopher/radix/v3/trace"
 )
 
@@ -119,7 +124,7 @@ func TestClusterDo(t *T) {
 	{
 		var vgot string
 		cmd := Cmd(&vgot, "GET", k)
-		require.Nil(t, c.doInner(cmd, stub16k.addr, k, false, doAttempts))
+		require.Nil(t, c.doInner(context.Background(), cmd, stub16k.addr, k, false, doAttempts))
 		assert.Equal(t, v, vgot)
 		assert.Equal(t, trace.ClusterRedirected{
 			Addr:          stub16k.addr,
@@ -193,6 +198,224 @@ func TestClusterDoWhenDown(t *T) {
 	assert.False(t, isDown)
 }
 
+func TestClusterDoContext(t *T) {
+	c, _ := newTestCluster()
+	defer c.Close()
+
+	k, v := clusterSlotKeys[0], randStr()
+	require.Nil(t, c.DoContext(context.Background(), Cmd(nil, "SET", k, v)))
+
+	var vgot string
+	require.Nil(t, c.DoContext(context.Background(), Cmd(&vgot, "GET", k)))
+	assert.Equal(t, v, vgot)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := c.DoContext(ctx, Cmd(nil, "GET", k))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestClusterDoCrossSlot(t *T) {
+	var redirects int64
+	c, scl := newTestCluster(ClusterWithTrace(trace.ClusterTrace{
+		Redirected: func(trace.ClusterRedirected) { atomic.AddInt64(&redirects, 1) },
+	}))
+	defer c.Close()
+
+	// keys spread over all nodes, with two in the same slot
+	k0, k0b := clusterSlotKeys[0], "{"+clusterSlotKeys[0]+"}b"
+	k8k, k16k := clusterSlotKeys[8000], clusterSlotKeys[16000]
+	require.NotEqual(t, scl.stubForSlot(0).addr, scl.stubForSlot(16000).addr)
+
+	var ok string
+	require.Nil(t, c.Do(Cmd(&ok, "MSET", k16k, "c", k0, "a", k8k, "b", k0b, "d")))
+	assert.Equal(t, "OK", ok)
+
+	var vals []string
+	require.Nil(t, c.Do(Cmd(&vals, "MGET", k0, k8k, k16k, k0b)))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, vals)
+
+	vals = nil
+	require.Nil(t, c.DoSecondary(Cmd(&vals, "MGET", k16k, k0b)))
+	assert.Equal(t, []string{"c", "d"}, vals)
+
+	// writes are performed on the primaries, rather than being redirected
+	// there by the secondaries
+	prevRedirects := atomic.LoadInt64(&redirects)
+	require.Nil(t, c.DoSecondary(Cmd(&ok, "MSET", k0b, "d", k16k, "c")))
+	assert.Equal(t, "OK", ok)
+	assert.Equal(t, prevRedirects, atomic.LoadInt64(&redirects))
+
+	var n int
+	require.Nil(t, c.Do(Cmd(&n, "EXISTS", k0, k8k, k16k, k0b)))
+	assert.Equal(t, 4, n)
+	require.Nil(t, c.Do(Cmd(&n, "DEL", k0, k16k)))
+	assert.Equal(t, 2, n)
+	require.Nil(t, c.Do(Cmd(&n, "UNLINK", k0, k8k, k16k, k0b)))
+	assert.Equal(t, 2, n)
+
+	// the parts of a split command are redirected like any other command
+	scl.migrateInit(scl.stubForSlot(16000).addr, 0)
+	scl.migrateAllKeys(0)
+	scl.migrateDone(0)
+	require.Nil(t, c.Do(Cmd(nil, "MSET", k0, "a", k16k, "c")))
+	require.Nil(t, c.Do(Cmd(&vals, "MGET", k16k, k0)))
+	assert.Equal(t, []string{"c", "a"}, vals)
+}
+
+func TestClusterDoPipeline(t *T) {
+	var redirects []trace.ClusterRedirected
+	c, scl := newTestCluster(ClusterWithTrace(trace.ClusterTrace{
+		Redirected: func(r trace.ClusterRedirected) { redirects = append(redirects, r) },
+	}))
+	defer c.Close()
+	ctx := context.Background()
+
+	var keys []string
+	for s := uint16(0); s < numSlots; s += 100 {
+		keys = append(keys, clusterSlotKeys[s])
+	}
+
+	setCmds := make([]CmdAction, len(keys))
+	for i, k := range keys {
+		setCmds[i] = Cmd(nil, "SET", k, "v"+k)
+	}
+	require.Nil(t, c.DoPipeline(ctx, setCmds...))
+
+	vals := make([]string, len(keys))
+	getCmds := make([]CmdAction, len(keys))
+	for i, k := range keys {
+		getCmds[i] = Cmd(&vals[i], "GET", k)
+	}
+	require.Nil(t, c.DoPipeline(ctx, getCmds...))
+	for i, k := range keys {
+		assert.Equal(t, "v"+k, vals[i])
+	}
+
+	// errors are returned per command
+	k0, k16k := clusterSlotKeys[0], clusterSlotKeys[16000]
+	var v0, v16k string
+	err := c.DoPipeline(ctx,
+		Cmd(&v0, "GET", k0),
+		Cmd(nil, "FOO", k16k),
+		NewFunctionLibrary("#!lua name=lib\n").FCall(nil, "f", []string{k0, k16k}),
+		Cmd(&v16k, "GET", k16k),
+	)
+	var pErr *ClusterPipelineError
+	require.True(t, errors.As(err, &pErr))
+	require.Len(t, pErr.Errs, 4)
+	assert.Nil(t, pErr.Errs[0])
+	assert.Contains(t, pErr.Errs[1].Error(), "unknown command")
+	assert.Contains(t, pErr.Errs[2].Error(), "do not belong to the same slot")
+	assert.Nil(t, pErr.Errs[3])
+	assert.Equal(t, "v"+k0, v0)
+	assert.Equal(t, "v"+k16k, v16k)
+
+	// commands are redirected individually, first with an ASK while the slot is
+	// migrating and then with a MOVED once it's done
+	dst := scl.stubForSlot(16000)
+	scl.migrateInit(dst.addr, 0)
+	scl.migrateKey(k0)
+	v0, v16k = "", ""
+	require.Nil(t, c.DoPipeline(ctx, Cmd(&v0, "GET", k0), Cmd(&v16k, "GET", k16k)))
+	assert.Equal(t, "v"+k0, v0)
+	assert.Equal(t, "v"+k16k, v16k)
+	require.Len(t, redirects, 1)
+	assert.True(t, redirects[0].Ask)
+	assert.Equal(t, k0, redirects[0].Key)
+
+	scl.migrateAllKeys(0)
+	scl.migrateDone(0)
+	v0 = ""
+	require.Nil(t, c.DoPipeline(ctx, Cmd(&v0, "GET", k0)))
+	assert.Equal(t, "v"+k0, v0)
+	require.Len(t, redirects, 2)
+	assert.True(t, redirects[1].Moved)
+	assert.Equal(t, dst.addr, c.addrForKey(k0))
+}
+
+func TestClusterDoPipelineDecodeErr(t *T) {
+	scl := newStubCluster(testTopo)
+	c := scl.newCluster(ClusterPoolFunc(func(network, addr string) (Client, error) {
+		for _, s := range scl.stubs {
+			if s.addr == addr {
+				return NewPool(network, addr, 1, PoolConnFunc(func(string, string) (Conn, error) {
+					return s.newConn(), nil
+				}), PoolPipelineWindow(0, 0))
+			}
+		}
+		return nil, errors.Errorf("unknown addr: %q", addr)
+	}))
+	defer c.Close()
+	ctx := context.Background()
+
+	k0, k1, k2 := clusterSlotKeys[0], clusterSlotKeys[1], clusterSlotKeys[2]
+	require.Equal(t, c.addrForKey(k0), c.addrForKey(k1))
+	require.Equal(t, c.addrForKey(k0), c.addrForKey(k2))
+	for _, k := range []string{k0, k1, k2} {
+		require.Nil(t, c.Do(Cmd(nil, "SET", k, "v"+k)))
+	}
+
+	// a reply which doesn't fit its receiver only fails its own command, and
+	// the replies following it are still read
+	var v0, v2 string
+	var i1 int
+	err := c.DoPipeline(ctx, Cmd(&v0, "GET", k0), Cmd(&i1, "GET", k1), Cmd(&v2, "GET", k2))
+	var pErr *ClusterPipelineError
+	require.True(t, errors.As(err, &pErr))
+	assert.Nil(t, pErr.Errs[0])
+	assert.True(t, errors.As(pErr.Errs[1], new(resp.ErrDiscarded)))
+	assert.Nil(t, pErr.Errs[2])
+	assert.Equal(t, "v"+k0, v0)
+	assert.Equal(t, "v"+k2, v2)
+
+	// the Conn was returned to the pool without any replies left on it
+	var v string
+	require.Nil(t, c.Do(Cmd(&v, "GET", k2)))
+	assert.Equal(t, "v"+k2, v)
+}
+
+func TestClusterBroadcast(t *T) {
+	c, _ := newTestCluster()
+	defer c.Close()
+	ctx := context.Background()
+	topo := c.Topo()
+
+	keys := []string{clusterSlotKeys[0], clusterSlotKeys[6000], clusterSlotKeys[16000]}
+	for _, k := range keys {
+		require.Nil(t, c.Do(Cmd(nil, "SET", k, k)))
+	}
+
+	n, err := c.BroadcastSum(ctx, "DBSIZE", nil)
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(keys)), n)
+
+	// secondaries share their primary's dataset in the stub
+	n, err = c.BroadcastSum(ctx, "DBSIZE", nil, BroadcastAllNodes())
+	require.Nil(t, err)
+	assert.Equal(t, int64(2*len(keys)), n)
+
+	gotKeys, err := c.BroadcastConcat(ctx, "KEYS", []string{"*"})
+	require.Nil(t, err)
+	assert.ElementsMatch(t, keys, gotKeys)
+
+	addrs, err := c.BroadcastMap(ctx, "ADDR", nil, BroadcastAllNodes())
+	require.Nil(t, err)
+	require.Len(t, addrs, len(topo))
+	for addr, gotAddr := range addrs {
+		assert.Equal(t, []byte(addr), gotAddr)
+	}
+
+	// errors are reported per node
+	err = c.Broadcast(ctx, func(string) Action { return Cmd(nil, "FOO") })
+	var bErr *ClusterBroadcastError
+	require.True(t, errors.As(err, &bErr))
+	assert.Len(t, bErr.Errs, len(topo.Primaries()))
+	for _, node := range topo.Primaries() {
+		assert.Contains(t, bErr.Errs[node.Addr].Error(), "unknown command")
+	}
+}
+
 func BenchmarkClusterDo(b *B) {
 	c, _ := newTestCluster()
 	defer c.Close()
@@ -274,6 +497,149 @@ func TestClusterDoSecondary(t *T) {
 	assert.Equal(t, 2, redirects)
 }
 
+type testReplicaSelector struct {
+	selects []string
+	dones   []error
+}
+
+func (rs *testReplicaSelector) Select(addrs []string) string {
+	rs.selects = append(rs.selects, addrs[0])
+	return addrs[0]
+}
+
+func (rs *testReplicaSelector) Done(_ string, _ time.Duration, err error) {
+	rs.dones = append(rs.dones, err)
+}
+
+type netErrClient struct {
+	Client
+}
+
+func (netErrClient) Do(Action) error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}
+}
+
+func TestClusterReplicaSelector(t *T) {
+	rs := new(testReplicaSelector)
+	c, _ := newTestCluster(ClusterReplicaSelector(rs))
+	defer c.Close()
+
+	key := clusterSlotKeys[0]
+	primAddr := c.addrForKey(key)
+	secAddr := c.secondaryAddrs[primAddr][0]
+
+	var addr string
+	require.NoError(t, c.DoSecondary(Cmd(&addr, "ADDR", key)))
+	assert.Equal(t, secAddr, addr)
+	assert.Equal(t, []string{secAddr}, rs.selects)
+	assert.Equal(t, []error{nil}, rs.dones)
+
+	// a secondary which returns a network error isn't used until the next sync
+	c.l.Lock()
+	c.pools[secAddr] = netErrClient{Client: c.pools[secAddr]}
+	c.l.Unlock()
+	assert.Error(t, c.DoSecondary(Cmd(nil, "ADDR", key)))
+	assert.Len(t, rs.dones, 2)
+
+	require.NoError(t, c.DoSecondary(Cmd(&addr, "ADDR", key)))
+	assert.Equal(t, primAddr, addr)
+	assert.Len(t, rs.selects, 2)
+
+	// syncing doesn't make it healthy again while it's still failing, and the
+	// sync itself isn't done using it
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.Sync())
+	}
+	require.NoError(t, c.DoSecondary(Cmd(&addr, "ADDR", key)))
+	assert.Equal(t, primAddr, addr)
+	assert.Len(t, rs.selects, 2)
+
+	// once it responds again the check following the next sync makes it
+	// healthy
+	c.l.Lock()
+	c.pools[secAddr] = c.pools[secAddr].(netErrClient).Client
+	c.l.Unlock()
+	require.NoError(t, c.Sync())
+	waitClusterHealthy(t, c, secAddr)
+	require.NoError(t, c.DoSecondary(Cmd(&addr, "ADDR", key)))
+	assert.Equal(t, secAddr, addr)
+	assert.Len(t, rs.selects, 3)
+}
+
+// waitClusterHealthy waits for the check of unhealthy secondaries, which runs
+// in the background, to mark the given secondary as healthy.
+func waitClusterHealthy(tb TB, c *Cluster, addr string) {
+	tb.Helper()
+	for i := 0; i < 300; i++ {
+		c.l.RLock()
+		unhealthy := c.unhealthy[addr]
+		c.l.RUnlock()
+		if !unhealthy {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.Fatalf("%s wasn't marked as healthy", addr)
+}
+
+// hangingClient doesn't respond to any Action until release is closed, or the
+// context given to DoContext is done.
+type hangingClient struct {
+	Client
+	release chan struct{}
+}
+
+func (hc hangingClient) Do(Action) error {
+	<-hc.release
+	return errClientClosed
+}
+
+func (hc hangingClient) DoContext(ctx context.Context, _ Action) error {
+	select {
+	case <-hc.release:
+		return errClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestClusterCheckUnhealthy(t *T) {
+	c, _ := newTestCluster()
+
+	primAddr := c.addrForKey(clusterSlotKeys[0])
+	hangAddr := c.secondaryAddrs[primAddr][0]
+	release := make(chan struct{})
+	defer close(release)
+
+	c.l.Lock()
+	c.pools[hangAddr] = hangingClient{Client: c.pools[hangAddr], release: release}
+	c.l.Unlock()
+	c.setUnhealthy(hangAddr)
+
+	// syncs aren't delayed by the unhealthy secondary not responding
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		require.NoError(t, c.Sync())
+		assert.True(t, time.Since(start) < unhealthyPingTimeout/2, "sync took %v", time.Since(start))
+	}
+
+	// other secondaries still become healthy again, once the check which is
+	// waiting on the unresponsive one has timed out
+	otherAddr := c.secondaryAddrs[c.addrForKey(clusterSlotKeys[16000])][0]
+	c.setUnhealthy(otherAddr)
+	require.NoError(t, c.Sync())
+	waitClusterHealthy(t, c, otherAddr)
+
+	c.l.RLock()
+	assert.True(t, c.unhealthy[hangAddr])
+	c.l.RUnlock()
+
+	// closing interrupts the check
+	start := time.Now()
+	require.NoError(t, c.Close())
+	assert.True(t, time.Since(start) < unhealthyPingTimeout/2, "close took %v", time.Since(start))
+}
+
 var clusterAddrs []string
 
 func ExampleClusterPoolFunc_defaultClusterConnFunc() {
@@ -2,14 +2,25 @@ package radix
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	errors "golang.org/x/xerrors"
+
 	"github.com/mediocregopher/radix/v3/resp"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+	"github.com/mediocregopher/radix/v3/resp/resp3"
 )
 
 // Conn is a Client wrapping a single network connection which synchronously
@@ -66,15 +77,27 @@ func wrapDefaultConnFunc(addr string) ConnFunc {
 type connWrap struct {
 	net.Conn
 	brw *bufio.ReadWriter
+	cr  *countReader
+
+	// the protocol version negotiated with HELLO, 0 if HELLO wasn't performed,
+	// and the reply to that HELLO
+	proto int
+	hello HelloInfo
 }
 
 // NewConn takes an existing net.Conn and wraps it to support the Conn interface
 // of this package. The Read and Write methods on the original net.Conn should
 // not be used after calling this method.
 func NewConn(conn net.Conn) Conn {
+	return newConnWrap(conn)
+}
+
+func newConnWrap(conn net.Conn) *connWrap {
+	cr := &countReader{r: conn}
 	return &connWrap{
 		Conn: conn,
-		brw:  bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		brw:  bufio.NewReadWriter(bufio.NewReader(cr), bufio.NewWriter(conn)),
+		cr:   cr,
 	}
 }
 
@@ -82,6 +105,16 @@ func (cw *connWrap) Do(a Action) error {
 	return a.Run(cw)
 }
 
+// DoContext implements the method for the ContextClient interface.
+//
+// If the context is done while the Action is in the middle of reading or
+// writing then the underlying net.Conn will have its deadline set in the past,
+// interrupting the Action. The Conn should be closed if DoContext returns the
+// context's error, as there's no telling what state the connection was left in.
+func (cw *connWrap) DoContext(ctx context.Context, a Action) error {
+	return doConnContext(ctx, cw, a)
+}
+
 func (cw *connWrap) Encode(m resp.Marshaler) error {
 	if err := m.MarshalRESP(cw.brw); err != nil {
 		return err
@@ -90,6 +123,9 @@ func (cw *connWrap) Encode(m resp.Marshaler) error {
 }
 
 func (cw *connWrap) Decode(u resp.Unmarshaler) error {
+	if cw.proto == 3 {
+		return unmarshalRESP3(cw.brw.Reader, u)
+	}
 	return u.UnmarshalRESP(cw.brw.Reader)
 }
 
@@ -97,12 +133,156 @@ func (cw *connWrap) NetConn() net.Conn {
 	return cw.Conn
 }
 
+// bytesRead returns the total number of bytes which have been consumed by
+// calls to Decode.
+func (cw *connWrap) bytesRead() int64 {
+	return cw.cr.n - int64(cw.brw.Reader.Buffered())
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// connBytesRead returns the total number of bytes which have been consumed by
+// calls to Decode on the Conn, if the Conn is one which keeps track of that.
+func connBytesRead(c Conn) (int64, bool) {
+	switch c := c.(type) {
+	case *connWrap:
+		return c.bytesRead(), true
+	case *ioErrConn:
+		return connBytesRead(c.Conn)
+	default:
+		return 0, false
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// HelloInfo describes the reply redis gives to the HELLO command. A Conn
+// created by Dial using the DialHello option will hold on to the HelloInfo it
+// received, which can be retrieved using ConnHelloInfo.
+type HelloInfo struct {
+	Server  string        `redis:"server"`
+	Version string        `redis:"version"`
+	Proto   int           `redis:"proto"`
+	ID      int64         `redis:"id"`
+	Mode    string        `redis:"mode"`
+	Role    string        `redis:"role"`
+	Modules []HelloModule `redis:"modules"`
+}
+
+// HelloModule describes a single module loaded into a redis instance, as
+// reported in HelloInfo.
+type HelloModule struct {
+	Name string `redis:"name"`
+	Ver  int    `redis:"ver"`
+}
+
+// ConnHelloInfo returns the HelloInfo which the given Conn received from redis
+// when it was created, if it was created by Dial using the DialHello option.
+// Conns which are handed out by a Pool (e.g. via WithConn) are supported as
+// well.
+func ConnHelloInfo(c Conn) (HelloInfo, bool) {
+	for {
+		switch cT := c.(type) {
+		case *connWrap:
+			return cT.hello, cT.proto != 0
+		case *ioErrConn:
+			c = cT.Conn
+		case askConn:
+			c = cT.Conn
+		default:
+			return HelloInfo{}, false
+		}
+	}
+}
+
+// resp3Unmarshaler is implemented by types which are able to unmarshal replies
+// directly off of a Conn which has switched to RESP3 using DialHello. Any other
+// resp.Unmarshaler which isn't from the resp3 package will be given replies
+// converted to RESP2, so that it doesn't need to know about RESP3.
+type resp3Unmarshaler interface {
+	unmarshalRESP3(*bufio.Reader) error
+}
+
+var resp3PkgPath = reflect.TypeOf(resp3.Any{}).PkgPath()
+
+func isRESP3Unmarshaler(u interface{}) bool {
+	if _, ok := u.(resp3Unmarshaler); ok {
+		return true
+	}
+	t := reflect.TypeOf(u)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.PkgPath() == resp3PkgPath
+}
+
+// unmarshalRESP3 unmarshals a RESP3 message off the reader into the given
+// resp.Unmarshaler, downgrading the message to RESP2 first if the Unmarshaler
+// doesn't support RESP3. Errors returned by redis are always returned as
+// resp2.Error, so they can be handled the same regardless of protocol.
+func unmarshalRESP3(br *bufio.Reader, u resp.Unmarshaler) error {
+	var err error
+	if r3u, ok := u.(resp3Unmarshaler); ok {
+		err = r3u.unmarshalRESP3(br)
+	} else if isRESP3Unmarshaler(u) {
+		err = u.UnmarshalRESP(br)
+	} else {
+		err = unmarshalDowngraded(br, u)
+	}
+	return resp3ErrToResp2(err)
+}
+
+var downgradeBufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func unmarshalDowngraded(br *bufio.Reader, u resp.Unmarshaler) error {
+	buf := downgradeBufPool.Get().(*bytes.Buffer)
+	defer downgradeBufPool.Put(buf)
+	buf.Reset()
+	if err := resp3.Downgrade(buf, br); err != nil {
+		return err
+	}
+	return resp2.RawMessage(buf.Bytes()).UnmarshalInto(u)
+}
+
+func resp3ErrToResp2(err error) error {
+	switch errT := err.(type) {
+	case resp3.SimpleError:
+		return resp2.Error{E: errT.E}
+	case resp3.BlobError:
+		return resp2.Error{E: errT.E}
+	case resp.ErrDiscarded:
+		switch innerErr := errT.Err.(type) {
+		case resp3.SimpleError:
+			return resp2.Error{E: innerErr.E}
+		case resp3.BlobError:
+			return resp2.Error{E: innerErr.E}
+		}
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 type dialOpts struct {
 	connectTimeout, readTimeout, writeTimeout time.Duration
 	authUser, authPass                        string
 	selectDB                                  string
 	useTLSConfig                              bool
 	tlsConfig                                 *tls.Config
+	helloProto                                int
+	helloClientName                           string
 }
 
 // DialOpt is an optional behavior which can be applied to the Dial function to
@@ -180,6 +360,28 @@ func DialSelectDB(db int) DialOpt {
 	}
 }
 
+// DialHello will cause Dial to perform a HELLO command once the connection is
+// created, switching the connection to the given protocol version (2 or 3).
+// Any AUTH information (from DialAuthUser, DialAuthPass, or the redis URI) will
+// be sent as part of the HELLO, rather than as a separate AUTH command. If
+// clientName is not empty it will be set as the connection's name as well.
+//
+// The server's reply to HELLO can be retrieved from the Conn using
+// ConnHelloInfo. HELLO is only supported by redis 6 and up.
+//
+// If protocol version 3 is used then replies will be read as RESP3. Actions in
+// this package, as well as any resp.Unmarshaler from the resp3 package, will
+// receive replies as RESP3, so that for example a map reply can be unmarshaled
+// into a map rather than a flattened array. All other resp.Unmarshalers will
+// receive replies converted to their RESP2 equivalent. Errors from redis will
+// always be returned as resp2.Error.
+func DialHello(protover int, clientName string) DialOpt {
+	return func(do *dialOpts) {
+		do.helloProto = protover
+		do.helloClientName = clientName
+	}
+}
+
 // DialUseTLS will cause Dial to perform a TLS handshake using the provided
 // config. If config is nil the config is interpreted as equivalent to the zero
 // configuration. See https://golang.org/pkg/crypto/tls/#Config
@@ -190,25 +392,145 @@ func DialUseTLS(config *tls.Config) DialOpt {
 	}
 }
 
+// aLongTimeAgo is a non-zero time, far in the past, used to immediately
+// interrupt any blocked reads or writes on a net.Conn.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// contextError is returned when an Action fails after it was interrupted due to
+// its context being done. It wraps both the context's error and the Action's
+// error, which is usually due to the interruption, but may be unrelated.
+type contextError struct {
+	ctxErr, err error
+}
+
+func (e *contextError) Error() string {
+	return fmt.Sprintf("%v: %v", e.ctxErr, e.err)
+}
+
+// Unwrap returns the context's error.
+func (e *contextError) Unwrap() error {
+	return e.ctxErr
+}
+
+// Is allows errors.Is to find the Action's error as well.
+func (e *contextError) Is(target error) bool {
+	return errors.Is(e.err, target)
+}
+
+// As allows errors.As to find the Action's error as well.
+func (e *contextError) As(target interface{}) bool {
+	return errors.As(e.err, target)
+}
+
+// contextAction is implemented by Actions which wait on something other than
+// the Conn, e.g. a backoff, and so need the context given to DoContext in order
+// to be interrupted by it.
+type contextAction interface {
+	Action
+	runContext(ctx context.Context, c Conn) error
+}
+
+// runAction runs the Action on the Conn, passing it the context if it's a
+// contextAction.
+func runAction(ctx context.Context, c Conn, a Action) error {
+	if ca, ok := a.(contextAction); ok {
+		return ca.runContext(ctx, c)
+	}
+	return a.Run(c)
+}
+
+// doConnContext runs the Action on the Conn, interrupting any blocked reads or
+// writes on the Conn's underlying net.Conn once the context is done.
+func doConnContext(ctx context.Context, c Conn, a Action) error {
+	done := ctx.Done()
+	if done == nil {
+		return runAction(ctx, c, a)
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	netConn := c.NetConn()
+	stopCh := make(chan struct{})
+	abortedCh := make(chan bool, 1)
+	go func() {
+		select {
+		case <-done:
+			netConn.SetDeadline(aLongTimeAgo)
+			abortedCh <- true
+		case <-stopCh:
+			abortedCh <- false
+		}
+	}()
+
+	err := runAction(ctx, c, a)
+	close(stopCh)
+	if aborted := <-abortedCh; !aborted {
+		return err
+	} else if err != nil {
+		return &contextError{ctxErr: ctx.Err(), err: err}
+	}
+
+	// the Action managed to complete regardless of the interruption, so the
+	// connection is still in a usable state and can have its deadline reset.
+	netConn.SetDeadline(time.Time{})
+	return nil
+}
+
 type timeoutConn struct {
+	// Atomic fields must be at the beginning of the struct since they must be
+	// correctly aligned or else access may cause panics on 32-bit architectures
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	deadline int64 // unix nanoseconds, set by SetDeadline, atomic
+
 	net.Conn
 	readTimeout, writeTimeout time.Duration
 }
 
+// setTimeout sets a deadline using the given setter which is the given timeout
+// from now, or the deadline given to SetDeadline if that is earlier.
+func (tc *timeoutConn) setTimeout(set func(time.Time) error, timeout time.Duration) {
+	for {
+		explicit := atomic.LoadInt64(&tc.deadline)
+		t := time.Now().Add(timeout)
+		if explicit != 0 && explicit < t.UnixNano() {
+			t = time.Unix(0, explicit)
+		}
+		set(t)
+
+		// SetDeadline may have been called concurrently, in which case the
+		// deadline just set may have overwritten it.
+		if atomic.LoadInt64(&tc.deadline) == explicit {
+			return
+		}
+	}
+}
+
 func (tc *timeoutConn) Read(b []byte) (int, error) {
 	if tc.readTimeout > 0 {
-		tc.Conn.SetReadDeadline(time.Now().Add(tc.readTimeout))
+		tc.setTimeout(tc.Conn.SetReadDeadline, tc.readTimeout)
 	}
 	return tc.Conn.Read(b)
 }
 
 func (tc *timeoutConn) Write(b []byte) (int, error) {
 	if tc.writeTimeout > 0 {
-		tc.Conn.SetWriteDeadline(time.Now().Add(tc.writeTimeout))
+		tc.setTimeout(tc.Conn.SetWriteDeadline, tc.writeTimeout)
 	}
 	return tc.Conn.Write(b)
 }
 
+// SetDeadline sets the deadline on the underlying net.Conn, and ensures that
+// the deadline is honored by the read and write timeouts if it is earlier than
+// them. A zero value for t clears the deadline.
+func (tc *timeoutConn) SetDeadline(t time.Time) error {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	atomic.StoreInt64(&tc.deadline, deadline)
+	return tc.Conn.SetDeadline(t)
+}
+
 var defaultDialOpts = []DialOpt{
 	DialTimeout(10 * time.Second),
 }
@@ -319,13 +641,18 @@ func Dial(network, addr string, opts ...DialOpt) (Conn, error) {
 		}
 	}
 
-	conn := NewConn(&timeoutConn{
+	conn := newConnWrap(&timeoutConn{
 		readTimeout:  do.readTimeout,
 		writeTimeout: do.writeTimeout,
 		Conn:         netConn,
 	})
 
-	if do.authUser != "" && do.authUser != defaultAuthUser {
+	if do.helloProto > 0 {
+		if err := conn.doHello(do); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else if do.authUser != "" && do.authUser != defaultAuthUser {
 		if err := conn.Do(Cmd(nil, "AUTH", do.authUser, do.authPass)); err != nil {
 			conn.Close()
 			return nil, err
@@ -346,3 +673,25 @@ func Dial(network, addr string, opts ...DialOpt) (Conn, error) {
 
 	return conn, nil
 }
+
+func (cw *connWrap) doHello(do dialOpts) error {
+	args := []string{strconv.Itoa(do.helloProto)}
+	if (do.authUser != "" && do.authUser != defaultAuthUser) || do.authPass != "" {
+		user := do.authUser
+		if user == "" {
+			user = defaultAuthUser
+		}
+		args = append(args, "AUTH", user, do.authPass)
+	}
+	if do.helloClientName != "" {
+		args = append(args, "SETNAME", do.helloClientName)
+	}
+
+	// the reply to HELLO is already in the requested protocol
+	cw.proto = do.helloProto
+	if err := cw.Do(Cmd(&cw.hello, "HELLO", args...)); err != nil {
+		cw.proto = 0
+		return err
+	}
+	return nil
+}
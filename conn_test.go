@@ -1,6 +1,8 @@
 package radix
 
 import (
+	"bufio"
+	"net"
 	"regexp"
 	"strings"
 	. "testing"
@@ -8,6 +10,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
 )
 
 func TestCloseBehavior(t *T) {
@@ -134,3 +139,123 @@ func TestDialSelect(t *T) {
 		}
 	}
 }
+
+func TestDialHello(t *T) {
+	conn := dial()
+	defer conn.Close()
+	requireRedisVersion(t, conn, 6, 0, 0)
+
+	for _, proto := range []int{2, 3} {
+		c := dial(DialHello(proto, "radix-test"))
+		info, ok := ConnHelloInfo(c)
+		assert.True(t, ok)
+		assert.Equal(t, proto, info.Proto)
+		assert.Equal(t, "redis", info.Server)
+		assert.NotEmpty(t, info.Version)
+
+		var name string
+		require.Nil(t, c.Do(Cmd(&name, "CLIENT", "GETNAME")))
+		assert.Equal(t, "radix-test", name)
+
+		key := randStr()
+		require.Nil(t, c.Do(Cmd(nil, "HSET", key, "a", "1", "b", "2")))
+		var m map[string]int
+		require.Nil(t, c.Do(Cmd(&m, "HGETALL", key)))
+		assert.Equal(t, map[string]int{"a": 1, "b": 2}, m)
+		c.Close()
+	}
+
+	_, ok := ConnHelloInfo(conn)
+	assert.False(t, ok)
+}
+
+// fakeRESP3Server reads a command off the given net.Conn for each reply given,
+// sending the reply after each one and returning the received commands.
+func fakeRESP3Server(conn net.Conn, replies ...string) <-chan [][]string {
+	ch := make(chan [][]string, 1)
+	go func() {
+		br := bufio.NewReader(conn)
+		var cmds [][]string
+		for _, reply := range replies {
+			var cmd []string
+			if err := (resp2.Any{I: &cmd}).UnmarshalRESP(br); err != nil {
+				panic(err)
+			} else if _, err := conn.Write([]byte(reply)); err != nil {
+				panic(err)
+			}
+			cmds = append(cmds, cmd)
+		}
+		ch <- cmds
+	}()
+	return ch
+}
+
+func TestConnRESP3(t *T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	cw := newConnWrap(clientConn)
+	defer cw.Close()
+
+	cmdsCh := fakeRESP3Server(serverConn,
+		"%6\r\n"+
+			"+server\r\n+redis\r\n"+
+			"+version\r\n+6.0.0\r\n"+
+			"+proto\r\n:3\r\n"+
+			"+mode\r\n+standalone\r\n"+
+			"+role\r\n+master\r\n"+
+			"+modules\r\n*1\r\n%2\r\n+name\r\n+foo\r\n+ver\r\n:1\r\n",
+		"%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n",
+		"%1\r\n+a\r\n#t\r\n",
+		"_\r\n",
+		"~1\r\n+a\r\n",
+		"-ERR foo\r\n",
+	)
+
+	require.Nil(t, cw.doHello(dialOpts{
+		helloProto:      3,
+		helloClientName: "bar",
+		authUser:        "user",
+		authPass:        "pass",
+	}))
+	info, ok := ConnHelloInfo(newIOErrConn(cw))
+	assert.True(t, ok)
+	assert.Equal(t, HelloInfo{
+		Server:  "redis",
+		Version: "6.0.0",
+		Proto:   3,
+		Mode:    "standalone",
+		Role:    "master",
+		Modules: []HelloModule{{Name: "foo", Ver: 1}},
+	}, info)
+
+	{ // map into map
+		var m map[string]int
+		require.Nil(t, cw.Do(Cmd(&m, "HGETALL", "foo")))
+		assert.Equal(t, map[string]int{"a": 1, "b": 2}, m)
+	}
+
+	{ // map into interface{} keeps its typing
+		var i interface{}
+		require.Nil(t, cw.Do(Cmd(&i, "FOO")))
+		assert.Equal(t, map[interface{}]interface{}{"a": true}, i)
+	}
+
+	{ // resp.Unmarshalers which don't know about RESP3 get RESP2
+		var mn MaybeNil
+		require.Nil(t, cw.Do(Cmd(&mn, "GET", "foo")))
+		assert.True(t, mn.Nil)
+
+		var rm resp2.RawMessage
+		require.Nil(t, cw.Do(Cmd(&rm, "SMEMBERS", "foo")))
+		assert.Equal(t, "*1\r\n+a\r\n", string(rm))
+	}
+
+	{ // errors are always resp2.Error
+		err := cw.Do(Cmd(nil, "FOO"))
+		assert.True(t, errors.As(err, new(resp2.Error)))
+		assert.Equal(t, "ERR foo", err.Error())
+	}
+
+	cmds := <-cmdsCh
+	assert.Equal(t, []string{"HELLO", "3", "AUTH", "user", "pass", "SETNAME", "bar"}, cmds[0])
+}
@@ -0,0 +1,198 @@
+package radix
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+	"github.com/mediocregopher/radix/v3/resp/resp3"
+)
+
+// FunctionLibrary contains the code of a library of redis functions, as used by
+// redis' FUNCTION LOAD and FCALL functionality (redis 7.0 and up). Call FCall or
+// FCallRO on a FunctionLibrary to create an Action which calls one of the
+// library's functions.
+type FunctionLibrary struct {
+	name, code string
+	opts       functionLibraryOpts
+}
+
+type functionLibraryOpts struct {
+	autoLoad bool
+}
+
+// FunctionLibraryOpt is an optional behavior which can be applied to the
+// NewFunctionLibrary function to effect a FunctionLibrary's behavior.
+type FunctionLibraryOpt func(*functionLibraryOpts)
+
+// FunctionLibraryAutoLoad causes Actions created by FCall and FCallRO to load
+// the library using FUNCTION LOAD, and then retry the call, if redis reports
+// that the function doesn't exist.
+//
+// The library is never loaded with REPLACE, so a different version of the
+// library which is already loaded is left alone. If loading fails, e.g.
+// because the Action was performed on a read-only replica, the original error
+// from the call is returned.
+func FunctionLibraryAutoLoad() FunctionLibraryOpt {
+	return func(opts *functionLibraryOpts) {
+		opts.autoLoad = true
+	}
+}
+
+// NewFunctionLibrary initializes a FunctionLibrary instance. The code must
+// begin with a shebang line giving the engine and name of the library, e.g.
+// "#!lua name=mylib".
+//
+// By default the library isn't loaded automatically, see Load and
+// FunctionLibraryAutoLoad.
+func NewFunctionLibrary(code string, opts ...FunctionLibraryOpt) FunctionLibrary {
+	fl := FunctionLibrary{code: code}
+	for _, opt := range opts {
+		opt(&fl.opts)
+	}
+	shebang := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		shebang = code[:i]
+	}
+	if strings.HasPrefix(shebang, "#!") {
+		for _, field := range strings.Fields(shebang)[1:] {
+			if strings.HasPrefix(field, "name=") {
+				fl.name = strings.TrimPrefix(field, "name=")
+			}
+		}
+	}
+	return fl
+}
+
+// Name returns the name of the library, as given in the code's shebang line.
+func (fl FunctionLibrary) Name() string {
+	return fl.name
+}
+
+// Load returns a CmdAction which will load the library onto a redis instance
+// using FUNCTION LOAD. If replace is true then any existing library with the
+// same name will be replaced, otherwise loading a library which already exists
+// will return an error.
+//
+// When using Cluster the library must be loaded onto every primary, see
+// Cluster.Client, unless FunctionLibraryAutoLoad is used.
+func (fl FunctionLibrary) Load(replace bool) CmdAction {
+	if replace {
+		return Cmd(nil, "FUNCTION", "LOAD", "REPLACE", fl.code)
+	}
+	return Cmd(nil, "FUNCTION", "LOAD", fl.code)
+}
+
+var (
+	fcall   = []byte("FCALL")
+	fcallRO = []byte("FCALL_RO")
+)
+
+type fcallAction struct {
+	FunctionLibrary
+	ro         bool
+	fn         string
+	keys, args []string
+	rcv        interface{}
+}
+
+// FCall is like the top-level Cmd but it calls the given function of the
+// library using FCALL. If FunctionLibraryAutoLoad was given and the function
+// doesn't exist on the redis instance the library will be loaded and the call
+// retried.
+//
+// The given keys will be returned from the Action's Keys method, so it will be
+// routed correctly when used with Cluster.
+func (fl FunctionLibrary) FCall(rcv interface{}, fn string, keys []string, args ...string) CmdAction {
+	return &fcallAction{
+		FunctionLibrary: fl,
+		fn:              fn,
+		keys:            keys,
+		args:            args,
+		rcv:             rcv,
+	}
+}
+
+// FCallRO is like FCall but uses FCALL_RO, and so can only call functions which
+// have the no-writes flag. Actions created by FCallRO can be performed on
+// replicas, e.g. using Cluster.DoSecondary or Sentinel.DoSecondary.
+func (fl FunctionLibrary) FCallRO(rcv interface{}, fn string, keys []string, args ...string) CmdAction {
+	fa := fl.FCall(rcv, fn, keys, args...).(*fcallAction)
+	fa.ro = true
+	return fa
+}
+
+func (fa *fcallAction) Keys() []string {
+	return fa.keys
+}
+
+func (fa *fcallAction) MarshalRESP(w io.Writer) error {
+	// FCALL(_RO) function numkeys keys... args...
+	ah := resp2.ArrayHeader{N: 3 + len(fa.keys) + len(fa.args)}
+	if err := ah.MarshalRESP(w); err != nil {
+		return err
+	}
+
+	var err error
+	if fa.ro {
+		err = marshalBulkStringBytes(err, w, fcallRO)
+	} else {
+		err = marshalBulkStringBytes(err, w, fcall)
+	}
+	err = marshalBulkString(err, w, fa.fn)
+	err = marshalBulkString(err, w, strconv.Itoa(len(fa.keys)))
+	for i := range fa.keys {
+		err = marshalBulkString(err, w, fa.keys[i])
+	}
+	for i := range fa.args {
+		err = marshalBulkString(err, w, fa.args[i])
+	}
+	return err
+}
+
+func (fa *fcallAction) UnmarshalRESP(br *bufio.Reader) error {
+	return (resp2.Any{I: fa.rcv}).UnmarshalRESP(br)
+}
+
+func (fa *fcallAction) unmarshalRESP3(br *bufio.Reader) error {
+	if u, ok := fa.rcv.(resp.Unmarshaler); ok && !isRESP3Unmarshaler(u) {
+		return unmarshalDowngraded(br, u)
+	}
+	return resp3.Any{I: fa.rcv}.UnmarshalRESP(br)
+}
+
+func (fa *fcallAction) Run(conn Conn) error {
+	run := func() error {
+		if err := conn.Encode(fa); err != nil {
+			return err
+		}
+		return conn.Decode(fa)
+	}
+
+	err := run()
+	var respErr resp2.Error
+	if !fa.opts.autoLoad || !errors.As(err, &respErr) ||
+		!strings.HasPrefix(respErr.Error(), "ERR Function not found") {
+		return err
+	}
+
+	// if the library can't be loaded, e.g. because conn is to a replica, the
+	// original error is more useful
+	if loadErr := conn.Do(fa.Load(false)); loadErr != nil {
+		return err
+	}
+	return run()
+}
+
+func (fa *fcallAction) String() string {
+	return cmdString(fa)
+}
+
+func (fa *fcallAction) ClusterCanRetry() bool {
+	return true
+}
@@ -0,0 +1,95 @@
+package radix
+
+import (
+	"strings"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+const testFunctionLibraryCode = `#!lua name=radixtest
+redis.register_function('echokey', function(keys, args) return keys[1] .. args[1] end)
+redis.register_function{
+	function_name='echokey_ro',
+	callback=function(keys, args) return keys[1] .. args[1] end,
+	flags={'no-writes'},
+}
+`
+
+func TestFunctionLibrary(t *T) {
+	fl := NewFunctionLibrary(testFunctionLibraryCode, FunctionLibraryAutoLoad())
+	assert.Equal(t, "radixtest", fl.Name())
+
+	var cmds [][]string
+	var loaded, readOnly bool
+	conn := Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+		cmds = append(cmds, args)
+		switch strings.ToUpper(args[0]) {
+		case "FUNCTION":
+			if readOnly {
+				return resp2.Error{E: errors.New("READONLY You can't write against a read only replica.")}
+			}
+			loaded = true
+			return fl.Name()
+		case "FCALL", "FCALL_RO":
+			if !loaded {
+				return resp2.Error{E: errors.New("ERR Function not found")}
+			}
+			return args[3] + args[4]
+		}
+		return resp2.Error{E: errors.Errorf("unknown command %q", args)}
+	})
+
+	var out string
+	fcall := fl.FCall(&out, "echokey", []string{"foo"}, "bar")
+	assert.Equal(t, []string{"foo"}, fcall.Keys())
+	require.Nil(t, conn.Do(fcall))
+	assert.Equal(t, "foobar", out)
+	assert.Equal(t, [][]string{
+		{"FCALL", "echokey", "1", "foo", "bar"},
+		{"FUNCTION", "LOAD", testFunctionLibraryCode},
+		{"FCALL", "echokey", "1", "foo", "bar"},
+	}, cmds)
+
+	// once loaded the library isn't loaded again, and FCallRO can be
+	// pipelined
+	cmds = nil
+	var out2 string
+	require.Nil(t, conn.Do(Pipeline(
+		fl.FCallRO(&out, "echokey_ro", []string{"foo"}, "baz"),
+		fl.FCallRO(&out2, "echokey_ro", []string{"bar"}, "baz"),
+	)))
+	assert.Equal(t, "foobaz", out)
+	assert.Equal(t, "barbaz", out2)
+	assert.Equal(t, [][]string{
+		{"FCALL_RO", "echokey_ro", "1", "foo", "baz"},
+		{"FCALL_RO", "echokey_ro", "1", "bar", "baz"},
+	}, cmds)
+
+	// if the library can't be loaded the original error is returned
+	cmds, loaded, readOnly = nil, false, true
+	err := conn.Do(fl.FCallRO(&out, "echokey_ro", []string{"foo"}, "baz"))
+	assert.Equal(t, "ERR Function not found", err.Error())
+	assert.Equal(t, [][]string{
+		{"FCALL_RO", "echokey_ro", "1", "foo", "baz"},
+		{"FUNCTION", "LOAD", testFunctionLibraryCode},
+	}, cmds)
+
+	// without FunctionLibraryAutoLoad the library isn't loaded
+	cmds, readOnly = nil, false
+	err = conn.Do(NewFunctionLibrary(testFunctionLibraryCode).FCall(&out, "echokey", []string{"foo"}, "bar"))
+	assert.Equal(t, "ERR Function not found", err.Error())
+	assert.Equal(t, [][]string{{"FCALL", "echokey", "1", "foo", "bar"}}, cmds)
+}
+
+func TestFCallCmdKeys(t *T) {
+	assert.Equal(t, []string{"a", "b"}, Cmd(nil, "FCALL", "fn", "2", "a", "b", "arg").Keys())
+	assert.Equal(t, []string{"a"}, Cmd(nil, "fcall_ro", "fn", "1", "a").Keys())
+	assert.Equal(t, []string(nil), Cmd(nil, "FCALL", "fn", "0", "arg").Keys())
+	assert.Equal(t, []string{"a"}, Cmd(nil, "FCALL", "fn", "3", "a").Keys())
+	assert.Equal(t, []string(nil), Cmd(nil, "FUNCTION", "LOAD", "code").Keys())
+}
@@ -0,0 +1,379 @@
+// Package lock implements distributed locks on top of redis, using SET NX PX
+// to acquire a lock and scripts which check the lock's token to safely extend
+// and release it.
+//
+// A Locker created with New uses a single redis instance (which may be a Pool,
+// Sentinel, Cluster, or any other radix.Client). A Locker created with
+// NewRedlock uses several independent instances, and only considers a lock
+// acquired once a majority of them have granted it, as described by the
+// Redlock algorithm: https://redis.io/topics/distlock
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+var (
+	// ErrNotAcquired is returned by TryAcquire when the lock is held by
+	// someone else.
+	ErrNotAcquired = errors.New("lock not acquired")
+
+	// ErrNotHeld is returned when extending or releasing a lock which is no
+	// longer held, e.g. because it expired and was acquired by someone else.
+	ErrNotHeld = errors.New("lock not held")
+)
+
+var (
+	extendScript = radix.NewEvalScript(1, `
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		end
+		return 0
+	`)
+
+	releaseScript = radix.NewEvalScript(1, `
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("DEL", KEYS[1])
+		end
+		return 0
+	`)
+)
+
+type opts struct {
+	ttl           time.Duration
+	retryInterval time.Duration
+	autoRenew     bool
+}
+
+// Opt is an optional parameter which can be passed into New or NewRedlock in
+// order to affect the Locker's behavior.
+type Opt func(*opts)
+
+// TTL sets how long a lock is held for after being acquired or extended,
+// unless it's released first.
+func TTL(d time.Duration) Opt {
+	return func(o *opts) {
+		o.ttl = d
+	}
+}
+
+// RetryInterval sets how long Acquire waits in between attempts to acquire a
+// lock which is held by someone else. A random jitter of up to half the
+// interval is subtracted from each wait.
+func RetryInterval(d time.Duration) Opt {
+	return func(o *opts) {
+		o.retryInterval = d
+	}
+}
+
+// AutoRenew causes acquired locks to be extended in the background, every
+// third of the TTL, until they are released. If a lock can't be extended
+// before it expires its Lost channel is closed.
+func AutoRenew() Opt {
+	return func(o *opts) {
+		o.autoRenew = true
+	}
+}
+
+// Locker is used to acquire a lock on a single key. All methods on Locker are
+// thread-safe, and a single Locker may be used to acquire the lock any number
+// of times.
+type Locker struct {
+	clients []radix.Client
+	key     string
+	opts    opts
+}
+
+// New returns a Locker for the given key, which will be stored on the redis
+// instance behind the given Client. The default options New uses are:
+//
+//	TTL(10 * time.Second)
+//	RetryInterval(100 * time.Millisecond)
+func New(client radix.Client, key string, o ...Opt) *Locker {
+	return NewRedlock([]radix.Client{client}, key, o...)
+}
+
+// NewRedlock returns a Locker for the given key, which will be stored on each
+// of the independent redis instances behind the given Clients. A lock is only
+// considered acquired once a majority of the instances have granted it, and
+// the time it's valid for is reduced by the time taken to acquire it. The
+// default options are the same as for New.
+func NewRedlock(clients []radix.Client, key string, o ...Opt) *Locker {
+	l := &Locker{clients: clients, key: key}
+	defaultOpts := []Opt{
+		TTL(10 * time.Second),
+		RetryInterval(100 * time.Millisecond),
+	}
+	for _, opt := range append(defaultOpts, o...) {
+		opt(&(l.opts))
+	}
+	return l
+}
+
+func (l *Locker) ttlMS() string {
+	return strconv.FormatInt(int64(l.opts.ttl/time.Millisecond), 10)
+}
+
+func (l *Locker) quorum() int {
+	return len(l.clients)/2 + 1
+}
+
+// doAll performs the Action returned by mkAction on every Client concurrently,
+// returning the number of them for which the Action succeeded and its returned
+// ok function returned true, the number of them which returned an error, and
+// the first error encountered.
+func (l *Locker) doAll(ctx context.Context, mkAction func() (a radix.Action, ok func() bool)) (int, int, error) {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		n, numErr int
+		first     error
+	)
+	for _, client := range l.clients {
+		wg.Add(1)
+		go func(client radix.Client) {
+			defer wg.Done()
+			a, ok := mkAction()
+			err := radix.DoContext(ctx, client, a)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if numErr++; first == nil {
+					first = err
+				}
+			} else if ok() {
+				n++
+			}
+		}(client)
+	}
+	wg.Wait()
+	return n, numErr, first
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// the redlock algorithm allows for some clock drift between the instances
+func (l *Locker) drift() time.Duration {
+	return l.opts.ttl/100 + 2*time.Millisecond
+}
+
+// TryAcquire makes a single attempt at acquiring the lock, returning
+// ErrNotAcquired if it's held by someone else.
+func (l *Locker) TryAcquire(ctx context.Context) (*Lock, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	n, numErr, err := l.doAll(ctx, func() (radix.Action, func() bool) {
+		// SET NX returns nil if the key is already set
+		mn := new(radix.MaybeNil)
+		a := radix.Cmd(mn, "SET", l.key, token, "NX", "PX", l.ttlMS())
+		return a, func() bool { return !mn.Nil }
+	})
+
+	validity := l.opts.ttl - time.Since(start) - l.drift()
+	if n < l.quorum() || validity <= 0 {
+		// release whatever was acquired, so others don't need to wait for it
+		// to expire. An instance which returned an error may still have
+		// performed the SET, e.g. if only its reply was lost, so it's released
+		// as well, which is safe since the release checks the token. This uses
+		// a fresh context in case ctx is what caused the failure.
+		if n > 0 || numErr > 0 {
+			releaseCtx, cancel := context.WithTimeout(context.Background(), l.opts.ttl)
+			defer cancel()
+			l.release(releaseCtx, token)
+		}
+		// only return the error if it's what prevented a quorum from being
+		// reached, otherwise the lock is held by someone else
+		if numErr > len(l.clients)-l.quorum() {
+			return nil, err
+		}
+		return nil, ErrNotAcquired
+	}
+
+	lk := &Lock{
+		l:      l,
+		token:  token,
+		expiry: start.Add(validity),
+		lostCh: make(chan struct{}),
+	}
+	if l.opts.autoRenew {
+		lk.stopCh = make(chan struct{})
+		lk.wg.Add(1)
+		go lk.renew()
+	}
+	return lk, nil
+}
+
+// Acquire attempts to acquire the lock until it succeeds or the context is
+// done, in which case the context's error is returned.
+func (l *Locker) Acquire(ctx context.Context) (*Lock, error) {
+	for {
+		lk, err := l.TryAcquire(ctx)
+		if err == nil {
+			return lk, nil
+		} else if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		} else if err != ErrNotAcquired {
+			return nil, err
+		}
+
+		wait := l.opts.retryInterval
+		if half := int64(wait / 2); half > 0 {
+			jitter, err := rand.Int(rand.Reader, big.NewInt(half))
+			if err == nil {
+				wait -= time.Duration(jitter.Int64())
+			}
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *Locker) release(ctx context.Context, token string) (int, int, error) {
+	return l.doAll(ctx, func() (radix.Action, func() bool) {
+		var deleted int
+		return releaseScript.Cmd(&deleted, l.key, token), func() bool { return deleted > 0 }
+	})
+}
+
+// Lock is a lock which has been acquired by a Locker. All methods on Lock are
+// thread-safe.
+type Lock struct {
+	l     *Locker
+	token string
+
+	mu       sync.Mutex
+	expiry   time.Time
+	released bool
+
+	lostCh   chan struct{}
+	lostOnce sync.Once
+
+	// only set when auto-renewing
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Token returns the random token which the lock's key is set to while the lock
+// is held.
+func (lk *Lock) Token() string {
+	return lk.token
+}
+
+// Expiry returns the time at which the lock will expire, unless it's extended.
+func (lk *Lock) Expiry() time.Time {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	return lk.expiry
+}
+
+// Lost returns a channel which is closed when the lock is found to no longer
+// be held, either by Extend or by the background renewal enabled by AutoRenew.
+// It is not closed by Release.
+func (lk *Lock) Lost() <-chan struct{} {
+	return lk.lostCh
+}
+
+func (lk *Lock) lost() {
+	lk.lostOnce.Do(func() { close(lk.lostCh) })
+}
+
+// Extend resets the lock's TTL, returning ErrNotHeld if the lock is no longer
+// held.
+func (lk *Lock) Extend(ctx context.Context) error {
+	l := lk.l
+	start := time.Now()
+	n, numErr, err := l.doAll(ctx, func() (radix.Action, func() bool) {
+		var extended int
+		return extendScript.Cmd(&extended, l.key, lk.token, l.ttlMS()), func() bool { return extended > 0 }
+	})
+
+	validity := l.opts.ttl - time.Since(start) - l.drift()
+	if n >= l.quorum() && validity > 0 {
+		lk.mu.Lock()
+		lk.expiry = start.Add(validity)
+		lk.mu.Unlock()
+		return nil
+	} else if numErr > len(l.clients)-l.quorum() {
+		return err
+	}
+	lk.lost()
+	return ErrNotHeld
+}
+
+func (lk *Lock) renew() {
+	defer lk.wg.Done()
+	interval := lk.l.opts.ttl / 3
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-lk.stopCh:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := lk.Extend(ctx)
+		cancel()
+		if err == ErrNotHeld {
+			return
+		} else if err != nil && time.Now().After(lk.Expiry()) {
+			// errors are retried on the next tick, unless the lock has
+			// already expired in the meantime
+			lk.lost()
+			return
+		}
+	}
+}
+
+// Release releases the lock, stopping any background renewal. It returns
+// ErrNotHeld if the lock was no longer held, or if Release has already been
+// called.
+func (lk *Lock) Release(ctx context.Context) error {
+	lk.mu.Lock()
+	released := lk.released
+	lk.released = true
+	lk.mu.Unlock()
+	if released {
+		return ErrNotHeld
+	}
+
+	if lk.stopCh != nil {
+		close(lk.stopCh)
+		lk.wg.Wait()
+	}
+
+	n, numErr, err := lk.l.release(ctx, lk.token)
+	if n >= lk.l.quorum() {
+		return nil
+	} else if numErr > len(lk.l.clients)-lk.l.quorum() {
+		return err
+	}
+	return ErrNotHeld
+}
@@ -0,0 +1,196 @@
+package lock
+
+import (
+	"context"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// lockStub fakes a redis instance which supports SET NX PX and the lock
+// package's scripts, which it identifies by their contents.
+type lockStub struct {
+	l      sync.Mutex
+	m      map[string]string
+	expiry map[string]time.Time
+	down   bool
+
+	// if set SET is performed, but an error is returned in place of its reply
+	loseSetReplies bool
+}
+
+func newLockStub() *lockStub {
+	return &lockStub{m: map[string]string{}, expiry: map[string]time.Time{}}
+}
+
+func (s *lockStub) get(key string) (string, bool) {
+	if time.Now().After(s.expiry[key]) {
+		delete(s.m, key)
+	}
+	v, ok := s.m[key]
+	return v, ok
+}
+
+func (s *lockStub) setDown(down bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.down = down
+}
+
+func (s *lockStub) client() radix.Client {
+	return radix.Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+		s.l.Lock()
+		defer s.l.Unlock()
+		if s.down {
+			return resp2.Error{E: errors.New("ERR down")}
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			// SET key value NX PX ms
+			if _, ok := s.get(args[1]); ok {
+				return nil
+			}
+			ms, _ := time.ParseDuration(args[5] + "ms")
+			s.m[args[1]] = args[2]
+			s.expiry[args[1]] = time.Now().Add(ms)
+			if s.loseSetReplies {
+				return resp2.Error{E: errors.New("ERR reply lost")}
+			}
+			return "OK"
+		case "EVALSHA":
+			return resp2.Error{E: errors.New("NOSCRIPT No matching script")}
+		case "EVAL":
+			// EVAL script 1 key token [ms]
+			if v, ok := s.get(args[3]); !ok || v != args[4] {
+				return 0
+			} else if strings.Contains(args[1], "PEXPIRE") {
+				ms, _ := time.ParseDuration(args[5] + "ms")
+				s.expiry[args[3]] = time.Now().Add(ms)
+				return 1
+			}
+			delete(s.m, args[3])
+			return 1
+		}
+		return resp2.Error{E: errors.Errorf("unknown command %q", args)}
+	})
+}
+
+func TestLock(t *T) {
+	s := newLockStub()
+	ctx := context.Background()
+	l := New(s.client(), "foo", TTL(time.Second), RetryInterval(10*time.Millisecond))
+
+	lk, err := l.TryAcquire(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, lk.Token(), s.m["foo"])
+	assert.True(t, lk.Expiry().After(time.Now()))
+
+	_, err = l.TryAcquire(ctx)
+	assert.Equal(t, ErrNotAcquired, err)
+
+	// Acquire gives up once the context is done
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = l.Acquire(timeoutCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Acquire succeeds once the lock is released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, lk.Release(ctx))
+	}()
+	lk2, err := l.Acquire(ctx)
+	require.Nil(t, err)
+	assert.NotEqual(t, lk.Token(), lk2.Token())
+
+	// a released lock can't be released again, and can't be extended
+	assert.Equal(t, ErrNotHeld, lk.Release(ctx))
+	assert.Equal(t, ErrNotHeld, lk.Extend(ctx))
+	select {
+	case <-lk.Lost():
+	default:
+		t.Fatal("lock not lost")
+	}
+
+	require.Nil(t, lk2.Extend(ctx))
+	require.Nil(t, lk2.Release(ctx))
+	_, ok := s.m["foo"]
+	assert.False(t, ok)
+}
+
+func TestLockAutoRenew(t *T) {
+	s := newLockStub()
+	ctx := context.Background()
+	l := New(s.client(), "foo", TTL(60*time.Millisecond), AutoRenew())
+
+	lk, err := l.TryAcquire(ctx)
+	require.Nil(t, err)
+
+	// the lock outlives its TTL
+	time.Sleep(150 * time.Millisecond)
+	_, err = l.TryAcquire(ctx)
+	assert.Equal(t, ErrNotAcquired, err)
+
+	// if the key is taken by someone else the lock is lost
+	s.l.Lock()
+	s.m["foo"] = "someone else"
+	s.l.Unlock()
+	select {
+	case <-lk.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock never lost")
+	}
+	assert.Equal(t, ErrNotHeld, lk.Release(ctx))
+}
+
+func TestRedlock(t *T) {
+	stubs := []*lockStub{newLockStub(), newLockStub(), newLockStub()}
+	clients := make([]radix.Client, len(stubs))
+	for i := range stubs {
+		clients[i] = stubs[i].client()
+	}
+	ctx := context.Background()
+	l := NewRedlock(clients, "foo", TTL(time.Second))
+
+	// a minority of instances being down doesn't prevent acquiring the lock
+	stubs[2].setDown(true)
+	lk, err := l.TryAcquire(ctx)
+	require.Nil(t, err)
+	require.Nil(t, lk.Extend(ctx))
+	require.Nil(t, lk.Release(ctx))
+
+	// if the lock is held on one instance and another is down then a quorum
+	// can't be reached, and what was acquired is released
+	stubs[1].m["foo"] = "someone else"
+	stubs[1].expiry["foo"] = time.Now().Add(time.Second)
+	_, err = l.TryAcquire(ctx)
+	assert.Equal(t, ErrNotAcquired, err)
+	_, ok := stubs[0].m["foo"]
+	assert.False(t, ok)
+
+	// if a majority of instances are down the error is returned
+	stubs[1].setDown(true)
+	_, err = l.TryAcquire(ctx)
+	assert.Contains(t, err.Error(), "ERR down")
+
+	// instances whose SET succeeded, but whose replies were lost, are released
+	stubs[1].setDown(false)
+	delete(stubs[1].m, "foo")
+	stubs[0].loseSetReplies, stubs[1].loseSetReplies = true, true
+	_, err = l.TryAcquire(ctx)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrNotAcquired, err)
+	for _, s := range stubs[:2] {
+		_, ok := s.m["foo"]
+		assert.False(t, ok)
+	}
+}
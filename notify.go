@@ -0,0 +1,39 @@
+package radix
+
+import "sync"
+
+// notifier holds a set of channels which are written to, without blocking,
+// whenever notify is called. It is used to let long-lived components, e.g.
+// ShardedPubSub, follow changes in the Client they're built on.
+type notifier struct {
+	l   sync.Mutex
+	chs map[chan struct{}]bool
+}
+
+// add causes the given channel to be written to on every call to notify, until
+// remove is called with it. The channel should be buffered.
+func (n *notifier) add(ch chan struct{}) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	if n.chs == nil {
+		n.chs = map[chan struct{}]bool{}
+	}
+	n.chs[ch] = true
+}
+
+func (n *notifier) remove(ch chan struct{}) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	delete(n.chs, ch)
+}
+
+func (n *notifier) notify() {
+	n.l.Lock()
+	defer n.l.Unlock()
+	for ch := range n.chs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -2,9 +2,11 @@ package radix
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mediocregopher/radix/v3/resp"
@@ -28,6 +30,13 @@ var blockingCmds = map[string]bool{
 }
 
 type pipeliner struct {
+	// Atomic fields must be at the beginning of the struct since they must be
+	// correctly aligned or else access may cause panics on 32-bit architectures
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	flushes     uint64 // atomic, number of pipelines flushed
+	flushedCmds uint64 // atomic, total number of commands in those pipelines
+	maxFlushed  uint64 // atomic, largest number of commands in a pipeline
+
 	c Client
 
 	limit  int
@@ -96,19 +105,41 @@ func (p *pipeliner) CanDo(a Action) bool {
 //
 // If a is not a CmdAction, Do panics.
 func (p *pipeliner) Do(a Action) error {
-	req := getPipelinerCmd(a.(CmdAction)) // get this outside the lock to avoid
+	return p.DoContext(context.Background(), a)
+}
+
+// DoContext is like Do, but the Action will be dropped from the pipeline if the
+// context is done before the pipeline is flushed.
+//
+// If a is not a CmdAction, DoContext panics.
+func (p *pipeliner) DoContext(ctx context.Context, a Action) error {
+	_, err := p.doContext(ctx, a)
+	return err
+}
+
+// doContext is like DoContext, but also returns the number of bytes which were
+// read for the Action's reply, if known.
+func (p *pipeliner) doContext(ctx context.Context, a Action) (int, error) {
+	req := getPipelinerCmd(ctx, a.(CmdAction)) // get this outside the lock to avoid
 
 	p.l.RLock()
 	if p.closed {
 		p.l.RUnlock()
-		return errClientClosed
+		return 0, errClientClosed
+	}
+	select {
+	case p.reqCh <- req:
+	case <-ctx.Done():
+		p.l.RUnlock()
+		poolPipelinerCmd(req)
+		return 0, ctx.Err()
 	}
-	p.reqCh <- req
 	p.l.RUnlock()
 
 	err := <-req.resCh
+	replySize := req.replySize
 	poolPipelinerCmd(req)
-	return err
+	return replySize, err
 }
 
 // Close closes the pipeliner and makes sure that all background goroutines
@@ -179,7 +210,22 @@ func (p *pipeliner) flush(reqs []CmdAction) []CmdAction {
 			p.reqsBufCh <- reqs[:0]
 		}()
 
-		pp := &pipelinerPipeline{pipeline: pipeline(reqs)}
+		// commands whose context is already done don't need to be sent at all
+		live := reqs[:0]
+		for _, req := range reqs {
+			cmd := req.(*pipelinerCmd)
+			if err := cmd.ctx.Err(); err != nil {
+				cmd.sendRes(err)
+				continue
+			}
+			live = append(live, req)
+		}
+		if len(live) == 0 {
+			return
+		}
+		p.countFlush(len(live))
+
+		pp := &pipelinerPipeline{pipeline: pipeline(live)}
 		defer pp.flush()
 
 		if err := p.c.Do(pp); err != nil {
@@ -190,13 +236,26 @@ func (p *pipeliner) flush(reqs []CmdAction) []CmdAction {
 	return <-p.reqsBufCh
 }
 
+func (p *pipeliner) countFlush(n int) {
+	atomic.AddUint64(&p.flushes, 1)
+	atomic.AddUint64(&p.flushedCmds, uint64(n))
+	for {
+		max := atomic.LoadUint64(&p.maxFlushed)
+		if uint64(n) <= max || atomic.CompareAndSwapUint64(&p.maxFlushed, max, uint64(n)) {
+			return
+		}
+	}
+}
+
 type pipelinerCmd struct {
 	CmdAction
 
+	ctx   context.Context
 	resCh chan error
 
 	unmarshalCalled bool
 	unmarshalErr    error
+	replySize       int
 }
 
 var (
@@ -213,19 +272,27 @@ func (p *pipelinerCmd) UnmarshalRESP(br *bufio.Reader) error {
 	return p.unmarshalErr
 }
 
+func (p *pipelinerCmd) unmarshalRESP3(br *bufio.Reader) error {
+	p.unmarshalErr = unmarshalRESP3(br, p.CmdAction)
+	p.unmarshalCalled = true
+	return p.unmarshalErr
+}
+
 var pipelinerCmdPool sync.Pool
 
-func getPipelinerCmd(cmd CmdAction) *pipelinerCmd {
+func getPipelinerCmd(ctx context.Context, cmd CmdAction) *pipelinerCmd {
 	req, _ := pipelinerCmdPool.Get().(*pipelinerCmd)
 	if req != nil {
 		*req = pipelinerCmd{
 			CmdAction: cmd,
+			ctx:       ctx,
 			resCh:     req.resCh,
 		}
 		return req
 	}
 	return &pipelinerCmd{
 		CmdAction: cmd,
+		ctx:       ctx,
 		// using a buffer of 1 is faster than no buffer in most cases
 		resCh: make(chan error, 1),
 	}
@@ -233,6 +300,7 @@ func getPipelinerCmd(cmd CmdAction) *pipelinerCmd {
 
 func poolPipelinerCmd(req *pipelinerCmd) {
 	req.CmdAction = nil
+	req.ctx = nil
 	pipelinerCmdPool.Put(req)
 }
 
@@ -266,7 +334,11 @@ func (p *pipelinerPipeline) Run(c Conn) (err error) {
 	}
 	errConn := ioErrConn{Conn: c}
 	for _, req := range p.pipeline {
-		if _ = errConn.Decode(req); errConn.lastIOErr != nil {
+		before, _ := connBytesRead(c)
+		_ = errConn.Decode(req)
+		after, _ := connBytesRead(c)
+		req.(*pipelinerCmd).replySize = int(after - before)
+		if errConn.lastIOErr != nil {
 			return errConn.lastIOErr
 		}
 	}
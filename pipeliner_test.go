@@ -2,6 +2,7 @@ package radix
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"net"
 	. "testing"
@@ -40,15 +41,15 @@ func TestPipeliner(t *T) {
 	testMarshalPanic := func(t *T, p *pipeliner) {
 		key := randStr()
 
-		setCmd := getPipelinerCmd(Cmd(nil, "SET", key, key))
+		setCmd := getPipelinerCmd(context.Background(), Cmd(nil, "SET", key, key))
 
 		var firstGetResult string
-		firstGetCmd := getPipelinerCmd(Cmd(&firstGetResult, "GET", key))
+		firstGetCmd := getPipelinerCmd(context.Background(), Cmd(&firstGetResult, "GET", key))
 
-		panicingCmd := getPipelinerCmd(&panicingCmdAction{panicOnMarshal: true})
+		panicingCmd := getPipelinerCmd(context.Background(), &panicingCmdAction{panicOnMarshal: true})
 
 		var secondGetResult string
-		secondGetCmd := getPipelinerCmd(Cmd(&secondGetResult, "GET", key))
+		secondGetCmd := getPipelinerCmd(context.Background(), Cmd(&secondGetResult, "GET", key))
 
 		p.flush([]CmdAction{setCmd, firstGetCmd, panicingCmd, secondGetCmd})
 
@@ -61,15 +62,15 @@ func TestPipeliner(t *T) {
 	testUnmarshalPanic := func(t *T, p *pipeliner) {
 		key := randStr()
 
-		setCmd := getPipelinerCmd(Cmd(nil, "SET", key, key))
+		setCmd := getPipelinerCmd(context.Background(), Cmd(nil, "SET", key, key))
 
 		var firstGetResult string
-		firstGetCmd := getPipelinerCmd(Cmd(&firstGetResult, "GET", key))
+		firstGetCmd := getPipelinerCmd(context.Background(), Cmd(&firstGetResult, "GET", key))
 
-		panicingCmd := getPipelinerCmd(&panicingCmdAction{})
+		panicingCmd := getPipelinerCmd(context.Background(), &panicingCmdAction{})
 
 		var secondGetResult string
-		secondGetCmd := getPipelinerCmd(Cmd(&secondGetResult, "GET", key))
+		secondGetCmd := getPipelinerCmd(context.Background(), Cmd(&secondGetResult, "GET", key))
 
 		p.flush([]CmdAction{setCmd, firstGetCmd, panicingCmd, secondGetCmd})
 
@@ -86,15 +87,15 @@ func TestPipeliner(t *T) {
 	testRecoverableError := func(t *T, p *pipeliner) {
 		key := randStr()
 
-		setCmd := getPipelinerCmd(Cmd(nil, "SET", key, key))
+		setCmd := getPipelinerCmd(context.Background(), Cmd(nil, "SET", key, key))
 
 		var firstGetResult string
-		firstGetCmd := getPipelinerCmd(Cmd(&firstGetResult, "GET", key))
+		firstGetCmd := getPipelinerCmd(context.Background(), Cmd(&firstGetResult, "GET", key))
 
-		invalidCmd := getPipelinerCmd(Cmd(nil, "RADIXISAWESOME"))
+		invalidCmd := getPipelinerCmd(context.Background(), Cmd(nil, "RADIXISAWESOME"))
 
 		var secondGetResult string
-		secondGetCmd := getPipelinerCmd(Cmd(&secondGetResult, "GET", key))
+		secondGetCmd := getPipelinerCmd(context.Background(), Cmd(&secondGetResult, "GET", key))
 
 		p.flush([]CmdAction{setCmd, firstGetCmd, invalidCmd, secondGetCmd})
 
@@ -112,23 +113,23 @@ func TestPipeliner(t *T) {
 	testTimeout := func(t *T, p *pipeliner) {
 		key := randStr()
 
-		delCmd := getPipelinerCmd(Cmd(nil, "DEL", key))
-		pushCmd := getPipelinerCmd(Cmd(nil, "LPUSH", key, "3", "2", "1"))
+		delCmd := getPipelinerCmd(context.Background(), Cmd(nil, "DEL", key))
+		pushCmd := getPipelinerCmd(context.Background(), Cmd(nil, "LPUSH", key, "3", "2", "1"))
 		p.flush([]CmdAction{delCmd, pushCmd})
 		require.Nil(t, <-delCmd.resCh)
 		require.Nil(t, <-pushCmd.resCh)
 
 		var firstPopResult string
-		firstPopCmd := getPipelinerCmd(Cmd(&firstPopResult, "LPOP", key))
+		firstPopCmd := getPipelinerCmd(context.Background(), Cmd(&firstPopResult, "LPOP", key))
 
 		var pauseResult string
-		pauseCmd := getPipelinerCmd(Cmd(&pauseResult, "CLIENT", "PAUSE", "1100"))
+		pauseCmd := getPipelinerCmd(context.Background(), Cmd(&pauseResult, "CLIENT", "PAUSE", "1100"))
 
 		var secondPopResult string
-		secondPopCmd := getPipelinerCmd(Cmd(&secondPopResult, "LPOP", key))
+		secondPopCmd := getPipelinerCmd(context.Background(), Cmd(&secondPopResult, "LPOP", key))
 
 		var thirdPopResult string
-		thirdPopCmd := getPipelinerCmd(Cmd(&thirdPopResult, "LPOP", key))
+		thirdPopCmd := getPipelinerCmd(context.Background(), Cmd(&thirdPopResult, "LPOP", key))
 
 		p.flush([]CmdAction{firstPopCmd, pauseCmd, secondPopCmd, thirdPopCmd})
 
@@ -1,6 +1,7 @@
 package radix
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -62,6 +63,10 @@ func (ioc *ioErrConn) Do(a Action) error {
 	return a.Run(ioc)
 }
 
+func (ioc *ioErrConn) DoContext(ctx context.Context, a Action) error {
+	return doConnContext(ctx, ioc, a)
+}
+
 func (ioc *ioErrConn) Close() error {
 	ioc.lastIOErr = io.EOF
 	return ioc.Conn.Close()
@@ -123,7 +128,8 @@ func PoolRefillInterval(d time.Duration) PoolOpt {
 
 // PoolOnEmptyWait effects the Pool's behavior when there are no available
 // connections in the Pool. The effect is to cause actions to block as long as
-// it takes until a connection becomes available.
+// it takes until a connection becomes available, or until the context passed
+// to DoContext is done.
 func PoolOnEmptyWait() PoolOpt {
 	return func(po *poolOpts) {
 		po.onEmptyWait = -1
@@ -243,7 +249,9 @@ type Pool struct {
 	// Atomic fields must be at the beginning of the struct since they must be
 	// correctly aligned or else access may cause panics on 32-bit architectures
 	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
-	totalConns int64 // atomic, must only be access using functions from sync/atomic
+	totalConns int64  // atomic, must only be access using functions from sync/atomic
+	actionID   uint64 // atomic, the ID of the last Action given to ActionStarted
+	stats      poolStats
 
 	opts          poolOpts
 	network, addr string
@@ -406,6 +414,7 @@ func (p *Pool) traceCommon() trace.PoolCommon {
 }
 
 func (p *Pool) traceConnCreated(connectTime time.Duration, reason trace.PoolConnCreatedReason, err error) {
+	p.stats.connCreated(reason, err)
 	if p.opts.pt.ConnCreated != nil {
 		p.opts.pt.ConnCreated(trace.PoolConnCreated{
 			PoolCommon:  p.traceCommon(),
@@ -417,6 +426,7 @@ func (p *Pool) traceConnCreated(connectTime time.Duration, reason trace.PoolConn
 }
 
 func (p *Pool) traceConnClosed(reason trace.PoolConnClosedReason) {
+	p.stats.connClosed(reason)
 	if p.opts.pt.ConnClosed != nil {
 		p.opts.pt.ConnClosed(trace.PoolConnClosed{
 			PoolCommon: p.traceCommon(),
@@ -496,7 +506,7 @@ func (p *Pool) doOverflowDrain() {
 	atomic.AddInt64(&p.totalConns, -1)
 }
 
-func (p *Pool) getExisting() (*ioErrConn, error) {
+func (p *Pool) getExisting(ctx context.Context) (*ioErrConn, error) {
 	// Fast-path if the pool is not empty. Return error if pool has been closed.
 	select {
 	case ioc, ok := <-p.pool:
@@ -511,6 +521,7 @@ func (p *Pool) getExisting() (*ioErrConn, error) {
 		// If we should not wait we return without allocating a timer.
 		return nil, p.opts.errOnEmpty
 	}
+	atomic.AddUint64(&p.stats.emptyWaits, 1)
 
 	// only set when we have a timeout, since a nil channel always blocks which
 	// is what we want
@@ -530,11 +541,13 @@ func (p *Pool) getExisting() (*ioErrConn, error) {
 		return ioc, nil
 	case <-tc:
 		return nil, p.opts.errOnEmpty
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
-func (p *Pool) get() (*ioErrConn, error) {
-	ioc, err := p.getExisting()
+func (p *Pool) get(ctx context.Context) (*ioErrConn, error) {
+	ioc, err := p.getExisting(ctx)
 	if err != nil {
 		return nil, err
 	} else if ioc != nil {
@@ -579,43 +592,249 @@ func (p *Pool) put(ioc *ioErrConn) bool {
 // Due to a limitation in the implementation, custom CmdAction implementations
 // are currently not automatically pipelined.
 func (p *Pool) Do(a Action) error {
+	return p.DoContext(context.Background(), a)
+}
+
+// DoContext implements the method for the ContextClient interface. It behaves
+// like Do, except that waiting on an available connection (see the PoolOnEmpty
+// options) and reading the Action's response will both be abandoned once the
+// context is done.
+//
+// Implicitly pipelined Actions which are still waiting to be flushed when the
+// context is done will not be sent at all, but once they have been written to
+// redis their response will always be waited on.
+func (p *Pool) DoContext(ctx context.Context, a Action) error {
 	startTime := time.Now()
 	if p.pipeliner != nil && p.pipeliner.CanDo(a) {
-		err := p.pipeliner.Do(a)
-		p.traceDoCompleted(time.Since(startTime), err)
+		pa, traced := p.traceActionStarted(ctx, a, true)
+		replySize, err := p.pipeliner.doContext(ctx, a)
+		elapsed := time.Since(startTime)
+		p.stats.doCompleted(elapsed, err)
+		if traced {
+			p.traceActionCompleted(ctx, pa, replySize, elapsed, err)
+		}
+		p.traceDoCompleted(elapsed, err, false)
 
 		return err
 	}
 
-	c, err := p.get()
+	pa, traced := p.traceActionStarted(ctx, a, false)
+	c, err := p.get(ctx)
 	if err != nil {
+		if traced {
+			p.traceActionCompleted(ctx, pa, 0, time.Since(startTime), err)
+		}
 		return err
 	}
 
-	err = c.Do(a)
+	before, _ := connBytesRead(c)
+	err = c.DoContext(ctx, a)
+	after, _ := connBytesRead(c)
 	p.put(c)
-	p.traceDoCompleted(time.Since(startTime), err)
+	elapsed := time.Since(startTime)
+	// the pipeliner flushes its pipelines through the Pool, those have already
+	// been counted as the individual Actions which were in them.
+	_, flush := a.(*pipelinerPipeline)
+	if !flush {
+		p.stats.doCompleted(elapsed, err)
+	}
+	if traced {
+		p.traceActionCompleted(ctx, pa, int(after-before), elapsed, err)
+	}
+	p.traceDoCompleted(elapsed, err, flush)
 
 	return err
 }
 
-func (p *Pool) traceDoCompleted(elapsedTime time.Duration, err error) {
-	if p.opts.pt.DoCompleted != nil {
-		p.opts.pt.DoCompleted(trace.PoolDoCompleted{
+// traceActionStarted returns false if neither ActionStarted nor
+// ActionCompleted need to be called for the Action.
+func (p *Pool) traceActionStarted(ctx context.Context, a Action, pipelined bool) (trace.PoolAction, bool) {
+	if p.opts.pt.ActionStarted == nil && p.opts.pt.ActionCompleted == nil {
+		return trace.PoolAction{}, false
+	} else if _, ok := a.(*pipelinerPipeline); ok {
+		return trace.PoolAction{}, false
+	}
+
+	pa := trace.PoolAction{
+		ID: atomic.AddUint64(&p.actionID, 1),
+		// Keys may be backed by the Action itself, which could be reused once
+		// it has completed.
+		Keys:      append([]string(nil), a.Keys()...),
+		Pipelined: pipelined,
+	}
+	pa.Cmd, pa.NumArgs = actionCmd(a)
+
+	if p.opts.pt.ActionStarted != nil {
+		p.opts.pt.ActionStarted(trace.PoolActionStarted{
+			PoolCommon: p.traceCommon(),
+			PoolAction: pa,
+			Context:    ctx,
+		})
+	}
+	return pa, true
+}
+
+func (p *Pool) traceActionCompleted(
+	ctx context.Context, pa trace.PoolAction, replySize int, elapsedTime time.Duration, err error,
+) {
+	if p.opts.pt.ActionCompleted != nil {
+		p.opts.pt.ActionCompleted(trace.PoolActionCompleted{
 			PoolCommon:  p.traceCommon(),
-			AvailCount:  len(p.pool),
+			PoolAction:  pa,
+			Context:     ctx,
+			ReplySize:   replySize,
 			ElapsedTime: elapsedTime,
 			Err:         err,
 		})
 	}
 }
 
+func (p *Pool) traceDoCompleted(elapsedTime time.Duration, err error, flush bool) {
+	if p.opts.pt.DoCompleted != nil {
+		p.opts.pt.DoCompleted(trace.PoolDoCompleted{
+			PoolCommon:    p.traceCommon(),
+			AvailCount:    len(p.pool),
+			ElapsedTime:   elapsedTime,
+			Err:           err,
+			PipelineFlush: flush,
+		})
+	}
+}
+
 // NumAvailConns returns the number of connections currently available in the
 // pool, as well as in the overflow buffer if that option is enabled.
 func (p *Pool) NumAvailConns() int {
 	return len(p.pool)
 }
 
+// PoolStats is a snapshot of the state of a Pool, along with totals of its
+// activity since it was created. See the Stats method on Pool.
+type PoolStats struct {
+	// TotalConns is the number of connections the Pool currently has open,
+	// including those which are in use.
+	TotalConns int
+
+	// AvailConns is the number of connections currently available in the Pool,
+	// the same as NumAvailConns. OverflowConns is how many of those are being
+	// held in the overflow buffer (see PoolOnFullBuffer), whose capacity is
+	// BufferSize.
+	AvailConns, OverflowConns, BufferSize int
+
+	// ConnsCreated is the number of connections which have been created, by
+	// the reason they were created for. ConnCreateErrs is the number of
+	// attempts to create a connection which failed, and are not included in
+	// ConnsCreated.
+	ConnsCreated   map[trace.PoolConnCreatedReason]uint64
+	ConnCreateErrs uint64
+
+	// ConnsClosed is the number of connections which have been closed, by the
+	// reason they were closed for.
+	ConnsClosed map[trace.PoolConnClosedReason]uint64
+
+	// EmptyWaits is the number of times an Action had to wait for a
+	// connection because the Pool was empty (see the PoolOnEmpty options).
+	EmptyWaits uint64
+
+	// PipelineFlushes is the number of implicit pipelines which have been
+	// written to redis, and PipelineCmds is the total number of commands
+	// across all of them. PipelineMaxCmds is the number of commands in the
+	// largest one. These will all be zero if implicit pipelining is disabled.
+	PipelineFlushes, PipelineCmds, PipelineMaxCmds uint64
+
+	// Dos is the number of calls to Do or DoContext which have completed, and
+	// DoErrs is how many of those returned an error. DoTime is the total time
+	// spent in all of them, and AvgDoTime is DoTime divided by Dos.
+	Dos, DoErrs uint64
+	DoTime      time.Duration
+	AvgDoTime   time.Duration
+}
+
+// poolStats holds the counters behind PoolStats. All fields are atomic, and must
+// only be accessed using functions from sync/atomic.
+type poolStats struct {
+	connsCreatedInit, connsCreatedRefill, connsCreatedEmpty  uint64
+	connCreateErrs                                           uint64
+	connsClosedPoolClosed, connsClosedDrain, connsClosedFull uint64
+	emptyWaits                                               uint64
+	dos, doErrs                                              uint64
+	doTime                                                   int64
+}
+
+func (s *poolStats) connCreated(reason trace.PoolConnCreatedReason, err error) {
+	if err != nil {
+		atomic.AddUint64(&s.connCreateErrs, 1)
+		return
+	}
+	switch reason {
+	case trace.PoolConnCreatedReasonInitialization:
+		atomic.AddUint64(&s.connsCreatedInit, 1)
+	case trace.PoolConnCreatedReasonRefill:
+		atomic.AddUint64(&s.connsCreatedRefill, 1)
+	case trace.PoolConnCreatedReasonPoolEmpty:
+		atomic.AddUint64(&s.connsCreatedEmpty, 1)
+	}
+}
+
+func (s *poolStats) connClosed(reason trace.PoolConnClosedReason) {
+	switch reason {
+	case trace.PoolConnClosedReasonPoolClosed:
+		atomic.AddUint64(&s.connsClosedPoolClosed, 1)
+	case trace.PoolConnClosedReasonBufferDrain:
+		atomic.AddUint64(&s.connsClosedDrain, 1)
+	case trace.PoolConnClosedReasonPoolFull:
+		atomic.AddUint64(&s.connsClosedFull, 1)
+	}
+}
+
+func (s *poolStats) doCompleted(elapsed time.Duration, err error) {
+	atomic.AddUint64(&s.dos, 1)
+	atomic.AddInt64(&s.doTime, int64(elapsed))
+	if err != nil {
+		atomic.AddUint64(&s.doErrs, 1)
+	}
+}
+
+// Stats returns a snapshot of the Pool's current state and of the totals of
+// its activity so far. Each value is read individually, so under load the
+// values may not be exactly consistent with each other.
+func (p *Pool) Stats() PoolStats {
+	s := PoolStats{
+		TotalConns: int(atomic.LoadInt64(&p.totalConns)),
+		AvailConns: len(p.pool),
+		BufferSize: p.opts.overflowSize,
+		ConnsCreated: map[trace.PoolConnCreatedReason]uint64{
+			trace.PoolConnCreatedReasonInitialization: atomic.LoadUint64(&p.stats.connsCreatedInit),
+			trace.PoolConnCreatedReasonRefill:         atomic.LoadUint64(&p.stats.connsCreatedRefill),
+			trace.PoolConnCreatedReasonPoolEmpty:      atomic.LoadUint64(&p.stats.connsCreatedEmpty),
+		},
+		ConnCreateErrs: atomic.LoadUint64(&p.stats.connCreateErrs),
+		ConnsClosed: map[trace.PoolConnClosedReason]uint64{
+			trace.PoolConnClosedReasonPoolClosed:  atomic.LoadUint64(&p.stats.connsClosedPoolClosed),
+			trace.PoolConnClosedReasonBufferDrain: atomic.LoadUint64(&p.stats.connsClosedDrain),
+			trace.PoolConnClosedReasonPoolFull:    atomic.LoadUint64(&p.stats.connsClosedFull),
+		},
+		EmptyWaits: atomic.LoadUint64(&p.stats.emptyWaits),
+		Dos:        atomic.LoadUint64(&p.stats.dos),
+		DoErrs:     atomic.LoadUint64(&p.stats.doErrs),
+		DoTime:     time.Duration(atomic.LoadInt64(&p.stats.doTime)),
+	}
+
+	if s.AvailConns > p.size {
+		s.OverflowConns = s.AvailConns - p.size
+	}
+
+	if p.pipeliner != nil {
+		s.PipelineFlushes = atomic.LoadUint64(&p.pipeliner.flushes)
+		s.PipelineCmds = atomic.LoadUint64(&p.pipeliner.flushedCmds)
+		s.PipelineMaxCmds = atomic.LoadUint64(&p.pipeliner.maxFlushed)
+	}
+
+	if s.Dos > 0 {
+		s.AvgDoTime = s.DoTime / time.Duration(s.Dos)
+	}
+	return s
+}
+
 // Close implements the Close method of the Client
 func (p *Pool) Close() error {
 	p.l.Lock()
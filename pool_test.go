@@ -1,7 +1,9 @@
 package radix
 
 import (
+	"context"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
 	. "testing"
@@ -97,14 +99,14 @@ func TestPool(t *T) {
 func TestPoolGet(t *T) {
 	getBlock := func(p *Pool) (time.Duration, error) {
 		start := time.Now()
-		_, err := p.get()
+		_, err := p.get(context.Background())
 		return time.Since(start), err
 	}
 
 	// this one is a bit weird, cause it would block infinitely if we let it
 	t.Run("onEmptyWait", func(t *T) {
 		pool := testPool(1, PoolOnEmptyWait())
-		conn, err := pool.get()
+		conn, err := pool.get(context.Background())
 		assert.NoError(t, err)
 
 		go func() {
@@ -132,6 +134,174 @@ func TestPoolGet(t *T) {
 	t.Run("onEmptyErrAfter", gen(PoolOnEmptyErrAfter, 1*time.Second, ErrPoolEmpty))
 }
 
+func TestPoolDoContext(t *T) {
+	pool, err := NewPool("tcp", "127.0.0.1:6379", 1,
+		PoolConnFunc(func(string, string) (Conn, error) { return testStub(), nil }),
+		PoolOnEmptyWait(),
+		PoolPipelineWindow(0, 0),
+	)
+	require.Nil(t, err)
+	defer pool.Close()
+
+	{ // Normal usage
+		var out string
+		require.Nil(t, pool.DoContext(context.Background(), Cmd(&out, "ECHO", "foo")))
+		assert.Equal(t, "foo", out)
+	}
+
+	// take the only connection out of the pool, DoContext should give up
+	// waiting for one once the context is done
+	conn, err := pool.get(context.Background())
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = pool.DoContext(ctx, Cmd(nil, "ECHO", "foo"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	pool.put(conn)
+	require.Nil(t, pool.DoContext(context.Background(), Cmd(nil, "ECHO", "foo")))
+}
+
+func TestPoolStats(t *T) {
+	pool, err := NewPool("tcp", "127.0.0.1:6379", 2,
+		PoolConnFunc(func(string, string) (Conn, error) { return testStub(), nil }),
+		PoolOnEmptyCreateAfter(10*time.Millisecond),
+		PoolOnFullBuffer(2, time.Hour),
+		PoolPingInterval(0),
+		PoolRefillInterval(0),
+	)
+	require.Nil(t, err)
+	<-pool.initDone
+
+	stats := pool.Stats()
+	assert.Equal(t, 2, stats.TotalConns)
+	assert.Equal(t, 2, stats.AvailConns)
+	assert.Equal(t, 2, stats.BufferSize)
+	assert.Equal(t, uint64(2), stats.ConnsCreated[trace.PoolConnCreatedReasonInitialization])
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, pool.Do(Cmd(nil, "ECHO", "foo")))
+		}()
+	}
+	wg.Wait()
+
+	stats = pool.Stats()
+	assert.Equal(t, uint64(10), stats.Dos)
+	assert.Equal(t, uint64(0), stats.DoErrs)
+	assert.True(t, stats.AvgDoTime > 0)
+	assert.Equal(t, stats.DoTime/10, stats.AvgDoTime)
+	assert.Equal(t, uint64(10), stats.PipelineCmds)
+	assert.True(t, stats.PipelineFlushes > 0)
+	assert.True(t, stats.PipelineMaxCmds > 0)
+
+	// take all connections out, so the next Do has to wait and then create a
+	// new one, which will go into the overflow buffer when put back
+	conns := []*ioErrConn{}
+	for i := 0; i < 2; i++ {
+		conn, err := pool.get(context.Background())
+		require.Nil(t, err)
+		conns = append(conns, conn)
+	}
+	require.Nil(t, pool.Do(WithConn("", func(Conn) error { return nil })))
+	for _, conn := range conns {
+		pool.put(conn)
+	}
+
+	stats = pool.Stats()
+	assert.Equal(t, uint64(1), stats.EmptyWaits)
+	assert.Equal(t, uint64(1), stats.ConnsCreated[trace.PoolConnCreatedReasonPoolEmpty])
+	assert.Equal(t, 3, stats.TotalConns)
+	assert.Equal(t, 3, stats.AvailConns)
+	assert.Equal(t, 1, stats.OverflowConns)
+
+	require.Nil(t, pool.Close())
+	stats = pool.Stats()
+	assert.Equal(t, 0, stats.TotalConns)
+	assert.Equal(t, uint64(3), stats.ConnsClosed[trace.PoolConnClosedReasonPoolClosed])
+}
+
+func TestPoolActionTrace(t *T) {
+	var l sync.Mutex
+	var started []trace.PoolActionStarted
+	var completed []trace.PoolActionCompleted
+	pt := trace.PoolTrace{
+		ActionStarted: func(s trace.PoolActionStarted) {
+			l.Lock()
+			defer l.Unlock()
+			started = append(started, s)
+		},
+		ActionCompleted: func(c trace.PoolActionCompleted) {
+			l.Lock()
+			defer l.Unlock()
+			completed = append(completed, c)
+		},
+	}
+
+	t.Run("conn", func(t *T) {
+		started, completed = nil, nil
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		fakeRESP3Server(serverConn, "+OK\r\n", "$3\r\nbar\r\n")
+
+		pool, err := NewPool("tcp", "127.0.0.1:6379", 1,
+			PoolConnFunc(func(string, string) (Conn, error) { return NewConn(clientConn), nil }),
+			PoolPingInterval(0),
+			PoolRefillInterval(0),
+			PoolPipelineWindow(0, 0),
+			PoolWithTrace(pt),
+		)
+		require.Nil(t, err)
+		defer pool.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		require.Nil(t, pool.DoContext(ctx, FlatCmd(nil, "SET", "foo", "bar")))
+		var out string
+		require.Nil(t, pool.Do(Cmd(&out, "GET", "foo")))
+		assert.Equal(t, "bar", out)
+
+		l.Lock()
+		defer l.Unlock()
+		require.Len(t, started, 2)
+		require.Len(t, completed, 2)
+
+		assert.Equal(t, trace.PoolAction{ID: 1, Cmd: "SET", Keys: []string{"foo"}, NumArgs: 2}, started[0].PoolAction)
+		assert.Equal(t, ctx, started[0].Context)
+		assert.Equal(t, started[0].PoolAction, completed[0].PoolAction)
+		assert.Equal(t, 5, completed[0].ReplySize)
+		assert.Nil(t, completed[0].Err)
+
+		assert.Equal(t, trace.PoolAction{ID: 2, Cmd: "GET", Keys: []string{"foo"}, NumArgs: 1}, started[1].PoolAction)
+		assert.Equal(t, started[1].PoolAction, completed[1].PoolAction)
+		assert.Equal(t, 9, completed[1].ReplySize)
+		assert.True(t, completed[1].ElapsedTime > 0)
+	})
+
+	t.Run("pipelined", func(t *T) {
+		started, completed = nil, nil
+		pool, err := NewPool("tcp", "127.0.0.1:6379", 1,
+			PoolConnFunc(func(string, string) (Conn, error) { return testStub(), nil }),
+			PoolWithTrace(pt),
+		)
+		require.Nil(t, err)
+		defer pool.Close()
+
+		require.Nil(t, pool.Do(Cmd(nil, "ECHO", "foo")))
+		require.Nil(t, pool.Do(Pipeline(Cmd(nil, "ECHO", "foo"))))
+
+		l.Lock()
+		defer l.Unlock()
+		require.Len(t, completed, 2)
+		assert.Equal(t, trace.PoolAction{ID: 1, Cmd: "ECHO", NumArgs: 1, Pipelined: true}, completed[0].PoolAction)
+		assert.Equal(t, trace.PoolAction{ID: 2}, completed[1].PoolAction)
+	})
+}
+
 func TestPoolOnFull(t *T) {
 	t.Run("onFullClose", func(t *T) {
 		var reason trace.PoolConnClosedReason
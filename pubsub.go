@@ -16,9 +16,13 @@ import (
 
 // PubSubMessage describes a message being published to a subscribed channel
 type PubSubMessage struct {
-	Type    string // "message" or "pmessage"
+	Type    string // "message", "pmessage" or "smessage"
 	Pattern string // will be set if Type is "pmessage"
 	Channel string
+
+	// Message is the published message. Messages which are not bulk strings,
+	// such as the key arrays redis publishes on its client side caching
+	// invalidation channel, are given as their raw RESP encoding.
 	Message []byte
 }
 
@@ -31,7 +35,7 @@ func (m PubSubMessage) MarshalRESP(w io.Writer) error {
 		}
 	}
 
-	if m.Type == "message" {
+	if m.Type == "message" || m.Type == "smessage" {
 		marshal(resp2.ArrayHeader{N: 3})
 		marshal(resp2.BulkString{S: m.Type})
 	} else if m.Type == "pmessage" {
@@ -84,8 +88,8 @@ func (m *PubSubMessage) UnmarshalRESP(br *bufio.Reader) error {
 	}
 
 	switch string(msgType.B) {
-	case "message":
-		m.Type = "message"
+	case "message", "smessage":
+		m.Type = string(msgType.B)
 		if ah.N != 3 {
 			return errors.New("message has wrong number of elements")
 		}
@@ -116,6 +120,17 @@ func (m *PubSubMessage) UnmarshalRESP(br *bufio.Reader) error {
 	}
 	m.Channel = channel.S
 
+	if prefix, err := br.Peek(1); err != nil {
+		return err
+	} else if !bytes.Equal(prefix, resp2.BulkStringPrefix) {
+		var rm resp2.RawMessage
+		if err := rm.UnmarshalRESP(br); err != nil {
+			return err
+		}
+		m.Message = rm
+		return nil
+	}
+
 	var msg resp2.BulkStringBytes
 	if err := msg.UnmarshalRESP(br); err != nil {
 		return err
@@ -61,12 +61,18 @@ type pubSubCmd struct {
 }
 
 type persistentPubSub struct {
-	dial func() (Conn, error)
-	opts persistentPubSubOpts
+	addrFn func() (network, addr string)
+	opts   persistentPubSubOpts
+
+	// if set, values on switchCh indicate addrFn may now return a different
+	// address, and onClose is called when the persistentPubSub is closed.
+	switchCh <-chan struct{}
+	onClose  func()
 
 	subs, psubs chanSet
 
 	curr      PubSubConn
+	currAddr  string
 	currErrCh chan error
 
 	cmdCh chan pubSubCmd
@@ -98,6 +104,61 @@ func PersistentPubSubWithOpts(
 	network, addr string, options ...PersistentPubSubOpt,
 ) (
 	PubSubConn, error,
+) {
+	addrFn := func() (string, string) { return network, addr }
+	return newPersistentPubSub(addrFn, nil, nil, options)
+}
+
+// PersistentPubSubFollow is like PersistentPubSubWithOpts, but rather than
+// always connecting to the same address it calls addrFn to get the address to
+// connect to every time it (re)connects.
+//
+// Whenever a value is received on switchCh addrFn is called again, and if the
+// address it returns has changed the PubSubConn will connect to the new
+// address, close its connection to the old one, and re-subscribe to all of the
+// channels and patterns which are currently subscribed to.
+//
+// See PersistentPubSubSentinel for a PubSubConn which follows the primary of a
+// Sentinel.
+func PersistentPubSubFollow(
+	addrFn func() (network, addr string), switchCh <-chan struct{},
+	options ...PersistentPubSubOpt,
+) (
+	PubSubConn, error,
+) {
+	return newPersistentPubSub(addrFn, switchCh, nil, options)
+}
+
+// PersistentPubSubSentinel is like PersistentPubSubWithOpts, but it connects
+// to whichever instance is the primary of the given Sentinel. When the
+// Sentinel's primary changes, e.g. after a switch-master event, the
+// PubSubConn will connect to the new primary and re-subscribe to all of the
+// channels and patterns which are currently subscribed to.
+//
+// Closing the Sentinel does not close the returned PubSubConn, but once the
+// Sentinel is closed the PubSubConn will no longer follow the primary.
+func PersistentPubSubSentinel(sc *Sentinel, options ...PersistentPubSubOpt) (PubSubConn, error) {
+	addrFn := func() (string, string) {
+		addr, _ := sc.Addrs()
+		return "tcp", addr
+	}
+	switchCh := make(chan struct{}, 1)
+	sc.switchNotifier.add(switchCh)
+	onClose := func() { sc.switchNotifier.remove(switchCh) }
+
+	p, err := newPersistentPubSub(addrFn, switchCh, onClose, options)
+	if err != nil {
+		onClose()
+		return nil, err
+	}
+	return p, nil
+}
+
+func newPersistentPubSub(
+	addrFn func() (string, string), switchCh <-chan struct{}, onClose func(),
+	options []PersistentPubSubOpt,
+) (
+	PubSubConn, error,
 ) {
 	opts := persistentPubSubOpts{
 		connFn: DefaultConnFunc,
@@ -107,12 +168,14 @@ func PersistentPubSubWithOpts(
 	}
 
 	p := &persistentPubSub{
-		dial:    func() (Conn, error) { return opts.connFn(network, addr) },
-		opts:    opts,
-		subs:    chanSet{},
-		psubs:   chanSet{},
-		cmdCh:   make(chan pubSubCmd),
-		closeCh: make(chan struct{}),
+		addrFn:   addrFn,
+		opts:     opts,
+		switchCh: switchCh,
+		onClose:  onClose,
+		subs:     chanSet{},
+		psubs:    chanSet{},
+		cmdCh:    make(chan pubSubCmd),
+		closeCh:  make(chan struct{}),
 	}
 	if err := p.refresh(); err != nil {
 		return nil, err
@@ -142,11 +205,13 @@ func (p *persistentPubSub) refresh() error {
 		p.curr.Close()
 		<-p.currErrCh
 		p.curr = nil
+		p.currAddr = ""
 		p.currErrCh = nil
 	}
 
 	attempt := func() (PubSubConn, chan error, error) {
-		c, err := p.dial()
+		network, addr := p.addrFn()
+		c, err := p.opts.connFn(network, addr)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -166,6 +231,7 @@ func (p *persistentPubSub) refresh() error {
 				return nil, nil, err
 			}
 		}
+		p.currAddr = addr
 		return pc, errCh, nil
 	}
 
@@ -253,6 +319,13 @@ func (p *persistentPubSub) spin() {
 			if err := p.refresh(); err != nil {
 				p.err(err)
 			}
+		case <-p.switchCh:
+			if _, addr := p.addrFn(); p.curr != nil && addr == p.currAddr {
+				continue
+			}
+			if err := p.refresh(); err != nil {
+				p.err(err)
+			}
 		case cmd := <-p.cmdCh:
 			cmd.resCh <- p.execCmd(cmd)
 			if cmd.close {
@@ -306,6 +379,9 @@ func (p *persistentPubSub) Ping() error {
 
 func (p *persistentPubSub) Close() error {
 	p.closeOnce.Do(func() {
+		if p.onClose != nil {
+			p.onClose()
+		}
 		p.closeErr = p.cmd(pubSubCmd{close: true})
 		close(p.closeCh)
 		if p.opts.errCh != nil {
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	errors "golang.org/x/xerrors"
 )
 
@@ -130,3 +131,67 @@ func TestPersistentPubSubUseAfterCloseDeadlock(t *T) {
 	}
 
 }
+
+func TestPersistentPubSubSentinel(t *T) {
+	const primAddr, secAddr = "127.0.0.1:9736", "127.0.0.2:9736"
+	stub := newSentinelStub(primAddr, []string{secAddr}, []string{"127.0.0.1:29736"})
+	poolFn := func(network, addr string) (Client, error) {
+		return Stub(network, addr, func([]string) interface{} { return nil }), nil
+	}
+
+	scc, err := NewSentinel(
+		"stub", stub.sentAddrs,
+		SentinelConnFunc(stub.newConn), SentinelPoolFunc(poolFn),
+	)
+	require.Nil(t, err)
+	defer scc.Close()
+
+	stubs := newPubSubStubs()
+	p, err := PersistentPubSubSentinel(scc, PersistentPubSubConnFunc(stubs.connFunc))
+	require.Nil(t, err)
+	defer p.Close()
+
+	msgCh := make(chan PubSubMessage, 1)
+	require.Nil(t, p.Subscribe(msgCh, "foo"))
+	require.Nil(t, p.PSubscribe(msgCh, "ba*"))
+	assert.True(t, stubs.subscribed(primAddr, "foo"))
+
+	assertMsg := func(addr string, m PubSubMessage) {
+		_, inCh := stubs.latest(addr)
+		inCh <- m
+		select {
+		case got := <-msgCh:
+			assert.Equal(t, m.Channel, got.Channel)
+			assert.Equal(t, m.Message, got.Message)
+		case <-time.After(time.Second):
+			t.Fatalf("message on %q not received", m.Channel)
+		}
+	}
+	assertMsg(primAddr, PubSubMessage{Channel: "foo", Message: []byte("a")})
+
+	oldConn, _ := stubs.latest(primAddr)
+	stub.switchPrimary(secAddr, primAddr)
+	assert.Equal(t, "switch-master completed", <-scc.testEventCh)
+	waitFor(t, "resubscribe on new primary", func() bool {
+		newConn, _ := stubs.latest(secAddr)
+		if newConn == nil {
+			return false
+		}
+		newConn.l.Lock()
+		defer newConn.l.Unlock()
+		return newConn.subbed["foo"] && newConn.psubbed["ba*"]
+	})
+
+	// the resubscribe happens within the spin goroutine, so once Ping returns
+	// it has completed
+	require.Nil(t, p.Ping())
+
+	select {
+	case <-oldConn.closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("connection to old primary not closed")
+	}
+
+	assertMsg(secAddr, PubSubMessage{Channel: "foo", Message: []byte("b")})
+	assertMsg(secAddr, PubSubMessage{Pattern: "ba*", Channel: "bar", Message: []byte("c")})
+}
@@ -0,0 +1,598 @@
+package radix
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+type shardedPubSubOpts struct {
+	connFn ConnFunc
+	errCh  chan<- error
+}
+
+// ShardedPubSubOpt is an optional parameter which can be passed into
+// ShardedPubSub in order to affect its behavior.
+type ShardedPubSubOpt func(*shardedPubSubOpts)
+
+// ShardedPubSubConnFunc causes ShardedPubSub to use the given ConnFunc when
+// connecting to cluster nodes.
+func ShardedPubSubConnFunc(connFn ConnFunc) ShardedPubSubOpt {
+	return func(opts *shardedPubSubOpts) {
+		opts.connFn = connFn
+	}
+}
+
+// ShardedPubSubErrCh takes a channel which asynchronous errors encountered by
+// the ShardedPubSub, e.g. while moving subscriptions between nodes, can be read
+// off of. If the channel blocks the error will be dropped.
+//
+// The channel is never closed by the ShardedPubSub, so it may be shared with
+// other components. Once Close has returned no more errors will be written to
+// it.
+func ShardedPubSubErrCh(errCh chan<- error) ShardedPubSubOpt {
+	return func(opts *shardedPubSubOpts) {
+		opts.errCh = errCh
+	}
+}
+
+var errShardedPattern = errors.New("pattern subscriptions are not supported by sharded pubsub")
+
+// shardConn is a connection to a single cluster node which is used for sharded
+// subscriptions.
+type shardConn struct {
+	ps   *shardedPubSub
+	addr string
+	conn Conn
+
+	// used for waiting on the responses to commands, see do.
+	cmdResCh chan error
+
+	l sync.Mutex
+	// number of responses which do is waiting on. Responses which arrive when
+	// none are expected are dropped, so that spin never blocks on cmdResCh.
+	expecting int
+	// number of sunsubscribe responses expected for each channel, so that ones
+	// sent by the node itself when a slot is migrated can be told apart.
+	pending map[string]int
+	// channels which the node has unsubscribed the conn from by itself.
+	dropped []string
+	closed  bool
+}
+
+func (sc *shardConn) isClosed() bool {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+	return sc.closed
+}
+
+func (sc *shardConn) close() {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+	if !sc.closed {
+		sc.closed = true
+		sc.conn.Close()
+	}
+}
+
+func (sc *shardConn) takeDropped() []string {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+	dropped := sc.dropped
+	sc.dropped = nil
+	return dropped
+}
+
+// respond passes the response to a command back to do, unless do isn't
+// expecting any. An error response rejects the whole command, so do won't
+// expect any further responses after it.
+func (sc *shardConn) respond(err error) {
+	sc.l.Lock()
+	if sc.expecting == 0 {
+		sc.l.Unlock()
+		return
+	} else if err != nil {
+		sc.expecting = 0
+	} else {
+		sc.expecting--
+	}
+	sc.l.Unlock()
+	sc.cmdResCh <- err
+}
+
+func (sc *shardConn) spin() {
+	defer sc.ps.wg.Done()
+	for {
+		var rm resp2.RawMessage
+		err := sc.conn.Decode(&rm)
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			continue
+		} else if err != nil {
+			if !sc.isClosed() {
+				sc.close()
+				sc.ps.err(errors.Errorf("sharded pubsub connection to %s failed: %w", sc.addr, err))
+				sc.ps.kick()
+			}
+			close(sc.cmdResCh)
+			return
+		}
+
+		var m PubSubMessage
+		if err := rm.UnmarshalInto(&m); err == nil {
+			sc.ps.publish(m)
+			continue
+		} else if !errors.Is(err, errNotPubSubMessage) {
+			// error responses, e.g. MOVED, are passed back to the command
+			sc.respond(err)
+			continue
+		}
+
+		// subscribe responses and PONGs are responses to commands, but the
+		// node can also unsubscribe the conn when a slot is migrated.
+		var ss []string
+		if rm.UnmarshalInto(resp2.Any{I: &ss}) == nil && len(ss) > 1 && ss[0] == "sunsubscribe" {
+			sc.l.Lock()
+			unsolicited := sc.pending[ss[1]] == 0
+			if unsolicited {
+				sc.dropped = append(sc.dropped, ss[1])
+			} else if sc.pending[ss[1]]--; sc.pending[ss[1]] == 0 {
+				delete(sc.pending, ss[1])
+			}
+			sc.l.Unlock()
+			if unsolicited {
+				sc.ps.kick()
+				continue
+			}
+		}
+		sc.respond(nil)
+	}
+}
+
+// NOTE the shardedPubSub's cmdL _must_ be held to use do
+func (sc *shardConn) do(exp int, cmd string, args ...string) error {
+	sc.l.Lock()
+	sc.expecting += exp
+	sc.l.Unlock()
+
+	if err := sc.conn.Encode(Cmd(nil, cmd, args...)); err != nil {
+		sc.l.Lock()
+		sc.expecting -= exp
+		sc.l.Unlock()
+		return err
+	}
+
+	for i := 0; i < exp; i++ {
+		err, ok := <-sc.cmdResCh
+		if err != nil {
+			return err
+		} else if !ok {
+			return errors.New("connection closed")
+		}
+	}
+	return nil
+}
+
+// NOTE the shardedPubSub's cmdL _must_ be held to use sunsubscribe
+func (sc *shardConn) sunsubscribe(channels []string) error {
+	sc.l.Lock()
+	for _, channel := range channels {
+		sc.pending[channel]++
+	}
+	sc.l.Unlock()
+	return sc.do(len(channels), "SUNSUBSCRIBE", channels...)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type shardedPubSub struct {
+	cluster *Cluster
+	opts    shardedPubSubOpts
+
+	csL  sync.RWMutex
+	subs chanSet
+
+	// cmdL must be held when using conns, chanAddrs, or closed, and while
+	// performing commands.
+	cmdL      sync.Mutex
+	conns     map[string]*shardConn
+	chanAddrs map[string]string // channel -> addr subscribed on, "" if none
+	closed    bool
+
+	syncCh, kickCh chan struct{}
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// ShardedPubSub returns a PubSubConn which uses redis' sharded pubsub
+// (SSUBSCRIBE/SUNSUBSCRIBE, redis 7.0 and up) on the given Cluster. Each
+// channel is subscribed to on the primary which serves the channel's slot,
+// with one connection being made to each primary as needed. Messages published
+// to a channel using SPUBLISH, e.g. via Cluster.Do, are received as
+// PubSubMessages with a Type of "smessage".
+//
+// Whenever the Cluster syncs its topology any subscriptions whose slots have
+// moved to a different primary are moved there, and the same happens when a
+// node unsubscribes from a channel by itself because its slot was migrated.
+// Subscriptions on a connection which fails are also re-made on a new one.
+// PSubscribe and PUnsubscribe are not supported, and always return an error.
+//
+// The options which ShardedPubSub uses by default are:
+//
+//	ShardedPubSubConnFunc(DefaultConnFunc)
+func ShardedPubSub(c *Cluster, opts ...ShardedPubSubOpt) PubSubConn {
+	ps := &shardedPubSub{
+		cluster:   c,
+		subs:      chanSet{},
+		conns:     map[string]*shardConn{},
+		chanAddrs: map[string]string{},
+		syncCh:    make(chan struct{}, 1),
+		kickCh:    make(chan struct{}, 1),
+		closeCh:   make(chan struct{}),
+	}
+	defaultOpts := []ShardedPubSubOpt{
+		ShardedPubSubConnFunc(DefaultConnFunc),
+	}
+	for _, opt := range append(defaultOpts, opts...) {
+		opt(&ps.opts)
+	}
+
+	c.syncNotifier.add(ps.syncCh)
+	ps.wg.Add(1)
+	go ps.spin()
+	return ps
+}
+
+func (ps *shardedPubSub) err(err error) {
+	if ps.opts.errCh == nil {
+		return
+	}
+	select {
+	case ps.opts.errCh <- err:
+	default:
+	}
+}
+
+// kick causes the subscriptions to be re-checked as soon as possible.
+func (ps *shardedPubSub) kick() {
+	select {
+	case ps.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+func (ps *shardedPubSub) publish(m PubSubMessage) {
+	ps.csL.RLock()
+	defer ps.csL.RUnlock()
+	for ch := range ps.subs[m.Channel] {
+		ch <- m
+	}
+}
+
+func (ps *shardedPubSub) spin() {
+	defer ps.wg.Done()
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ps.syncCh:
+		case <-ps.kickCh:
+			// the cluster's topology has likely changed, resync it first
+			if err := ps.cluster.Sync(); err != nil {
+				ps.err(err)
+			}
+		case <-t.C:
+			// this doubles as a keepalive, and as a retry of any resubscribes
+			// which previously failed
+			if err := ps.Ping(); err != nil {
+				ps.err(err)
+			}
+		case <-ps.closeCh:
+			return
+		}
+
+		ps.cmdL.Lock()
+		if !ps.closed {
+			if err := ps.resync(); err != nil {
+				ps.err(err)
+			}
+		}
+		ps.cmdL.Unlock()
+	}
+}
+
+// NOTE cmdL _must_ be held to use conn
+func (ps *shardedPubSub) conn(addr string) (*shardConn, error) {
+	if sc, ok := ps.conns[addr]; ok && !sc.isClosed() {
+		return sc, nil
+	}
+	ps.forgetConn(addr)
+
+	conn, err := ps.opts.connFn("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sc := &shardConn{
+		ps:       ps,
+		addr:     addr,
+		conn:     conn,
+		cmdResCh: make(chan error, 1),
+		pending:  map[string]int{},
+	}
+	ps.conns[addr] = sc
+	ps.wg.Add(1)
+	go sc.spin()
+	return sc, nil
+}
+
+// forgetConn closes and removes the conn to the given addr, if any, and marks
+// all channels which were subscribed on it as needing to be resubscribed.
+//
+// NOTE cmdL _must_ be held to use forgetConn
+func (ps *shardedPubSub) forgetConn(addr string) {
+	sc, ok := ps.conns[addr]
+	if !ok {
+		return
+	}
+	sc.close()
+	delete(ps.conns, addr)
+	for channel, chanAddr := range ps.chanAddrs {
+		if chanAddr == addr {
+			ps.chanAddrs[channel] = ""
+		}
+	}
+}
+
+// bySlot groups the given channels by the address of the node serving their
+// slot, and then by slot.
+func (ps *shardedPubSub) bySlot(channels []string) map[string]map[uint16][]string {
+	m := map[string]map[uint16][]string{}
+	for _, channel := range channels {
+		addr := ps.cluster.addrForKey(channel)
+		if m[addr] == nil {
+			m[addr] = map[uint16][]string{}
+		}
+		slot := ClusterSlot([]byte(channel))
+		m[addr][slot] = append(m[addr][slot], channel)
+	}
+	return m
+}
+
+// subscribe subscribes to each of the given channels on the node which serves
+// its slot. Since sharded subscriptions must all belong to the same slot a
+// command is performed for each slot. Channels which are subscribed to
+// successfully have their address set in chanAddrs, and the first error
+// encountered is returned.
+//
+// NOTE cmdL _must_ be held to use subscribe
+func (ps *shardedPubSub) subscribe(channels []string) error {
+	var retErr error
+	for addr, slots := range ps.bySlot(channels) {
+		sc, err := ps.conn(addr)
+		if err != nil {
+			if retErr == nil {
+				retErr = err
+			}
+			continue
+		}
+		for _, slotChannels := range slots {
+			if err := sc.do(len(slotChannels), "SSUBSCRIBE", slotChannels...); err != nil {
+				if retErr == nil {
+					retErr = err
+				}
+				continue
+			}
+			for _, channel := range slotChannels {
+				ps.chanAddrs[channel] = addr
+			}
+		}
+	}
+	return retErr
+}
+
+// resync moves any subscriptions which are no longer on the node which serves
+// their slot, or which have been dropped, to the correct node.
+//
+// NOTE cmdL _must_ be held to use resync
+func (ps *shardedPubSub) resync() error {
+	for addr, sc := range ps.conns {
+		if sc.isClosed() {
+			ps.forgetConn(addr)
+			continue
+		}
+		for _, channel := range sc.takeDropped() {
+			if ps.chanAddrs[channel] == addr {
+				ps.chanAddrs[channel] = ""
+			}
+		}
+	}
+
+	var toSub []string
+	toUnsub := map[string][]string{}
+	for channel, addr := range ps.chanAddrs {
+		if addr != "" && addr == ps.cluster.addrForKey(channel) {
+			continue
+		} else if addr != "" {
+			toUnsub[addr] = append(toUnsub[addr], channel)
+		}
+		toSub = append(toSub, channel)
+	}
+	if len(toSub) == 0 {
+		return nil
+	}
+	sort.Strings(toSub)
+
+	var retErr error
+	for addr, channels := range toUnsub {
+		for _, channel := range channels {
+			ps.chanAddrs[channel] = ""
+		}
+		sc, ok := ps.conns[addr]
+		if !ok {
+			continue
+		}
+		for _, slotChannels := range ps.bySlotOnly(channels) {
+			if err := sc.sunsubscribe(slotChannels); err != nil && retErr == nil {
+				retErr = err
+			}
+		}
+	}
+
+	if err := ps.subscribe(toSub); err != nil && retErr == nil {
+		retErr = err
+	}
+	return retErr
+}
+
+func (ps *shardedPubSub) Subscribe(msgCh chan<- PubSubMessage, channels ...string) error {
+	ps.cmdL.Lock()
+	defer ps.cmdL.Unlock()
+	if ps.closed {
+		return errClientClosed
+	}
+
+	ps.csL.RLock()
+	missing := ps.subs.missing(channels)
+	ps.csL.RUnlock()
+
+	if len(missing) > 0 {
+		if err := ps.subscribe(missing); err != nil {
+			// channels which were subscribed to on some nodes would otherwise
+			// be left without any subscribers
+			ps.unsubscribe(missing)
+			return err
+		}
+	}
+
+	ps.csL.Lock()
+	for _, channel := range channels {
+		ps.subs.add(channel, msgCh)
+	}
+	ps.csL.Unlock()
+	return nil
+}
+
+func (ps *shardedPubSub) Unsubscribe(msgCh chan<- PubSubMessage, channels ...string) error {
+	ps.cmdL.Lock()
+	defer ps.cmdL.Unlock()
+	if ps.closed {
+		return errClientClosed
+	}
+
+	ps.csL.Lock()
+	var empty []string
+	for _, channel := range channels {
+		if ps.subs.del(channel, msgCh) {
+			empty = append(empty, channel)
+		}
+	}
+	ps.csL.Unlock()
+
+	return ps.unsubscribe(empty)
+}
+
+// unsubscribe removes the given channels from chanAddrs, and unsubscribes from
+// those which are subscribed to on a node. The first error encountered is
+// returned.
+//
+// NOTE cmdL _must_ be held to use unsubscribe
+func (ps *shardedPubSub) unsubscribe(channels []string) error {
+	byAddr := map[string][]string{}
+	for _, channel := range channels {
+		addr, ok := ps.chanAddrs[channel]
+		if !ok {
+			continue
+		}
+		delete(ps.chanAddrs, channel)
+		if addr != "" {
+			byAddr[addr] = append(byAddr[addr], channel)
+		}
+	}
+
+	var retErr error
+	for addr, addrChannels := range byAddr {
+		sc, ok := ps.conns[addr]
+		if !ok || sc.isClosed() {
+			continue
+		}
+		for _, slotChannels := range ps.bySlotOnly(addrChannels) {
+			if err := sc.sunsubscribe(slotChannels); err != nil && retErr == nil {
+				retErr = err
+			}
+		}
+	}
+	return retErr
+}
+
+// bySlotOnly groups the given channels by slot.
+func (ps *shardedPubSub) bySlotOnly(channels []string) [][]string {
+	m := map[uint16][]string{}
+	for _, channel := range channels {
+		slot := ClusterSlot([]byte(channel))
+		m[slot] = append(m[slot], channel)
+	}
+	out := make([][]string, 0, len(m))
+	for _, slotChannels := range m {
+		out = append(out, slotChannels)
+	}
+	return out
+}
+
+func (ps *shardedPubSub) PSubscribe(msgCh chan<- PubSubMessage, patterns ...string) error {
+	return errShardedPattern
+}
+
+func (ps *shardedPubSub) PUnsubscribe(msgCh chan<- PubSubMessage, patterns ...string) error {
+	return errShardedPattern
+}
+
+// Ping pings every node which the ShardedPubSub is connected to, returning
+// the first error encountered.
+func (ps *shardedPubSub) Ping() error {
+	ps.cmdL.Lock()
+	defer ps.cmdL.Unlock()
+	if ps.closed {
+		return errClientClosed
+	}
+
+	addrs := make([]string, 0, len(ps.conns))
+	for addr := range ps.conns {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var retErr error
+	for _, addr := range addrs {
+		if sc := ps.conns[addr]; sc.isClosed() {
+			continue
+		} else if err := sc.do(1, "PING"); err != nil && retErr == nil {
+			retErr = errors.Errorf("pinging %s: %w", addr, err)
+		}
+	}
+	return retErr
+}
+
+func (ps *shardedPubSub) Close() error {
+	err := errClientClosed
+	ps.closeOnce.Do(func() {
+		ps.cluster.syncNotifier.remove(ps.syncCh)
+
+		ps.cmdL.Lock()
+		ps.closed = true
+		for _, sc := range ps.conns {
+			sc.close()
+		}
+		ps.cmdL.Unlock()
+
+		close(ps.closeCh)
+		ps.wg.Wait()
+		err = nil
+	})
+	return err
+}
@@ -0,0 +1,126 @@
+package radix
+
+import (
+	. "testing"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedPubSub(t *T) {
+	c, scl := newTestCluster()
+	defer c.Close()
+	stubs := newPubSubStubs()
+	errCh := make(chan error, 1)
+	ps := ShardedPubSub(c, ShardedPubSubConnFunc(stubs.connFunc), ShardedPubSubErrCh(errCh))
+	defer ps.Close()
+
+	ch0, ch16k := clusterSlotKeys[0], clusterSlotKeys[16000]
+	addr0, addr16k := c.addrForKey(ch0), c.addrForKey(ch16k)
+	require.NotEqual(t, addr0, addr16k)
+
+	msgCh := make(chan PubSubMessage, 1)
+	require.Nil(t, ps.Subscribe(msgCh, ch0, ch16k))
+	assert.True(t, stubs.subscribed(addr0, ch0))
+	assert.True(t, stubs.subscribed(addr16k, ch16k))
+	assert.Nil(t, ps.Ping())
+	assert.Error(t, ps.PSubscribe(msgCh, "*"))
+
+	assertMsg := func(addr, channel, msg string) {
+		_, inCh := stubs.latest(addr)
+		inCh <- PubSubMessage{Type: "smessage", Channel: channel, Message: []byte(msg)}
+		select {
+		case m := <-msgCh:
+			assert.Equal(t, PubSubMessage{Type: "smessage", Channel: channel, Message: []byte(msg)}, m)
+		case <-time.After(time.Second):
+			t.Fatalf("message %q not received on %q", msg, channel)
+		}
+	}
+	assertMsg(addr0, ch0, "foo")
+	assertMsg(addr16k, ch16k, "bar")
+
+	migrate := func(dstAddr string) {
+		scl.migrateInit(dstAddr, 0)
+		scl.migrateAllKeys(0)
+		scl.migrateDone(0)
+	}
+
+	// when the slot moves the subscription is moved after the cluster syncs
+	migrate(addr16k)
+	require.Nil(t, c.Sync())
+	waitFor(t, "subscription to move", func() bool {
+		return stubs.subscribed(addr16k, ch0) && !stubs.subscribed(addr0, ch0)
+	})
+	assertMsg(addr16k, ch0, "baz")
+
+	// when the node unsubscribes by itself the cluster is synced and the
+	// subscription is moved
+	migrate(addr0)
+	conn16k, _ := stubs.latest(addr16k)
+	require.Nil(t, conn16k.Encode(Cmd(nil, "SUNSUBSCRIBE", ch0)))
+	waitFor(t, "subscription to move back", func() bool {
+		return stubs.subscribed(addr0, ch0)
+	})
+	assertMsg(addr0, ch0, "qux")
+
+	// when a connection fails its subscriptions are made on a new one
+	conn0, _ := stubs.latest(addr0)
+	conn0.Close()
+	waitFor(t, "new connection", func() bool {
+		newConn0, _ := stubs.latest(addr0)
+		return newConn0 != conn0 && stubs.subscribed(addr0, ch0)
+	})
+	assertMsg(addr0, ch0, "quux")
+
+	require.Nil(t, ps.Unsubscribe(msgCh, ch0, ch16k))
+	assert.False(t, stubs.subscribed(addr0, ch0))
+	assert.False(t, stubs.subscribed(addr16k, ch16k))
+
+	require.Nil(t, ps.Close())
+	assert.Error(t, ps.Subscribe(msgCh, ch0))
+
+	// the error channel belongs to the caller, and is left open
+	for drained := false; !drained; {
+		select {
+		case err, ok := <-errCh:
+			require.True(t, ok, "errCh was closed")
+			t.Logf("async error: %v", err)
+		default:
+			drained = true
+		}
+	}
+}
+
+func TestShardedPubSubSubscribeErr(t *T) {
+	c, _ := newTestCluster()
+	defer c.Close()
+
+	ch0, ch16k := clusterSlotKeys[0], clusterSlotKeys[16000]
+	addr0, addr16k := c.addrForKey(ch0), c.addrForKey(ch16k)
+	require.NotEqual(t, addr0, addr16k)
+
+	stubs := newPubSubStubs()
+	ps := ShardedPubSub(c, ShardedPubSubConnFunc(func(network, addr string) (Conn, error) {
+		if addr == addr16k {
+			return nil, errors.New("can't connect")
+		}
+		return stubs.connFunc(network, addr)
+	}))
+	defer ps.Close()
+
+	// if subscribing fails on one node the subscriptions made on others are
+	// undone, and aren't made again later
+	msgCh := make(chan PubSubMessage, 1)
+	assert.Error(t, ps.Subscribe(msgCh, ch0, ch16k))
+	assert.False(t, stubs.subscribed(addr0, ch0))
+
+	sps := ps.(*shardedPubSub)
+	sps.cmdL.Lock()
+	assert.Empty(t, sps.chanAddrs)
+	assert.Nil(t, sps.resync())
+	sps.cmdL.Unlock()
+	assert.False(t, stubs.subscribed(addr0, ch0))
+}
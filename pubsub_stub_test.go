@@ -2,6 +2,7 @@ package radix
 
 import (
 	"log"
+	"sync"
 	. "testing"
 	"time"
 
@@ -118,3 +119,53 @@ func ExamplePubSubStub() {
 		log.Printf("read m: %#v", m)
 	}
 }
+
+// pubSubStubs has a ConnFunc which creates a PubSubStub for every connection,
+// keeping track of the latest one for each address.
+type pubSubStubs struct {
+	l     sync.Mutex
+	conns map[string]*pubSubStub
+	inChs map[string]chan<- PubSubMessage
+}
+
+func newPubSubStubs() *pubSubStubs {
+	return &pubSubStubs{
+		conns: map[string]*pubSubStub{},
+		inChs: map[string]chan<- PubSubMessage{},
+	}
+}
+
+func (s *pubSubStubs) connFunc(network, addr string) (Conn, error) {
+	conn, inCh := PubSubStub(network, addr, func([]string) interface{} { return nil })
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.conns[addr] = conn.(*pubSubStub)
+	s.inChs[addr] = inCh
+	return conn, nil
+}
+
+func (s *pubSubStubs) latest(addr string) (*pubSubStub, chan<- PubSubMessage) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.conns[addr], s.inChs[addr]
+}
+
+func (s *pubSubStubs) subscribed(addr, channel string) bool {
+	conn, _ := s.latest(addr)
+	if conn == nil {
+		return false
+	}
+	conn.l.Lock()
+	defer conn.l.Unlock()
+	return conn.subbed[channel] || conn.ssubbed[channel]
+}
+
+func waitFor(t *T, desc string, fn func() bool) {
+	for i := 0; i < 200; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", desc)
+}
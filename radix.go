@@ -163,6 +163,8 @@
 package radix
 
 import (
+	"context"
+
 	errors "golang.org/x/xerrors"
 )
 
@@ -182,6 +184,41 @@ type Client interface {
 	Close() error
 }
 
+// ContextClient describes a Client which can also carry out Actions under a
+// context.Context. All Clients in this package (Conn, Pool, Cluster, and
+// Sentinel) implement ContextClient.
+//
+// If the context is canceled or its deadline passes before the Action has
+// completed then DoContext will return the context's error. What happens to the
+// Action in that case depends on where it was at that moment: an Action which
+// is still waiting on a connection, or on a redirect, will not be performed at
+// all, while an Action which was already written to redis will have its
+// connection's read interrupted, and that connection will be discarded.
+//
+// If the Action fails after being interrupted the returned error wraps both the
+// context's error and the Action's own error, so either can be checked for
+// using errors.Is or errors.As.
+type ContextClient interface {
+	Client
+
+	// DoContext performs an Action, returning any error. The Action will be
+	// abandoned, as far as is possible, once the context is done.
+	DoContext(context.Context, Action) error
+}
+
+// DoContext performs the Action on the Client using the given context, if the
+// Client is a ContextClient. Otherwise the context is only checked prior to
+// calling Do. It is useful for code which accepts any Client but still wants
+// to honor a context where possible.
+func DoContext(ctx context.Context, c Client, a Action) error {
+	if cc, ok := c.(ContextClient); ok {
+		return cc.DoContext(ctx, a)
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Do(a)
+}
+
 // ClientFunc is a function which can be used to create a Client for a single
 // redis instance on the given network/address.
 type ClientFunc func(network, addr string) (Client, error)
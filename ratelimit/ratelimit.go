@@ -0,0 +1,291 @@
+// Package ratelimit implements rate limiting on top of redis, with each
+// decision being made atomically by a script on the redis instance.
+//
+// Two algorithms are provided:
+//
+// * GCRA (the generic cell rate algorithm) behaves like a token bucket which
+// is refilled at a constant rate, but only needs to store a single timestamp
+// per key.
+//
+// * SlidingWindow keeps a log of the times of all allowed requests within the
+// window, and so is exact, at the cost of storing an entry per request.
+//
+// Both use the redis instance's clock, so that the clocks of the clients don't
+// need to agree, and both store all data for a key under a single redis key, so
+// they work with Cluster as well as Pool, Sentinel, or any other radix.Client.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+// Result describes the outcome of a call to Allow.
+type Result struct {
+	// Allowed is true if the requests were allowed, in which case they have
+	// been counted against the limit.
+	Allowed bool
+
+	// Remaining is the number of further requests which would be allowed
+	// right now.
+	Remaining int
+
+	// RetryAfter is how long to wait before the same number of requests would
+	// be allowed, if they weren't allowed. It is -1 if they would never be
+	// allowed, because more were requested than the limit.
+	RetryAfter time.Duration
+
+	// ResetAfter is how long it will take for the limit to be fully available
+	// again, assuming no further requests are allowed.
+	ResetAfter time.Duration
+}
+
+// Limiter is implemented by all the rate limiters in this package.
+type Limiter interface {
+	// Allow checks whether n requests for the given key are allowed, and if so
+	// counts them against the key's limit.
+	Allow(ctx context.Context, key string, n int) (Result, error)
+}
+
+type opts struct {
+	prefix string
+	burst  int
+}
+
+// Opt is an optional parameter which can be passed into NewGCRA or
+// NewSlidingWindow in order to affect the Limiter's behavior.
+type Opt func(*opts)
+
+// Prefix sets the prefix of the redis keys which the Limiter uses. The key
+// passed into Allow is wrapped in a cluster hash tag and appended to the
+// prefix, e.g. with the default prefix the key "foo" is stored at
+// "ratelimit:{foo}".
+func Prefix(prefix string) Opt {
+	return func(o *opts) {
+		o.prefix = prefix
+	}
+}
+
+// Burst sets the maximum number of requests which a GCRA Limiter will allow at
+// once, after a period of inactivity. It defaults to the limit given to
+// NewGCRA. It has no effect on SlidingWindow.
+func Burst(n int) Opt {
+	return func(o *opts) {
+		o.burst = n
+	}
+}
+
+func applyOpts(defaultOpts []Opt, o []Opt) opts {
+	var oo opts
+	for _, opt := range append(defaultOpts, o...) {
+		opt(&oo)
+	}
+	return oo
+}
+
+func (o opts) key(key string) string {
+	return o.prefix + "{" + key + "}"
+}
+
+// all scripts return {allowed, remaining, retryAfter, resetAfter}, with
+// durations in microseconds.
+func resultFromReply(reply []int64) (Result, error) {
+	if len(reply) != 4 {
+		return Result{}, errors.Errorf("malformed rate limit script reply %v", reply)
+	}
+	res := Result{
+		Allowed:    reply[0] == 1,
+		Remaining:  int(reply[1]),
+		RetryAfter: time.Duration(reply[2]) * time.Microsecond,
+		ResetAfter: time.Duration(reply[3]) * time.Microsecond,
+	}
+	if reply[2] < 0 {
+		res.RetryAfter = -1
+	}
+	return res, nil
+}
+
+func formatMicros(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Microsecond), 10)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// the current time is retrieved from redis, which requires scripts to be
+// replicated by their effects. That's the default from redis 5 onwards, and
+// replicate_commands enables it prior to that.
+const scriptNow = `
+	if redis.replicate_commands then redis.replicate_commands() end
+	local t = redis.call("TIME")
+	local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+`
+
+// KEYS[1]: key
+// ARGV[1]: emission interval, ARGV[2]: burst, ARGV[3]: n
+var gcraScript = radix.NewEvalScript(1, scriptNow+`
+	local emission = tonumber(ARGV[1])
+	local burst = tonumber(ARGV[2])
+	local n = tonumber(ARGV[3])
+	local tolerance = emission * burst
+
+	-- tat is the theoretical arrival time, i.e. the time at which the bucket
+	-- will be full again
+	local tat = tonumber(redis.call("GET", KEYS[1]))
+	if not tat or tat < now then
+		tat = now
+	end
+
+	if n > burst then
+		return {0, math.floor((now - (tat - tolerance)) / emission), -1, tat - now}
+	end
+
+	local newTat = tat + emission * n
+	local allowAt = newTat - tolerance
+	if allowAt > now then
+		return {0, math.max(0, math.floor((now - (tat - tolerance)) / emission)), allowAt - now, tat - now}
+	end
+
+	if n > 0 then
+		redis.call("SET", KEYS[1], string.format("%.0f", newTat), "PX", math.ceil((newTat - now) / 1000))
+	end
+	return {1, math.floor((now - allowAt) / emission), 0, newTat - now}
+`)
+
+// GCRA is a Limiter which allows requests at a constant rate, with bursts of
+// up to a configured size.
+type GCRA struct {
+	client   radix.Client
+	emission time.Duration
+	opts     opts
+}
+
+var _ Limiter = new(GCRA)
+
+// NewGCRA returns a GCRA Limiter which allows limit requests per period for
+// each key, using the given Client. An error is returned if limit, period or
+// the burst aren't positive. The default options NewGCRA uses are:
+//
+//	Prefix("ratelimit:")
+//	Burst(limit)
+func NewGCRA(client radix.Client, limit int, period time.Duration, o ...Opt) (*GCRA, error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("limit must be positive, got %d", limit)
+	} else if period <= 0 {
+		return nil, errors.Errorf("period must be positive, got %v", period)
+	}
+
+	g := &GCRA{
+		client:   client,
+		emission: period / time.Duration(limit),
+		opts:     applyOpts([]Opt{Prefix("ratelimit:"), Burst(limit)}, o),
+	}
+	if g.opts.burst <= 0 {
+		return nil, errors.Errorf("burst must be positive, got %d", g.opts.burst)
+	} else if g.emission == 0 {
+		return nil, errors.Errorf("period %v is too short for a limit of %d", period, limit)
+	}
+	return g, nil
+}
+
+// Allow implements the method for the Limiter interface.
+func (g *GCRA) Allow(ctx context.Context, key string, n int) (Result, error) {
+	var reply []int64
+	err := radix.DoContext(ctx, g.client, gcraScript.Cmd(&reply, g.opts.key(key),
+		formatMicros(g.emission), strconv.Itoa(g.opts.burst), strconv.Itoa(n)))
+	if err != nil {
+		return Result{}, err
+	}
+	return resultFromReply(reply)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// KEYS[1]: key
+// ARGV[1]: window, ARGV[2]: limit, ARGV[3]: n, ARGV[4]: unique id of the call
+var slidingWindowScript = radix.NewEvalScript(1, scriptNow+`
+	local window = tonumber(ARGV[1])
+	local limit = tonumber(ARGV[2])
+	local n = tonumber(ARGV[3])
+
+	-- an entry leaves the window exactly window after it was added, which is
+	-- what retryAfter and resetAfter are computed from
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", string.format("%.0f", now - window))
+	local count = redis.call("ZCARD", KEYS[1])
+
+	local resetAfter = 0
+	local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+	if newest[2] then
+		resetAfter = tonumber(newest[2]) + window - now
+	end
+
+	if n > limit then
+		return {0, limit - count, -1, resetAfter}
+	elseif count + n > limit then
+		-- enough of the oldest entries must expire for n more to fit
+		local i = count + n - limit - 1
+		local oldest = redis.call("ZRANGE", KEYS[1], i, i, "WITHSCORES")
+		return {0, limit - count, tonumber(oldest[2]) + window - now, resetAfter}
+	end
+
+	local score = string.format("%.0f", now)
+	for i = 1, n do
+		redis.call("ZADD", KEYS[1], score, score .. ":" .. ARGV[4] .. ":" .. i)
+	end
+	redis.call("PEXPIRE", KEYS[1], math.ceil(window / 1000))
+	return {1, limit - count - n, 0, window}
+`)
+
+// SlidingWindow is a Limiter which allows up to a limit of requests within any
+// window of time of a configured duration.
+type SlidingWindow struct {
+	client radix.Client
+	limit  int
+	window time.Duration
+	opts   opts
+}
+
+var _ Limiter = new(SlidingWindow)
+
+// NewSlidingWindow returns a SlidingWindow Limiter which allows limit requests
+// within any window of the given duration for each key, using the given Client.
+// An error is returned if limit or window aren't positive. The default options
+// NewSlidingWindow uses are:
+//
+//	Prefix("ratelimit:")
+func NewSlidingWindow(client radix.Client, limit int, window time.Duration, o ...Opt) (*SlidingWindow, error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("limit must be positive, got %d", limit)
+	} else if window < time.Millisecond {
+		return nil, errors.Errorf("window must be at least 1ms, got %v", window)
+	}
+
+	return &SlidingWindow{
+		client: client,
+		limit:  limit,
+		window: window,
+		opts:   applyOpts([]Opt{Prefix("ratelimit:")}, o),
+	}, nil
+}
+
+// Allow implements the method for the Limiter interface.
+func (sw *SlidingWindow) Allow(ctx context.Context, key string, n int) (Result, error) {
+	idB := make([]byte, 8)
+	if _, err := rand.Read(idB); err != nil {
+		return Result{}, err
+	}
+
+	var reply []int64
+	err := radix.DoContext(ctx, sw.client, slidingWindowScript.Cmd(&reply, sw.opts.key(key),
+		formatMicros(sw.window), strconv.Itoa(sw.limit), strconv.Itoa(n), hex.EncodeToString(idB)))
+	if err != nil {
+		return Result{}, err
+	}
+	return resultFromReply(reply)
+}
@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mediocregopher/radix/v3"
+)
+
+func randStr() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func testClient(t *T) *radix.Pool {
+	pool, err := radix.NewPool("tcp", "127.0.0.1:6379", 2)
+	require.Nil(t, err)
+	return pool
+}
+
+func TestGCRA(t *T) {
+	client := testClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	key := randStr()
+	l, err := NewGCRA(client, 10, time.Second, Burst(3))
+	require.Nil(t, err)
+
+	for i := 2; i >= 0; i-- {
+		res, err := l.Allow(ctx, key, 1)
+		require.Nil(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+		assert.Equal(t, time.Duration(0), res.RetryAfter)
+		assert.True(t, res.ResetAfter > 0 && res.ResetAfter <= 300*time.Millisecond)
+	}
+
+	res, err := l.Allow(ctx, key, 1)
+	require.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.True(t, res.RetryAfter > 0 && res.RetryAfter <= 100*time.Millisecond)
+
+	// more than the burst can never be allowed
+	res, err = l.Allow(ctx, key, 4)
+	require.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Duration(-1), res.RetryAfter)
+
+	// after waiting a request is allowed again
+	time.Sleep(res.ResetAfter - 100*time.Millisecond)
+	res, err = l.Allow(ctx, key, 2)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed)
+
+	var ttl int
+	require.Nil(t, client.Do(radix.Cmd(&ttl, "PTTL", "ratelimit:{"+key+"}")))
+	assert.True(t, ttl > 0)
+}
+
+func TestSlidingWindow(t *T) {
+	client := testClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	key := randStr()
+	l, err := NewSlidingWindow(client, 3, 200*time.Millisecond, Prefix("test:"))
+	require.Nil(t, err)
+
+	res, err := l.Allow(ctx, key, 2)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+	assert.Equal(t, 200*time.Millisecond, res.ResetAfter)
+
+	time.Sleep(100 * time.Millisecond)
+	res, err = l.Allow(ctx, key, 1)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	// the first two requests need to leave the window for two more to fit
+	res, err = l.Allow(ctx, key, 2)
+	require.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.True(t, res.RetryAfter > 0 && res.RetryAfter <= 100*time.Millisecond)
+	assert.True(t, res.ResetAfter > res.RetryAfter)
+	retryAfter := res.RetryAfter
+
+	res, err = l.Allow(ctx, key, 4)
+	require.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Duration(-1), res.RetryAfter)
+
+	time.Sleep(retryAfter + 10*time.Millisecond)
+	res, err = l.Allow(ctx, key, 2)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	var card int
+	require.Nil(t, client.Do(radix.Cmd(&card, "ZCARD", "test:{"+key+"}")))
+	assert.Equal(t, 3, card)
+}
+
+func TestNewLimiterErrors(t *T) {
+	_, err := NewGCRA(nil, 0, time.Second)
+	assert.Error(t, err)
+	_, err = NewGCRA(nil, 10, 0)
+	assert.Error(t, err)
+	_, err = NewGCRA(nil, 10, time.Second, Burst(0))
+	assert.Error(t, err)
+	_, err = NewGCRA(nil, 10, 5*time.Nanosecond)
+	assert.Error(t, err)
+
+	_, err = NewSlidingWindow(nil, -1, time.Second)
+	assert.Error(t, err)
+	_, err = NewSlidingWindow(nil, 10, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,253 @@
+package radix
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplicaSelector is used to choose which replica (secondary) instance a read
+// should be sent to, out of all the healthy replicas currently known. It is
+// used by Sentinel.DoSecondary and Cluster.DoSecondary.
+//
+// Implementations must be thread-safe.
+type ReplicaSelector interface {
+	// Select returns one of the given replica addresses. addrs will never be
+	// empty, and must not be modified.
+	Select(addrs []string) string
+
+	// Done is called once for every call to Select, after the Action has been
+	// performed against the selected address. It is given how long the Action
+	// took to perform and the error it returned, if any.
+	Done(addr string, elapsed time.Duration, err error)
+}
+
+// replicaSelectorSyncer is implemented by ReplicaSelectors which keep state for
+// each replica address. syncReplicas is called with all currently known
+// replica addresses whenever the topology is updated, so that the state of
+// replicas which have left it can be dropped.
+type replicaSelectorSyncer interface {
+	syncReplicas(addrs map[string]bool)
+}
+
+func syncReplicaSelector(rs ReplicaSelector, addrs map[string]bool) {
+	if s, ok := rs.(replicaSelectorSyncer); ok {
+		s.syncReplicas(addrs)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type randomReplicaSelector struct{}
+
+// RandomReplicaSelector returns a ReplicaSelector which selects a replica at
+// random.
+func RandomReplicaSelector() ReplicaSelector {
+	return randomReplicaSelector{}
+}
+
+func (randomReplicaSelector) Select(addrs []string) string {
+	return addrs[rand.Intn(len(addrs))]
+}
+
+func (randomReplicaSelector) Done(string, time.Duration, error) {}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type roundRobinReplicaSelector struct {
+	// Atomic fields must be at the beginning of the struct since they must be
+	// correctly aligned or else access may cause panics on 32-bit architectures
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	n uint64
+}
+
+// RoundRobinReplicaSelector returns a ReplicaSelector which selects each
+// replica in turn.
+func RoundRobinReplicaSelector() ReplicaSelector {
+	return new(roundRobinReplicaSelector)
+}
+
+func (rr *roundRobinReplicaSelector) Select(addrs []string) string {
+	n := atomic.AddUint64(&rr.n, 1) - 1
+	return addrs[n%uint64(len(addrs))]
+}
+
+func (*roundRobinReplicaSelector) Done(string, time.Duration, error) {}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type leastOutstandingReplicaSelector struct {
+	l           sync.Mutex
+	outstanding map[string]int
+}
+
+// LeastOutstandingReplicaSelector returns a ReplicaSelector which selects the
+// replica with the fewest Actions currently being performed against it. Ties
+// are broken at random.
+func LeastOutstandingReplicaSelector() ReplicaSelector {
+	return &leastOutstandingReplicaSelector{
+		outstanding: map[string]int{},
+	}
+}
+
+func (lo *leastOutstandingReplicaSelector) Select(addrs []string) string {
+	lo.l.Lock()
+	defer lo.l.Unlock()
+
+	// start from a random offset so that ties don't always go to the same
+	// replica
+	offset := rand.Intn(len(addrs))
+	addr := addrs[offset]
+	for i := 1; i < len(addrs); i++ {
+		thisAddr := addrs[(offset+i)%len(addrs)]
+		if lo.outstanding[thisAddr] < lo.outstanding[addr] {
+			addr = thisAddr
+		}
+	}
+	lo.outstanding[addr]++
+	return addr
+}
+
+func (lo *leastOutstandingReplicaSelector) Done(addr string, _ time.Duration, _ error) {
+	lo.l.Lock()
+	defer lo.l.Unlock()
+	if lo.outstanding[addr]--; lo.outstanding[addr] <= 0 {
+		delete(lo.outstanding, addr)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type latencyReplicaSelector struct {
+	l         sync.Mutex
+	latencies map[string]time.Duration
+}
+
+// LatencyReplicaSelector returns a ReplicaSelector which selects a replica at
+// random, weighted by the inverse of each replica's recent average latency, so
+// that faster replicas receive proportionally more reads.
+//
+// Replicas which haven't had a successful Action performed against them yet
+// are weighted as if they were the fastest, so that they are quickly measured.
+func LatencyReplicaSelector() ReplicaSelector {
+	return &latencyReplicaSelector{
+		latencies: map[string]time.Duration{},
+	}
+}
+
+func (ls *latencyReplicaSelector) Select(addrs []string) string {
+	ls.l.Lock()
+	defer ls.l.Unlock()
+
+	var minLatency time.Duration
+	for _, addr := range addrs {
+		if lat, ok := ls.latencies[addr]; ok && (minLatency == 0 || lat < minLatency) {
+			minLatency = lat
+		}
+	}
+	if minLatency == 0 {
+		minLatency = 1
+	}
+
+	weights := make([]float64, len(addrs))
+	var total float64
+	for i, addr := range addrs {
+		lat, ok := ls.latencies[addr]
+		if !ok || lat <= 0 {
+			lat = minLatency
+		}
+		weights[i] = 1 / float64(lat)
+		total += weights[i]
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r -= w; r < 0 {
+			return addrs[i]
+		}
+	}
+	return addrs[len(addrs)-1]
+}
+
+func (ls *latencyReplicaSelector) Done(addr string, elapsed time.Duration, err error) {
+	// errored Actions may have returned early, or have taken as long as a
+	// timeout, either way their latency isn't representative
+	if err != nil {
+		return
+	}
+
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	if lat, ok := ls.latencies[addr]; ok {
+		// exponentially weighted moving average, so recent latencies count for
+		// more than older ones
+		ls.latencies[addr] = lat + (elapsed-lat)/4
+	} else {
+		ls.latencies[addr] = elapsed
+	}
+}
+
+func (ls *latencyReplicaSelector) syncReplicas(addrs map[string]bool) {
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	for addr := range ls.latencies {
+		if !addrs[addr] {
+			delete(ls.latencies, addr)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type preferReplicaSelector struct {
+	prefer func(addr string) bool
+	ReplicaSelector
+}
+
+// PreferReplicaSelector returns a ReplicaSelector which uses the given one to
+// select only from the replicas for which prefer returns true, e.g. those in
+// the same zone as the caller. If prefer doesn't return true for any replica
+// then the given ReplicaSelector selects from all of them.
+func PreferReplicaSelector(prefer func(addr string) bool, rs ReplicaSelector) ReplicaSelector {
+	return preferReplicaSelector{prefer: prefer, ReplicaSelector: rs}
+}
+
+func (ps preferReplicaSelector) Select(addrs []string) string {
+	var preferred []string
+	for _, addr := range addrs {
+		if ps.prefer(addr) {
+			preferred = append(preferred, addr)
+		}
+	}
+	if len(preferred) == 0 {
+		return ps.ReplicaSelector.Select(addrs)
+	}
+	return ps.ReplicaSelector.Select(preferred)
+}
+
+func (ps preferReplicaSelector) syncReplicas(addrs map[string]bool) {
+	syncReplicaSelector(ps.ReplicaSelector, addrs)
+}
+
+// SubnetReplicaSelector is like PreferReplicaSelector, but prefers the
+// replicas whose IP is within any of the given subnets.
+func SubnetReplicaSelector(rs ReplicaSelector, subnets ...*net.IPNet) ReplicaSelector {
+	return PreferReplicaSelector(func(addr string) bool {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, subnet := range subnets {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, rs)
+}
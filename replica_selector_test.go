@@ -0,0 +1,80 @@
+package radix
+
+import (
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundRobinReplicaSelector(t *T) {
+	rs := RoundRobinReplicaSelector()
+	addrs := []string{"a", "b", "c"}
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, rs.Select(addrs))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+}
+
+func TestLeastOutstandingReplicaSelector(t *T) {
+	rs := LeastOutstandingReplicaSelector()
+	addrs := []string{"a", "b", "c"}
+
+	// with nothing completing each replica is selected once before any is
+	// selected twice
+	selected := map[string]int{}
+	for i := 0; i < 3; i++ {
+		selected[rs.Select(addrs)]++
+	}
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1}, selected)
+
+	rs.Done("b", time.Millisecond, nil)
+	assert.Equal(t, "b", rs.Select(addrs))
+}
+
+func TestLatencyReplicaSelector(t *T) {
+	rs := LatencyReplicaSelector()
+	addrs := []string{"a", "b"}
+	rs.Done("a", time.Millisecond, nil)
+	rs.Done("b", 99*time.Millisecond, nil)
+
+	// errors don't count towards latency
+	rs.Done("b", time.Nanosecond, errClientClosed)
+
+	selected := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		selected[rs.Select(addrs)]++
+	}
+	assert.True(t, selected["a"] > 900, "a selected %d times", selected["a"])
+
+	// an unmeasured replica is weighted as the fastest
+	selected = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		selected[rs.Select(append(addrs, "c"))]++
+	}
+	assert.True(t, selected["c"] > 400, "c selected %d times", selected["c"])
+
+	// replicas which have left the topology are forgotten, also when wrapped
+	ls := rs.(*latencyReplicaSelector)
+	syncReplicaSelector(PreferReplicaSelector(func(string) bool { return true }, rs), map[string]bool{"a": true})
+	assert.Equal(t, map[string]time.Duration{"a": time.Millisecond}, ls.latencies)
+}
+
+func TestSubnetReplicaSelector(t *T) {
+	_, subnet, err := net.ParseCIDR("10.0.1.0/24")
+	require.Nil(t, err)
+	rs := SubnetReplicaSelector(RoundRobinReplicaSelector(), subnet)
+
+	addrs := []string{"10.0.0.1:6379", "10.0.1.1:6379", "10.0.1.2:6379"}
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, rs.Select(addrs))
+	}
+	assert.Equal(t, []string{"10.0.1.1:6379", "10.0.1.2:6379", "10.0.1.1:6379", "10.0.1.2:6379"}, got)
+
+	// if none are in the subnet all are selected from
+	assert.Equal(t, "10.0.0.1:6379", rs.Select([]string{"10.0.0.1:6379", "10.0.0.2:6379"}))
+}
@@ -0,0 +1,1898 @@
+// Package resp3 implements the RESP3 protocol, the successor to the original
+// RESP protocol (see the resp2 package), which redis 6 and up will speak once a
+// connection has been switched over to it using the HELLO command. RESP3 adds a
+// number of new types, such as maps, sets, doubles and booleans, so that
+// replies no longer need to be flattened into arrays of strings.
+//
+// The RESP3 types are a superset of the RESP2 types, and all of the
+// unmarshaling logic in this package will also accept RESP2 messages.
+//
+// Streamed strings and aggregates are not supported, since redis never sends
+// them.
+//
+// See https://github.com/antirez/RESP3/blob/master/spec.md for more details on
+// the protocol.
+package resp3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/internal/bytesutil"
+	"github.com/mediocregopher/radix/v3/resp"
+)
+
+var delim = []byte{'\r', '\n'}
+
+// prefix enumerates the possible RESP3 types by enumerating the different
+// prefixes a RESP3 message might start with.
+type prefix []byte
+
+// Enumeration of each of RESP3's message types, each denoted by the prefix
+// which is prepended to messages of that type.
+//
+// In order to determine the type of a message which is being written to a
+// *bufio.Reader, without actually consuming it, one can use the Peek method and
+// compare it against these values.
+var (
+	BlobStringPrefix     = []byte{'$'}
+	SimpleStringPrefix   = []byte{'+'}
+	SimpleErrorPrefix    = []byte{'-'}
+	NumberPrefix         = []byte{':'}
+	NullPrefix           = []byte{'_'}
+	DoublePrefix         = []byte{','}
+	BooleanPrefix        = []byte{'#'}
+	BlobErrorPrefix      = []byte{'!'}
+	VerbatimStringPrefix = []byte{'='}
+	BigNumberPrefix      = []byte{'('}
+
+	ArrayPrefix     = []byte{'*'}
+	MapPrefix       = []byte{'%'}
+	SetPrefix       = []byte{'~'}
+	AttributePrefix = []byte{'|'}
+	PushPrefix      = []byte{'>'}
+)
+
+// String formats a prefix into a human-readable name for the type it denotes.
+func (p prefix) String() string {
+	pStr := string(p)
+	switch pStr {
+	case string(BlobStringPrefix):
+		return "blob-string"
+	case string(SimpleStringPrefix):
+		return "simple-string"
+	case string(SimpleErrorPrefix):
+		return "simple-error"
+	case string(NumberPrefix):
+		return "number"
+	case string(NullPrefix):
+		return "null"
+	case string(DoublePrefix):
+		return "double"
+	case string(BooleanPrefix):
+		return "boolean"
+	case string(BlobErrorPrefix):
+		return "blob-error"
+	case string(VerbatimStringPrefix):
+		return "verbatim-string"
+	case string(BigNumberPrefix):
+		return "big-number"
+	case string(ArrayPrefix):
+		return "array"
+	case string(MapPrefix):
+		return "map"
+	case string(SetPrefix):
+		return "set"
+	case string(AttributePrefix):
+		return "attribute"
+	case string(PushPrefix):
+		return "push"
+	default:
+		return pStr
+	}
+}
+
+var (
+	null          = []byte("_\r\n")
+	nilBulkString = []byte("$-1\r\n")
+	nilArray      = []byte("*-1\r\n")
+	emptyArray    = []byte("*0\r\n")
+	boolTrue      = []byte("#t\r\n")
+	boolFalse     = []byte("#f\r\n")
+)
+
+var bools = [][]byte{
+	{'0'},
+	{'1'},
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type errUnexpectedPrefix struct {
+	Prefix         []byte
+	ExpectedPrefix []byte
+}
+
+func (e errUnexpectedPrefix) Error() string {
+	return fmt.Sprintf(
+		"expected prefix %q, got %q",
+		prefix(e.ExpectedPrefix).String(),
+		prefix(e.Prefix).String(),
+	)
+}
+
+// discardAttribute will discard the next message off the reader if it is an
+// attribute. Attributes are sent by redis preceding the reply they describe,
+// and are not needed for anything in this package.
+func discardAttribute(br *bufio.Reader) error {
+	b, err := br.Peek(len(AttributePrefix))
+	if err != nil {
+		return err
+	} else if !bytes.Equal(b, AttributePrefix) {
+		return nil
+	}
+
+	var ah AttributeHeader
+	if err := ah.UnmarshalRESP(br); err != nil {
+		return err
+	}
+	return discardMulti(br, ah.N*2)
+}
+
+// peekAndAssertPrefix will peek at the next incoming redis message and assert
+// that it is of the type identified by the given RESP3 prefix. Any attribute
+// preceding the message is discarded first.
+//
+// If the message is a RESP3 error (and that wasn't the intended prefix) then it
+// will be unmarshaled into a SimpleError or BlobError and returned. If the
+// message is of any other type (that isn't the intended prefix) it will be
+// discarded and errUnexpectedPrefix will be returned.
+func peekAndAssertPrefix(br *bufio.Reader, expectedPrefix []byte) error {
+	if !bytes.Equal(expectedPrefix, AttributePrefix) {
+		if err := discardAttribute(br); err != nil {
+			return err
+		}
+	}
+
+	b, err := br.Peek(len(expectedPrefix))
+	if err != nil {
+		return err
+	} else if bytes.Equal(b, expectedPrefix) {
+		return nil
+	} else if bytes.Equal(b, SimpleErrorPrefix) {
+		var respErr SimpleError
+		if err := respErr.UnmarshalRESP(br); err != nil {
+			return err
+		}
+		return resp.ErrDiscarded{Err: respErr}
+	} else if bytes.Equal(b, BlobErrorPrefix) {
+		var respErr BlobError
+		if err := respErr.UnmarshalRESP(br); err != nil {
+			return err
+		}
+		return resp.ErrDiscarded{Err: respErr}
+	}
+
+	// copy the prefix, since discarding the message will overwrite the peeked
+	// bytes
+	b = append([]byte(nil), b...)
+	if err := (Any{}).UnmarshalRESP(br); err != nil {
+		return err
+	}
+	return resp.ErrDiscarded{Err: errUnexpectedPrefix{
+		Prefix:         b,
+		ExpectedPrefix: expectedPrefix,
+	}}
+}
+
+// like peekAndAssertPrefix, but will consume the prefix if it is the correct
+// one as well.
+func assertBufferedPrefix(br *bufio.Reader, pref []byte) error {
+	if err := peekAndAssertPrefix(br, pref); err != nil {
+		return err
+	}
+	_, err := br.Discard(len(pref))
+	return err
+}
+
+// peekNull returns true and consumes the next message if it is a null, either
+// the RESP3 null or one of the RESP2 nil values.
+func peekNull(br *bufio.Reader) (bool, error) {
+	if err := discardAttribute(br); err != nil {
+		return false, err
+	}
+
+	b, err := br.Peek(len(null))
+	if err != nil {
+		// the message might legitimately be shorter than a null, let the
+		// caller deal with it
+		if len(b) == 0 {
+			return false, err
+		}
+		return false, nil
+	} else if bytes.Equal(b, null) {
+		_, err := br.Discard(len(null))
+		return true, err
+	} else if b[0] != BlobStringPrefix[0] && b[0] != ArrayPrefix[0] {
+		return false, nil
+	}
+
+	if b, _ := br.Peek(len(nilBulkString)); bytes.Equal(b, nilBulkString) || bytes.Equal(b, nilArray) {
+		_, err := br.Discard(len(nilBulkString))
+		return true, err
+	}
+	return false, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func marshalLine(w io.Writer, pref []byte, body string) error {
+	scratch := bytesutil.GetBytes()
+	*scratch = append(*scratch, pref...)
+	*scratch = append(*scratch, body...)
+	*scratch = append(*scratch, delim...)
+	_, err := w.Write(*scratch)
+	bytesutil.PutBytes(scratch)
+	return err
+}
+
+func marshalInt(w io.Writer, pref []byte, n int64) error {
+	scratch := bytesutil.GetBytes()
+	*scratch = append(*scratch, pref...)
+	*scratch = strconv.AppendInt(*scratch, n, 10)
+	*scratch = append(*scratch, delim...)
+	_, err := w.Write(*scratch)
+	bytesutil.PutBytes(scratch)
+	return err
+}
+
+func marshalBlob(w io.Writer, pref []byte, b []byte) error {
+	scratch := bytesutil.GetBytes()
+	*scratch = append(*scratch, pref...)
+	*scratch = strconv.AppendInt(*scratch, int64(len(b)), 10)
+	*scratch = append(*scratch, delim...)
+	*scratch = append(*scratch, b...)
+	*scratch = append(*scratch, delim...)
+	_, err := w.Write(*scratch)
+	bytesutil.PutBytes(scratch)
+	return err
+}
+
+// unmarshalBlob reads a blob message of the given prefix, appending its body
+// to the given byte slice. If the message is the RESP2 nil bulk string then nil
+// is returned.
+func unmarshalBlob(br *bufio.Reader, pref, b []byte) ([]byte, error) {
+	if err := assertBufferedPrefix(br, pref); err != nil {
+		return nil, err
+	}
+	n, err := bytesutil.BufferedIntDelim(br)
+	if err != nil {
+		return nil, err
+	} else if n == -1 {
+		return nil, nil
+	}
+
+	if b, err = bytesutil.ReadNAppend(br, b, int(n)); err != nil {
+		return nil, err
+	} else if _, err := bytesutil.BufferedBytesDelim(br); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SimpleString represents the simple string type in the RESP3 protocol
+type SimpleString struct {
+	S string
+}
+
+// MarshalRESP implements the Marshaler method
+func (ss SimpleString) MarshalRESP(w io.Writer) error {
+	return marshalLine(w, SimpleStringPrefix, ss.S)
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (ss *SimpleString) UnmarshalRESP(br *bufio.Reader) error {
+	if err := assertBufferedPrefix(br, SimpleStringPrefix); err != nil {
+		return err
+	}
+	b, err := bytesutil.BufferedBytesDelim(br)
+	if err != nil {
+		return err
+	}
+
+	ss.S = string(b)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SimpleError represents the simple error type in the RESP3 protocol, which is
+// the same as the error type in the RESP2 protocol. Note that this only
+// represents an actual error message being read/written on the stream, it is
+// separate from network or parsing errors. An E value of nil is equivalent to
+// an empty error string.
+type SimpleError struct {
+	E error
+}
+
+func (e SimpleError) Error() string {
+	return e.E.Error()
+}
+
+// MarshalRESP implements the Marshaler method
+func (e SimpleError) MarshalRESP(w io.Writer) error {
+	var s string
+	if e.E != nil {
+		s = e.E.Error()
+	}
+	return marshalLine(w, SimpleErrorPrefix, s)
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (e *SimpleError) UnmarshalRESP(br *bufio.Reader) error {
+	if err := assertBufferedPrefix(br, SimpleErrorPrefix); err != nil {
+		return err
+	}
+	b, err := bytesutil.BufferedBytesDelim(br)
+	e.E = errors.New(string(b))
+	return err
+}
+
+// As implements the method for the (x)errors.As function.
+func (e SimpleError) As(target interface{}) bool {
+	switch targetT := target.(type) {
+	case *resp.ErrDiscarded:
+		targetT.Err = e
+		return true
+	default:
+		return false
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// BlobError represents the blob error type in the RESP3 protocol. It is like
+// SimpleError, but is binary safe. An E value of nil is equivalent to an empty
+// error string.
+type BlobError struct {
+	E error
+}
+
+func (e BlobError) Error() string {
+	return e.E.Error()
+}
+
+// MarshalRESP implements the Marshaler method
+func (e BlobError) MarshalRESP(w io.Writer) error {
+	scratch := bytesutil.GetBytes()
+	defer bytesutil.PutBytes(scratch)
+	if e.E != nil {
+		*scratch = append(*scratch, e.E.Error()...)
+	}
+	return marshalBlob(w, BlobErrorPrefix, *scratch)
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (e *BlobError) UnmarshalRESP(br *bufio.Reader) error {
+	scratch := bytesutil.GetBytes()
+	defer bytesutil.PutBytes(scratch)
+	b, err := unmarshalBlob(br, BlobErrorPrefix, *scratch)
+	if err != nil {
+		return err
+	}
+	e.E = errors.New(string(b))
+	return nil
+}
+
+// As implements the method for the (x)errors.As function.
+func (e BlobError) As(target interface{}) bool {
+	switch targetT := target.(type) {
+	case *resp.ErrDiscarded:
+		targetT.Err = e
+		return true
+	default:
+		return false
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Number represents the number type in the RESP3 protocol, which is the same
+// as the integer type in the RESP2 protocol.
+type Number struct {
+	N int64
+}
+
+// MarshalRESP implements the Marshaler method
+func (n Number) MarshalRESP(w io.Writer) error {
+	return marshalInt(w, NumberPrefix, n.N)
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (n *Number) UnmarshalRESP(br *bufio.Reader) error {
+	if err := assertBufferedPrefix(br, NumberPrefix); err != nil {
+		return err
+	}
+	i, err := bytesutil.BufferedIntDelim(br)
+	n.N = i
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Null represents the null type in the RESP3 protocol. When unmarshaling the
+// RESP2 nil bulk string and nil array messages are accepted as well.
+type Null struct{}
+
+// MarshalRESP implements the Marshaler method
+func (Null) MarshalRESP(w io.Writer) error {
+	_, err := w.Write(null)
+	return err
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (*Null) UnmarshalRESP(br *bufio.Reader) error {
+	if ok, err := peekNull(br); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+	return assertBufferedPrefix(br, NullPrefix)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Double represents the double type in the RESP3 protocol. Positive and
+// negative infinity and NaN are all supported.
+type Double struct {
+	F float64
+}
+
+// MarshalRESP implements the Marshaler method
+func (d Double) MarshalRESP(w io.Writer) error {
+	scratch := bytesutil.GetBytes()
+	*scratch = append(*scratch, DoublePrefix...)
+	switch {
+	case math.IsInf(d.F, 1):
+		*scratch = append(*scratch, "inf"...)
+	case math.IsInf(d.F, -1):
+		*scratch = append(*scratch, "-inf"...)
+	case math.IsNaN(d.F):
+		*scratch = append(*scratch, "nan"...)
+	default:
+		*scratch = strconv.AppendFloat(*scratch, d.F, 'f', -1, 64)
+	}
+	*scratch = append(*scratch, delim...)
+	_, err := w.Write(*scratch)
+	bytesutil.PutBytes(scratch)
+	return err
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (d *Double) UnmarshalRESP(br *bufio.Reader) error {
+	if err := assertBufferedPrefix(br, DoublePrefix); err != nil {
+		return err
+	}
+	b, err := bytesutil.BufferedBytesDelim(br)
+	if err != nil {
+		return err
+	}
+	d.F, err = strconv.ParseFloat(string(b), 64)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Boolean represents the boolean type in the RESP3 protocol.
+type Boolean struct {
+	B bool
+}
+
+// MarshalRESP implements the Marshaler method
+func (b Boolean) MarshalRESP(w io.Writer) error {
+	bb := boolFalse
+	if b.B {
+		bb = boolTrue
+	}
+	_, err := w.Write(bb)
+	return err
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (b *Boolean) UnmarshalRESP(br *bufio.Reader) error {
+	if err := assertBufferedPrefix(br, BooleanPrefix); err != nil {
+		return err
+	}
+	body, err := bytesutil.BufferedBytesDelim(br)
+	if err != nil {
+		return err
+	}
+	switch string(body) {
+	case "t":
+		b.B = true
+	case "f":
+		b.B = false
+	default:
+		return errors.Errorf("invalid boolean value %q", body)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// BigNumber represents the big number type in the RESP3 protocol. An I value of
+// nil is equivalent to zero.
+type BigNumber struct {
+	I *big.Int
+}
+
+// MarshalRESP implements the Marshaler method
+func (b BigNumber) MarshalRESP(w io.Writer) error {
+	scratch := bytesutil.GetBytes()
+	*scratch = append(*scratch, BigNumberPrefix...)
+	if b.I == nil {
+		*scratch = append(*scratch, '0')
+	} else {
+		*scratch = b.I.Append(*scratch, 10)
+	}
+	*scratch = append(*scratch, delim...)
+	_, err := w.Write(*scratch)
+	bytesutil.PutBytes(scratch)
+	return err
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (b *BigNumber) UnmarshalRESP(br *bufio.Reader) error {
+	if err := assertBufferedPrefix(br, BigNumberPrefix); err != nil {
+		return err
+	}
+	body, err := bytesutil.BufferedBytesDelim(br)
+	if err != nil {
+		return err
+	}
+
+	if b.I == nil {
+		b.I = new(big.Int)
+	}
+	if _, ok := b.I.SetString(string(body), 10); !ok {
+		return errors.Errorf("invalid big number value %q", body)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// BlobStringBytes represents the blob string type in the RESP3 protocol using
+// a go byte slice. A B value of nil indicates the null message, versus a B
+// value of []byte{} which indicates a blob string of length 0.
+//
+// When unmarshaling the null message and the RESP2 nil bulk string are both
+// accepted, and will set B to nil.
+type BlobStringBytes struct {
+	B []byte
+
+	// If true then this won't marshal the null RESP3 value when B is nil, it
+	// will marshal as an empty string instead
+	MarshalNotNull bool
+}
+
+// MarshalRESP implements the Marshaler method
+func (b BlobStringBytes) MarshalRESP(w io.Writer) error {
+	if b.B == nil && !b.MarshalNotNull {
+		_, err := w.Write(null)
+		return err
+	}
+	return marshalBlob(w, BlobStringPrefix, b.B)
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (b *BlobStringBytes) UnmarshalRESP(br *bufio.Reader) error {
+	if ok, err := peekNull(br); err != nil {
+		return err
+	} else if ok {
+		b.B = nil
+		return nil
+	}
+
+	bb, err := unmarshalBlob(br, BlobStringPrefix, b.B[:0])
+	if err != nil {
+		return err
+	} else if bb == nil {
+		bb = []byte{}
+	}
+	b.B = bb
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// BlobString represents the blob string type in the RESP3 protocol using a go
+// string.
+type BlobString struct {
+	S string
+}
+
+// MarshalRESP implements the Marshaler method
+func (b BlobString) MarshalRESP(w io.Writer) error {
+	scratch := bytesutil.GetBytes()
+	defer bytesutil.PutBytes(scratch)
+	*scratch = append(*scratch, b.S...)
+	return marshalBlob(w, BlobStringPrefix, *scratch)
+}
+
+// UnmarshalRESP implements the Unmarshaler method. This treats a null message
+// as empty string.
+func (b *BlobString) UnmarshalRESP(br *bufio.Reader) error {
+	if ok, err := peekNull(br); err != nil {
+		return err
+	} else if ok {
+		b.S = ""
+		return nil
+	}
+
+	scratch := bytesutil.GetBytes()
+	defer bytesutil.PutBytes(scratch)
+	bb, err := unmarshalBlob(br, BlobStringPrefix, *scratch)
+	if err != nil {
+		return err
+	}
+	b.S = string(bb)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// BlobReader is like BlobString, but it only supports marshalling and will use
+// the given LenReader to do so. If LR is nil then the null RESP3 message will
+// be written.
+type BlobReader struct {
+	LR resp.LenReader
+}
+
+// MarshalRESP implements the Marshaler method
+func (b BlobReader) MarshalRESP(w io.Writer) error {
+	if b.LR == nil {
+		_, err := w.Write(null)
+		return err
+	}
+
+	l := b.LR.Len()
+	if err := marshalInt(w, BlobStringPrefix, l); err != nil {
+		return err
+	} else if _, err := io.CopyN(w, b.LR, l); err != nil {
+		return err
+	} else if _, err := w.Write(delim); err != nil {
+		return err
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// VerbatimString represents the verbatim string type in the RESP3 protocol. A
+// verbatim string is a blob string which also declares the format of its
+// contents, e.g. "txt" or "mkd". Format must be exactly three characters long,
+// and will default to "txt" if empty.
+type VerbatimString struct {
+	Format string
+	S      string
+}
+
+// MarshalRESP implements the Marshaler method
+func (v VerbatimString) MarshalRESP(w io.Writer) error {
+	format := v.Format
+	if format == "" {
+		format = "txt"
+	} else if len(format) != 3 {
+		return errors.Errorf("invalid verbatim string format %q", format)
+	}
+
+	scratch := bytesutil.GetBytes()
+	defer bytesutil.PutBytes(scratch)
+	*scratch = append(*scratch, format...)
+	*scratch = append(*scratch, ':')
+	*scratch = append(*scratch, v.S...)
+	return marshalBlob(w, VerbatimStringPrefix, *scratch)
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (v *VerbatimString) UnmarshalRESP(br *bufio.Reader) error {
+	scratch := bytesutil.GetBytes()
+	defer bytesutil.PutBytes(scratch)
+	b, err := unmarshalBlob(br, VerbatimStringPrefix, *scratch)
+	if err != nil {
+		return err
+	} else if len(b) < 4 || b[3] != ':' {
+		return errors.Errorf("malformed verbatim string %q", b)
+	}
+	v.Format, v.S = string(b[:3]), string(b[4:])
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ArrayHeader represents the header sent preceding array elements in the RESP3
+// protocol. It does not actually encompass any elements itself, it only
+// declares how many elements will come after it.
+//
+// An N of -1 may also be used to indicate the RESP2 nil array.
+type ArrayHeader struct {
+	N int
+}
+
+// MarshalRESP implements the Marshaler method
+func (ah ArrayHeader) MarshalRESP(w io.Writer) error {
+	return marshalInt(w, ArrayPrefix, int64(ah.N))
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (ah *ArrayHeader) UnmarshalRESP(br *bufio.Reader) error {
+	n, err := unmarshalHeader(br, ArrayPrefix)
+	ah.N = n
+	return err
+}
+
+// MapHeader represents the header sent preceding map elements in the RESP3
+// protocol. It does not actually encompass any elements itself, it only
+// declares how many key/value pairs will come after it.
+type MapHeader struct {
+	N int
+}
+
+// MarshalRESP implements the Marshaler method
+func (mh MapHeader) MarshalRESP(w io.Writer) error {
+	return marshalInt(w, MapPrefix, int64(mh.N))
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (mh *MapHeader) UnmarshalRESP(br *bufio.Reader) error {
+	n, err := unmarshalHeader(br, MapPrefix)
+	mh.N = n
+	return err
+}
+
+// SetHeader represents the header sent preceding set elements in the RESP3
+// protocol. It does not actually encompass any elements itself, it only
+// declares how many elements will come after it.
+type SetHeader struct {
+	N int
+}
+
+// MarshalRESP implements the Marshaler method
+func (sh SetHeader) MarshalRESP(w io.Writer) error {
+	return marshalInt(w, SetPrefix, int64(sh.N))
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (sh *SetHeader) UnmarshalRESP(br *bufio.Reader) error {
+	n, err := unmarshalHeader(br, SetPrefix)
+	sh.N = n
+	return err
+}
+
+// AttributeHeader represents the header sent preceding attribute elements in
+// the RESP3 protocol. It does not actually encompass any elements itself, it
+// only declares how many key/value pairs will come after it.
+//
+// An attribute is always followed by the reply it describes. All unmarshaling
+// in this package, other than AttributeHeader's, will skip over attributes.
+type AttributeHeader struct {
+	N int
+}
+
+// MarshalRESP implements the Marshaler method
+func (ah AttributeHeader) MarshalRESP(w io.Writer) error {
+	return marshalInt(w, AttributePrefix, int64(ah.N))
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (ah *AttributeHeader) UnmarshalRESP(br *bufio.Reader) error {
+	n, err := unmarshalHeader(br, AttributePrefix)
+	ah.N = n
+	return err
+}
+
+// PushHeader represents the header sent preceding push elements in the RESP3
+// protocol. It does not actually encompass any elements itself, it only
+// declares how many elements will come after it.
+//
+// Push messages are sent by redis out-of-band, i.e. not in response to any
+// particular command, e.g. for pubsub messages and client side caching
+// invalidations. The first element of a push message is always a string
+// denoting its kind.
+type PushHeader struct {
+	N int
+}
+
+// MarshalRESP implements the Marshaler method
+func (ph PushHeader) MarshalRESP(w io.Writer) error {
+	return marshalInt(w, PushPrefix, int64(ph.N))
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (ph *PushHeader) UnmarshalRESP(br *bufio.Reader) error {
+	n, err := unmarshalHeader(br, PushPrefix)
+	ph.N = n
+	return err
+}
+
+func unmarshalHeader(br *bufio.Reader, pref []byte) (int, error) {
+	if err := assertBufferedPrefix(br, pref); err != nil {
+		return 0, err
+	}
+	n, err := bytesutil.BufferedIntDelim(br)
+	return int(n), err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func discardMulti(br *bufio.Reader, l int) error {
+	for i := 0; i < l; i++ {
+		if err := (Any{}).UnmarshalRESP(br); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func discardMultiAfterErr(br *bufio.Reader, left int, err error) error {
+	// if the last error which occurred didn't discard the message it was on, we
+	// can't do anything
+	if !errors.As(err, new(resp.ErrDiscarded)) {
+		return err
+	} else if err := discardMulti(br, left); err != nil {
+		return err
+	}
+
+	// The original error was already wrapped in an ErrDiscarded, so just return
+	// it as it was given
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Any represents any primitive go type, such as integers, floats, strings,
+// bools, etc... It also includes encoding.Text(Un)Marshalers and
+// encoding.(Un)BinaryMarshalers. It will _not_ marshal resp.Marshalers.
+//
+// Most things will be marshaled as blob strings, except for those that have
+// their own corresponding type in the RESP3 protocol (e.g. ints, floats, bools
+// and *big.Ints). strings and []bytes will always be encoded as blob strings,
+// never simple strings.
+//
+// Arrays and slices will be marshaled as RESP3 arrays, and maps and structs as
+// RESP3 maps, and their values will be treated as if also wrapped in an Any
+// struct. Maps whose value type is struct{} will be marshaled as RESP3 sets of
+// their keys. Structs follow the same field rules as they do in resp2.Any.
+//
+// When using UnmarshalRESP the value of I must be a pointer or nil. If it is
+// nil then the RESP3 value will be read and discarded. Aggregate types can be
+// unmarshaled into slices, maps and structs. Maps unmarshaled into slices will
+// be flattened into alternating keys and values, and arrays unmarshaled into
+// maps or structs must consist of alternating keys and values, just as in
+// resp2.Any. Sets may also be unmarshaled into maps whose value type is
+// struct{} or bool. Attributes are always discarded.
+//
+// If an error type is read in the UnmarshalRESP method then a SimpleError or
+// BlobError will be returned with that error, and the value of I won't be
+// touched.
+type Any struct {
+	I interface{}
+
+	// If true then the MarshalRESP method will marshal all non-aggregate types
+	// as blob strings. This primarily effects numbers, doubles, booleans and
+	// errors.
+	MarshalBlobString bool
+
+	// If true then no aggregate headers will be sent when MarshalRESP is
+	// called. For I values which are non-aggregates this means no behavior
+	// change. For aggregates and embedded aggregates it means only the
+	// elements (or keys and values) will be written, and a header must have
+	// been manually marshalled beforehand.
+	MarshalNoAggHeaders bool
+}
+
+func (a Any) cp(i interface{}) Any {
+	a.I = i
+	return a
+}
+
+var (
+	byteSliceT = reflect.TypeOf([]byte{})
+	emptyT     = reflect.TypeOf(struct{}{})
+	boolT      = reflect.TypeOf(false)
+)
+
+// MarshalRESP implements the Marshaler method
+func (a Any) MarshalRESP(w io.Writer) error {
+	marshalBlobStr := func(b []byte) error {
+		bs := BlobStringBytes{B: b, MarshalNotNull: a.MarshalBlobString}
+		return bs.MarshalRESP(w)
+	}
+
+	switch at := a.I.(type) {
+	case []byte:
+		return marshalBlobStr(at)
+	case string:
+		if at == "" {
+			// special case, we never want string to be null, but appending
+			// empty string to a nil []byte would still be a null
+			return BlobStringBytes{MarshalNotNull: true}.MarshalRESP(w)
+		}
+		scratch := bytesutil.GetBytes()
+		defer bytesutil.PutBytes(scratch)
+		*scratch = append(*scratch, at...)
+		return marshalBlobStr(*scratch)
+	case bool:
+		if a.MarshalBlobString {
+			b := bools[0]
+			if at {
+				b = bools[1]
+			}
+			return marshalBlobStr(b)
+		}
+		return Boolean{B: at}.MarshalRESP(w)
+	case float32:
+		if a.MarshalBlobString {
+			scratch := bytesutil.GetBytes()
+			defer bytesutil.PutBytes(scratch)
+			*scratch = strconv.AppendFloat(*scratch, float64(at), 'f', -1, 32)
+			return marshalBlobStr(*scratch)
+		}
+		return Double{F: float64(at)}.MarshalRESP(w)
+	case float64:
+		if a.MarshalBlobString {
+			scratch := bytesutil.GetBytes()
+			defer bytesutil.PutBytes(scratch)
+			*scratch = strconv.AppendFloat(*scratch, at, 'f', -1, 64)
+			return marshalBlobStr(*scratch)
+		}
+		return Double{F: at}.MarshalRESP(w)
+	case nil:
+		if a.MarshalBlobString {
+			return marshalBlobStr(nil)
+		}
+		return Null{}.MarshalRESP(w)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		at64 := bytesutil.AnyIntToInt64(at)
+		if a.MarshalBlobString {
+			scratch := bytesutil.GetBytes()
+			defer bytesutil.PutBytes(scratch)
+			*scratch = strconv.AppendInt(*scratch, at64, 10)
+			return marshalBlobStr(*scratch)
+		}
+		return Number{N: at64}.MarshalRESP(w)
+	case *big.Int:
+		if a.MarshalBlobString {
+			scratch := bytesutil.GetBytes()
+			defer bytesutil.PutBytes(scratch)
+			*scratch = at.Append(*scratch, 10)
+			return marshalBlobStr(*scratch)
+		}
+		return BigNumber{I: at}.MarshalRESP(w)
+	case error:
+		if a.MarshalBlobString {
+			scratch := bytesutil.GetBytes()
+			defer bytesutil.PutBytes(scratch)
+			*scratch = append(*scratch, at.Error()...)
+			return marshalBlobStr(*scratch)
+		} else if strings.ContainsAny(at.Error(), "\r\n") {
+			return BlobError{E: at}.MarshalRESP(w)
+		}
+		return SimpleError{E: at}.MarshalRESP(w)
+	case resp.LenReader:
+		return BlobReader{LR: at}.MarshalRESP(w)
+	case encoding.TextMarshaler:
+		b, err := at.MarshalText()
+		if err != nil {
+			return err
+		}
+		return marshalBlobStr(b)
+	case encoding.BinaryMarshaler:
+		b, err := at.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return marshalBlobStr(b)
+	}
+
+	// now we use.... reflection! duhduhduuuuh....
+	vv := reflect.ValueOf(a.I)
+
+	// if it's a pointer we de-reference and try the pointed to value directly
+	if vv.Kind() == reflect.Ptr {
+		var ivv reflect.Value
+		if vv.IsNil() {
+			ivv = reflect.New(vv.Type().Elem())
+		} else {
+			ivv = reflect.Indirect(vv)
+		}
+		return a.cp(ivv.Interface()).MarshalRESP(w)
+	}
+
+	// some helper functions
+	var err error
+	aggHeader := func(m resp.Marshaler) {
+		if a.MarshalNoAggHeaders || err != nil {
+			return
+		}
+		err = m.MarshalRESP(w)
+	}
+	aggVal := func(v interface{}) {
+		if err != nil {
+			return
+		}
+		err = a.cp(v).MarshalRESP(w)
+	}
+
+	switch vv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if vv.Kind() == reflect.Slice && vv.IsNil() && !a.MarshalNoAggHeaders {
+			return Null{}.MarshalRESP(w)
+		}
+		l := vv.Len()
+		aggHeader(ArrayHeader{N: l})
+		for i := 0; i < l; i++ {
+			aggVal(vv.Index(i).Interface())
+		}
+
+	case reflect.Map:
+		if vv.IsNil() && !a.MarshalNoAggHeaders {
+			return Null{}.MarshalRESP(w)
+		}
+		kkv := vv.MapKeys()
+		if vv.Type().Elem() == emptyT {
+			aggHeader(SetHeader{N: len(kkv)})
+			for _, kv := range kkv {
+				aggVal(kv.Interface())
+			}
+			break
+		}
+		aggHeader(MapHeader{N: len(kkv)})
+		for _, kv := range kkv {
+			aggVal(kv.Interface())
+			aggVal(vv.MapIndex(kv).Interface())
+		}
+
+	case reflect.Struct:
+		return a.marshalStruct(w, vv, false)
+
+	default:
+		return errors.Errorf("could not marshal value of type %T", a.I)
+	}
+
+	return err
+}
+
+func numFieldsStruct(vv reflect.Value) int {
+	tt := vv.Type()
+	l := vv.NumField()
+	var c int
+	for i := 0; i < l; i++ {
+		ft, fv := tt.Field(i), vv.Field(i)
+		if ft.Anonymous {
+			if fv = reflect.Indirect(fv); fv.IsValid() { // fv isn't nil
+				c += numFieldsStruct(fv)
+			}
+			continue
+		} else if ft.PkgPath != "" || ft.Tag.Get("redis") == "-" {
+			continue
+		}
+		c++
+	}
+	return c
+}
+
+func (a Any) marshalStruct(w io.Writer, vv reflect.Value, inline bool) error {
+	if !a.MarshalNoAggHeaders && !inline {
+		mh := MapHeader{N: numFieldsStruct(vv)}
+		if err := mh.MarshalRESP(w); err != nil {
+			return err
+		}
+	}
+
+	tt := vv.Type()
+	l := vv.NumField()
+	for i := 0; i < l; i++ {
+		ft, fv := tt.Field(i), vv.Field(i)
+		tag := ft.Tag.Get("redis")
+		if ft.Anonymous {
+			if fv = reflect.Indirect(fv); !fv.IsValid() { // fv is nil
+				continue
+			} else if err := a.marshalStruct(w, fv, true); err != nil {
+				return err
+			}
+			continue
+		} else if ft.PkgPath != "" || tag == "-" {
+			continue // unexported
+		}
+
+		keyName := ft.Name
+		if tag != "" {
+			keyName = tag
+		}
+		if err := (BlobString{S: keyName}).MarshalRESP(w); err != nil {
+			return err
+		} else if err := a.cp(fv.Interface()).MarshalRESP(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saneDefault(prefix byte) interface{} {
+	// we don't handle the error prefixes because those always return an error
+	// and don't touch I, nor null or big numbers, which are handled by
+	// UnmarshalRESP directly
+	switch prefix {
+	case ArrayPrefix[0], SetPrefix[0], PushPrefix[0]:
+		ii := make([]interface{}, 8)
+		return &ii
+	case MapPrefix[0]:
+		m := map[interface{}]interface{}{}
+		return &m
+	case BlobStringPrefix[0]:
+		bb := make([]byte, 16)
+		return &bb
+	case SimpleStringPrefix[0], VerbatimStringPrefix[0]:
+		return new(string)
+	case NumberPrefix[0]:
+		return new(int64)
+	case DoublePrefix[0]:
+		return new(float64)
+	case BooleanPrefix[0]:
+		return new(bool)
+	}
+	return nil
+}
+
+// We use pools for these even though they only get used within
+// Any.UnmarshalRESP because of how often they get used. Any return from redis
+// which has a simple string or blob string (the vast majority of them) is going
+// to go through one of these.
+var (
+	// RawMessage.UnmarshalInto also uses these
+	byteReaderPool = sync.Pool{
+		New: func() interface{} {
+			return bytes.NewReader(nil)
+		},
+	}
+	bufioReaderPool = sync.Pool{
+		New: func() interface{} {
+			return bufio.NewReader(nil)
+		},
+	}
+)
+
+// UnmarshalRESP implements the Unmarshaler method
+func (a Any) UnmarshalRESP(br *bufio.Reader) error {
+	// if I is itself an Unmarshaler just hit that directly
+	if u, ok := a.I.(resp.Unmarshaler); ok {
+		return u.UnmarshalRESP(br)
+	}
+
+	if err := discardAttribute(br); err != nil {
+		return err
+	}
+
+	b, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+	prefix := b[0]
+
+	// This is a super special case that _must_ be handled before we actually
+	// read from the reader. If an *interface{} is given we instead unmarshal
+	// into a default (created based on the type of th message), then set the
+	// *interface{} to that
+	if ai, ok := a.I.(*interface{}); ok {
+		switch prefix {
+		case NullPrefix[0]:
+			*ai = nil
+			return (&Null{}).UnmarshalRESP(br)
+		case BigNumberPrefix[0]:
+			var bn BigNumber
+			if err := bn.UnmarshalRESP(br); err != nil {
+				return err
+			}
+			*ai = bn.I
+			return nil
+		}
+
+		innerA := Any{I: saneDefault(prefix)}
+		if err := innerA.UnmarshalRESP(br); err != nil {
+			return err
+		}
+		if innerV := reflect.ValueOf(innerA.I).Elem(); innerV.Kind() == reflect.Slice && innerV.IsNil() {
+			// RESP2 nil values
+			*ai = nil
+		} else {
+			*ai = innerV.Interface()
+		}
+		return nil
+	}
+
+	br.Discard(1)
+	b, err = bytesutil.BufferedBytesDelim(br)
+	if err != nil {
+		return err
+	}
+
+	switch prefix {
+	case SimpleErrorPrefix[0]:
+		return SimpleError{E: errors.New(string(b))}
+	case BlobErrorPrefix[0]:
+		l, err := bytesutil.ParseInt(b)
+		if err != nil {
+			return err
+		}
+		scratch := bytesutil.GetBytes()
+		defer bytesutil.PutBytes(scratch)
+		if *scratch, err = bytesutil.ReadNAppend(br, *scratch, int(l+2)); err != nil {
+			return err
+		}
+		return BlobError{E: errors.New(string((*scratch)[:l]))}
+	case NullPrefix[0]:
+		return a.unmarshalNil()
+	case ArrayPrefix[0], SetPrefix[0], PushPrefix[0], MapPrefix[0]:
+		l, err := bytesutil.ParseInt(b)
+		if err != nil {
+			return err
+		} else if l == -1 {
+			return a.unmarshalNil()
+		} else if prefix == MapPrefix[0] {
+			l *= 2
+		}
+		return a.unmarshalAgg(br, prefix, int(l))
+	case BlobStringPrefix[0], VerbatimStringPrefix[0]:
+		l, err := bytesutil.ParseInt(b)
+		if err != nil {
+			return err
+		} else if l == -1 {
+			return a.unmarshalNil()
+		}
+
+		// verbatim strings are unmarshaled as if they were blob strings
+		// without the format
+		if prefix == VerbatimStringPrefix[0] {
+			if l < 4 {
+				return errors.Errorf("malformed verbatim string of length %d", l)
+			} else if _, err := br.Discard(4); err != nil {
+				return err
+			}
+			l -= 4
+		}
+
+		// This is a bit of a clusterfuck. Basically:
+		// - If unmarshal returns a non-Discarded error, return that asap.
+		// - If discarding the last 2 bytes (in order to discard the full
+		//   message) fails, return that asap
+		// - Otherwise return the original error, if there was any
+		if err = a.unmarshalSingle(br, int(l)); err != nil {
+			if !errors.As(err, new(resp.ErrDiscarded)) {
+				return err
+			}
+		}
+		if _, discardErr := br.Discard(2); discardErr != nil {
+			return discardErr
+		}
+		return err
+	case BooleanPrefix[0]:
+		// booleans are unmarshaled as if they were the integers 1 and 0, so
+		// that they can go into numeric types as well as bools
+		switch string(b) {
+		case "t":
+			b = bools[1]
+		case "f":
+			b = bools[0]
+		default:
+			return errors.Errorf("invalid boolean value %q", b)
+		}
+		fallthrough
+	case SimpleStringPrefix[0], NumberPrefix[0], DoublePrefix[0], BigNumberPrefix[0]:
+		reader := byteReaderPool.Get().(*bytes.Reader)
+		reader.Reset(b)
+		err := a.unmarshalSingle(reader, reader.Len())
+		byteReaderPool.Put(reader)
+		return err
+	default:
+		return errors.Errorf("unknown type prefix %q", prefix)
+	}
+}
+
+func (a Any) unmarshalSingle(body io.Reader, n int) error {
+	var (
+		err error
+		i   int64
+		ui  uint64
+	)
+
+	switch ai := a.I.(type) {
+	case nil:
+		// just read it and do nothing
+		err = bytesutil.ReadNDiscard(body, n)
+	case *string:
+		scratch := bytesutil.GetBytes()
+		*scratch, err = bytesutil.ReadNAppend(body, *scratch, n)
+		*ai = string(*scratch)
+		bytesutil.PutBytes(scratch)
+	case *[]byte:
+		*ai, err = bytesutil.ReadNAppend(body, (*ai)[:0], n)
+	case *bool:
+		ui, err = bytesutil.ReadUint(body, n)
+		*ai = ui > 0
+	case *int:
+		i, err = bytesutil.ReadInt(body, n)
+		*ai = int(i)
+	case *int8:
+		i, err = bytesutil.ReadInt(body, n)
+		*ai = int8(i)
+	case *int16:
+		i, err = bytesutil.ReadInt(body, n)
+		*ai = int16(i)
+	case *int32:
+		i, err = bytesutil.ReadInt(body, n)
+		*ai = int32(i)
+	case *int64:
+		i, err = bytesutil.ReadInt(body, n)
+		*ai = i
+	case *uint:
+		ui, err = bytesutil.ReadUint(body, n)
+		*ai = uint(ui)
+	case *uint8:
+		ui, err = bytesutil.ReadUint(body, n)
+		*ai = uint8(ui)
+	case *uint16:
+		ui, err = bytesutil.ReadUint(body, n)
+		*ai = uint16(ui)
+	case *uint32:
+		ui, err = bytesutil.ReadUint(body, n)
+		*ai = uint32(ui)
+	case *uint64:
+		ui, err = bytesutil.ReadUint(body, n)
+		*ai = ui
+	case *float32:
+		var f float64
+		f, err = bytesutil.ReadFloat(body, 32, n)
+		*ai = float32(f)
+	case *float64:
+		*ai, err = bytesutil.ReadFloat(body, 64, n)
+	case io.Writer:
+		_, err = io.CopyN(ai, body, int64(n))
+	case encoding.TextUnmarshaler:
+		scratch := bytesutil.GetBytes()
+		if *scratch, err = bytesutil.ReadNAppend(body, *scratch, n); err != nil {
+			break
+		}
+		err = ai.UnmarshalText(*scratch)
+		bytesutil.PutBytes(scratch)
+	case encoding.BinaryUnmarshaler:
+		scratch := bytesutil.GetBytes()
+		if *scratch, err = bytesutil.ReadNAppend(body, *scratch, n); err != nil {
+			break
+		}
+		err = ai.UnmarshalBinary(*scratch)
+		bytesutil.PutBytes(scratch)
+	default:
+		scratch := bytesutil.GetBytes()
+		if *scratch, err = bytesutil.ReadNAppend(body, *scratch, n); err != nil {
+			break
+		}
+		err = resp.ErrDiscarded{
+			Err: errors.Errorf("can't unmarshal into %T, message body was: %q", a.I, *scratch),
+		}
+		bytesutil.PutBytes(scratch)
+	}
+
+	return err
+}
+
+func (a Any) unmarshalNil() error {
+	vv := reflect.ValueOf(a.I)
+	if vv.Kind() != reflect.Ptr || !vv.Elem().CanSet() {
+		// If the type in I can't be set then just ignore it. This is kind of
+		// weird but it's what encoding/json does in the same circumstance
+		return nil
+	}
+
+	vve := vv.Elem()
+	vve.Set(reflect.Zero(vve.Type()))
+	return nil
+}
+
+// unmarshalAgg unmarshals an aggregate with the given prefix and l total
+// elements into I. For maps l is twice the number of key/value pairs.
+func (a Any) unmarshalAgg(br *bufio.Reader, pref byte, l int) error {
+	aggName := prefix([]byte{pref}).String()
+	if a.I == nil {
+		return discardMulti(br, l)
+	}
+
+	size := l
+	v := reflect.ValueOf(a.I)
+	if v.Kind() != reflect.Ptr {
+		err := resp.ErrDiscarded{
+			Err: errors.Errorf("can't unmarshal %s into %T", aggName, a.I),
+		}
+		return discardMultiAfterErr(br, l, err)
+	}
+	v = reflect.Indirect(v)
+
+	switch v.Kind() {
+	case reflect.Slice:
+		if size > v.Cap() || v.IsNil() {
+			newV := reflect.MakeSlice(v.Type(), size, size)
+			// we copy only because there might be some preset values in there
+			// already that we're intended to decode into,
+			// e.g.  []interface{}{int8(0), ""}
+			reflect.Copy(newV, v)
+			v.Set(newV)
+		} else if size != v.Len() {
+			v.SetLen(size)
+		}
+
+		for i := 0; i < size; i++ {
+			ai := Any{I: v.Index(i).Addr().Interface()}
+			if err := ai.UnmarshalRESP(br); err != nil {
+				return discardMultiAfterErr(br, l-i-1, err)
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		elemT := v.Type().Elem()
+		if pref == SetPrefix[0] && (elemT == emptyT || elemT == boolT) {
+			return a.unmarshalSet(br, v, l)
+		} else if size%2 != 0 {
+			err := resp.ErrDiscarded{Err: errors.Errorf("cannot decode %s with odd number of elements into map", aggName)}
+			return discardMultiAfterErr(br, l, err)
+		} else if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), size/2))
+		}
+
+		var kvs reflect.Value
+		if size > 0 && canShareReflectValue(v.Type().Key()) {
+			kvs = reflect.New(v.Type().Key())
+		}
+
+		var vvs reflect.Value
+		if size > 0 && canShareReflectValue(elemT) {
+			vvs = reflect.New(elemT)
+		}
+
+		for i := 0; i < size; i += 2 {
+			kv := kvs
+			if !kv.IsValid() {
+				kv = reflect.New(v.Type().Key())
+			}
+			if err := (Any{I: kv.Interface()}).UnmarshalRESP(br); err != nil {
+				return discardMultiAfterErr(br, l-i-1, err)
+			} else if err := hashableKey(kv, aggName); err != nil {
+				return discardMultiAfterErr(br, l-i-1, err)
+			}
+
+			vv := vvs
+			if !vv.IsValid() {
+				vv = reflect.New(elemT)
+			}
+			if err := (Any{I: vv.Interface()}).UnmarshalRESP(br); err != nil {
+				return discardMultiAfterErr(br, l-i-2, err)
+			}
+
+			v.SetMapIndex(kv.Elem(), vv.Elem())
+		}
+		return nil
+
+	case reflect.Struct:
+		if size%2 != 0 {
+			err := resp.ErrDiscarded{Err: errors.Errorf("cannot decode %s with odd number of elements into struct", aggName)}
+			return discardMultiAfterErr(br, l, err)
+		}
+
+		structFields := getStructFields(v.Type())
+		var field []byte
+
+		for i := 0; i < size; i += 2 {
+			if err := (Any{I: &field}).UnmarshalRESP(br); err != nil {
+				return discardMultiAfterErr(br, l-i-1, err)
+			}
+
+			var vv reflect.Value
+			structField, ok := structFields[string(field)] // no allocation, since Go 1.3
+			if ok {
+				vv = getStructField(v, structField.indices)
+			}
+
+			if !ok || !vv.IsValid() {
+				// discard the value
+				if err := (Any{}).UnmarshalRESP(br); err != nil {
+					return discardMultiAfterErr(br, l-i-2, err)
+				}
+				continue
+			}
+
+			if err := (Any{I: vv.Interface()}).UnmarshalRESP(br); err != nil {
+				return discardMultiAfterErr(br, l-i-2, err)
+			}
+		}
+
+		return nil
+
+	default:
+		err := resp.ErrDiscarded{Err: errors.Errorf("cannot decode %s into %v", aggName, v.Type())}
+		return discardMultiAfterErr(br, l, err)
+	}
+}
+
+// unmarshalSet unmarshals l set elements as the keys of the map v, whose value
+// type is either struct{} or bool.
+func (a Any) unmarshalSet(br *bufio.Reader, v reflect.Value, l int) error {
+	aggName := prefix(SetPrefix).String()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(v.Type(), l))
+	}
+
+	elem := reflect.Zero(v.Type().Elem())
+	if v.Type().Elem() == boolT {
+		elem = reflect.ValueOf(true)
+	}
+
+	for i := 0; i < l; i++ {
+		kv := reflect.New(v.Type().Key())
+		if err := (Any{I: kv.Interface()}).UnmarshalRESP(br); err != nil {
+			return discardMultiAfterErr(br, l-i-1, err)
+		} else if err := hashableKey(kv, aggName); err != nil {
+			return discardMultiAfterErr(br, l-i-1, err)
+		}
+		v.SetMapIndex(kv.Elem(), elem)
+	}
+	return nil
+}
+
+// hashableKey takes a pointer to a map key which has been unmarshaled into,
+// and if it's an interface{} holding a []byte converts that to a string, so it
+// can be used as a map key. If the key is an interface{} holding some other
+// value which can't be used as a map key, e.g. because it was an aggregate, an
+// ErrDiscarded is returned.
+func hashableKey(kv reflect.Value, aggName string) error {
+	kve := kv.Elem()
+	if kve.Kind() != reflect.Interface || kve.IsNil() {
+		return nil
+	} else if b, ok := kve.Interface().([]byte); ok {
+		kve.Set(reflect.ValueOf(string(b)))
+	} else if !kve.Elem().Type().Comparable() {
+		return resp.ErrDiscarded{
+			Err: errors.Errorf("cannot decode %s with key of type %v into map", aggName, kve.Elem().Type()),
+		}
+	}
+	return nil
+}
+
+func canShareReflectValue(ty reflect.Type) bool {
+	switch ty.Kind() {
+	case reflect.Bool,
+		reflect.Int,
+		reflect.Int8,
+		reflect.Int16,
+		reflect.Int32,
+		reflect.Int64,
+		reflect.Uint,
+		reflect.Uint8,
+		reflect.Uint16,
+		reflect.Uint32,
+		reflect.Uint64,
+		reflect.Uintptr,
+		reflect.Float32,
+		reflect.Float64,
+		reflect.Complex64,
+		reflect.Complex128,
+		reflect.String:
+		return true
+	default:
+		return false
+	}
+}
+
+type structField struct {
+	name    string
+	fromTag bool // from a tag overwrites a field name
+	indices []int
+}
+
+// encoding/json uses a similar pattern for unmarshaling into structs
+var structFieldsCache sync.Map // aka map[reflect.Type]map[string]structField
+
+func getStructFields(t reflect.Type) map[string]structField {
+	if mV, ok := structFieldsCache.Load(t); ok {
+		return mV.(map[string]structField)
+	}
+
+	getIndices := func(parents []int, i int) []int {
+		indices := make([]int, len(parents), len(parents)+1)
+		copy(indices, parents)
+		indices = append(indices, i)
+		return indices
+	}
+
+	m := map[string]structField{}
+
+	var populateFrom func(reflect.Type, []int)
+	populateFrom = func(t reflect.Type, parents []int) {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		l := t.NumField()
+
+		// first get all fields which aren't embedded structs
+		for i := 0; i < l; i++ {
+			ft := t.Field(i)
+			if ft.Anonymous || ft.PkgPath != "" {
+				continue
+			}
+
+			key, fromTag := ft.Name, false
+			if tag := ft.Tag.Get("redis"); tag != "" && tag != "-" {
+				key, fromTag = tag, true
+			}
+			if m[key].fromTag {
+				continue
+			}
+			m[key] = structField{
+				name:    key,
+				fromTag: fromTag,
+				indices: getIndices(parents, i),
+			}
+		}
+
+		// then find all embedded structs and descend into them
+		for i := 0; i < l; i++ {
+			ft := t.Field(i)
+			if !ft.Anonymous {
+				continue
+			}
+			populateFrom(ft.Type, getIndices(parents, i))
+		}
+	}
+
+	populateFrom(t, []int{})
+	structFieldsCache.LoadOrStore(t, m)
+	return m
+}
+
+// v must be setable. Always returns a Kind() == reflect.Ptr, unless it returns
+// the zero Value, which means a setable value couldn't be gotten.
+func getStructField(v reflect.Value, ii []int) reflect.Value {
+	if len(ii) == 0 {
+		return v.Addr()
+	}
+	i, ii := ii[0], ii[1:]
+
+	iv := v.Field(i)
+	if iv.Kind() == reflect.Ptr && iv.IsNil() {
+		// If the field is a pointer to an unexported type then it won't be
+		// settable, though if the user pre-sets the value it will be (I think).
+		if !iv.CanSet() {
+			return reflect.Value{}
+		}
+		iv.Set(reflect.New(iv.Type().Elem()))
+	}
+	iv = reflect.Indirect(iv)
+
+	return getStructField(iv, ii)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RawMessage is a Marshaler/Unmarshaler which will capture the exact raw bytes
+// of a RESP3 message. When Marshaling the exact bytes of the RawMessage will be
+// written as-is. When Unmarshaling the bytes of a single RESP3 message will be
+// read into the RawMessage's bytes. If the message is preceded by an attribute
+// then the attribute will be captured as well.
+type RawMessage []byte
+
+// MarshalRESP implements the Marshaler method
+func (rm RawMessage) MarshalRESP(w io.Writer) error {
+	_, err := w.Write(rm)
+	return err
+}
+
+// UnmarshalRESP implements the Unmarshaler method
+func (rm *RawMessage) UnmarshalRESP(br *bufio.Reader) error {
+	*rm = (*rm)[:0]
+	return rm.unmarshal(br)
+}
+
+func (rm *RawMessage) unmarshal(br *bufio.Reader) error {
+	b, err := br.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	*rm = append(*rm, b...)
+
+	if len(b) < 3 {
+		return errors.New("malformed data read")
+	}
+	body := b[1 : len(b)-2]
+
+	switch b[0] {
+	case ArrayPrefix[0], SetPrefix[0], PushPrefix[0], MapPrefix[0], AttributePrefix[0]:
+		l, err := bytesutil.ParseInt(body)
+		if err != nil {
+			return err
+		} else if l == -1 {
+			return nil
+		} else if b[0] == MapPrefix[0] || b[0] == AttributePrefix[0] {
+			l *= 2
+		}
+
+		// an attribute is followed by the message it describes
+		if b[0] == AttributePrefix[0] {
+			l++
+		}
+
+		for i := 0; i < int(l); i++ {
+			if err := rm.unmarshal(br); err != nil {
+				return err
+			}
+		}
+		return nil
+	case BlobStringPrefix[0], BlobErrorPrefix[0], VerbatimStringPrefix[0]:
+		l, err := bytesutil.ParseInt(body) // fuck DRY
+		if err != nil {
+			return err
+		} else if l == -1 {
+			return nil
+		}
+		*rm, err = bytesutil.ReadNAppend(br, *rm, int(l+2))
+		return err
+	case SimpleStringPrefix[0], SimpleErrorPrefix[0], NumberPrefix[0], NullPrefix[0],
+		DoublePrefix[0], BooleanPrefix[0], BigNumberPrefix[0]:
+		return nil
+	default:
+		return errors.Errorf("unknown type prefix %q", b[0])
+	}
+}
+
+// UnmarshalInto is a shortcut for wrapping this RawMessage in a *bufio.Reader
+// and passing that into the given Unmarshaler's UnmarshalRESP method. Any error
+// from calling UnmarshalRESP is returned, and the RawMessage is unaffected in
+// all cases.
+func (rm RawMessage) UnmarshalInto(u resp.Unmarshaler) error {
+	r := byteReaderPool.Get().(*bytes.Reader)
+	r.Reset(rm)
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	err := u.UnmarshalRESP(br)
+	bufioReaderPool.Put(br)
+	byteReaderPool.Put(r)
+	return err
+}
+
+// IsNull returns true if the contents of RawMessage are the null value, or one
+// of the RESP2 nil values.
+func (rm RawMessage) IsNull() bool {
+	return bytes.Equal(rm, null) || bytes.Equal(rm, nilBulkString) || bytes.Equal(rm, nilArray)
+}
+
+// IsEmptyArray returns true if the contents of RawMessage is empty array value.
+func (rm RawMessage) IsEmptyArray() bool {
+	return bytes.Equal(rm, emptyArray)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Downgrade reads a single RESP3 message off of the given reader and writes its
+// RESP2 equivalent to the given writer, so that it can be unmarshaled using the
+// resp2 package. The conversion is the same as what redis itself does for
+// connections which haven't switched to RESP3:
+//
+//	maps are flattened into arrays of alternating keys and values
+//	sets and pushes become arrays
+//	doubles, big numbers and verbatim strings become bulk strings
+//	booleans become the integers 1 and 0
+//	null becomes the nil bulk string
+//	blob errors become simple errors
+//	attributes are discarded
+//
+// Note that RESP2 distinguishes between nil bulk strings and nil arrays, while
+// RESP3 only has null, so a nil array will never be written.
+func Downgrade(w io.Writer, br *bufio.Reader) error {
+	b, err := br.ReadSlice('\n')
+	if err != nil {
+		return err
+	} else if len(b) < 3 {
+		return errors.New("malformed data read")
+	}
+	pref, body := b[0], b[1:len(b)-2]
+
+	switch pref {
+	case SimpleStringPrefix[0], SimpleErrorPrefix[0], NumberPrefix[0]:
+		_, err := w.Write(b)
+		return err
+	case NullPrefix[0]:
+		_, err := w.Write(nilBulkString)
+		return err
+	case BooleanPrefix[0]:
+		switch string(body) {
+		case "t":
+			return marshalInt(w, NumberPrefix, 1)
+		case "f":
+			return marshalInt(w, NumberPrefix, 0)
+		default:
+			return errors.Errorf("invalid boolean value %q", body)
+		}
+	case DoublePrefix[0], BigNumberPrefix[0]:
+		return marshalBlob(w, BlobStringPrefix, body)
+	case BlobStringPrefix[0], BlobErrorPrefix[0], VerbatimStringPrefix[0]:
+		l, err := bytesutil.ParseInt(body)
+		if err != nil {
+			return err
+		} else if l == -1 {
+			_, err := w.Write(nilBulkString)
+			return err
+		}
+
+		scratch := bytesutil.GetBytes()
+		defer bytesutil.PutBytes(scratch)
+		if *scratch, err = bytesutil.ReadNAppend(br, *scratch, int(l+2)); err != nil {
+			return err
+		}
+		data := (*scratch)[:l]
+
+		switch pref {
+		case BlobErrorPrefix[0]:
+			// simple errors can't contain newlines
+			s := strings.NewReplacer("\r", " ", "\n", " ").Replace(string(data))
+			return marshalLine(w, SimpleErrorPrefix, s)
+		case VerbatimStringPrefix[0]:
+			if l < 4 {
+				return errors.Errorf("malformed verbatim string %q", data)
+			}
+			data = data[4:]
+		}
+		return marshalBlob(w, BlobStringPrefix, data)
+	case ArrayPrefix[0], SetPrefix[0], PushPrefix[0], MapPrefix[0]:
+		l, err := bytesutil.ParseInt(body)
+		if err != nil {
+			return err
+		} else if l == -1 {
+			_, err := w.Write(nilArray)
+			return err
+		} else if pref == MapPrefix[0] {
+			l *= 2
+		}
+
+		if err := marshalInt(w, ArrayPrefix, l); err != nil {
+			return err
+		}
+		for i := 0; i < int(l); i++ {
+			if err := Downgrade(w, br); err != nil {
+				return err
+			}
+		}
+		return nil
+	case AttributePrefix[0]:
+		l, err := bytesutil.ParseInt(body)
+		if err != nil {
+			return err
+		} else if err := discardMulti(br, int(l*2)); err != nil {
+			return err
+		}
+		return Downgrade(w, br)
+	default:
+		return errors.Errorf("unknown type prefix %q", pref)
+	}
+}
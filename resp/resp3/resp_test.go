@@ -0,0 +1,463 @@
+package resp3
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"math/big"
+	"reflect"
+	. "testing"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBR(s string) *bufio.Reader {
+	return bufio.NewReader(bytes.NewBufferString(s))
+}
+
+func TestPeekAndAssertPrefix(t *T) {
+	type test struct {
+		in, prefix []byte
+		exp        error
+	}
+
+	tests := []test{
+		{[]byte(":5\r\n"), NumberPrefix, nil},
+		{[]byte(":5\r\n"), SimpleStringPrefix, resp.ErrDiscarded{
+			Err: errUnexpectedPrefix{
+				Prefix: NumberPrefix, ExpectedPrefix: SimpleStringPrefix,
+			},
+		}},
+		{[]byte("-foo\r\n"), SimpleErrorPrefix, nil},
+		{[]byte("-foo\r\n"), NumberPrefix, resp.ErrDiscarded{Err: SimpleError{
+			E: errors.New("foo"),
+		}}},
+		{[]byte("!3\r\nfoo\r\n"), NumberPrefix, resp.ErrDiscarded{Err: BlobError{
+			E: errors.New("foo"),
+		}}},
+		{[]byte("|1\r\n+a\r\n:1\r\n:5\r\n"), NumberPrefix, nil},
+	}
+
+	for i, test := range tests {
+		br := bufio.NewReader(bytes.NewReader(test.in))
+		err := peekAndAssertPrefix(br, test.prefix)
+
+		debugArgs := []interface{}{"%d) %q (got err:%s)", i, test.in, err}
+		assert.IsType(t, test.exp, err, debugArgs...)
+		if expDiscarded, ok := test.exp.(resp.ErrDiscarded); ok {
+			discarded, _ := err.(resp.ErrDiscarded)
+			assert.IsType(t, expDiscarded.Err, discarded.Err, debugArgs...)
+		}
+		if test.exp != nil {
+			assert.Equal(t, test.exp.Error(), err.Error(), debugArgs...)
+		}
+	}
+}
+
+func TestRESPTypes(t *T) {
+	newLR := func(s string) resp.LenReader {
+		buf := bytes.NewBufferString(s)
+		return resp.NewLenReader(buf, int64(buf.Len()))
+	}
+
+	type encodeTest struct {
+		in  resp.Marshaler
+		out string
+
+		errStr bool
+	}
+
+	encodeTests := []encodeTest{
+		{in: &SimpleString{S: ""}, out: "+\r\n"},
+		{in: &SimpleString{S: "foo"}, out: "+foo\r\n"},
+		{in: &SimpleError{E: errors.New("")}, out: "-\r\n", errStr: true},
+		{in: &SimpleError{E: errors.New("foo")}, out: "-foo\r\n", errStr: true},
+		{in: &BlobError{E: errors.New("foo\r\nbar")}, out: "!8\r\nfoo\r\nbar\r\n", errStr: true},
+		{in: &Number{N: 5}, out: ":5\r\n"},
+		{in: &Number{N: 0}, out: ":0\r\n"},
+		{in: &Number{N: -5}, out: ":-5\r\n"},
+		{in: &Null{}, out: "_\r\n"},
+		{in: &Double{F: 1.5}, out: ",1.5\r\n"},
+		{in: &Double{F: -10}, out: ",-10\r\n"},
+		{in: &Double{F: math.Inf(1)}, out: ",inf\r\n"},
+		{in: &Double{F: math.Inf(-1)}, out: ",-inf\r\n"},
+		{in: &Boolean{B: true}, out: "#t\r\n"},
+		{in: &Boolean{B: false}, out: "#f\r\n"},
+		{in: &BigNumber{I: big.NewInt(-42)}, out: "(-42\r\n"},
+		{in: &BlobStringBytes{B: nil}, out: "_\r\n"},
+		{in: &BlobStringBytes{B: []byte{}}, out: "$0\r\n\r\n"},
+		{in: &BlobStringBytes{B: []byte("foo")}, out: "$3\r\nfoo\r\n"},
+		{in: &BlobStringBytes{B: []byte("foo\r\nbar")}, out: "$8\r\nfoo\r\nbar\r\n"},
+		{in: &BlobString{S: ""}, out: "$0\r\n\r\n"},
+		{in: &BlobString{S: "foo"}, out: "$3\r\nfoo\r\n"},
+		{in: &BlobString{S: "foo\r\nbar"}, out: "$8\r\nfoo\r\nbar\r\n"},
+		{in: &BlobReader{LR: newLR("foo\r\nbar")}, out: "$8\r\nfoo\r\nbar\r\n"},
+		{in: &VerbatimString{Format: "txt", S: "foo"}, out: "=7\r\ntxt:foo\r\n"},
+		{in: &VerbatimString{Format: "mkd", S: ""}, out: "=4\r\nmkd:\r\n"},
+		{in: &ArrayHeader{N: 5}, out: "*5\r\n"},
+		{in: &ArrayHeader{N: -1}, out: "*-1\r\n"},
+		{in: &MapHeader{N: 5}, out: "%5\r\n"},
+		{in: &SetHeader{N: 5}, out: "~5\r\n"},
+		{in: &AttributeHeader{N: 5}, out: "|5\r\n"},
+		{in: &PushHeader{N: 5}, out: ">5\r\n"},
+	}
+
+	for _, et := range encodeTests {
+		buf := new(bytes.Buffer)
+		err := et.in.MarshalRESP(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, et.out, buf.String())
+
+		br := bufio.NewReader(buf)
+		umr := reflect.New(reflect.TypeOf(et.in).Elem())
+		um, ok := umr.Interface().(resp.Unmarshaler)
+		if !ok {
+			br.Discard(len(et.out))
+			continue
+		}
+
+		err = um.UnmarshalRESP(br)
+		assert.Nil(t, err)
+
+		var exp interface{} = et.in
+		var got interface{} = umr.Interface()
+		if et.errStr {
+			exp = exp.(error).Error()
+			got = got.(error).Error()
+		}
+		assert.Equal(t, exp, got, "exp:%#v got:%#v", exp, got)
+	}
+
+	// RESP2 nil values should be accepted as nulls
+	{
+		bsb := BlobStringBytes{B: []byte("foo")}
+		require.Nil(t, bsb.UnmarshalRESP(newBR("$-1\r\n")))
+		assert.Nil(t, bsb.B)
+		require.Nil(t, (&Null{}).UnmarshalRESP(newBR("*-1\r\n")))
+	}
+}
+
+// structs used for tests
+type testStructInner struct {
+	Foo int
+	bar int
+	Baz string `redis:"BAZ"`
+	Buz string `redis:"-"`
+	Boz *int
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+type testStructA struct {
+	testStructInner
+	Biz []byte
+}
+
+func TestAnyMarshal(t *T) {
+	type encodeTest struct {
+		in             interface{}
+		out            string
+		forceStr, flat bool
+	}
+
+	var encodeTests = []encodeTest{
+		// Blob strings
+		{in: []byte("ohey"), out: "$4\r\nohey\r\n"},
+		{in: "ohey", out: "$4\r\nohey\r\n"},
+		{in: "", out: "$0\r\n\r\n"},
+		{in: nil, out: "_\r\n"},
+		{in: nil, forceStr: true, out: "$0\r\n\r\n"},
+		{in: []byte(nil), out: "_\r\n"},
+
+		// Numbers, doubles, booleans and big numbers
+		{in: 5, out: ":5\r\n"},
+		{in: uint64(5), forceStr: true, out: "$1\r\n5\r\n"},
+		{in: float64(5.5), out: ",5.5\r\n"},
+		{in: float32(5.5), forceStr: true, out: "$3\r\n5.5\r\n"},
+		{in: true, out: "#t\r\n"},
+		{in: false, forceStr: true, out: "$1\r\n0\r\n"},
+		{in: big.NewInt(5), out: "(5\r\n"},
+
+		// Errors
+		{in: errors.New(":("), out: "-:(\r\n"},
+		{in: errors.New(":(\n"), out: "!3\r\n:(\n\r\n"},
+		{in: errors.New(":("), forceStr: true, out: "$2\r\n:(\r\n"},
+
+		// Aggregates
+		{in: []string(nil), out: "_\r\n"},
+		{in: []string{}, out: "*0\r\n"},
+		{in: []int{1, 2}, out: "*2\r\n:1\r\n:2\r\n"},
+		{in: []int{1, 2}, flat: true, out: ":1\r\n:2\r\n"},
+		{in: map[string]int(nil), out: "_\r\n"},
+		{in: map[string]int{"one": 1}, out: "%1\r\n$3\r\none\r\n:1\r\n"},
+		{in: map[string]int{"one": 1}, flat: true, out: "$3\r\none\r\n:1\r\n"},
+		{in: map[string]struct{}{"one": {}}, out: "~1\r\n$3\r\none\r\n"},
+		{
+			in: testStructA{
+				testStructInner: testStructInner{
+					Foo: 1,
+					bar: 2,
+					Baz: "3",
+					Buz: "4",
+					Boz: intPtr(5),
+				},
+				Biz: []byte("10"),
+			},
+			out: "%4\r\n" +
+				"$3\r\nFoo\r\n" + ":1\r\n" +
+				"$3\r\nBAZ\r\n" + "$1\r\n3\r\n" +
+				"$3\r\nBoz\r\n" + ":5\r\n" +
+				"$3\r\nBiz\r\n" + "$2\r\n10\r\n",
+		},
+	}
+
+	for i, et := range encodeTests {
+		buf := new(bytes.Buffer)
+		a := Any{
+			I:                   et.in,
+			MarshalBlobString:   et.forceStr,
+			MarshalNoAggHeaders: et.flat,
+		}
+		require.Nil(t, a.MarshalRESP(buf), "%d) %#v", i, et.in)
+		assert.Equal(t, et.out, buf.String(), "%d) %#v", i, et.in)
+	}
+}
+
+func TestAnyUnmarshal(t *T) {
+	type decodeTest struct {
+		in   string
+		into interface{}
+		out  interface{}
+	}
+
+	decodeTests := []decodeTest{
+		// Singular types into strings and numbers
+		{in: "+ohey\r\n", into: new(string), out: "ohey"},
+		{in: "$4\r\nohey\r\n", into: new(string), out: "ohey"},
+		{in: "=8\r\ntxt:ohey\r\n", into: new(string), out: "ohey"},
+		{in: ":5\r\n", into: new(int), out: 5},
+		{in: ":5\r\n", into: new(string), out: "5"},
+		{in: ",5.5\r\n", into: new(float64), out: 5.5},
+		{in: ",inf\r\n", into: new(float64), out: math.Inf(1)},
+		{in: "#t\r\n", into: new(bool), out: true},
+		{in: "#f\r\n", into: new(bool), out: false},
+		{in: "#t\r\n", into: new(int), out: 1},
+		{in: "(12345678901234567890\r\n", into: new(uint64), out: uint64(12345678901234567890)},
+		{in: "(-5\r\n", into: new(big.Int), out: *big.NewInt(-5)},
+		{in: "_\r\n", into: func() *string { s := "foo"; return &s }(), out: ""},
+		{in: "$-1\r\n", into: func() *[]byte { b := []byte("foo"); return &b }(), out: []byte(nil)},
+
+		// Aggregates
+		{in: "*2\r\n:1\r\n:2\r\n", into: new([]int), out: []int{1, 2}},
+		{in: "~2\r\n:1\r\n:2\r\n", into: new([]int), out: []int{1, 2}},
+		{in: ">2\r\n+a\r\n+b\r\n", into: new([]string), out: []string{"a", "b"}},
+		{
+			in:   "%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n",
+			into: new(map[string]int),
+			out:  map[string]int{"a": 1, "b": 2},
+		},
+		{
+			in:   "%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n",
+			into: new([]string),
+			out:  []string{"a", "1", "b", "2"},
+		},
+		{
+			in:   "*4\r\n+a\r\n:1\r\n+b\r\n:2\r\n",
+			into: new(map[string]int),
+			out:  map[string]int{"a": 1, "b": 2},
+		},
+		{
+			in:   "~2\r\n+a\r\n+b\r\n",
+			into: new(map[string]struct{}),
+			out:  map[string]struct{}{"a": {}, "b": {}},
+		},
+		{
+			in:   "~2\r\n+a\r\n+b\r\n",
+			into: new(map[string]bool),
+			out:  map[string]bool{"a": true, "b": true},
+		},
+		{
+			in: "%3\r\n" +
+				"$3\r\nFoo\r\n" + ":1\r\n" +
+				"+BAZ\r\n" + "$1\r\n3\r\n" +
+				"$3\r\nBiz\r\n" + "$2\r\n10\r\n",
+			into: new(testStructA),
+			out: testStructA{
+				testStructInner: testStructInner{Foo: 1, Baz: "3"},
+				Biz:             []byte("10"),
+			},
+		},
+
+		// Attributes are discarded, wherever they may be
+		{in: "|1\r\n+ttl\r\n:5\r\n+ohey\r\n", into: new(string), out: "ohey"},
+		{
+			in:   "*2\r\n:1\r\n|1\r\n+ttl\r\n:5\r\n:2\r\n",
+			into: new([]int),
+			out:  []int{1, 2},
+		},
+
+		// Into interface{}
+		{in: "+ohey\r\n", into: new(interface{}), out: "ohey"},
+		{in: "$4\r\nohey\r\n", into: new(interface{}), out: []byte("ohey")},
+		{in: "=8\r\ntxt:ohey\r\n", into: new(interface{}), out: "ohey"},
+		{in: ":5\r\n", into: new(interface{}), out: int64(5)},
+		{in: ",5.5\r\n", into: new(interface{}), out: 5.5},
+		{in: "#t\r\n", into: new(interface{}), out: true},
+		{in: "(5\r\n", into: new(interface{}), out: big.NewInt(5)},
+		{in: "_\r\n", into: new(interface{}), out: nil},
+		{in: "$-1\r\n", into: new(interface{}), out: nil},
+		{
+			in:   "*2\r\n+a\r\n:1\r\n",
+			into: new(interface{}),
+			out:  []interface{}{"a", int64(1)},
+		},
+		{
+			in:   "%2\r\n$1\r\na\r\n:1\r\n:2\r\n#f\r\n",
+			into: new(interface{}),
+			out:  map[interface{}]interface{}{"a": int64(1), int64(2): false},
+		},
+	}
+
+	for i, dt := range decodeTests {
+		br := newBR(dt.in)
+		err := Any{I: dt.into}.UnmarshalRESP(br)
+		require.Nil(t, err, "%d) %q", i, dt.in)
+		assert.Equal(t, dt.out, reflect.ValueOf(dt.into).Elem().Interface(), "%d) %q", i, dt.in)
+		assert.Zero(t, br.Buffered(), "%d) %q", i, dt.in)
+	}
+}
+
+func TestAnyUnmarshalErrors(t *T) {
+	{ // simple error
+		var s string
+		err := Any{I: &s}.UnmarshalRESP(newBR("-ERR foo\r\n"))
+		assert.Equal(t, "ERR foo", err.Error())
+		assert.True(t, errors.As(err, new(SimpleError)))
+		assert.True(t, errors.As(err, new(resp.ErrDiscarded)))
+	}
+
+	{ // blob error
+		var s string
+		err := Any{I: &s}.UnmarshalRESP(newBR("!7\r\nERR foo\r\n"))
+		assert.Equal(t, "ERR foo", err.Error())
+		assert.True(t, errors.As(err, new(BlobError)))
+		assert.True(t, errors.As(err, new(resp.ErrDiscarded)))
+	}
+
+	{ // unmarshaling into the wrong type should discard the rest of the message
+		br := newBR("%2\r\n+a\r\n+b\r\n+c\r\n+d\r\n:1\r\n")
+		var ii []int
+		err := Any{I: &ii}.UnmarshalRESP(br)
+		assert.True(t, errors.As(err, new(resp.ErrDiscarded)))
+
+		var i int
+		require.Nil(t, Any{I: &i}.UnmarshalRESP(br))
+		assert.Equal(t, 1, i)
+	}
+
+	{ // aggregate map keys can't be decoded into an interface{} key
+		br := newBR("%2\r\n*1\r\n:1\r\n+a\r\n+b\r\n+c\r\n~1\r\n%1\r\n+a\r\n+b\r\n:2\r\n")
+		var m map[interface{}]interface{}
+		err := Any{I: &m}.UnmarshalRESP(br)
+		assert.True(t, errors.As(err, new(resp.ErrDiscarded)))
+
+		var s map[interface{}]bool
+		err = Any{I: &s}.UnmarshalRESP(br)
+		assert.True(t, errors.As(err, new(resp.ErrDiscarded)))
+
+		var i int
+		require.Nil(t, Any{I: &i}.UnmarshalRESP(br))
+		assert.Equal(t, 2, i)
+	}
+}
+
+func TestRawMessage(t *T) {
+	rmtests := []struct {
+		b      string
+		isNull bool
+	}{
+		{b: "+\r\n"},
+		{b: "+foo\r\n"},
+		{b: "-\r\n"},
+		{b: "-foo\r\n"},
+		{b: "!3\r\nfoo\r\n"},
+		{b: ":5\r\n"},
+		{b: ",5.5\r\n"},
+		{b: "#t\r\n"},
+		{b: "(5\r\n"},
+		{b: "_\r\n", isNull: true},
+		{b: "$-1\r\n", isNull: true},
+		{b: "$0\r\n\r\n"},
+		{b: "$3\r\nfoo\r\n"},
+		{b: "=7\r\ntxt:foo\r\n"},
+		{b: "*-1\r\n", isNull: true},
+		{b: "*0\r\n"},
+		{b: "*2\r\n+foo\r\n:1\r\n"},
+		{b: "~2\r\n+foo\r\n:1\r\n"},
+		{b: ">2\r\n+foo\r\n:1\r\n"},
+		{b: "%2\r\n+foo\r\n:1\r\n+bar\r\n%1\r\n+a\r\n_\r\n"},
+		{b: "|1\r\n+ttl\r\n:5\r\n*2\r\n+foo\r\n:1\r\n"},
+	}
+
+	for i, rmt := range rmtests {
+		buf := new(bytes.Buffer)
+		{
+			rm := RawMessage(rmt.b)
+			require.Nil(t, rm.MarshalRESP(buf))
+			assert.Equal(t, rmt.b, buf.String(), "%d", i)
+			assert.Equal(t, rmt.isNull, rm.IsNull(), "%d", i)
+		}
+		{
+			var rm RawMessage
+			require.Nil(t, rm.UnmarshalRESP(bufio.NewReader(buf)))
+			assert.Equal(t, rmt.b, string(rm), "%d", i)
+		}
+	}
+
+	// UnmarshalInto
+	{
+		rm := RawMessage("|1\r\n+ttl\r\n:5\r\n%1\r\n+foo\r\n:1\r\n")
+		var m map[string]int
+		require.Nil(t, rm.UnmarshalInto(Any{I: &m}))
+		assert.Equal(t, map[string]int{"foo": 1}, m)
+	}
+}
+
+func TestDowngrade(t *T) {
+	tests := []struct {
+		in, out string
+	}{
+		{in: "+foo\r\n", out: "+foo\r\n"},
+		{in: "-ERR foo\r\n", out: "-ERR foo\r\n"},
+		{in: ":5\r\n", out: ":5\r\n"},
+		{in: "_\r\n", out: "$-1\r\n"},
+		{in: "#t\r\n", out: ":1\r\n"},
+		{in: "#f\r\n", out: ":0\r\n"},
+		{in: ",5.5\r\n", out: "$3\r\n5.5\r\n"},
+		{in: "(12345678901234567890\r\n", out: "$20\r\n12345678901234567890\r\n"},
+		{in: "$3\r\nfoo\r\n", out: "$3\r\nfoo\r\n"},
+		{in: "$-1\r\n", out: "$-1\r\n"},
+		{in: "!8\r\nERR\r\nfoo\r\n", out: "-ERR  foo\r\n"},
+		{in: "=7\r\ntxt:foo\r\n", out: "$3\r\nfoo\r\n"},
+		{in: "*-1\r\n", out: "*-1\r\n"},
+		{in: "*2\r\n+foo\r\n_\r\n", out: "*2\r\n+foo\r\n$-1\r\n"},
+		{in: "~1\r\n#t\r\n", out: "*1\r\n:1\r\n"},
+		{in: ">2\r\n+a\r\n+b\r\n", out: "*2\r\n+a\r\n+b\r\n"},
+		{in: "%1\r\n+a\r\n%1\r\n+b\r\n:1\r\n", out: "*2\r\n+a\r\n*2\r\n+b\r\n:1\r\n"},
+		{in: "|1\r\n+ttl\r\n:5\r\n*1\r\n|1\r\n+a\r\n+b\r\n:1\r\n", out: "*1\r\n:1\r\n"},
+	}
+
+	for i, test := range tests {
+		br := newBR(test.in)
+		buf := new(bytes.Buffer)
+		require.Nil(t, Downgrade(buf, br), "%d) %q", i, test.in)
+		assert.Equal(t, test.out, buf.String(), "%d) %q", i, test.in)
+		assert.Zero(t, br.Buffered(), "%d) %q", i, test.in)
+	}
+}
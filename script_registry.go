@@ -0,0 +1,162 @@
+package radix
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+)
+
+// ScriptRegistry holds a set of EvalScripts which are loaded, using SCRIPT
+// LOAD, onto redis instances ahead of time, so that EvalScript actions don't
+// need to fall back from EVALSHA to EVAL after the instance's script cache has
+// been flushed, e.g. when a new primary is promoted or a node restarts.
+//
+// A ScriptRegistry can be hooked into a Client in a number of ways:
+//
+// * ConnFunc wraps a ConnFunc so that the scripts are loaded on every new Conn.
+// It can be used with PoolConnFunc.
+//
+// * ClientFunc wraps a ClientFunc so that the scripts are loaded whenever a new
+// Client is created. It can be used with SentinelPoolFunc or ClusterPoolFunc.
+//
+// * ClusterScriptRegistry has a Cluster load the scripts onto every node which
+// is added to its topology.
+//
+// All methods on ScriptRegistry are thread-safe.
+type ScriptRegistry struct {
+	l       sync.RWMutex
+	scripts map[string]EvalScript      // sum -> script
+	loaded  map[string]map[string]bool // addr -> sum -> loaded
+
+	// Any errors encountered while loading scripts in the background will be
+	// written to this channel. If nothing is reading the channel the errors
+	// will be dropped.
+	ErrCh chan error
+}
+
+// NewScriptRegistry initializes and returns a ScriptRegistry with the given
+// EvalScripts registered.
+func NewScriptRegistry(scripts ...EvalScript) *ScriptRegistry {
+	sr := &ScriptRegistry{
+		scripts: map[string]EvalScript{},
+		loaded:  map[string]map[string]bool{},
+		ErrCh:   make(chan error, 1),
+	}
+	sr.Register(scripts...)
+	return sr
+}
+
+func (sr *ScriptRegistry) err(err error) {
+	select {
+	case sr.ErrCh <- err:
+	default:
+	}
+}
+
+// Register adds the given EvalScripts to the ScriptRegistry. They will be
+// loaded onto instances from then on, but won't be loaded onto any instances
+// which the ScriptRegistry has already loaded scripts onto until those
+// instances are loaded again.
+func (sr *ScriptRegistry) Register(scripts ...EvalScript) {
+	sr.l.Lock()
+	defer sr.l.Unlock()
+	for _, es := range scripts {
+		sr.scripts[es.sum] = es
+	}
+}
+
+// Load loads all registered scripts onto the instance which the given Client
+// is connected to, which has the given address. It returns the first error
+// encountered, but attempts to load every script regardless.
+func (sr *ScriptRegistry) Load(addr string, c Client) error {
+	return sr.loadContext(context.Background(), addr, c)
+}
+
+func (sr *ScriptRegistry) loadContext(ctx context.Context, addr string, c Client) error {
+	sr.l.RLock()
+	scripts := make([]EvalScript, 0, len(sr.scripts))
+	for _, es := range sr.scripts {
+		scripts = append(scripts, es)
+	}
+	sr.l.RUnlock()
+
+	var retErr error
+	loaded := make(map[string]bool, len(scripts))
+	for _, es := range scripts {
+		var sum string
+		if err := DoContext(ctx, c, Cmd(&sum, "SCRIPT", "LOAD", es.script)); err != nil {
+			if retErr == nil {
+				retErr = errors.Errorf("loading script %s onto %s: %w", es.sum, addr, err)
+			}
+			continue
+		}
+		loaded[sum] = true
+	}
+
+	sr.l.Lock()
+	defer sr.l.Unlock()
+	if sr.loaded[addr] == nil {
+		sr.loaded[addr] = loaded
+	} else {
+		for sum := range loaded {
+			sr.loaded[addr][sum] = true
+		}
+	}
+	return retErr
+}
+
+// forget removes any record of scripts having been loaded onto the instance at
+// the given address.
+func (sr *ScriptRegistry) forget(addr string) {
+	sr.l.Lock()
+	defer sr.l.Unlock()
+	delete(sr.loaded, addr)
+}
+
+// Loaded returns the SHA1 sums of the scripts which have been loaded onto each
+// instance, keyed by instance address. The sums for each instance are sorted.
+func (sr *ScriptRegistry) Loaded() map[string][]string {
+	sr.l.RLock()
+	defer sr.l.RUnlock()
+	m := make(map[string][]string, len(sr.loaded))
+	for addr, sums := range sr.loaded {
+		m[addr] = make([]string, 0, len(sums))
+		for sum := range sums {
+			m[addr] = append(m[addr], sum)
+		}
+		sort.Strings(m[addr])
+	}
+	return m
+}
+
+// ConnFunc wraps the given ConnFunc such that all registered scripts are loaded
+// onto every Conn it creates. If loading fails the error is written to ErrCh,
+// but the Conn is still returned.
+func (sr *ScriptRegistry) ConnFunc(cf ConnFunc) ConnFunc {
+	return func(network, addr string) (Conn, error) {
+		conn, err := cf(network, addr)
+		if err != nil {
+			return nil, err
+		} else if err := sr.Load(addr, conn); err != nil {
+			sr.err(err)
+		}
+		return conn, nil
+	}
+}
+
+// ClientFunc wraps the given ClientFunc such that all registered scripts are
+// loaded using every Client it creates. If loading fails the error is written
+// to ErrCh, but the Client is still returned.
+func (sr *ScriptRegistry) ClientFunc(cf ClientFunc) ClientFunc {
+	return func(network, addr string) (Client, error) {
+		client, err := cf(network, addr)
+		if err != nil {
+			return nil, err
+		} else if err := sr.Load(addr, client); err != nil {
+			sr.err(err)
+		}
+		return client, nil
+	}
+}
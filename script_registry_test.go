@@ -0,0 +1,151 @@
+package radix
+
+import (
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// scriptStubConnFunc returns a ConnFunc whose Conns support SCRIPT LOAD and
+// EVALSHA. Loaded scripts are shared across all Conns to the same address.
+func scriptStubConnFunc() (ConnFunc, func(addr string)) {
+	var l sync.Mutex
+	loaded := map[string]map[string]bool{}
+	flush := func(addr string) {
+		l.Lock()
+		defer l.Unlock()
+		delete(loaded, addr)
+	}
+	return func(network, addr string) (Conn, error) {
+		return Stub(network, addr, func(args []string) interface{} {
+			l.Lock()
+			defer l.Unlock()
+			switch strings.ToUpper(args[0]) {
+			case "SCRIPT":
+				sum := NewEvalScript(0, args[2]).sum
+				if loaded[addr] == nil {
+					loaded[addr] = map[string]bool{}
+				}
+				loaded[addr][sum] = true
+				return sum
+			case "EVALSHA":
+				if !loaded[addr][args[1]] {
+					return resp2.Error{E: errors.New("NOSCRIPT No matching script")}
+				}
+				return "evalsha"
+			case "EVAL":
+				return "eval"
+			}
+			return resp2.Error{E: errors.Errorf("unknown command %q", args)}
+		}), nil
+	}, flush
+}
+
+func TestScriptRegistry(t *T) {
+	scriptA := NewEvalScript(0, "return 'a'")
+	scriptB := NewEvalScript(0, "return 'b'")
+	sr := NewScriptRegistry(scriptA)
+	cf, flush := scriptStubConnFunc()
+
+	pool, err := NewPool("tcp", "127.0.0.1:6379", 1,
+		PoolConnFunc(sr.ConnFunc(cf)), PoolPipelineWindow(0, 0))
+	require.Nil(t, err)
+	defer pool.Close()
+
+	var out string
+	require.Nil(t, pool.Do(scriptA.Cmd(&out)))
+	assert.Equal(t, "evalsha", out)
+	assert.Equal(t, map[string][]string{"127.0.0.1:6379": {scriptA.sum}}, sr.Loaded())
+
+	// newly registered scripts are loaded on new Conns
+	sr.Register(scriptB)
+	flush("127.0.0.1:6379")
+	conn, err := sr.ConnFunc(cf)("tcp", "127.0.0.1:6379")
+	require.Nil(t, err)
+	require.Nil(t, conn.Do(scriptB.Cmd(&out)))
+	assert.Equal(t, "evalsha", out)
+	require.Nil(t, conn.Do(scriptA.Cmd(&out)))
+	assert.Equal(t, "evalsha", out)
+
+	loaded := sr.Loaded()["127.0.0.1:6379"]
+	assert.ElementsMatch(t, []string{scriptA.sum, scriptB.sum}, loaded)
+}
+
+func TestScriptRegistryLoadErr(t *T) {
+	sr := NewScriptRegistry(NewEvalScript(0, "return 'a'"))
+	client := Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+		return resp2.Error{E: errors.New("ERR no scripts allowed")}
+	})
+
+	_, err := sr.ClientFunc(func(string, string) (Client, error) {
+		return client, nil
+	})("tcp", "127.0.0.1:6379")
+	require.Nil(t, err)
+	assert.Contains(t, (<-sr.ErrCh).Error(), "ERR no scripts allowed")
+	assert.Equal(t, map[string][]string{"127.0.0.1:6379": {}}, sr.Loaded())
+}
+
+func TestClusterScriptRegistry(t *T) {
+	script := NewEvalScript(0, "return 'a'")
+	sr := NewScriptRegistry(script)
+	c, scl := newTestCluster(ClusterScriptRegistry(sr))
+
+	// the scripts are loaded in the background
+	waitScriptsLoaded(t, sr, scl.addrs())
+	loaded := sr.Loaded()
+	assert.Len(t, loaded, len(scl.addrs()))
+	for _, addr := range scl.addrs() {
+		assert.Equal(t, []string{script.sum}, loaded[addr])
+	}
+
+	// a node which doesn't respond doesn't delay loading onto the others, nor
+	// the sync which triggered it
+	addrs := scl.addrs()
+	hangAddr := addrs[0]
+	release := make(chan struct{})
+	defer close(release)
+	c.l.Lock()
+	c.pools[hangAddr] = hangingClient{Client: c.pools[hangAddr], release: release}
+	c.l.Unlock()
+	for _, addr := range addrs {
+		sr.forget(addr)
+	}
+
+	start := time.Now()
+	c.syncScripts(nil, c.Topo())
+	assert.True(t, time.Since(start) < scriptLoadTimeout/2, "sync took %v", time.Since(start))
+	waitScriptsLoaded(t, sr, addrs[1:])
+	assert.NotContains(t, sr.Loaded(), hangAddr)
+
+	// closing interrupts the load which is still in progress
+	start = time.Now()
+	require.NoError(t, c.Close())
+	assert.True(t, time.Since(start) < scriptLoadTimeout/2, "close took %v", time.Since(start))
+}
+
+// waitScriptsLoaded waits for scripts to have been loaded onto all of the given
+// addresses.
+func waitScriptsLoaded(tb TB, sr *ScriptRegistry, addrs []string) {
+	tb.Helper()
+	for i := 0; i < 100; i++ {
+		loaded := sr.Loaded()
+		var n int
+		for _, addr := range addrs {
+			if _, ok := loaded[addr]; ok {
+				n++
+			}
+		}
+		if n == len(addrs) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.Fatalf("scripts weren't loaded onto %v", addrs)
+}
@@ -1,17 +1,25 @@
 package radix
 
 import (
+	"context"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+	"github.com/mediocregopher/radix/v3/trace"
 )
 
 type sentinelOpts struct {
 	cf ConnFunc
 	pf ClientFunc
+	st trace.SentinelTrace
+	rs ReplicaSelector
 }
 
 // SentinelOpt is an optional behavior which can be applied to the NewSentinel
@@ -40,6 +48,23 @@ func SentinelPoolFunc(pf ClientFunc) SentinelOpt {
 	}
 }
 
+// SentinelReplicaSelector tells the Sentinel to use the given ReplicaSelector
+// when choosing which replica DoSecondary should perform an Action on.
+func SentinelReplicaSelector(rs ReplicaSelector) SentinelOpt {
+	return func(so *sentinelOpts) {
+		so.rs = rs
+	}
+}
+
+// SentinelWithTrace tells the Sentinel to trace itself with the given
+// SentinelTrace. Note that SentinelTrace will block every point that you set to
+// trace.
+func SentinelWithTrace(st trace.SentinelTrace) SentinelOpt {
+	return func(so *sentinelOpts) {
+		so.st = st
+	}
+}
+
 // Sentinel is a Client which, in the background, connects to an available
 // sentinel node and handles all of the following:
 //
@@ -62,6 +87,7 @@ type Sentinel struct {
 	l             sync.RWMutex
 	primAddr      string
 	clients       map[string]Client
+	replicaAddrs  []string        // sorted, only replicas which are up, never includes primAddr
 	sentinelAddrs map[string]bool // the known sentinel addresses
 
 	// We use a persistent PubSubConn here, so we don't need to do much after
@@ -69,6 +95,10 @@ type Sentinel struct {
 	pconn   PubSubConn
 	pconnCh chan PubSubMessage
 
+	// notified whenever the primary changes. Used by PersistentPubSubSentinel
+	// to follow failovers.
+	switchNotifier notifier
+
 	// Any errors encountered internally will be written to this channel. If
 	// nothing is reading the channel the errors will be dropped. The channel
 	// will be closed when the Close is called.
@@ -78,6 +108,10 @@ type Sentinel struct {
 	closeWG   sync.WaitGroup
 	closeOnce sync.Once
 
+	// only used by the spin goroutine, to know if ConnLost has been traced
+	// without a following ConnReestablished
+	connLost bool
+
 	// only used by tests to ensure certain actions have happened before
 	// continuing on during the test
 	testEventCh chan string
@@ -93,6 +127,7 @@ type Sentinel struct {
 //
 //	SentinelConnFunc(DefaultConnFunc)
 //	SentinelPoolFunc(DefaultClientFunc)
+//	SentinelReplicaSelector(RandomReplicaSelector())
 //
 func NewSentinel(primaryName string, sentinelAddrs []string, opts ...SentinelOpt) (*Sentinel, error) {
 	addrs := map[string]bool{}
@@ -116,6 +151,7 @@ func NewSentinel(primaryName string, sentinelAddrs []string, opts ...SentinelOpt
 	sc.so.cf = wrapDefaultConnFunc(sentinelAddrs[0])
 	defaultSentinelOpts := []SentinelOpt{
 		SentinelPoolFunc(DefaultClientFunc),
+		SentinelReplicaSelector(RandomReplicaSelector()),
 	}
 
 	for _, opt := range append(defaultSentinelOpts, opts...) {
@@ -205,7 +241,19 @@ func (sc *Sentinel) Do(a Action) error {
 	return sc.clients[sc.primAddr].Do(a)
 }
 
-// DoSecondary is like Do but executes the Action on a random replica if possible.
+// DoContext implements the method for the ContextClient interface. It behaves
+// like Do, but passes the context along to the current primary's Client.
+func (sc *Sentinel) DoContext(ctx context.Context, a Action) error {
+	sc.l.RLock()
+	defer sc.l.RUnlock()
+	return DoContext(ctx, sc.clients[sc.primAddr], a)
+}
+
+// DoSecondary is like Do but executes the Action on a replica if possible. The
+// replica is chosen by the ReplicaSelector given with SentinelReplicaSelector,
+// out of all replicas which the sentinel doesn't consider to be down or
+// disconnected from the primary. If there are no such replicas the Action is
+// performed on the primary.
 //
 // For DoSecondary to work, replicas must be configured with replica-read-only
 // enabled, otherwise calls to DoSecondary may by rejected by the replica.
@@ -214,11 +262,28 @@ func (sc *Sentinel) Do(a Action) error {
 // actually carried out that there could be a failover event. In that case, the
 // Action will likely fail and return an error.
 func (sc *Sentinel) DoSecondary(a Action) error {
-	c, err := sc.clientInner("")
-	if err != nil {
-		return err
+	return sc.DoSecondaryContext(context.Background(), a)
+}
+
+// DoSecondaryContext is like DoSecondary, but passes the context along to the
+// chosen replica's Client, like DoContext.
+func (sc *Sentinel) DoSecondaryContext(ctx context.Context, a Action) error {
+	sc.l.RLock()
+	replicaAddrs := sc.replicaAddrs
+	sc.l.RUnlock()
+
+	if len(replicaAddrs) == 0 {
+		return sc.DoContext(ctx, a)
 	}
-	return c.Do(a)
+
+	addr := sc.so.rs.Select(replicaAddrs)
+	start := time.Now()
+	c, err := sc.clientInner(addr)
+	if err == nil {
+		err = DoContext(ctx, c, a)
+	}
+	sc.so.rs.Done(addr, time.Since(start), err)
+	return err
 }
 
 // Addrs returns the currently known network address of the current primary
@@ -265,22 +330,12 @@ func (sc *Sentinel) Client(addr string) (Client, error) {
 }
 
 func (sc *Sentinel) clientInner(addr string) (Client, error) {
-	var client Client
-
 	sc.l.RLock()
-	if addr == "" {
-		for addr, client = range sc.clients {
-			if addr != sc.primAddr {
-				break
-			}
-		}
-	} else {
-		var ok bool
-		if client, ok = sc.clients[addr]; !ok {
-			return nil, errUnknownAddress
-		}
-	}
+	client, ok := sc.clients[addr]
 	sc.l.RUnlock()
+	if !ok {
+		return nil, errUnknownAddress
+	}
 
 	if client != nil {
 		return client, nil
@@ -337,15 +392,40 @@ func sentinelMtoAddr(m map[string]string, cmd string) (string, error) {
 	return net.JoinHostPort(m["ip"], m["port"]), nil
 }
 
+// returns true if the given SENTINEL REPLICAS entry describes a replica which
+// shouldn't be read from, because either the sentinel considers it to be down
+// or it reports that its link to the primary is down.
+func sentinelReplicaDown(m map[string]string) bool {
+	if status, ok := m["master-link-status"]; ok && status != "ok" {
+		return true
+	}
+	for _, flag := range strings.Split(m["flags"], ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return true
+		}
+	}
+	return false
+}
+
 // given a connection to a sentinel, ensures that the Clients currently being
 // held agrees with what the sentinel thinks they should be
 func (sc *Sentinel) ensureClients(conn Conn) error {
 	var primM map[string]string
 	var secMM []map[string]string
-	if err := conn.Do(Pipeline(
+	err := conn.Do(Pipeline(
 		Cmd(&primM, "SENTINEL", "MASTER", sc.name),
-		Cmd(&secMM, "SENTINEL", "SLAVES", sc.name),
-	)); err != nil {
+		Cmd(&secMM, "SENTINEL", "REPLICAS", sc.name),
+	))
+	if errors.As(err, new(resp2.Error)) {
+		// SENTINEL REPLICAS was only added in redis 5, fall back to its older
+		// name
+		err = conn.Do(Pipeline(
+			Cmd(&primM, "SENTINEL", "MASTER", sc.name),
+			Cmd(&secMM, "SENTINEL", "SLAVES", sc.name),
+		))
+	}
+	if err != nil {
 		return err
 	}
 
@@ -355,26 +435,44 @@ func (sc *Sentinel) ensureClients(conn Conn) error {
 	}
 
 	newClients := map[string]Client{newPrimAddr: nil}
+	downAddrs := map[string]bool{}
 	for _, secM := range secMM {
-		newSecAddr, err := sentinelMtoAddr(secM, "SENTINEL SLAVES")
+		newSecAddr, err := sentinelMtoAddr(secM, "SENTINEL REPLICAS")
 		if err != nil {
 			return err
 		}
 		newClients[newSecAddr] = nil
+		if sentinelReplicaDown(secM) {
+			downAddrs[newSecAddr] = true
+		}
 	}
 
-	return sc.setClients(newPrimAddr, newClients)
+	return sc.setClients(newPrimAddr, newClients, downAddrs)
 }
 
-// all values of newClients should be nil
-func (sc *Sentinel) setClients(newPrimAddr string, newClients map[string]Client) error {
+// all values of newClients should be nil. Replicas in downAddrs are kept in
+// clients, but aren't selected by DoSecondary.
+func (sc *Sentinel) setClients(newPrimAddr string, newClients map[string]Client, downAddrs map[string]bool) error {
 	newClients[newPrimAddr] = nil
 	var toClose []Client
 
+	newReplicaAddrs := sentinelReplicaAddrs(newPrimAddr, newClients)
+	upReplicaAddrs := make(map[string]bool, len(newReplicaAddrs))
+	for addr := range newReplicaAddrs {
+		if !downAddrs[addr] {
+			upReplicaAddrs[addr] = true
+		}
+	}
+	sortedUpAddrs := sortedAddrs(upReplicaAddrs)
+
 	sc.l.RLock()
 
+	prevPrimAddr := sc.primAddr
+	prevReplicaAddrs := sentinelReplicaAddrs(sc.primAddr, sc.clients)
+
 	// stateChanged may be set to true in other ways later in the method
-	stateChanged := sc.primAddr != newPrimAddr
+	stateChanged := sc.primAddr != newPrimAddr ||
+		strings.Join(sc.replicaAddrs, ",") != strings.Join(sortedUpAddrs, ",")
 
 	// for each actual Client instance in sc.client, either move it over to
 	// newClients (if the address is shared) or make sure it is closed
@@ -419,15 +517,67 @@ func (sc *Sentinel) setClients(newPrimAddr string, newClients map[string]Client)
 	sc.l.Lock()
 	sc.primAddr = newPrimAddr
 	sc.clients = newClients
+	sc.replicaAddrs = sortedUpAddrs
 	sc.l.Unlock()
 
 	for _, client := range toClose {
 		client.Close()
 	}
 
+	syncReplicaSelector(sc.so.rs, newReplicaAddrs)
+
+	if prevPrimAddr != newPrimAddr {
+		sc.switchNotifier.notify()
+	}
+
+	// prevPrimAddr is only empty during initialization, which isn't traced
+	if prevPrimAddr != "" {
+		if prevPrimAddr != newPrimAddr {
+			sc.tracePrimarySwitched(prevPrimAddr, newPrimAddr)
+		}
+		sc.traceReplicasChanged(prevReplicaAddrs, newReplicaAddrs)
+	}
+
 	return nil
 }
 
+func sentinelReplicaAddrs(primAddr string, clients map[string]Client) map[string]bool {
+	addrs := make(map[string]bool, len(clients))
+	for addr := range clients {
+		if addr != primAddr {
+			addrs[addr] = true
+		}
+	}
+	return addrs
+}
+
+// returns the sorted addresses which are in newAddrs but not prevAddrs, and
+// those which are in prevAddrs but not newAddrs.
+func sentinelAddrsDiff(prevAddrs, newAddrs map[string]bool) (added, removed []string) {
+	for addr := range newAddrs {
+		if !prevAddrs[addr] {
+			added = append(added, addr)
+		}
+	}
+	for addr := range prevAddrs {
+		if !newAddrs[addr] {
+			removed = append(removed, addr)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func sortedAddrs(addrs map[string]bool) []string {
+	sorted := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		sorted = append(sorted, addr)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
 // annoyingly the SENTINEL SENTINELS <name> command doesn't return _this_
 // sentinel instance, only the others it knows about for that primary
 func (sc *Sentinel) ensureSentinelAddrs(conn Conn) error {
@@ -443,8 +593,15 @@ func (sc *Sentinel) ensureSentinelAddrs(conn Conn) error {
 	}
 
 	sc.l.Lock()
+	prevAddrs := sc.sentinelAddrs
+	// primAddr is only empty during initialization, which isn't traced
+	initialized := sc.primAddr != ""
 	sc.sentinelAddrs = addrs
 	sc.l.Unlock()
+
+	if initialized {
+		sc.traceSentinelsChanged(prevAddrs, addrs)
+	}
 	return nil
 }
 
@@ -479,18 +636,24 @@ func (sc *Sentinel) spin() {
 func (sc *Sentinel) innerSpin() error {
 	conn, err := sc.dialSentinel()
 	if err != nil {
+		sc.traceConnLost("", err)
 		return err
 	}
 	defer conn.Close()
 
+	addr := conn.NetConn().RemoteAddr().String()
+	sc.traceConnReestablished(addr)
+
 	tick := time.NewTicker(5 * time.Second)
 	defer tick.Stop()
 
 	var switchMaster bool
 	for {
 		if err := sc.ensureSentinelAddrs(conn); err != nil {
+			sc.traceConnLost(addr, err)
 			return err
 		} else if err := sc.ensureClients(conn); err != nil {
+			sc.traceConnLost(addr, err)
 			return err
 		}
 		sc.pconn.Ping()
@@ -522,3 +685,80 @@ func (sc *Sentinel) forceMasterSwitch(waitFor time.Duration) {
 	atomic.StoreUint32(&sc.testSleepBeforeSwitch, uint32(waitFor.Nanoseconds()/1e6))
 	sc.pconnCh <- PubSubMessage{}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+func (sc *Sentinel) traceCommon() trace.SentinelCommon {
+	return trace.SentinelCommon{PrimaryName: sc.name}
+}
+
+func (sc *Sentinel) tracePrimarySwitched(oldAddr, newAddr string) {
+	if sc.so.st.PrimarySwitched != nil {
+		sc.so.st.PrimarySwitched(trace.SentinelPrimarySwitched{
+			SentinelCommon: sc.traceCommon(),
+			OldAddr:        oldAddr,
+			NewAddr:        newAddr,
+		})
+	}
+}
+
+func (sc *Sentinel) traceReplicasChanged(prevAddrs, newAddrs map[string]bool) {
+	if sc.so.st.ReplicasChanged == nil {
+		return
+	}
+	added, removed := sentinelAddrsDiff(prevAddrs, newAddrs)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	sc.so.st.ReplicasChanged(trace.SentinelReplicasChanged{
+		SentinelCommon: sc.traceCommon(),
+		Added:          added,
+		Removed:        removed,
+		Addrs:          sortedAddrs(newAddrs),
+	})
+}
+
+func (sc *Sentinel) traceSentinelsChanged(prevAddrs, newAddrs map[string]bool) {
+	if sc.so.st.SentinelsChanged == nil {
+		return
+	}
+	added, removed := sentinelAddrsDiff(prevAddrs, newAddrs)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	sc.so.st.SentinelsChanged(trace.SentinelSentinelsChanged{
+		SentinelCommon: sc.traceCommon(),
+		Added:          added,
+		Removed:        removed,
+		Addrs:          sortedAddrs(newAddrs),
+	})
+}
+
+// NOTE this must only be called from within the spin goroutine
+func (sc *Sentinel) traceConnLost(addr string, err error) {
+	if sc.connLost {
+		return
+	}
+	sc.connLost = true
+	if sc.so.st.ConnLost != nil {
+		sc.so.st.ConnLost(trace.SentinelConnLost{
+			SentinelCommon: sc.traceCommon(),
+			Addr:           addr,
+			Err:            err,
+		})
+	}
+}
+
+// NOTE this must only be called from within the spin goroutine
+func (sc *Sentinel) traceConnReestablished(addr string) {
+	if !sc.connLost {
+		return
+	}
+	sc.connLost = false
+	if sc.so.st.ConnReestablished != nil {
+		sc.so.st.ConnReestablished(trace.SentinelConnReestablished{
+			SentinelCommon: sc.traceCommon(),
+			Addr:           addr,
+		})
+	}
+}
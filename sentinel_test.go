@@ -12,6 +12,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/mediocregopher/radix/v3/trace"
 )
 
 type sentinelStub struct {
@@ -25,6 +27,9 @@ type sentinelStub struct {
 	// addresses of all "sentinels" in the cluster
 	sentAddrs []string
 
+	// flags to report for secondaries, by address
+	secFlags map[string]string
+
 	// stubChs which have been created for stubs and want to know about
 	// switch-master messages
 	stubChs map[chan<- PubSubMessage]bool
@@ -35,6 +40,7 @@ func newSentinelStub(primAddr string, secAddrs, sentAddrs []string) sentinelStub
 		primAddr:  primAddr,
 		secAddrs:  secAddrs,
 		sentAddrs: sentAddrs,
+		secFlags:  map[string]string{},
 		stubChs:   map[chan<- PubSubMessage]bool{},
 	}
 }
@@ -86,10 +92,14 @@ func (s *sentinelStub) newConn(network, addr string) (Conn, error) {
 		case "MASTER":
 			return addrToM(s.primAddr)
 
-		case "SLAVES":
+		case "SLAVES", "REPLICAS":
 			mm := make([]map[string]string, len(s.secAddrs))
 			for i := range s.secAddrs {
 				mm[i] = addrToM(s.secAddrs[i])
+				mm[i]["flags"] = "slave"
+				if flags := s.secFlags[s.secAddrs[i]]; flags != "" {
+					mm[i]["flags"] += "," + flags
+				}
 			}
 			return mm
 
@@ -460,3 +470,135 @@ func TestSentinelSecondaryRead(t *T) {
 
 	runTest(32)
 }
+
+func TestSentinelTrace(t *T) {
+	stub := newSentinelStub(
+		"127.0.0.1:9736", // primAddr
+		[]string{"127.0.0.2:9736", "127.0.0.3:9736"},                      // secAddrs
+		[]string{"127.0.0.1:29736", "127.0.0.2:29736", "127.0.0.3:29736"}, // sentAddrs
+	)
+
+	poolFn := func(network, addr string) (Client, error) {
+		return Stub(network, addr, func(args []string) interface{} {
+			return addr
+		}), nil
+	}
+
+	var l sync.Mutex
+	var primarySwitched []trace.SentinelPrimarySwitched
+	var replicasChanged []trace.SentinelReplicasChanged
+	var sentinelsChanged []trace.SentinelSentinelsChanged
+	scc, err := NewSentinel(
+		"stub",
+		stub.sentAddrs,
+		SentinelConnFunc(stub.newConn),
+		SentinelPoolFunc(poolFn),
+		SentinelWithTrace(trace.SentinelTrace{
+			PrimarySwitched: func(ps trace.SentinelPrimarySwitched) {
+				l.Lock()
+				defer l.Unlock()
+				primarySwitched = append(primarySwitched, ps)
+			},
+			ReplicasChanged: func(rc trace.SentinelReplicasChanged) {
+				l.Lock()
+				defer l.Unlock()
+				replicasChanged = append(replicasChanged, rc)
+			},
+			SentinelsChanged: func(sc trace.SentinelSentinelsChanged) {
+				l.Lock()
+				defer l.Unlock()
+				sentinelsChanged = append(sentinelsChanged, sc)
+			},
+		}),
+	)
+	require.Nil(t, err)
+	defer scc.Close()
+
+	stub.Lock()
+	stub.sentAddrs = append(stub.sentAddrs, "127.0.0.4:29736")
+	stub.Unlock()
+
+	stub.switchPrimary("127.0.0.2:9736", "127.0.0.3:9736", "127.0.0.4:9736")
+	assert.Equal(t, "switch-master completed", <-scc.testEventCh)
+
+	common := trace.SentinelCommon{PrimaryName: "stub"}
+	l.Lock()
+	defer l.Unlock()
+	assert.Equal(t, []trace.SentinelPrimarySwitched{{
+		SentinelCommon: common,
+		OldAddr:        "127.0.0.1:9736",
+		NewAddr:        "127.0.0.2:9736",
+	}}, primarySwitched)
+	assert.Equal(t, []trace.SentinelReplicasChanged{{
+		SentinelCommon: common,
+		Added:          []string{"127.0.0.4:9736"},
+		Removed:        []string{"127.0.0.2:9736"},
+		Addrs:          []string{"127.0.0.3:9736", "127.0.0.4:9736"},
+	}}, replicasChanged)
+	assert.Equal(t, []trace.SentinelSentinelsChanged{{
+		SentinelCommon: common,
+		Added:          []string{"127.0.0.4:29736"},
+		Addrs: []string{
+			"127.0.0.1:29736", "127.0.0.2:29736", "127.0.0.3:29736", "127.0.0.4:29736",
+		},
+	}}, sentinelsChanged)
+}
+
+func TestSentinelReplicaSelector(t *T) {
+	stub := newSentinelStub(
+		"127.0.0.1:9736", // primAddr
+		[]string{"127.0.0.2:9736", "127.0.0.3:9736", "127.0.0.4:9736"}, // secAddrs
+		[]string{"127.0.0.1:29736"},                                    // sentAddrs
+	)
+	stub.secFlags["127.0.0.3:9736"] = "s_down"
+
+	poolFn := func(network, addr string) (Client, error) {
+		return Stub(network, addr, func(args []string) interface{} {
+			return addr
+		}), nil
+	}
+
+	scc, err := NewSentinel(
+		"stub",
+		stub.sentAddrs,
+		SentinelConnFunc(stub.newConn),
+		SentinelPoolFunc(poolFn),
+		SentinelReplicaSelector(RoundRobinReplicaSelector()),
+	)
+	require.Nil(t, err)
+	defer scc.Close()
+
+	assertAddrs := func(expAddrs ...string) {
+		for _, expAddr := range expAddrs {
+			var addr string
+			require.Nil(t, scc.DoSecondary(Cmd(&addr, "GIMME", "YOUR", "ADDRESS")))
+			assert.Equal(t, expAddr, addr)
+		}
+	}
+
+	// the replica which is down is never read from, but is still known
+	assertAddrs("127.0.0.2:9736", "127.0.0.4:9736", "127.0.0.2:9736", "127.0.0.4:9736")
+	_, secAddrs := scc.Addrs()
+	assert.ElementsMatch(t, []string{"127.0.0.2:9736", "127.0.0.3:9736", "127.0.0.4:9736"}, secAddrs)
+	_, err = scc.Client("127.0.0.3:9736")
+	assert.Nil(t, err)
+
+	stub.Lock()
+	stub.secFlags["127.0.0.2:9736"] = "disconnected"
+	stub.secFlags["127.0.0.4:9736"] = "s_down"
+	stub.Unlock()
+	scc.forceMasterSwitch(0)
+	assert.Equal(t, "switch-master completed", <-scc.testEventCh)
+
+	// with no replicas up reads go to the primary
+	assertAddrs("127.0.0.1:9736", "127.0.0.1:9736")
+
+	stub.Lock()
+	stub.secFlags = map[string]string{}
+	stub.Unlock()
+	scc.forceMasterSwitch(0)
+	assert.Equal(t, "switch-master completed", <-scc.testEventCh)
+
+	// the round-robin carries on from where it was, but now over all replicas
+	assertAddrs("127.0.0.3:9736", "127.0.0.4:9736", "127.0.0.2:9736")
+}
@@ -3,10 +3,12 @@ package radix
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	errors "golang.org/x/xerrors"
@@ -237,6 +239,26 @@ type StreamReaderOpts struct {
 	// NoAck optionally enables passing the NOACK flag to XREADGROUP.
 	NoAck bool
 
+	// CreateGroup optionally causes the consumer group to be created, using XGROUP CREATE with MKSTREAM, on each
+	// of the streams before the first read. Streams which don't exist yet are created as well. Streams on which
+	// the group already exists are left as they are.
+	//
+	// CreateGroup only has an effect if Group is set.
+	CreateGroup bool
+
+	// CreateGroupID is the ID with which consumer groups are created due to CreateGroup or RecreateGroup. Only
+	// entries newer than the ID will be read by the group.
+	//
+	// If CreateGroupID is nil, "$" is used, which means only entries added after the group was created will be
+	// read.
+	CreateGroupID *StreamEntryID
+
+	// RecreateGroup optionally causes the consumer group to be created again, as with CreateGroup, when a read
+	// fails with a NOGROUP error, e.g. because one of the streams was deleted. The read is then retried once.
+	//
+	// RecreateGroup only has an effect if Group is set.
+	RecreateGroup bool
+
 	// Block specifies the duration in milliseconds that reads will wait for new data before returning.
 	//
 	// If Block is negative, reads will block indefinitely until new entries can be read or there is an error.
@@ -276,11 +298,77 @@ type StreamReader interface {
 	Next() (stream string, entries []StreamEntry, ok bool)
 }
 
+// StreamGroupReader is a StreamReader reading as part of a consumer group,
+// which can also acknowledge the entries it has read.
+type StreamGroupReader interface {
+	StreamReader
+
+	// Ack marks the entries with the given IDs in the given stream as
+	// acknowledged for the consumer group. The acknowledgements are buffered
+	// and sent when Flush is called, which happens automatically before each
+	// read done by Next, using a single XACK per stream.
+	//
+	// Entries claimed by a reader returned from NewStreamReclaimer for the same
+	// consumer group can be acknowledged here as well.
+	Ack(stream string, ids ...StreamEntryID) error
+
+	// Flush sends all acknowledgements buffered by Ack. If sending the
+	// acknowledgements for a stream fails they are kept to be sent by the next
+	// Flush, and the error is returned.
+	//
+	// If the Flush done by Next fails Next returns ok == false, and Err
+	// returns the error from Flush. Unlike other errors this one doesn't end
+	// the reader: the next call to Next clears it and tries again.
+	Flush() error
+
+	// Handle calls Next and then calls fn for each of the entries returned, in
+	// order. Each entry for which fn returns nil is acknowledged using Ack.
+	//
+	// If fn returns an error Handle stops and returns that error. The entry
+	// and the entries following it are not acknowledged, so they remain pending
+	// and can be reclaimed. If Next fails the error from Err is returned.
+	Handle(fn func(stream string, entry StreamEntry) error) error
+
+	// Close interrupts any read or Flush which is in progress, and causes all
+	// calls to Next made after it to fail. Close may be called concurrently with
+	// Next, e.g. to stop a reader which is blocked waiting for new entries.
+	//
+	// Close does not send any acknowledgements still buffered by Ack, Flush
+	// should be called before Close for that.
+	Close() error
+}
+
 // NewStreamReader returns a new StreamReader for the given client.
 //
+// If the client is a *Cluster and the streams belong to different slots, the
+// streams are read using a separate XREAD or XREADGROUP for each slot. Reads of
+// slots on different nodes are performed concurrently, and Next returns the
+// entries of whichever completes first. Only a single read per node is in
+// progress at a time: if a node serves multiple of the slots they are read in
+// turn without blocking, and polled until entries are available or the block
+// duration has passed.
+//
 // Any changes on opts after calling NewStreamReader will have no effect.
 func NewStreamReader(c Client, opts StreamReaderOpts) StreamReader {
+	return NewStreamGroupReader(c, opts)
+}
+
+// NewStreamGroupReader is like NewStreamReader, but returns a
+// StreamGroupReader which can acknowledge the entries it has read. opts.Group
+// and opts.Consumer must be set.
+func NewStreamGroupReader(c Client, opts StreamReaderOpts) StreamGroupReader {
+	if cluster, ok := c.(*Cluster); ok {
+		if sr := newClusterStreamReader(cluster, opts); sr != nil {
+			return sr
+		}
+	}
+	return newStreamReader(c, opts)
+}
+
+func newStreamReader(c Client, opts StreamReaderOpts) *streamReader {
 	sr := &streamReader{c: c, opts: opts}
+	sr.ctx, sr.cancel = context.WithCancel(context.Background())
+	sr.streamAcks = streamAcks{c: c, ctx: sr.ctx, group: opts.Group}
 
 	if sr.opts.Group != "" {
 		sr.cmd = "XREADGROUP"
@@ -294,15 +382,9 @@ func NewStreamReader(c Client, opts StreamReaderOpts) StreamReader {
 		sr.fixedArgs = append(sr.fixedArgs, "COUNT", strconv.Itoa(sr.opts.Count))
 	}
 
-	if !sr.opts.NoBlock {
-		dur := 5 * time.Second
-		if sr.opts.Block < 0 {
-			dur = 0
-		} else if sr.opts.Block > 0 {
-			dur = sr.opts.Block
-		}
+	if dur, ok := streamReaderBlock(sr.opts); ok {
 		msec := int(dur / time.Millisecond)
-		sr.fixedArgs = append(sr.fixedArgs, "BLOCK", strconv.Itoa(msec))
+		sr.blockArgs = []string{"BLOCK", strconv.Itoa(msec)}
 	}
 
 	if sr.opts.Group != "" && sr.opts.NoAck {
@@ -327,15 +409,25 @@ func NewStreamReader(c Client, opts StreamReaderOpts) StreamReader {
 	// the map after using the reader.
 	sr.opts.Streams = nil
 
-	sr.fixedArgs = append(sr.fixedArgs, "STREAMS")
-	sr.fixedArgs = append(sr.fixedArgs, sr.streams...)
-
 	// preallocate space for all arguments passed to Cmd
-	sr.args = make([]string, 0, len(sr.fixedArgs)+len(sr.streams))
+	sr.args = make([]string, 0, len(sr.fixedArgs)+len(sr.blockArgs)+1+2*len(sr.streams))
 
 	return sr
 }
 
+// streamReaderBlock returns the duration reads using the given options block
+// for, where 0 means blocking indefinitely. ok is false if reads don't block.
+func streamReaderBlock(opts StreamReaderOpts) (dur time.Duration, ok bool) {
+	if opts.NoBlock {
+		return 0, false
+	} else if opts.Block < 0 {
+		return 0, true
+	} else if opts.Block > 0 {
+		return opts.Block, true
+	}
+	return 5 * time.Second, true
+}
+
 // streamReader implements the StreamReader interface.
 type streamReader struct {
 	c    Client
@@ -346,29 +438,114 @@ type streamReader struct {
 
 	cmd       string   // command. either XREAD or XREADGROUP
 	fixedArgs []string // fixed arguments that always come directly after the command
+	blockArgs []string // BLOCK and its argument, empty if reads don't block
 	args      []string // arguments passed to Cmd. reused between calls to Next to avoid allocations.
 
-	unread []StreamEntries
-	err    error
+	groupsCreated bool // true once CreateGroup has been handled
+
+	// ctx is used for all commands, and is cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	streamAcks
+
+	unread   []StreamEntries
+	err      error
+	flushErr error // error from the last Flush done by Next, cleared by Next
 }
 
-func (sr *streamReader) backfill() bool {
+func isRespErrPrefix(err error, prefix string) bool {
+	var respErr resp2.Error
+	return errors.As(err, &respErr) && strings.HasPrefix(respErr.Error(), prefix)
+}
+
+// createGroups creates the consumer group on all streams which don't have it yet.
+func (sr *streamReader) createGroups() error {
+	id := "$"
+	if sr.opts.CreateGroupID != nil {
+		id = sr.opts.CreateGroupID.String()
+	}
+
+	for _, stream := range sr.streams {
+		err := DoContext(sr.ctx, sr.c, Cmd(nil, "XGROUP", "CREATE", stream, sr.opts.Group, id, "MKSTREAM"))
+		if err != nil && !isRespErrPrefix(err, "BUSYGROUP") {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sr *streamReader) read(block bool) error {
 	sr.args = append(sr.args[:0], sr.fixedArgs...)
+	if block {
+		sr.args = append(sr.args, sr.blockArgs...)
+	}
 
+	sr.args = append(sr.args, "STREAMS")
+	sr.args = append(sr.args, sr.streams...)
 	for _, s := range sr.streams {
 		sr.args = append(sr.args, sr.ids[s])
 	}
 
-	if sr.err = sr.c.Do(Cmd(&sr.unread, sr.cmd, sr.args...)); sr.err != nil {
+	return DoContext(sr.ctx, sr.c, Cmd(&sr.unread, sr.cmd, sr.args...))
+}
+
+// resolveLastIDs replaces the "$" ID of each stream read using XREAD with the
+// ID of the stream's last entry, or 0-0 if it's empty. This allows the streams
+// to be read without blocking, which would never return anything for "$".
+func (sr *streamReader) resolveLastIDs() error {
+	for _, s := range sr.streams {
+		if sr.ids[s] != "$" {
+			continue
+		}
+
+		var last []StreamEntry
+		if err := DoContext(sr.ctx, sr.c, Cmd(&last, "XREVRANGE", s, "+", "-", "COUNT", "1")); err != nil {
+			return err
+		}
+
+		sr.ids[s] = "0-0"
+		if len(last) > 0 {
+			sr.ids[s] = last[0].ID.String()
+		}
+	}
+	return nil
+}
+
+// backfill reads new entries into unread. If block is false the read doesn't
+// block, even if the reader's options say otherwise.
+func (sr *streamReader) backfill(block bool) bool {
+	if sr.flushErr = sr.Flush(); sr.flushErr != nil {
 		return false
 	}
 
-	return true
+	if sr.cmd == "XREADGROUP" && sr.opts.CreateGroup && !sr.groupsCreated {
+		if sr.err = sr.createGroups(); sr.err != nil {
+			return false
+		}
+		sr.groupsCreated = true
+	}
+
+	sr.err = sr.read(block)
+	if sr.err != nil && sr.cmd == "XREADGROUP" && sr.opts.RecreateGroup && isRespErrPrefix(sr.err, "NOGROUP") {
+		if sr.err = sr.createGroups(); sr.err == nil {
+			sr.err = sr.read(block)
+		}
+	}
+
+	if sr.err != nil && sr.ctx.Err() != nil {
+		sr.err = errClientClosed
+	}
+	return sr.err == nil
 }
 
 // Err implements the StreamReader interface.
 func (sr *streamReader) Err() error {
-	return sr.err
+	if sr.err != nil {
+		return sr.err
+	}
+	return sr.flushErr
 }
 
 func (sr *streamReader) nextFromBuffer() (stream string, entries []StreamEntry) {
@@ -396,6 +573,10 @@ func (sr *streamReader) nextFromBuffer() (stream string, entries []StreamEntry)
 
 // Next implements the StreamReader interface.
 func (sr *streamReader) Next() (stream string, entries []StreamEntry, ok bool) {
+	sr.flushErr = nil
+	if sr.err == nil && sr.ctx.Err() != nil {
+		sr.err = errClientClosed
+	}
 	if sr.err != nil {
 		return "", nil, false
 	}
@@ -404,7 +585,7 @@ func (sr *streamReader) Next() (stream string, entries []StreamEntry, ok bool) {
 		return stream, entries, true
 	}
 
-	if !sr.backfill() {
+	if !sr.backfill(true) {
 		return "", nil, false
 	}
 
@@ -414,3 +595,74 @@ func (sr *streamReader) Next() (stream string, entries []StreamEntry, ok bool) {
 
 	return "", nil, true
 }
+
+var errStreamNoGroup = errors.New("stream reader has no consumer group")
+
+// streamAcks implements the Ack and Flush methods of StreamGroupReader.
+type streamAcks struct {
+	c     Client
+	ctx   context.Context // the reader's ctx, which interrupts Flush on Close
+	group string
+	acks  map[string][]string // buffered acknowledgements by stream
+}
+
+// Ack implements the StreamGroupReader interface.
+func (sa *streamAcks) Ack(stream string, ids ...StreamEntryID) error {
+	if sa.group == "" {
+		return errStreamNoGroup
+	} else if sa.acks == nil {
+		sa.acks = map[string][]string{}
+	}
+
+	for _, id := range ids {
+		sa.acks[stream] = append(sa.acks[stream], id.String())
+	}
+	return nil
+}
+
+// Flush implements the StreamGroupReader interface.
+func (sa *streamAcks) Flush() error {
+	var err error
+	for stream, ids := range sa.acks {
+		args := append([]string{stream, sa.group}, ids...)
+		if ackErr := DoContext(sa.ctx, sa.c, Cmd(nil, "XACK", args...)); ackErr != nil {
+			if sa.ctx.Err() != nil {
+				return errClientClosed
+			} else if err == nil {
+				err = ackErr
+			}
+			continue
+		}
+		delete(sa.acks, stream)
+	}
+	return err
+}
+
+// streamHandle implements the Handle method of StreamGroupReader using the
+// other methods.
+func streamHandle(r StreamGroupReader, fn func(stream string, entry StreamEntry) error) error {
+	stream, entries, ok := r.Next()
+	if !ok {
+		return r.Err()
+	}
+
+	for _, entry := range entries {
+		if err := fn(stream, entry); err != nil {
+			return err
+		} else if err := r.Ack(stream, entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handle implements the StreamGroupReader interface.
+func (sr *streamReader) Handle(fn func(stream string, entry StreamEntry) error) error {
+	return streamHandle(sr, fn)
+}
+
+// Close implements the StreamGroupReader interface.
+func (sr *streamReader) Close() error {
+	sr.cancel()
+	return nil
+}
@@ -0,0 +1,280 @@
+package radix
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// streamPollInterval is the longest a clusterStreamReader waits between
+// non-blocking reads of the slots of a node.
+const streamPollInterval = 100 * time.Millisecond
+
+// clusterStreamReader implements the StreamGroupReader interface for streams
+// which belong to different slots of a Cluster. Since XREAD and XREADGROUP
+// require all of their streams to belong to a single slot, a streamReader is
+// used for each slot.
+//
+// The slots are grouped by the node serving them, and only a single read is in
+// progress per node. Reads of different nodes are performed concurrently.
+type clusterStreamReader struct {
+	c       *Cluster
+	opts    StreamReaderOpts
+	readers []*streamReader // one per slot
+
+	reading      []bool                 // whether a read is in progress for each reader
+	readingAddrs map[string]bool        // nodes which have a read in progress
+	readCh       chan clusterStreamRead // reads which have completed
+
+	// ctx is used for waiting between non-blocking reads and for Flush, and is
+	// cancelled by Close. l protects ctx and wg against concurrent calls to Next and Close.
+	l      sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	streamAcks
+
+	err      error
+	flushErr error // see streamReader
+}
+
+// clusterStreamRead describes a read of one or more slots of a single node.
+type clusterStreamRead struct {
+	addr string
+	idxs []int // indexes of the readers being read
+}
+
+// newClusterStreamReader returns a clusterStreamReader if the streams in opts
+// belong to more than one slot, or nil otherwise.
+func newClusterStreamReader(c *Cluster, opts StreamReaderOpts) *clusterStreamReader {
+	bySlot := map[uint16]map[string]*StreamEntryID{}
+	for stream, id := range opts.Streams {
+		slot := ClusterSlot([]byte(stream))
+		if bySlot[slot] == nil {
+			bySlot[slot] = map[string]*StreamEntryID{}
+		}
+		bySlot[slot][stream] = id
+	}
+	if len(bySlot) < 2 {
+		return nil
+	}
+
+	slots := make([]int, 0, len(bySlot))
+	for slot := range bySlot {
+		slots = append(slots, int(slot))
+	}
+	sort.Ints(slots)
+
+	sr := &clusterStreamReader{
+		c:            c,
+		opts:         opts,
+		readers:      make([]*streamReader, len(slots)),
+		reading:      make([]bool, len(slots)),
+		readingAddrs: map[string]bool{},
+		readCh:       make(chan clusterStreamRead, len(slots)),
+	}
+	sr.opts.Streams = nil
+	sr.ctx, sr.cancel = context.WithCancel(context.Background())
+	sr.streamAcks = streamAcks{c: c, ctx: sr.ctx, group: opts.Group}
+
+	for i, slot := range slots {
+		slotOpts := opts
+		slotOpts.Streams = bySlot[uint16(slot)]
+		sr.readers[i] = newStreamReader(c, slotOpts)
+	}
+	return sr
+}
+
+// Err implements the StreamReader interface.
+func (sr *clusterStreamReader) Err() error {
+	if sr.err != nil {
+		return sr.err
+	}
+	return sr.flushErr
+}
+
+func (sr *clusterStreamReader) nextFromBuffers() (stream string, entries []StreamEntry) {
+	for i, r := range sr.readers {
+		if sr.reading[i] {
+			continue
+		} else if stream, entries = r.nextFromBuffer(); stream != "" {
+			return stream, entries
+		}
+	}
+	return "", nil
+}
+
+// startReads starts a read for each node which doesn't have one in progress,
+// covering all of the node's slots which aren't being read. It returns false if
+// the reader has been closed.
+func (sr *clusterStreamReader) startReads() bool {
+	sr.l.Lock()
+	defer sr.l.Unlock()
+	if sr.ctx.Err() != nil {
+		return false
+	}
+
+	byAddr := map[string][]int{}
+	var addrs []string
+	for i, r := range sr.readers {
+		if sr.reading[i] {
+			continue
+		}
+		addr := sr.c.addrForKey(r.streams[0])
+		if sr.readingAddrs[addr] {
+			continue
+		} else if byAddr[addr] == nil {
+			addrs = append(addrs, addr)
+		}
+		byAddr[addr] = append(byAddr[addr], i)
+	}
+
+	for _, addr := range addrs {
+		read := clusterStreamRead{addr: addr, idxs: byAddr[addr]}
+		sr.readingAddrs[addr] = true
+		for _, i := range read.idxs {
+			sr.reading[i] = true
+		}
+
+		sr.wg.Add(1)
+		go func() {
+			defer sr.wg.Done()
+			sr.readNode(read.idxs)
+			sr.readCh <- read
+		}()
+	}
+	return true
+}
+
+// readNode reads the slots of a single node. A single slot is read as usual.
+// Multiple slots are read in turn without blocking, and then polled until
+// entries were read or the reader's block duration has passed, so that only a
+// single connection to the node is used.
+func (sr *clusterStreamReader) readNode(idxs []int) {
+	if len(idxs) == 1 {
+		sr.readers[idxs[0]].backfill(true)
+		return
+	}
+
+	for _, i := range idxs {
+		r := sr.readers[i]
+		if r.err = r.resolveLastIDs(); r.err != nil {
+			if r.ctx.Err() != nil {
+				r.err = errClientClosed
+			}
+			return
+		}
+	}
+
+	block, blocks := streamReaderBlock(sr.opts)
+	deadline := time.Now().Add(block)
+	for {
+		var read bool
+		for _, i := range idxs {
+			r := sr.readers[i]
+			if !r.backfill(false) {
+				return
+			}
+			read = read || len(r.unread) > 0
+		}
+
+		wait := streamPollInterval
+		if remaining := time.Until(deadline); block > 0 && remaining < wait {
+			wait = remaining
+		}
+		if read || !blocks || wait <= 0 {
+			return
+		}
+
+		t := getTimer(wait)
+		select {
+		case <-t.C:
+		case <-sr.ctx.Done():
+		}
+		putTimer(t)
+		if sr.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (sr *clusterStreamReader) readDone(read clusterStreamRead) {
+	delete(sr.readingAddrs, read.addr)
+	for _, i := range read.idxs {
+		sr.reading[i] = false
+		if err := sr.readers[i].err; err != nil && sr.err == nil {
+			sr.err = err
+		}
+	}
+}
+
+// Next implements the StreamReader interface.
+//
+// A read is started for each node which doesn't have one in progress, and Next
+// returns once any of them has completed. Reads which are still in progress
+// will be picked up by later calls to Next.
+func (sr *clusterStreamReader) Next() (stream string, entries []StreamEntry, ok bool) {
+	sr.flushErr = nil
+	if sr.err == nil && sr.ctx.Err() != nil {
+		sr.err = errClientClosed
+	}
+	if sr.err != nil {
+		return "", nil, false
+	}
+
+	if stream, entries = sr.nextFromBuffers(); stream != "" {
+		return stream, entries, true
+	}
+
+	if sr.flushErr = sr.Flush(); sr.flushErr != nil {
+		return "", nil, false
+	}
+
+	if !sr.startReads() {
+		sr.err = errClientClosed
+		return "", nil, false
+	}
+
+	sr.readDone(<-sr.readCh)
+	for more := true; more; {
+		select {
+		case read := <-sr.readCh:
+			sr.readDone(read)
+		default:
+			more = false
+		}
+	}
+
+	if sr.err == nil && sr.ctx.Err() != nil {
+		sr.err = errClientClosed
+	}
+	if sr.err != nil {
+		return "", nil, false
+	} else if stream, entries = sr.nextFromBuffers(); stream != "" {
+		return stream, entries, true
+	}
+
+	return "", nil, true
+}
+
+// Handle implements the StreamGroupReader interface.
+func (sr *clusterStreamReader) Handle(fn func(stream string, entry StreamEntry) error) error {
+	return streamHandle(sr, fn)
+}
+
+// Close implements the StreamGroupReader interface.
+//
+// Close waits for all reads which are in progress to be interrupted.
+func (sr *clusterStreamReader) Close() error {
+	sr.l.Lock()
+	sr.cancel()
+	for _, r := range sr.readers {
+		r.Close()
+	}
+	sr.l.Unlock()
+
+	sr.wg.Wait()
+	return nil
+}
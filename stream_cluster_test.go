@@ -0,0 +1,181 @@
+package radix
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clusterStreamTestKeys returns keys of streams in different slots, the first
+// two of which are on the same node, and the others on different nodes.
+func clusterStreamTestKeys(tb TB, c *Cluster) []string {
+	tb.Helper()
+	streams := []string{clusterSlotKeys[0], clusterSlotKeys[1], clusterSlotKeys[8000], clusterSlotKeys[16000]}
+	addrs := map[string]bool{}
+	for _, stream := range streams {
+		addrs[c.addrForKey(stream)] = true
+	}
+	require.Len(tb, addrs, len(streams)-1)
+	require.Equal(tb, c.addrForKey(streams[0]), c.addrForKey(streams[1]))
+	return streams
+}
+
+// assertClusterStreamEntries reads until the expected entry ID has been read
+// from each of the given streams.
+func assertClusterStreamEntries(tb TB, r StreamReader, exp map[string]string) {
+	tb.Helper()
+	// the stub doesn't support BLOCK, so reads of single slot nodes return
+	// immediately while multi-slot nodes are polled. The loop is therefore
+	// bounded by time rather than by the number of reads.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(exp) > 0 && time.Now().Before(deadline) {
+		stream, entries, ok := r.Next()
+		require.True(tb, ok, "err: %v", r.Err())
+		if stream == "" {
+			continue
+		}
+		require.Contains(tb, exp, stream)
+		require.Len(tb, entries, 1)
+		assert.Equal(tb, exp[stream], entries[0].ID.String())
+		assert.Equal(tb, map[string]string{"key": stream}, entries[0].Fields)
+		delete(exp, stream)
+	}
+	assert.Empty(tb, exp)
+}
+
+func assertNoClusterStreamEntries(tb TB, r StreamReader) {
+	tb.Helper()
+	for i := 0; i < 3; i++ {
+		stream, entries, ok := r.Next()
+		require.True(tb, ok, "err: %v", r.Err())
+		assert.Empty(tb, stream)
+		assert.Empty(tb, entries)
+	}
+
+	// Next doesn't wait for the reads of every node, so wait for the ones
+	// still in progress to complete. Otherwise they may resolve "$" IDs or
+	// create groups only after the caller has added new entries.
+	sr := r.(*clusterStreamReader)
+	for i := 0; len(sr.readCh) < len(sr.readingAddrs); i++ {
+		require.True(tb, i < 300, "reads didn't complete")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterStreamReader(t *T) {
+	c, _ := newTestCluster()
+	defer c.Close()
+	streams := clusterStreamTestKeys(t, c)
+
+	// a single stream is read as usual
+	r := NewStreamReader(c, StreamReaderOpts{
+		Streams: map[string]*StreamEntryID{streams[0]: nil},
+	})
+	assert.IsType(t, new(streamReader), r)
+
+	// streams[1] is polled along with streams[0], so its "$" ID is resolved to
+	// 0-0, since the stream doesn't exist yet
+	r = NewStreamReader(c, StreamReaderOpts{
+		Streams: map[string]*StreamEntryID{
+			streams[0]: {},
+			streams[1]: nil,
+			streams[2]: {},
+			streams[3]: {},
+		},
+		NoBlock: true,
+	})
+	require.IsType(t, new(clusterStreamReader), r)
+	defer r.(StreamGroupReader).Close()
+
+	assertNoClusterStreamEntries(t, r)
+
+	for _, stream := range streams {
+		require.Nil(t, c.Do(Cmd(nil, "SET", stream, "1-1")))
+	}
+	assertClusterStreamEntries(t, r, map[string]string{
+		streams[0]: "1-1", streams[1]: "1-1", streams[2]: "1-1", streams[3]: "1-1",
+	})
+	assertNoClusterStreamEntries(t, r)
+
+	// the ID of each stream is tracked separately
+	require.Nil(t, c.Do(Cmd(nil, "SET", streams[1], "2-1")))
+	assertClusterStreamEntries(t, r, map[string]string{streams[1]: "2-1"})
+	assertNoClusterStreamEntries(t, r)
+
+	// acknowledging requires a group
+	gr := r.(StreamGroupReader)
+	assert.Error(t, gr.Ack(streams[0], StreamEntryID{Time: 1, Seq: 1}))
+}
+
+func TestClusterStreamGroupReader(t *T) {
+	c, _ := newTestCluster()
+	defer c.Close()
+	streams := clusterStreamTestKeys(t, c)
+	for _, stream := range streams {
+		require.Nil(t, c.Do(Cmd(nil, "SET", stream, "1-1")))
+	}
+
+	newReader := func(block time.Duration) StreamGroupReader {
+		r := NewStreamGroupReader(c, StreamReaderOpts{
+			Streams: map[string]*StreamEntryID{
+				streams[0]: nil,
+				streams[1]: nil,
+				streams[2]: nil,
+				streams[3]: nil,
+			},
+			Group:       "group",
+			Consumer:    "consumer",
+			CreateGroup: true,
+			Block:       block,
+		})
+		require.IsType(t, new(clusterStreamReader), r)
+		return r
+	}
+
+	t.Run("CreateGroup", func(t *T) {
+		r := newReader(50 * time.Millisecond)
+		defer r.Close()
+
+		// the group is created in every slot, starting after the existing
+		// entries
+		assertNoClusterStreamEntries(t, r)
+
+		for _, stream := range streams {
+			require.Nil(t, c.Do(Cmd(nil, "SET", stream, "2-1")))
+		}
+		assertClusterStreamEntries(t, r, map[string]string{
+			streams[0]: "2-1", streams[1]: "2-1", streams[2]: "2-1", streams[3]: "2-1",
+		})
+		assertNoClusterStreamEntries(t, r)
+
+		for _, stream := range streams {
+			require.NoError(t, r.Ack(stream, StreamEntryID{Time: 2, Seq: 1}))
+		}
+		require.NoError(t, r.Flush())
+	})
+
+	t.Run("Close", func(t *T) {
+		// the streams on the same node are polled until Close is called
+		r := newReader(-1)
+
+		errCh := make(chan error)
+		go func() {
+			for {
+				if _, _, ok := r.Next(); !ok {
+					errCh <- r.Err()
+					return
+				}
+			}
+		}()
+
+		time.Sleep(150 * time.Millisecond)
+		require.NoError(t, r.Close())
+		assert.Equal(t, errClientClosed, <-errCh)
+
+		_, _, ok := r.Next()
+		assert.False(t, ok)
+		assert.Equal(t, errClientClosed, r.Err())
+	})
+}
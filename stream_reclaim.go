@@ -0,0 +1,496 @@
+package radix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// StreamReclaimerOpts contains various options given for NewStreamReclaimer
+// that influence the behaviour.
+//
+// Streams, Group and Consumer are required.
+type StreamReclaimerOpts struct {
+	// Streams must contain one or more stream names whose pending entries will
+	// be reclaimed.
+	Streams []string
+
+	// Group is the consumer group whose pending entries will be reclaimed.
+	Group string
+
+	// Consumer is the consumer which reclaimed entries will be claimed for.
+	Consumer string
+
+	// MinIdle is the minimum duration an entry must have been pending, without
+	// being delivered again, before it is reclaimed.
+	//
+	// The default, if MinIdle is 0, is 30 seconds.
+	MinIdle time.Duration
+
+	// Count limits the number of pending entries which are looked at per
+	// stream by each call to Next which needs to query redis.
+	//
+	// The default, if Count is 0, is 100.
+	Count int
+
+	// Interval is the duration Next will wait before looking for pending
+	// entries again, once all pending entries of all streams have been looked
+	// at and none could be reclaimed.
+	//
+	// The default, if Interval is 0, is 5 seconds.
+	Interval time.Duration
+
+	// NoBlock disables waiting for Interval when there are no entries to
+	// reclaim.
+	NoBlock bool
+
+	// MaxDeliveries optionally limits the number of times an entry will be
+	// delivered. Entries which would be delivered more often than
+	// MaxDeliveries are added to DeadLetterStream, if it is set, and then
+	// acknowledged, instead of being returned from Next.
+	//
+	// Delivery counts are only available through XPENDING, so if MaxDeliveries
+	// is set XPENDING and XCLAIM are used even if NoAutoClaim is false.
+	MaxDeliveries int
+
+	// DeadLetterStream is the stream which entries exceeding MaxDeliveries are
+	// added to, with the same fields as the original entry. If it's empty such
+	// entries are only acknowledged.
+	DeadLetterStream string
+
+	// NoAutoClaim causes XPENDING and XCLAIM to be used instead of XAUTOCLAIM,
+	// which is only available since redis 6.2.
+	NoAutoClaim bool
+}
+
+// NewStreamReclaimer returns a StreamGroupReader which, rather than reading new
+// entries, claims entries which were delivered to other consumers of a
+// consumer group but haven't been acknowledged within opts.MinIdle, e.g.
+// because the consumer crashed. It is meant to be used alongside a StreamReader
+// using the same Group and Consumer.
+//
+// Each call to Next which needs to query redis will look at up to opts.Count
+// pending entries of each stream, and return those which could be claimed.
+// Once all pending entries have been looked at, and none could be claimed,
+// the next call to Next will wait opts.Interval before starting over from the
+// oldest pending entry. The wait is interrupted by Close.
+//
+// Entries which were deleted from their stream while pending are acknowledged
+// and skipped.
+//
+// Any changes on opts after calling NewStreamReclaimer will have no effect.
+func NewStreamReclaimer(c Client, opts StreamReclaimerOpts) StreamGroupReader {
+	sr := &streamReclaimer{c: c, opts: opts}
+	sr.opts.Streams = append([]string(nil), opts.Streams...)
+	sr.ctx, sr.cancel = context.WithCancel(context.Background())
+	sr.streamAcks = streamAcks{c: c, ctx: sr.ctx, group: opts.Group}
+
+	if sr.opts.MinIdle == 0 {
+		sr.opts.MinIdle = 30 * time.Second
+	}
+	if sr.opts.Count == 0 {
+		sr.opts.Count = 100
+	}
+	if sr.opts.Interval == 0 {
+		sr.opts.Interval = 5 * time.Second
+	}
+
+	sr.minIdle = strconv.FormatInt(int64(sr.opts.MinIdle/time.Millisecond), 10)
+	sr.count = strconv.Itoa(sr.opts.Count)
+	sr.cursors = make(map[string]StreamEntryID, len(sr.opts.Streams))
+	return sr
+}
+
+// streamReclaimer implements the StreamGroupReader interface.
+type streamReclaimer struct {
+	c    Client
+	opts StreamReclaimerOpts
+
+	// ctx is used for all commands and for waiting between runs, and is
+	// cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	streamAcks
+
+	minIdle, count string
+
+	// cursors contains the ID from which to look for pending entries next in
+	// each stream. A zero ID means the stream will be looked at from the start.
+	cursors map[string]StreamEntryID
+
+	// idle is set if the last backfill started over for all streams without
+	// reclaiming any entries.
+	idle bool
+
+	unread   []StreamEntries
+	err      error
+	flushErr error // see streamReader
+}
+
+func (sr *streamReclaimer) do(a Action) error {
+	return DoContext(sr.ctx, sr.c, a)
+}
+
+func (sr *streamReclaimer) backfill() bool {
+	if sr.flushErr = sr.Flush(); sr.flushErr != nil {
+		return false
+	}
+
+	sr.idle = true
+	for _, stream := range sr.opts.Streams {
+		var entries []StreamEntry
+		if sr.opts.NoAutoClaim || sr.opts.MaxDeliveries > 0 {
+			entries, sr.err = sr.claim(stream)
+		} else {
+			entries, sr.err = sr.autoClaim(stream)
+		}
+		if sr.err != nil {
+			if sr.ctx.Err() != nil {
+				sr.err = errClientClosed
+			}
+			return false
+		}
+
+		if len(entries) > 0 {
+			sr.unread = append(sr.unread, StreamEntries{Stream: stream, Entries: entries})
+			sr.idle = false
+		} else if sr.cursors[stream] != (StreamEntryID{}) {
+			sr.idle = false
+		}
+	}
+	return true
+}
+
+func (sr *streamReclaimer) autoClaim(stream string) ([]StreamEntry, error) {
+	cursor := sr.cursors[stream]
+	var res streamAutoClaimResult
+	err := sr.do(Cmd(&res, "XAUTOCLAIM", stream, sr.opts.Group, sr.opts.Consumer,
+		sr.minIdle, cursor.String(), "COUNT", sr.count))
+	if err != nil {
+		return nil, err
+	}
+	sr.cursors[stream] = res.cursor
+
+	return sr.filterClaimed(stream, res.entries, nil, func() ([]StreamEntryID, error) {
+		// XAUTOCLAIM doesn't return the IDs of deleted entries before redis
+		// 7.0, but they are now pending for Consumer within the scanned range.
+		end := "+"
+		if res.cursor != (StreamEntryID{}) {
+			end = "(" + res.cursor.String()
+		}
+
+		var pending []streamPendingEntry
+		err := sr.do(Cmd(&pending, "XPENDING", stream, sr.opts.Group,
+			cursor.String(), end, sr.count, sr.opts.Consumer))
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]StreamEntryID, len(pending))
+		for i, p := range pending {
+			ids[i] = p.id
+		}
+		return ids, nil
+	})
+}
+
+func (sr *streamReclaimer) claim(stream string) ([]StreamEntry, error) {
+	cursor := sr.cursors[stream]
+	var pending []streamPendingEntry
+	err := sr.do(Cmd(&pending, "XPENDING", stream, sr.opts.Group, cursor.String(), "+", sr.count))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pending) < sr.opts.Count {
+		sr.cursors[stream] = StreamEntryID{}
+	} else {
+		sr.cursors[stream] = pending[len(pending)-1].id.Next()
+	}
+
+	args := []string{stream, sr.opts.Group, sr.opts.Consumer, sr.minIdle}
+	ids := make([]StreamEntryID, 0, len(pending))
+	deliveries := make(map[StreamEntryID]int, len(pending))
+	for _, p := range pending {
+		if p.idle < sr.opts.MinIdle {
+			continue
+		}
+		args = append(args, p.id.String())
+		ids = append(ids, p.id)
+		deliveries[p.id] = p.deliveries
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var claimed streamClaimedEntries
+	if err := sr.do(Cmd(&claimed, "XCLAIM", args...)); err != nil {
+		return nil, err
+	}
+
+	return sr.filterClaimed(stream, claimed, deliveries, func() ([]StreamEntryID, error) {
+		return ids, nil
+	})
+}
+
+// filterClaimed returns the claimed entries which should be returned from Next.
+// Entries exceeding MaxDeliveries, according to the given delivery counts, are
+// dead-lettered, and entries which were deleted from the stream are
+// acknowledged, since they can't be handled.
+//
+// Depending on the redis version deleted entries are either returned without
+// fields, as nil, or not at all. In the latter two cases candidates is called to get the IDs which may
+// belong to deleted entries, and each of those which wasn't returned and no
+// longer exists in the stream is acknowledged as well.
+func (sr *streamReclaimer) filterClaimed(
+	stream string, claimed streamClaimedEntries, deliveries map[StreamEntryID]int,
+	candidates func() ([]StreamEntryID, error),
+) ([]StreamEntry, error) {
+	var deleted []string
+	returned := make(map[StreamEntryID]bool, len(claimed.entries))
+	entries := claimed.entries[:0]
+	for _, entry := range claimed.entries {
+		returned[entry.ID] = true
+
+		// the entry was deleted from the stream, but its ID is still known
+		if entry.Fields == nil {
+			deleted = append(deleted, entry.ID.String())
+			continue
+		}
+
+		// XCLAIM increments the delivery count, which is accounted for here
+		if sr.opts.MaxDeliveries > 0 && deliveries[entry.ID]+1 > sr.opts.MaxDeliveries {
+			if err := sr.deadLetter(stream, entry); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if claimed.deleted > 0 {
+		ids, err := candidates()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			if returned[id] {
+				continue
+			}
+
+			// entries which still exist may have been claimed by another
+			// consumer in the meantime, and are left alone
+			var existing []StreamEntry
+			if err := sr.do(Cmd(&existing, "XRANGE", stream, id.String(), id.String())); err != nil {
+				return nil, err
+			} else if len(existing) == 0 {
+				deleted = append(deleted, id.String())
+			}
+		}
+	}
+
+	if len(deleted) > 0 {
+		args := append([]string{stream, sr.opts.Group}, deleted...)
+		if err := sr.do(Cmd(nil, "XACK", args...)); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (sr *streamReclaimer) deadLetter(stream string, entry StreamEntry) error {
+	if sr.opts.DeadLetterStream != "" {
+		args := make([]string, 0, 2+len(entry.Fields)*2)
+		args = append(args, sr.opts.DeadLetterStream, "*")
+		for k, v := range entry.Fields {
+			args = append(args, k, v)
+		}
+		if err := sr.do(Cmd(nil, "XADD", args...)); err != nil {
+			return err
+		}
+	}
+	return sr.do(Cmd(nil, "XACK", stream, sr.opts.Group, entry.ID.String()))
+}
+
+// Err implements the StreamReader interface.
+func (sr *streamReclaimer) Err() error {
+	if sr.err != nil {
+		return sr.err
+	}
+	return sr.flushErr
+}
+
+func (sr *streamReclaimer) nextFromBuffer() (stream string, entries []StreamEntry) {
+	if len(sr.unread) == 0 {
+		return "", nil
+	}
+	sre := sr.unread[0]
+	sr.unread = sr.unread[1:]
+	return sre.Stream, sre.Entries
+}
+
+// Next implements the StreamReader interface.
+func (sr *streamReclaimer) Next() (stream string, entries []StreamEntry, ok bool) {
+	sr.flushErr = nil
+	if sr.err == nil && sr.ctx.Err() != nil {
+		sr.err = errClientClosed
+	}
+	if sr.err != nil {
+		return "", nil, false
+	}
+
+	if stream, entries = sr.nextFromBuffer(); stream != "" {
+		return stream, entries, true
+	}
+
+	if sr.idle && !sr.opts.NoBlock {
+		t := getTimer(sr.opts.Interval)
+		select {
+		case <-t.C:
+		case <-sr.ctx.Done():
+		}
+		putTimer(t)
+
+		if sr.ctx.Err() != nil {
+			sr.err = errClientClosed
+			return "", nil, false
+		}
+	}
+
+	if !sr.backfill() {
+		return "", nil, false
+	}
+
+	if stream, entries = sr.nextFromBuffer(); stream != "" {
+		return stream, entries, true
+	}
+
+	return "", nil, true
+}
+
+// Handle implements the StreamGroupReader interface.
+func (sr *streamReclaimer) Handle(fn func(stream string, entry StreamEntry) error) error {
+	return streamHandle(sr, fn)
+}
+
+// Close implements the StreamGroupReader interface.
+func (sr *streamReclaimer) Close() error {
+	sr.cancel()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// streamPendingEntry is an entry of the extended form of XPENDING.
+type streamPendingEntry struct {
+	id         StreamEntryID
+	consumer   string
+	idle       time.Duration
+	deliveries int
+}
+
+func (p *streamPendingEntry) UnmarshalRESP(br *bufio.Reader) error {
+	var ah resp2.ArrayHeader
+	if err := ah.UnmarshalRESP(br); err != nil {
+		return err
+	} else if ah.N != 4 {
+		return errors.New("invalid xpending response")
+	} else if err := p.id.UnmarshalRESP(br); err != nil {
+		return err
+	}
+
+	var bs resp2.BulkString
+	if err := bs.UnmarshalRESP(br); err != nil {
+		return err
+	}
+	p.consumer = bs.S
+
+	var i resp2.Int
+	if err := i.UnmarshalRESP(br); err != nil {
+		return err
+	}
+	p.idle = time.Duration(i.I) * time.Millisecond
+
+	if err := i.UnmarshalRESP(br); err != nil {
+		return err
+	}
+	p.deliveries = int(i.I)
+	return nil
+}
+
+// streamClaimedEntries is the list of entries returned by XCLAIM and
+// XAUTOCLAIM. Unlike a []StreamEntry it may contain nil entries, for entries
+// which were deleted from the stream. Those are counted in deleted rather than
+// being added to entries.
+type streamClaimedEntries struct {
+	entries []StreamEntry
+	deleted int
+}
+
+var (
+	nilArrayPrefix = []byte("*-1")
+	nilBulkPrefix  = []byte("$-1")
+)
+
+func (s *streamClaimedEntries) UnmarshalRESP(br *bufio.Reader) error {
+	var ah resp2.ArrayHeader
+	if err := ah.UnmarshalRESP(br); err != nil {
+		return err
+	}
+
+	s.entries = make([]StreamEntry, 0, ah.N)
+	s.deleted = 0
+	for i := 0; i < ah.N; i++ {
+		if b, err := br.Peek(len(nilArrayPrefix)); err != nil {
+			return err
+		} else if bytes.Equal(b, nilArrayPrefix) || bytes.Equal(b, nilBulkPrefix) {
+			if err := (resp2.Any{}).UnmarshalRESP(br); err != nil {
+				return err
+			}
+			s.deleted++
+			continue
+		}
+
+		var entry StreamEntry
+		if err := entry.UnmarshalRESP(br); err != nil {
+			return err
+		}
+		s.entries = append(s.entries, entry)
+	}
+	return nil
+}
+
+// streamAutoClaimResult is the result of XAUTOCLAIM.
+type streamAutoClaimResult struct {
+	cursor  StreamEntryID
+	entries streamClaimedEntries
+}
+
+func (r *streamAutoClaimResult) UnmarshalRESP(br *bufio.Reader) error {
+	var ah resp2.ArrayHeader
+	if err := ah.UnmarshalRESP(br); err != nil {
+		return err
+	} else if ah.N != 2 && ah.N != 3 {
+		return errors.New("invalid xautoclaim response")
+	} else if err := r.cursor.UnmarshalRESP(br); err != nil {
+		return err
+	} else if err := r.entries.UnmarshalRESP(br); err != nil {
+		return err
+	}
+
+	// since redis 7.0 the IDs of deleted entries, which have been removed from
+	// the PEL, are returned as well
+	if ah.N == 3 {
+		return resp2.Any{}.UnmarshalRESP(br)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package radix
+
+import (
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addPendingStreamEntries adds n entries to the stream and reads them as the
+// given consumer of the group, so that they are pending.
+func addPendingStreamEntries(tb TB, c Client, stream, group, consumer string, n int) []StreamEntryID {
+	tb.Helper()
+	addStreamGroup(tb, c, stream, group, "0")
+	ids := addNStreamEntries(tb, c, stream, n)
+	r := NewStreamReader(c, StreamReaderOpts{
+		Streams:  map[string]*StreamEntryID{stream: nil},
+		Group:    group,
+		Consumer: consumer,
+		NoBlock:  true,
+	})
+	// assertStreamReaderEntries modifies the slices it's given
+	assertStreamReaderEntries(tb, r, map[string][]StreamEntryID{
+		stream: append([]StreamEntryID(nil), ids...),
+	})
+	return ids
+}
+
+func TestStreamReclaimer(t *T) {
+	for _, noAutoClaim := range []bool{false, true} {
+		name := "XAUTOCLAIM"
+		if noAutoClaim {
+			name = "XCLAIM"
+		}
+		t.Run(name, func(t *T) {
+			c := dial()
+			defer c.Close()
+
+			group, consumer1, consumer2 := randStr(), randStr(), randStr()
+			stream1, stream2 := randStr(), randStr()
+			ids1 := addPendingStreamEntries(t, c, stream1, group, consumer1, 3)
+			ids2 := addPendingStreamEntries(t, c, stream2, group, consumer1, 1)
+
+			r := NewStreamReclaimer(c, StreamReclaimerOpts{
+				Streams:     []string{stream1, stream2},
+				Group:       group,
+				Consumer:    consumer2,
+				MinIdle:     100 * time.Millisecond,
+				Count:       2,
+				NoBlock:     true,
+				NoAutoClaim: noAutoClaim,
+			})
+
+			// nothing has been idle for long enough yet
+			assertNoStreamReaderEntries(t, r)
+			assertNoStreamReaderEntries(t, r)
+
+			time.Sleep(150 * time.Millisecond)
+			assertStreamReaderEntries(t, r, map[string][]StreamEntryID{
+				stream1: ids1[:2],
+				stream2: ids2,
+			})
+			assertStreamReaderEntries(t, r, map[string][]StreamEntryID{
+				stream1: ids1[2:],
+			})
+
+			// the claimed entries are no longer idle
+			assertNoStreamReaderEntries(t, r)
+			assertConsumer(t, c, stream1, group, consumer1, 0)
+			assertConsumer(t, c, stream1, group, consumer2, 3)
+			assertConsumer(t, c, stream2, group, consumer2, 1)
+		})
+	}
+
+	t.Run("DeadLetter", func(t *T) {
+		c := dial()
+		defer c.Close()
+
+		group, consumer1, consumer2 := randStr(), randStr(), randStr()
+		stream, deadStream := randStr(), randStr()
+		ids := addPendingStreamEntries(t, c, stream, group, consumer1, 2)
+
+		var entries []StreamEntry
+		require.NoError(t, c.Do(Cmd(&entries, "XRANGE", stream, "-", "+")))
+
+		r := NewStreamReclaimer(c, StreamReclaimerOpts{
+			Streams:          []string{stream},
+			Group:            group,
+			Consumer:         consumer2,
+			MinIdle:          100 * time.Millisecond,
+			NoBlock:          true,
+			MaxDeliveries:    2,
+			DeadLetterStream: deadStream,
+		})
+
+		// the second delivery is still allowed
+		time.Sleep(150 * time.Millisecond)
+		assertStreamReaderEntries(t, r, map[string][]StreamEntryID{stream: ids})
+
+		// the third isn't
+		time.Sleep(150 * time.Millisecond)
+		assertNoStreamReaderEntries(t, r)
+
+		var pending []interface{}
+		require.NoError(t, c.Do(Cmd(&pending, "XPENDING", stream, group)))
+		assert.Equal(t, int64(0), pending[0])
+
+		var dead []StreamEntry
+		require.NoError(t, c.Do(Cmd(&dead, "XRANGE", deadStream, "-", "+")))
+		require.Len(t, dead, len(entries))
+		for i := range dead {
+			assert.Equal(t, entries[i].Fields, dead[i].Fields)
+		}
+	})
+}
+
+func TestStreamReclaimerStub(t *T) {
+	for _, noAutoClaim := range []bool{false, true} {
+		name := "DeletedXAUTOCLAIM"
+		if noAutoClaim {
+			name = "DeletedXCLAIM"
+		}
+		t.Run(name, func(t *T) {
+			entry := []interface{}{"1-2", []string{"f", "v"}}
+
+			var cmds []string
+			stub := Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+				cmds = append(cmds, strings.Join(args, " "))
+				switch args[0] {
+				case "XAUTOCLAIM":
+					return []interface{}{"0-0", []interface{}{nil, entry}}
+				case "XCLAIM":
+					return []interface{}{nil, entry}
+				case "XPENDING":
+					return []interface{}{
+						[]interface{}{"1-1", "consumer", 200, 1},
+						[]interface{}{"1-2", "consumer", 200, 1},
+						[]interface{}{"1-3", "consumer", 200, 1},
+					}
+				case "XRANGE":
+					// 1-3 still exists, e.g. because it was claimed by
+					// another consumer in the meantime
+					if args[2] == "1-3" {
+						return []interface{}{[]interface{}{"1-3", []string{"f", "v"}}}
+					}
+					return []interface{}{}
+				}
+				return 1
+			})
+
+			r := NewStreamReclaimer(stub, StreamReclaimerOpts{
+				Streams:     []string{"stream"},
+				Group:       "group",
+				Consumer:    "consumer",
+				MinIdle:     100 * time.Millisecond,
+				Count:       10,
+				NoBlock:     true,
+				NoAutoClaim: noAutoClaim,
+			})
+
+			stream, entries, ok := r.Next()
+			require.True(t, ok, "err: %v", r.Err())
+			assert.Equal(t, "stream", stream)
+			require.Len(t, entries, 1)
+			assert.Equal(t, StreamEntryID{Time: 1, Seq: 2}, entries[0].ID)
+
+			assert.Contains(t, cmds, "XRANGE stream 1-1 1-1")
+			assert.Contains(t, cmds, "XRANGE stream 1-3 1-3")
+			assert.NotContains(t, cmds, "XRANGE stream 1-2 1-2")
+			assert.Equal(t, "XACK stream group 1-1", cmds[len(cmds)-1])
+			if !noAutoClaim {
+				assert.Contains(t, cmds, "XPENDING stream group 0-0 + 10 consumer")
+			}
+		})
+	}
+
+	t.Run("Close", func(t *T) {
+		stub := Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+			return []interface{}{"0-0", []interface{}{}}
+		})
+
+		r := NewStreamReclaimer(stub, StreamReclaimerOpts{
+			Streams:  []string{"stream"},
+			Group:    "group",
+			Consumer: "consumer",
+			Interval: time.Hour,
+		})
+
+		// the first run finds nothing, so the next call to Next would wait
+		// for Interval
+		_, entries, ok := r.Next()
+		require.True(t, ok, "err: %v", r.Err())
+		assert.Empty(t, entries)
+
+		okCh := make(chan bool)
+		go func() {
+			_, _, ok := r.Next()
+			okCh <- ok
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, r.Close())
+		assert.False(t, <-okCh)
+		assert.Equal(t, errClientClosed, r.Err())
+	})
+}
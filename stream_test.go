@@ -3,6 +3,7 @@ package radix
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io/ioutil"
 	"math"
 	"strconv"
@@ -10,8 +11,12 @@ import (
 	. "testing"
 	"time"
 
+	errors "golang.org/x/xerrors"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
 )
 
 func TestStreamEntryID(t *T) {
@@ -736,6 +741,167 @@ func TestStreamReader(t *T) {
 
 			assertNoStreamReaderEntries(t, r)
 		})
+
+		t.Run("CreateGroup", func(t *T) {
+			c := dial()
+			defer c.Close()
+
+			consumer, group := randStr(), randStr()
+			stream1, stream2 := randStr(), randStr()
+
+			// stream1 exists with an entry already, stream2 doesn't exist at all
+			s1id1 := addStreamEntry(t, c, stream1)
+
+			r := NewStreamReader(c, StreamReaderOpts{
+				Streams: map[string]*StreamEntryID{
+					stream1: nil,
+					stream2: nil,
+				},
+				Group:         group,
+				Consumer:      consumer,
+				NoBlock:       true,
+				CreateGroup:   true,
+				CreateGroupID: &StreamEntryID{},
+			})
+
+			assertStreamReaderEntries(t, r, map[string][]StreamEntryID{stream1: {s1id1}})
+
+			s2id1 := addStreamEntry(t, c, stream2)
+			assertStreamReaderEntries(t, r, map[string][]StreamEntryID{stream2: {s2id1}})
+
+			assertNoStreamReaderEntries(t, r)
+			assertConsumer(t, c, stream1, group, consumer, 1)
+			assertConsumer(t, c, stream2, group, consumer, 1)
+
+			// creating the group again for a new reader is a no-op
+			r = NewStreamReader(c, StreamReaderOpts{
+				Streams:     map[string]*StreamEntryID{stream1: nil},
+				Group:       group,
+				Consumer:    consumer,
+				NoBlock:     true,
+				CreateGroup: true,
+			})
+			assertNoStreamReaderEntries(t, r)
+		})
+
+		t.Run("RecreateGroup", func(t *T) {
+			c := dial()
+			defer c.Close()
+
+			consumer, group := randStr(), randStr()
+			stream1 := randStr()
+
+			addStreamGroup(t, c, stream1, group, "0")
+
+			r := NewStreamReader(c, StreamReaderOpts{
+				Streams:       map[string]*StreamEntryID{stream1: nil},
+				Group:         group,
+				Consumer:      consumer,
+				NoBlock:       true,
+				RecreateGroup: true,
+				CreateGroupID: &StreamEntryID{},
+			})
+
+			id1 := addStreamEntry(t, c, stream1)
+			assertStreamReaderEntries(t, r, map[string][]StreamEntryID{stream1: {id1}})
+
+			// deleting the stream also deletes the group
+			require.NoError(t, c.Do(Cmd(nil, "DEL", stream1)))
+			id2 := addStreamEntry(t, c, stream1)
+			assertStreamReaderEntries(t, r, map[string][]StreamEntryID{stream1: {id2}})
+
+			assertNoStreamReaderEntries(t, r)
+			assertConsumer(t, c, stream1, group, consumer, 1)
+		})
+
+		t.Run("Ack", func(t *T) {
+			c := dial()
+			defer c.Close()
+
+			consumer, group := randStr(), randStr()
+			stream1, stream2 := randStr(), randStr()
+
+			addStreamGroup(t, c, stream1, group, "0-0")
+			addStreamGroup(t, c, stream2, group, "0-0")
+			ids1 := addNStreamEntries(t, c, stream1, 3)
+			ids2 := addNStreamEntries(t, c, stream2, 2)
+
+			r := NewStreamGroupReader(c, StreamReaderOpts{
+				Streams: map[string]*StreamEntryID{
+					stream1: nil,
+					stream2: nil,
+				},
+				Group:    group,
+				Consumer: consumer,
+				NoBlock:  true,
+			})
+
+			assertStreamReaderEntries(t, r, map[string][]StreamEntryID{
+				stream1: append([]StreamEntryID(nil), ids1...),
+				stream2: append([]StreamEntryID(nil), ids2...),
+			})
+
+			// acks are only sent on Flush
+			require.NoError(t, r.Ack(stream1, ids1[0], ids1[1]))
+			require.NoError(t, r.Ack(stream2, ids2...))
+			assertConsumer(t, c, stream1, group, consumer, 3)
+			require.NoError(t, r.Flush())
+			assertConsumer(t, c, stream1, group, consumer, 1)
+			assertConsumer(t, c, stream2, group, consumer, 0)
+
+			// or before the next read
+			require.NoError(t, r.Ack(stream1, ids1[2]))
+			assertNoStreamReaderEntries(t, r)
+			assertConsumer(t, c, stream1, group, consumer, 0)
+
+			// without a group there's nothing to ack
+			nr := NewStreamGroupReader(c, StreamReaderOpts{
+				Streams: map[string]*StreamEntryID{stream1: nil},
+				NoBlock: true,
+			})
+			assert.Error(t, nr.Ack(stream1, ids1[0]))
+		})
+
+		t.Run("Handle", func(t *T) {
+			c := dial()
+			defer c.Close()
+
+			consumer, group := randStr(), randStr()
+			stream1 := randStr()
+
+			addStreamGroup(t, c, stream1, group, "0-0")
+			ids := addNStreamEntries(t, c, stream1, 3)
+
+			r := NewStreamGroupReader(c, StreamReaderOpts{
+				Streams:  map[string]*StreamEntryID{stream1: nil},
+				Group:    group,
+				Consumer: consumer,
+				NoBlock:  true,
+			})
+
+			errHandler := errors.New("handler failed")
+			var handled []StreamEntryID
+			err := r.Handle(func(stream string, entry StreamEntry) error {
+				assert.Equal(t, stream1, stream)
+				handled = append(handled, entry.ID)
+				if entry.ID == ids[1] {
+					return errHandler
+				}
+				return nil
+			})
+			assert.Equal(t, errHandler, err)
+			assert.Equal(t, ids[:2], handled)
+
+			// only the first entry was acknowledged
+			require.NoError(t, r.Flush())
+			assertConsumer(t, c, stream1, group, consumer, 2)
+
+			// nothing left to read, so the handler isn't called
+			require.NoError(t, r.Handle(func(string, StreamEntry) error {
+				assert.Fail(t, "handler called unexpectedly")
+				return nil
+			}))
+		})
 	})
 
 	t.Run("NoGroup", func(t *T) {
@@ -897,6 +1063,106 @@ func TestStreamReader(t *T) {
 	})
 }
 
+// blockingClient blocks every DoContext call until its context is done.
+type blockingClient struct {
+	Client
+}
+
+func (bc blockingClient) DoContext(ctx context.Context, a Action) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStreamGroupReaderStub(t *T) {
+	t.Run("FlushErr", func(t *T) {
+		var cmds []string
+		var ackFails bool
+		stub := Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+			cmds = append(cmds, strings.Join(args, " "))
+			if args[0] == "XACK" && ackFails {
+				return resp2.Error{E: errors.New("ERR ack failed")}
+			}
+			return nil
+		})
+
+		r := NewStreamGroupReader(stub, StreamReaderOpts{
+			Streams:  map[string]*StreamEntryID{"stream": nil},
+			Group:    "group",
+			Consumer: "consumer",
+			NoBlock:  true,
+		})
+
+		// a failed Flush is returned from Next, but doesn't end the reader
+		ackFails = true
+		require.NoError(t, r.Ack("stream", StreamEntryID{Time: 1}))
+		_, _, ok := r.Next()
+		assert.False(t, ok)
+		assert.Error(t, r.Err())
+
+		ackFails = false
+		cmds = nil
+		_, _, ok = r.Next()
+		assert.True(t, ok)
+		assert.NoError(t, r.Err())
+		assert.Equal(t, []string{
+			"XACK stream group 1-0",
+			"XREADGROUP GROUP group consumer STREAMS stream >",
+		}, cmds)
+	})
+
+	t.Run("Close", func(t *T) {
+		r := NewStreamGroupReader(blockingClient{}, StreamReaderOpts{
+			Streams:  map[string]*StreamEntryID{"stream": nil},
+			Group:    "group",
+			Consumer: "consumer",
+			Block:    -1,
+		})
+
+		okCh := make(chan bool)
+		go func() {
+			_, _, ok := r.Next()
+			okCh <- ok
+		}()
+
+		require.NoError(t, r.Close())
+		assert.False(t, <-okCh)
+		assert.Equal(t, errClientClosed, r.Err())
+
+		_, _, ok := r.Next()
+		assert.False(t, ok)
+		assert.Equal(t, errClientClosed, r.Err())
+	})
+
+	t.Run("CloseFlush", func(t *T) {
+		release := make(chan struct{})
+		defer close(release)
+		r := NewStreamGroupReader(hangingClient{release: release}, StreamReaderOpts{
+			Streams:  map[string]*StreamEntryID{"stream": nil},
+			Group:    "group",
+			Consumer: "consumer",
+			NoBlock:  true,
+		})
+		require.NoError(t, r.Ack("stream", StreamEntryID{Time: 1}))
+
+		// the Flush done by Next is interrupted as well
+		okCh := make(chan bool)
+		go func() {
+			_, _, ok := r.Next()
+			okCh <- ok
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, r.Close())
+		select {
+		case ok := <-okCh:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("Flush wasn't interrupted by Close")
+		}
+		assert.Equal(t, errClientClosed, r.Err())
+	})
+}
+
 func BenchmarkStreamReader(b *B) {
 	c := dial()
 	defer c.Close()
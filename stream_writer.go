@@ -0,0 +1,132 @@
+package radix
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+// StreamWriterOpts contains various options given for NewStreamWriter that
+// influence the behaviour.
+type StreamWriterOpts struct {
+	// MaxLen optionally causes streams to be trimmed to MaxLen entries when
+	// entries are added, by passing MAXLEN to XADD.
+	MaxLen int64
+
+	// MinAge optionally causes entries older than MinAge to be evicted from
+	// streams when entries are added, by passing MINID to XADD. The ID is
+	// computed from the current time on each XADD, so this assumes that
+	// entry IDs are generated by redis, or are otherwise based on the time
+	// in milliseconds. This requires redis 6.2.
+	//
+	// MaxLen and MinAge can't both be set.
+	MinAge time.Duration
+
+	// Approx causes streams to be trimmed approximately, by passing "~" along
+	// with MAXLEN or MINID. This is much more efficient, but may leave some
+	// more entries than requested in a stream.
+	Approx bool
+}
+
+// StreamWriterEntry describes an entry which is to be added to a stream by a
+// StreamWriter.
+type StreamWriterEntry struct {
+	// Stream is the name of the stream the entry is added to.
+	Stream string
+
+	// ID is the ID of the new entry. If ID is nil, redis generates the ID.
+	ID *StreamEntryID
+
+	// Fields contains the fields and values of the entry. It is flattened in
+	// the same way as the arguments to FlatCmd, so it may be a map, a struct,
+	// or a slice of alternating fields and values. Struct fields are encoded
+	// using the same rules as resp2 struct marshaling, e.g. they can be
+	// renamed or skipped using the "redis" tag.
+	Fields interface{}
+}
+
+// StreamWriter adds entries to streams using XADD.
+type StreamWriter struct {
+	c      Client
+	opts   StreamWriterOpts
+	maxLen string // MaxLen formatted for XADD, if set
+}
+
+var errStreamWriterTrim = errors.New("MaxLen and MinAge can't both be set")
+
+// NewStreamWriter returns a new StreamWriter for the given client. An error is
+// returned if opts are invalid.
+//
+// Any changes on opts after calling NewStreamWriter will have no effect.
+func NewStreamWriter(c Client, opts StreamWriterOpts) (*StreamWriter, error) {
+	if opts.MaxLen > 0 && opts.MinAge > 0 {
+		return nil, errStreamWriterTrim
+	}
+
+	sw := &StreamWriter{c: c, opts: opts}
+	if opts.MaxLen > 0 {
+		sw.maxLen = strconv.FormatInt(opts.MaxLen, 10)
+	}
+	return sw, nil
+}
+
+func (sw *StreamWriter) cmd(rcv *StreamEntryID, now time.Time, entry StreamWriterEntry) CmdAction {
+	id := "*"
+	if entry.ID != nil {
+		id = entry.ID.String()
+	}
+
+	args := make([]interface{}, 0, 5)
+	if sw.maxLen != "" || sw.opts.MinAge > 0 {
+		strategy, threshold := "MAXLEN", sw.maxLen
+		if sw.opts.MinAge > 0 {
+			minTime := now.Add(-sw.opts.MinAge).UnixNano() / int64(time.Millisecond)
+			strategy, threshold = "MINID", StreamEntryID{Time: uint64(minTime)}.String()
+		}
+
+		args = append(args, strategy)
+		if sw.opts.Approx {
+			args = append(args, "~")
+		}
+		args = append(args, threshold)
+	}
+
+	args = append(args, id, entry.Fields)
+	return FlatCmd(rcv, "XADD", entry.Stream, args...)
+}
+
+// Add adds a single entry with the given fields to the stream, with an ID
+// generated by redis, and returns the ID. See StreamWriterEntry for how fields
+// is encoded.
+func (sw *StreamWriter) Add(ctx context.Context, stream string, fields interface{}) (StreamEntryID, error) {
+	var id StreamEntryID
+	err := DoContext(ctx, sw.c, sw.cmd(&id, time.Now(), StreamWriterEntry{Stream: stream, Fields: fields}))
+	return id, err
+}
+
+// AddBatch adds all of the given entries using a single pipeline, and returns
+// the ID of each entry in the same order.
+//
+// If the client is a *Cluster the entries may belong to streams in different
+// slots, in which case Cluster.DoPipeline is used. Otherwise the entries are
+// added using Pipeline.
+//
+// If an error is returned some of the entries may still have been added, in
+// which case their IDs are set in the returned slice.
+func (sw *StreamWriter) AddBatch(ctx context.Context, entries ...StreamWriterEntry) ([]StreamEntryID, error) {
+	ids := make([]StreamEntryID, len(entries))
+	cmds := make([]CmdAction, len(entries))
+	now := time.Now()
+	for i, entry := range entries {
+		cmds[i] = sw.cmd(&ids[i], now, entry)
+	}
+
+	if len(cmds) == 0 {
+		return ids, nil
+	} else if c, ok := sw.c.(*Cluster); ok {
+		return ids, c.DoPipeline(ctx, cmds...)
+	}
+	return ids, DoContext(ctx, sw.c, Pipeline(cmds...))
+}
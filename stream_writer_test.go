@@ -0,0 +1,92 @@
+package radix
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type streamWriterTestEntry struct {
+	Foo  string
+	Bar  int    `redis:"bar"`
+	Skip string `redis:"-"`
+}
+
+func TestStreamWriter(t *T) {
+	ctx := context.Background()
+
+	var got []string
+	var n int
+	stub := Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+		got = append(got, strings.Join(args, " "))
+		n++
+		return StreamEntryID{Time: 1, Seq: uint64(n)}.String()
+	})
+
+	assertAdd := func(opts StreamWriterOpts, fields interface{}, exp string) {
+		got = got[:0]
+		sw, err := NewStreamWriter(stub, opts)
+		require.Nil(t, err)
+		id, err := sw.Add(ctx, "stream", fields)
+		require.Nil(t, err)
+		assert.Equal(t, StreamEntryID{Time: 1, Seq: uint64(n)}, id)
+		assert.Equal(t, []string{exp}, got)
+	}
+
+	entry := streamWriterTestEntry{Foo: "a", Bar: 1, Skip: "b"}
+	assertAdd(StreamWriterOpts{}, entry, "XADD stream * Foo a bar 1")
+	assertAdd(StreamWriterOpts{}, map[string]string{"foo": "a"}, "XADD stream * foo a")
+	assertAdd(StreamWriterOpts{}, []string{"foo", "a", "bar", "b"}, "XADD stream * foo a bar b")
+	assertAdd(StreamWriterOpts{MaxLen: 10}, entry, "XADD stream MAXLEN 10 * Foo a bar 1")
+	assertAdd(StreamWriterOpts{MaxLen: 10, Approx: true}, entry, "XADD stream MAXLEN ~ 10 * Foo a bar 1")
+
+	{
+		// the MINID is computed when each entry is added
+		got = got[:0]
+		sw, err := NewStreamWriter(stub, StreamWriterOpts{MinAge: time.Minute, Approx: true})
+		require.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+
+		before := time.Now().Add(-time.Minute)
+		_, err = sw.Add(ctx, "stream", entry)
+		require.Nil(t, err)
+		after := time.Now().Add(-time.Minute)
+
+		require.Len(t, got, 1)
+		args := strings.Split(got[0], " ")
+		require.Equal(t, []string{"XADD", "stream", "MINID", "~"}, args[:4])
+		assert.Equal(t, "* Foo a bar 1", strings.Join(args[5:], " "))
+
+		require.True(t, strings.HasSuffix(args[4], "-0"))
+		minTime, err := strconv.ParseInt(strings.TrimSuffix(args[4], "-0"), 10, 64)
+		require.Nil(t, err)
+		assert.True(t, minTime >= before.UnixNano()/int64(time.Millisecond))
+		assert.True(t, minTime <= after.UnixNano()/int64(time.Millisecond))
+	}
+
+	{
+		_, err := NewStreamWriter(stub, StreamWriterOpts{MaxLen: 10, MinAge: time.Minute})
+		assert.Error(t, err)
+	}
+
+	{
+		got = got[:0]
+		sw, err := NewStreamWriter(stub, StreamWriterOpts{MaxLen: 10})
+		require.Nil(t, err)
+		ids, err := sw.AddBatch(ctx,
+			StreamWriterEntry{Stream: "stream1", Fields: entry},
+			StreamWriterEntry{Stream: "stream2", ID: &StreamEntryID{Time: 2, Seq: 1}, Fields: entry},
+		)
+		require.Nil(t, err)
+		assert.Equal(t, []StreamEntryID{{Time: 1, Seq: uint64(n - 1)}, {Time: 1, Seq: uint64(n)}}, ids)
+		assert.Equal(t, []string{
+			"XADD stream1 MAXLEN 10 * Foo a bar 1",
+			"XADD stream2 MAXLEN 10 2-1 Foo a bar 1",
+		}, got)
+	}
+}
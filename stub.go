@@ -3,6 +3,7 @@ package radix
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"net"
 	"sync"
 	"time"
@@ -93,6 +94,12 @@ func (b *buffer) Decode(u resp.Unmarshaler) error {
 		default:
 		}
 
+		// the deadline may have been moved into the past while waiting, e.g.
+		// to abort a DoContext call
+		if !b.readDeadline.IsZero() && b.readDeadline.Before(time.Now()) {
+			return b.err("read", new(timeoutError))
+		}
+
 		// we have to periodically wakeup to double-check the timeoutCh, if
 		// there is one
 		if timeoutCh != nil {
@@ -134,6 +141,7 @@ func (b *buffer) SetReadDeadline(t time.Time) error {
 		return b.err("set", errClosed)
 	}
 	b.readDeadline = t
+	b.bufL.Broadcast()
 	return nil
 }
 
@@ -189,6 +197,10 @@ func (s *stub) Do(a Action) error {
 	return a.Run(s)
 }
 
+func (s *stub) DoContext(ctx context.Context, a Action) error {
+	return doConnContext(ctx, s, a)
+}
+
 func (s *stub) Encode(m resp.Marshaler) error {
 	// first marshal into a RawMessage
 	buf := new(bytes.Buffer)
@@ -215,7 +227,9 @@ func (s *stub) Encode(m resp.Marshaler) error {
 		// result is an error it is assumed to want to be returned directly.
 		ret := s.fn(ss)
 		if m, ok := ret.(resp.Marshaler); ok {
-			return s.buffer.Encode(m)
+			if err := s.buffer.Encode(m); err != nil {
+				return err
+			}
 		} else if err, _ := ret.(error); err != nil {
 			return err
 		} else if err = s.buffer.Encode(resp2.Any{I: ret}); err != nil {
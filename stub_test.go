@@ -1,6 +1,7 @@
 package radix
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -105,6 +106,39 @@ func TestStubLockingTimeout(t *T) {
 	assert.True(t, nerr.Timeout())
 }
 
+func TestStubDoContext(t *T) {
+	stub := testStub()
+
+	{ // Normal usage
+		var out string
+		require.Nil(t, stub.(ContextClient).DoContext(context.Background(), Cmd(&out, "ECHO", "foo")))
+		assert.Equal(t, "foo", out)
+	}
+
+	{ // Already canceled context
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := stub.(ContextClient).DoContext(ctx, Cmd(nil, "ECHO", "foo"))
+		assert.Equal(t, context.Canceled, err)
+	}
+
+	{ // Context which expires while blocked on a read
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := stub.(ContextClient).DoContext(ctx, WithConn("", func(conn Conn) error {
+			// nothing has been written, so this will block
+			return conn.Decode(resp2.Any{})
+		}))
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "err: %v", err)
+
+		// the error from the interrupted read is kept as well
+		var nerr net.Error
+		assert.True(t, errors.As(err, &nerr), "err: %v", err)
+		assert.True(t, time.Since(start) < 1*time.Second)
+	}
+}
+
 func ExampleStub() {
 	m := map[string]string{}
 	stub := Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
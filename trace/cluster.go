@@ -23,6 +23,9 @@ type ClusterTrace struct {
 
 type ClusterStateChange struct {
 	IsDown bool
+
+	// Addr is the address of the node whose response caused the change.
+	Addr string
 }
 
 type ClusterNodeInfo struct {
@@ -0,0 +1,250 @@
+// Package metrics turns the callbacks of the trace package into metrics. It
+// has no dependency on any particular metrics library, instead the metrics are
+// created through the Registry interface, which is simple to implement on top
+// of most libraries (e.g. prometheus' CounterVec, GaugeVec and HistogramVec).
+//
+// The same disclaimer as for the trace package applies: this package is still
+// under active development and may undergo changes to its types and metrics.
+package metrics
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mediocregopher/radix/v3/trace"
+)
+
+// Counter is a metric whose value only ever increases.
+type Counter interface {
+	Add(float64)
+}
+
+// Gauge is a metric whose value can be set arbitrarily.
+type Gauge interface {
+	Set(float64)
+}
+
+// Histogram is a metric which samples observed values into buckets.
+type Histogram interface {
+	Observe(float64)
+}
+
+// Registry creates the metrics which Metrics records into. The same name may
+// be requested multiple times with different label values, but the set of
+// label names used for a particular name will always be the same. The labels
+// given include those given to ConstLabels. Metrics keeps hold of the metrics
+// it is given, so each name/labels combination is generally only requested
+// once.
+type Registry interface {
+	Counter(name, help string, labels map[string]string) Counter
+	Gauge(name, help string, labels map[string]string) Gauge
+	Histogram(name, help string, labels map[string]string) Histogram
+}
+
+// All metric names, prefixed by the namespace (by default "radix_").
+const (
+	// PoolDoDuration is a Histogram of the seconds taken by each call to
+	// Do on a Pool, labeled by "addr". Like radix.PoolStats, the pipelines
+	// flushed by the Pool's implicit pipelining aren't counted, only the
+	// Actions in them.
+	PoolDoDuration = "pool_do_duration_seconds"
+
+	// PoolDoErrors is a Counter of the calls to Do on a Pool which returned
+	// an error, labeled by "addr". Pipeline flushes are excluded the same way
+	// as for PoolDoDuration.
+	PoolDoErrors = "pool_do_errors_total"
+
+	// PoolConnsCreated is a Counter of the connections created by a Pool,
+	// labeled by "addr" and "reason" (see trace.PoolConnCreatedReason).
+	PoolConnsCreated = "pool_conns_created_total"
+
+	// PoolConnCreateErrors is a Counter of the failed attempts to create a
+	// connection by a Pool, labeled by "addr" and "reason".
+	PoolConnCreateErrors = "pool_conn_create_errors_total"
+
+	// PoolConnsClosed is a Counter of the connections closed by a Pool,
+	// labeled by "addr" and "reason" (see trace.PoolConnClosedReason).
+	PoolConnsClosed = "pool_conns_closed_total"
+
+	// ClusterRedirects is a Counter of the MOVED and ASK errors received by a
+	// Cluster, labeled by "addr" and "type" ("moved" or "ask").
+	ClusterRedirects = "cluster_redirects_total"
+
+	// ClusterDown is a Gauge which is 1 while a Cluster is down and 0
+	// otherwise, labeled by "addr", the node which reported the Cluster being
+	// down. Once the Cluster is available again all of its ClusterDown gauges
+	// are set to 0.
+	ClusterDown = "cluster_down"
+)
+
+var help = map[string]string{
+	PoolDoDuration:       "Seconds taken by calls to Do on the Pool.",
+	PoolDoErrors:         "Calls to Do on the Pool which returned an error.",
+	PoolConnsCreated:     "Connections created by the Pool.",
+	PoolConnCreateErrors: "Failed attempts to create a connection by the Pool.",
+	PoolConnsClosed:      "Connections closed by the Pool.",
+	ClusterRedirects:     "MOVED and ASK errors received by the Cluster.",
+	ClusterDown:          "Whether the Cluster is currently down.",
+}
+
+type opts struct {
+	namespace string
+	labels    map[string]string
+}
+
+// Opt is an optional parameter which can be passed into New in order to
+// affect the metrics it creates.
+type Opt func(*opts)
+
+// Namespace sets the prefix of all metric names. The prefix and the name are
+// joined with an underscore, unless the prefix is empty.
+func Namespace(namespace string) Opt {
+	return func(o *opts) {
+		o.namespace = namespace
+	}
+}
+
+// ConstLabels adds the given labels to every metric, e.g. to distinguish
+// between multiple Pools or Clusters with the same addresses.
+func ConstLabels(labels map[string]string) Opt {
+	return func(o *opts) {
+		o.labels = labels
+	}
+}
+
+// Metrics creates trace callbacks which record metrics into a Registry. A
+// single Metrics may be used to create the traces of any number of Pools and
+// Clusters.
+type Metrics struct {
+	r    Registry
+	opts opts
+
+	// all created metrics, keyed by name and label values, so that each
+	// name/labels combination is only requested from the Registry once.
+	m sync.Map
+}
+
+// New initializes a Metrics which will create its metrics using the given
+// Registry.
+//
+// New takes in a number of options which can overwrite its default behavior.
+// The default options New uses are:
+//
+//	Namespace("radix")
+func New(r Registry, options ...Opt) *Metrics {
+	m := &Metrics{r: r}
+	defaultOpts := []Opt{
+		Namespace("radix"),
+	}
+	for _, opt := range append(defaultOpts, options...) {
+		opt(&m.opts)
+	}
+	return m
+}
+
+func (m *Metrics) fullName(name string) string {
+	if m.opts.namespace == "" {
+		return name
+	}
+	return m.opts.namespace + "_" + name
+}
+
+// get returns the metric with the given name and label key/value pairs,
+// using create to create it if it hasn't been already.
+func (m *Metrics) get(name string, kvs []string, create func(string, string, map[string]string) interface{}) interface{} {
+	key := name + "\x00" + strings.Join(kvs, "\x00")
+	if v, ok := m.m.Load(key); ok {
+		return v
+	}
+
+	labels := make(map[string]string, len(m.opts.labels)+len(kvs)/2)
+	for k, v := range m.opts.labels {
+		labels[k] = v
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		labels[kvs[i]] = kvs[i+1]
+	}
+
+	// two go-routines may both create the metric here, LoadOrStore makes sure
+	// only one is ever used.
+	v, _ := m.m.LoadOrStore(key, create(m.fullName(name), help[name], labels))
+	return v
+}
+
+func (m *Metrics) counter(name string, kvs ...string) Counter {
+	return m.get(name, kvs, func(n, h string, l map[string]string) interface{} {
+		return m.r.Counter(n, h, l)
+	}).(Counter)
+}
+
+func (m *Metrics) gauge(name string, kvs ...string) Gauge {
+	return m.get(name, kvs, func(n, h string, l map[string]string) interface{} {
+		return m.r.Gauge(n, h, l)
+	}).(Gauge)
+}
+
+func (m *Metrics) histogram(name string, kvs ...string) Histogram {
+	return m.get(name, kvs, func(n, h string, l map[string]string) interface{} {
+		return m.r.Histogram(n, h, l)
+	}).(Histogram)
+}
+
+// PoolTrace returns a trace.PoolTrace, to be passed into radix.PoolWithTrace,
+// which records the Pool's metrics.
+func (m *Metrics) PoolTrace() trace.PoolTrace {
+	return trace.PoolTrace{
+		ConnCreated: func(c trace.PoolConnCreated) {
+			name := PoolConnsCreated
+			if c.Err != nil {
+				name = PoolConnCreateErrors
+			}
+			m.counter(name, "addr", c.Addr, "reason", string(c.Reason)).Add(1)
+		},
+		ConnClosed: func(c trace.PoolConnClosed) {
+			m.counter(PoolConnsClosed, "addr", c.Addr, "reason", string(c.Reason)).Add(1)
+		},
+		DoCompleted: func(d trace.PoolDoCompleted) {
+			if d.PipelineFlush {
+				return
+			}
+			m.histogram(PoolDoDuration, "addr", d.Addr).Observe(d.ElapsedTime.Seconds())
+			if d.Err != nil {
+				m.counter(PoolDoErrors, "addr", d.Addr).Add(1)
+			}
+		},
+	}
+}
+
+// ClusterTrace returns a trace.ClusterTrace, to be passed into
+// radix.ClusterWithTrace, which records the Cluster's metrics. The metrics of
+// the Cluster's Pools are recorded separately, see PoolTrace.
+func (m *Metrics) ClusterTrace() trace.ClusterTrace {
+	// the addresses whose ClusterDown gauge is currently set, which may be
+	// different from the address which reports the Cluster as available again.
+	var l sync.Mutex
+	downAddrs := map[string]bool{}
+
+	return trace.ClusterTrace{
+		StateChange: func(s trace.ClusterStateChange) {
+			l.Lock()
+			defer l.Unlock()
+			if s.IsDown {
+				downAddrs[s.Addr] = true
+				m.gauge(ClusterDown, "addr", s.Addr).Set(1)
+				return
+			}
+			downAddrs[s.Addr] = true
+			for addr := range downAddrs {
+				m.gauge(ClusterDown, "addr", addr).Set(0)
+				delete(downAddrs, addr)
+			}
+		},
+		Redirected: func(r trace.ClusterRedirected) {
+			typ := "moved"
+			if r.Ask {
+				typ = "ask"
+			}
+			m.counter(ClusterRedirects, "addr", r.Addr, "type", typ).Add(1)
+		},
+	}
+}
@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/trace"
+)
+
+// testRegistry implements Registry by recording the values of all metrics,
+// keyed by their name and labels.
+type testRegistry struct {
+	l       sync.Mutex
+	created int
+	vals    map[string]float64
+	obs     map[string][]float64
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		vals: map[string]float64{},
+		obs:  map[string][]float64{},
+	}
+}
+
+func testKey(name string, labels map[string]string) string {
+	var kvs []string
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return name + "{" + strings.Join(kvs, ",") + "}"
+}
+
+type testMetric struct {
+	r   *testRegistry
+	key string
+}
+
+func (m testMetric) Add(f float64) {
+	m.r.l.Lock()
+	defer m.r.l.Unlock()
+	m.r.vals[m.key] += f
+}
+
+func (m testMetric) Set(f float64) {
+	m.r.l.Lock()
+	defer m.r.l.Unlock()
+	m.r.vals[m.key] = f
+}
+
+func (m testMetric) Observe(f float64) {
+	m.r.l.Lock()
+	defer m.r.l.Unlock()
+	m.r.obs[m.key] = append(m.r.obs[m.key], f)
+}
+
+func (r *testRegistry) metric(name string, labels map[string]string) testMetric {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.created++
+	return testMetric{r: r, key: testKey(name, labels)}
+}
+
+func (r *testRegistry) Counter(name, _ string, labels map[string]string) Counter {
+	return r.metric(name, labels)
+}
+
+func (r *testRegistry) Gauge(name, _ string, labels map[string]string) Gauge {
+	return r.metric(name, labels)
+}
+
+func (r *testRegistry) Histogram(name, _ string, labels map[string]string) Histogram {
+	return r.metric(name, labels)
+}
+
+func TestPoolTrace(t *T) {
+	r := newTestRegistry()
+	m := New(r, ConstLabels(map[string]string{"service": "test"}))
+	pt := m.PoolTrace()
+
+	common := trace.PoolCommon{Network: "tcp", Addr: "127.0.0.1:6379"}
+	pt.ConnCreated(trace.PoolConnCreated{
+		PoolCommon: common,
+		Reason:     trace.PoolConnCreatedReasonInitialization,
+	})
+	pt.ConnCreated(trace.PoolConnCreated{
+		PoolCommon: common,
+		Reason:     trace.PoolConnCreatedReasonInitialization,
+	})
+	pt.ConnCreated(trace.PoolConnCreated{
+		PoolCommon: common,
+		Reason:     trace.PoolConnCreatedReasonRefill,
+		Err:        errors.New("refused"),
+	})
+	pt.ConnClosed(trace.PoolConnClosed{
+		PoolCommon: common,
+		Reason:     trace.PoolConnClosedReasonPoolFull,
+	})
+	pt.DoCompleted(trace.PoolDoCompleted{
+		PoolCommon:  common,
+		ElapsedTime: 2 * time.Millisecond,
+	})
+	pt.DoCompleted(trace.PoolDoCompleted{
+		PoolCommon:  common,
+		ElapsedTime: 4 * time.Millisecond,
+		Err:         errors.New("boom"),
+	})
+
+	// pipeline flushes aren't counted, like in radix.PoolStats
+	pt.DoCompleted(trace.PoolDoCompleted{
+		PoolCommon:    common,
+		ElapsedTime:   8 * time.Millisecond,
+		Err:           errors.New("boom"),
+		PipelineFlush: true,
+	})
+
+	assert.Equal(t, map[string]float64{
+		"radix_pool_conns_created_total{addr=127.0.0.1:6379,reason=initialization,service=test}": 2,
+		"radix_pool_conn_create_errors_total{addr=127.0.0.1:6379,reason=refill,service=test}":    1,
+		"radix_pool_conns_closed_total{addr=127.0.0.1:6379,reason=pool full,service=test}":       1,
+		"radix_pool_do_errors_total{addr=127.0.0.1:6379,service=test}":                           1,
+	}, r.vals)
+	assert.Equal(t, map[string][]float64{
+		"radix_pool_do_duration_seconds{addr=127.0.0.1:6379,service=test}": {0.002, 0.004},
+	}, r.obs)
+
+	// each metric is only created once
+	assert.Equal(t, 5, r.created)
+}
+
+func TestClusterTrace(t *T) {
+	r := newTestRegistry()
+	m := New(r, Namespace(""))
+	ct := m.ClusterTrace()
+
+	ct.StateChange(trace.ClusterStateChange{IsDown: true, Addr: "a"})
+	assert.Equal(t, float64(1), r.vals["cluster_down{addr=a}"])
+	ct.StateChange(trace.ClusterStateChange{IsDown: true, Addr: "b"})
+	assert.Equal(t, float64(1), r.vals["cluster_down{addr=b}"])
+
+	// the gauge of every node which reported the cluster as down is reset
+	ct.StateChange(trace.ClusterStateChange{IsDown: false, Addr: "c"})
+	assert.Equal(t, float64(0), r.vals["cluster_down{addr=a}"])
+	assert.Equal(t, float64(0), r.vals["cluster_down{addr=b}"])
+	assert.Equal(t, float64(0), r.vals["cluster_down{addr=c}"])
+
+	ct.Redirected(trace.ClusterRedirected{Addr: "a", Moved: true})
+	ct.Redirected(trace.ClusterRedirected{Addr: "a", Ask: true})
+	ct.Redirected(trace.ClusterRedirected{Addr: "b", Moved: true})
+	ct.Redirected(trace.ClusterRedirected{Addr: "a", Moved: true})
+	assert.Equal(t, float64(2), r.vals["cluster_redirects_total{addr=a,type=moved}"])
+	assert.Equal(t, float64(1), r.vals["cluster_redirects_total{addr=a,type=ask}"])
+	assert.Equal(t, float64(1), r.vals["cluster_redirects_total{addr=b,type=moved}"])
+}
+
+func TestPoolTraceWithPool(t *T) {
+	r := newTestRegistry()
+	m := New(r)
+
+	pool, err := radix.NewPool("tcp", "127.0.0.1:6379", 1,
+		radix.PoolConnFunc(func(network, addr string) (radix.Conn, error) {
+			return radix.Stub(network, addr, func(args []string) interface{} {
+				return args[len(args)-1]
+			}), nil
+		}),
+		radix.PoolWithTrace(m.PoolTrace()),
+	)
+	require.Nil(t, err)
+
+	var out string
+	require.Nil(t, pool.Do(radix.Cmd(&out, "ECHO", "foo")))
+	assert.Equal(t, "foo", out)
+	require.Nil(t, pool.Close())
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	assert.Equal(t, float64(1), r.vals["radix_pool_conns_created_total{addr=127.0.0.1:6379,reason=initialization}"])
+	assert.Equal(t, float64(1), r.vals["radix_pool_conns_closed_total{addr=127.0.0.1:6379,reason=pool closed}"])
+	assert.NotEmpty(t, r.obs["radix_pool_do_duration_seconds{addr=127.0.0.1:6379}"])
+}
@@ -1,6 +1,9 @@
 package trace
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // PoolTrace is passed into radix.NewPool via radix.PoolWithTrace, and contains
 // callbacks which will be triggered for specific events during the Pool's
@@ -22,6 +25,13 @@ type PoolTrace struct {
 
 	// InitCompleted is called after pool fills its connections
 	InitCompleted func(PoolInitCompleted)
+
+	// ActionStarted is called before an Action is performed by the Pool, and
+	// ActionCompleted after it has completed. Both are called in the
+	// go-routine which called Do, so the same race condition considerations
+	// apply to them as to DoCompleted.
+	ActionStarted   func(PoolActionStarted)
+	ActionCompleted func(PoolActionCompleted)
 }
 
 // PoolCommon contains information which is passed into all Pool-related
@@ -117,6 +127,11 @@ type PoolDoCompleted struct {
 
 	// This is the error returned from redis.
 	Err error
+
+	// PipelineFlush is set if this Do was the Pool flushing a pipeline of
+	// implicitly pipelined Actions, each of which has already had its own
+	// DoCompleted called.
+	PipelineFlush bool
 }
 
 // PoolInitCompleted is passed into the PoolTrace.InitCompleted callback whenever Pool initialized.
@@ -131,3 +146,60 @@ type PoolInitCompleted struct {
 	// How long it took to fill all connections.
 	ElapsedTime time.Duration
 }
+
+// PoolAction describes the Action which a PoolActionStarted or
+// PoolActionCompleted is for.
+type PoolAction struct {
+	// ID is unique to the Action within the Pool, and can be used to match up
+	// the ActionStarted and ActionCompleted calls for it.
+	ID uint64
+
+	// Cmd is the name of the command, as it was passed into Cmd or FlatCmd,
+	// or EVALSHA for EvalScript Actions. It will be empty for other types of
+	// Action (e.g. Pipeline or WithConn).
+	Cmd string
+
+	// Keys are the keys of the Action, as returned by its Keys method.
+	Keys []string
+
+	// NumArgs is the number of arguments passed to the command, not including
+	// the command name itself. It will be zero if Cmd is empty.
+	NumArgs int
+
+	// Pipelined indicates whether the Action is being implicitly pipelined
+	// with other concurrent Actions.
+	Pipelined bool
+}
+
+// PoolActionStarted is passed into the PoolTrace.ActionStarted callback
+// whenever the Pool is about to perform an Action.
+type PoolActionStarted struct {
+	PoolCommon
+	PoolAction
+
+	// Context is the context the Action is being performed with. It will be
+	// context.Background() if Do was called, rather than DoContext.
+	Context context.Context
+}
+
+// PoolActionCompleted is passed into the PoolTrace.ActionCompleted callback
+// whenever the Pool has performed an Action.
+type PoolActionCompleted struct {
+	PoolCommon
+	PoolAction
+
+	// Context is the context the Action was performed with.
+	Context context.Context
+
+	// ReplySize is the number of bytes which were read from the connection for
+	// the Action's reply. It will be zero if this isn't known, for example if
+	// the Pool's ConnFunc returns Conns not created by radix.Dial or
+	// radix.NewConn.
+	ReplySize int
+
+	// How long it took to perform the Action.
+	ElapsedTime time.Duration
+
+	// The error returned by the Action, if any.
+	Err error
+}
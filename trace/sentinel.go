@@ -0,0 +1,97 @@
+package trace
+
+// SentinelTrace is passed into radix.NewSentinel via radix.SentinelWithTrace,
+// and contains callbacks which will be triggered for specific events during
+// the Sentinel's runtime.
+//
+// All callbacks are called synchronously.
+type SentinelTrace struct {
+	// PrimarySwitched is called when the sentinel reports that the primary
+	// instance has changed, once the Client for the new primary is in place.
+	PrimarySwitched func(SentinelPrimarySwitched)
+
+	// ReplicasChanged is called when the set of replica instances reported by
+	// the sentinel has changed.
+	ReplicasChanged func(SentinelReplicasChanged)
+
+	// SentinelsChanged is called when the set of known sentinel instances has
+	// changed.
+	SentinelsChanged func(SentinelSentinelsChanged)
+
+	// ConnLost is called when the connection to a sentinel instance, which the
+	// Sentinel uses to keep itself up-to-date, has failed or couldn't be made.
+	// It won't be called again until the connection has been reestablished.
+	ConnLost func(SentinelConnLost)
+
+	// ConnReestablished is called when a connection to a sentinel instance has
+	// been made after ConnLost was called.
+	ConnReestablished func(SentinelConnReestablished)
+}
+
+// SentinelCommon contains information which is passed into all
+// Sentinel-related callbacks.
+type SentinelCommon struct {
+	// PrimaryName is the name of the primary which the Sentinel was created
+	// for.
+	PrimaryName string
+}
+
+// SentinelPrimarySwitched is passed into the SentinelTrace.PrimarySwitched
+// callback whenever the primary instance changes.
+type SentinelPrimarySwitched struct {
+	SentinelCommon
+
+	// OldAddr and NewAddr are the addresses of the previous and the current
+	// primary instance.
+	OldAddr, NewAddr string
+}
+
+// SentinelReplicasChanged is passed into the SentinelTrace.ReplicasChanged
+// callback whenever the set of replica instances changes.
+type SentinelReplicasChanged struct {
+	SentinelCommon
+
+	// Added and Removed are the addresses of the replicas which are new and
+	// which are no longer present, respectively. A replica which has been
+	// promoted to primary will be in Removed.
+	Added, Removed []string
+
+	// Addrs are the addresses of all the current replicas.
+	Addrs []string
+}
+
+// SentinelSentinelsChanged is passed into the SentinelTrace.SentinelsChanged
+// callback whenever the set of known sentinel instances changes.
+type SentinelSentinelsChanged struct {
+	SentinelCommon
+
+	// Added and Removed are the addresses of the sentinels which are new and
+	// which are no longer known, respectively.
+	Added, Removed []string
+
+	// Addrs are the addresses of all the currently known sentinels.
+	Addrs []string
+}
+
+// SentinelConnLost is passed into the SentinelTrace.ConnLost callback whenever
+// the connection to a sentinel instance is lost.
+type SentinelConnLost struct {
+	SentinelCommon
+
+	// Addr is the address of the sentinel instance the connection was to. It
+	// will be empty if no connection could be made to any sentinel instance.
+	Addr string
+
+	// Err is the error which caused the connection to be lost.
+	Err error
+}
+
+// SentinelConnReestablished is passed into the
+// SentinelTrace.ConnReestablished callback whenever a connection to a sentinel
+// instance has been made after the previous one was lost.
+type SentinelConnReestablished struct {
+	SentinelCommon
+
+	// Addr is the address of the sentinel instance which was connected to.
+	Addr string
+}
@@ -0,0 +1,297 @@
+package radix
+
+import (
+	"bufio"
+	"context"
+	"math/rand"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp"
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// ErrTransactionAborted is returned from a Transaction's Run method when EXEC
+// was aborted, due to a watched key being modified, on every attempt.
+var ErrTransactionAborted = errors.New("transaction aborted on every attempt")
+
+type transactionOpts struct {
+	maxAttempts            int
+	minBackoff, maxBackoff time.Duration
+}
+
+// TransactionOpt is an optional behavior which can be applied to the
+// Transaction function to effect its behavior.
+type TransactionOpt func(*transactionOpts)
+
+// TransactionMaxAttempts sets the maximum number of times the Transaction will
+// be attempted before ErrTransactionAborted is returned. If n is less than 1
+// the Transaction will be attempted until it succeeds.
+func TransactionMaxAttempts(n int) TransactionOpt {
+	return func(to *transactionOpts) {
+		to.maxAttempts = n
+	}
+}
+
+// TransactionBackoff sets the minimum and maximum time the Transaction will
+// wait before retrying an aborted attempt. The wait starts at min and doubles
+// with every aborted attempt, up to max, with a random jitter applied so that
+// competing Transactions don't retry in lockstep.
+//
+// If min is 0 the first retry is immediate, and the wait then starts from 1ms.
+// If max is 0 retries are never delayed.
+func TransactionBackoff(min, max time.Duration) TransactionOpt {
+	return func(to *transactionOpts) {
+		to.minBackoff, to.maxBackoff = min, max
+	}
+}
+
+// Tx is passed into the callback given to Transaction, and is used to both
+// perform Actions prior to the transaction (e.g. reading the watched keys) and
+// to queue the commands which make up the transaction itself.
+type Tx struct {
+	conn Conn
+	cmds []CmdAction
+}
+
+// Do performs the given Action immediately, outside of the transaction but on
+// the same Conn which the transaction will be performed on. It is generally
+// used for reading the current values of the watched keys.
+func (tx *Tx) Do(a Action) error {
+	return tx.conn.Do(a)
+}
+
+// Queue adds the given CmdActions to the transaction. They will be sent
+// between MULTI and EXEC once the callback returns, and each CmdAction's
+// receiver will be filled with its corresponding reply from EXEC.
+//
+// The given CmdActions should not be used again after being queued.
+func (tx *Tx) Queue(cmds ...CmdAction) {
+	tx.cmds = append(tx.cmds, cmds...)
+}
+
+type transaction struct {
+	keys []string
+	fn   func(*Tx) error
+	opts transactionOpts
+
+	// the keys of the commands queued by the most recent attempt
+	queuedKeys []string
+}
+
+// Transaction returns an Action which performs an optimistic transaction using
+// WATCH, MULTI and EXEC, all on a single Conn. Each attempt goes as follows:
+//
+// * WATCH is called on the given keys, if any.
+//
+// * fn is called with a Tx, which it can use to read the current state of the
+// watched keys via Tx.Do and then queue the commands to perform based on that
+// state via Tx.Queue.
+//
+// * The queued commands are sent between MULTI and EXEC, and each one's reply
+// from EXEC is decoded into its receiver.
+//
+// If EXEC is aborted because one of the watched keys was modified then the
+// attempt is retried from the beginning, after waiting out a backoff. When the
+// Transaction is performed using DoContext the backoff is interrupted once the
+// context is done. If fn
+// returns an error, or doesn't queue any commands, the keys are unwatched and
+// the error (or nil) is returned without performing a transaction.
+//
+// Since fn may be called multiple times it should not have any side-effects
+// other than those it performs with the Tx.
+//
+// When used with a Cluster all keys, both the watched ones and those of the
+// queued commands, must belong to the same slot, as with any other Action. The
+// keys of the queued commands are only known once fn has been called, so if no
+// keys are watched the first attempt may be performed on the wrong node. In
+// that case redis rejects the queued commands with MOVED and the Cluster
+// retries the Transaction on the correct node. The default options Transaction
+// uses are:
+//
+//	TransactionMaxAttempts(10)
+//	TransactionBackoff(1 * time.Millisecond, 100 * time.Millisecond)
+func Transaction(keys []string, fn func(*Tx) error, opts ...TransactionOpt) Action {
+	t := &transaction{keys: keys, fn: fn}
+	defaultTransactionOpts := []TransactionOpt{
+		TransactionMaxAttempts(10),
+		TransactionBackoff(1*time.Millisecond, 100*time.Millisecond),
+	}
+	for _, opt := range append(defaultTransactionOpts, opts...) {
+		opt(&(t.opts))
+	}
+	return t
+}
+
+// Keys returns the watched keys, followed by the keys of the commands queued
+// by the most recent attempt, if any.
+func (t *transaction) Keys() []string {
+	if len(t.queuedKeys) == 0 {
+		return t.keys
+	}
+	keys := make([]string, 0, len(t.keys)+len(t.queuedKeys))
+	keys = append(keys, t.keys...)
+	return append(keys, t.queuedKeys...)
+}
+
+func (t *transaction) Run(conn Conn) error {
+	return t.runContext(context.Background(), conn)
+}
+
+func (t *transaction) runContext(ctx context.Context, conn Conn) error {
+	backoff := t.opts.minBackoff
+	for attempt := 1; ; attempt++ {
+		if aborted, err := t.attempt(conn); err != nil {
+			return err
+		} else if !aborted {
+			return nil
+		} else if t.opts.maxAttempts > 0 && attempt >= t.opts.maxAttempts {
+			return ErrTransactionAborted
+		}
+
+		if backoff > 0 {
+			tm := getTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			select {
+			case <-tm.C:
+			case <-ctx.Done():
+				putTimer(tm)
+				return ctx.Err()
+			}
+			putTimer(tm)
+		}
+		if backoff *= 2; backoff == 0 {
+			backoff = time.Millisecond
+		}
+		if backoff > t.opts.maxBackoff {
+			backoff = t.opts.maxBackoff
+		}
+	}
+}
+
+func (t *transaction) attempt(conn Conn) (bool, error) {
+	if len(t.keys) > 0 {
+		if err := conn.Do(Cmd(nil, "WATCH", t.keys...)); err != nil {
+			return false, err
+		}
+	}
+
+	tx := &Tx{conn: conn}
+	if err := t.fn(tx); err != nil {
+		t.unwatch(conn)
+		return false, err
+	} else if len(tx.cmds) == 0 {
+		t.unwatch(conn)
+		return false, nil
+	}
+
+	t.queuedKeys = t.queuedKeys[:0]
+	for _, cmd := range tx.cmds {
+		t.queuedKeys = append(t.queuedKeys, cmd.Keys()...)
+	}
+
+	if err := conn.Encode(Cmd(nil, "MULTI")); err != nil {
+		return false, err
+	}
+	for _, cmd := range tx.cmds {
+		if err := conn.Encode(cmd); err != nil {
+			return false, err
+		}
+	}
+	if err := conn.Encode(Cmd(nil, "EXEC")); err != nil {
+		return false, err
+	}
+
+	// the replies to MULTI and to each queued command. If a command couldn't
+	// be queued then EXEC will return EXECABORT, but the command's own error is
+	// more useful.
+	var queueErr error
+	for i := 0; i < len(tx.cmds)+1; i++ {
+		if err := conn.Decode(resp2.Any{}); errors.As(err, new(resp2.Error)) {
+			if queueErr == nil {
+				queueErr = err
+			}
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	exec := txExec{cmds: tx.cmds}
+	if err := conn.Decode(&exec); err != nil {
+		if queueErr != nil && errors.As(err, new(resp2.Error)) {
+			return false, queueErr
+		}
+		return false, err
+	}
+	return exec.aborted, nil
+}
+
+func (t *transaction) unwatch(conn Conn) {
+	if len(t.keys) > 0 {
+		// if this fails then the Conn is likely broken anyway, and the original
+		// error is more useful
+		_ = conn.Do(Cmd(nil, "UNWATCH"))
+	}
+}
+
+// ClusterCanRetry implements the method for the ClusterCanRetryAction
+// interface. A MOVED or ASK error can only be returned prior to EXEC
+// performing any of the queued commands, so it's always safe to retry.
+func (t *transaction) ClusterCanRetry() bool {
+	return true
+}
+
+// txExec unmarshals the reply to EXEC, decoding each element into its
+// corresponding queued command.
+type txExec struct {
+	cmds    []CmdAction
+	aborted bool
+}
+
+func (e *txExec) UnmarshalRESP(br *bufio.Reader) error {
+	// the RESP3 null which EXEC returns when aborted gets downgraded to a nil
+	// bulk string
+	if b, err := br.Peek(1); err != nil {
+		return err
+	} else if b[0] == resp2.BulkStringPrefix[0] {
+		var rm resp2.RawMessage
+		if err := rm.UnmarshalRESP(br); err != nil {
+			return err
+		} else if !rm.IsNil() {
+			return resp.ErrDiscarded{Err: errors.Errorf("unexpected EXEC reply %q", rm)}
+		}
+		e.aborted = true
+		return nil
+	}
+
+	var ah resp2.ArrayHeader
+	if err := ah.UnmarshalRESP(br); err != nil {
+		return err
+	} else if ah.N < 0 {
+		e.aborted = true
+		return nil
+	} else if ah.N != len(e.cmds) {
+		for i := 0; i < ah.N; i++ {
+			if err := (resp2.Any{}).UnmarshalRESP(br); err != nil {
+				return err
+			}
+		}
+		return resp.ErrDiscarded{
+			Err: errors.Errorf("expected EXEC to return %d replies but got %d", len(e.cmds), ah.N),
+		}
+	}
+
+	// like with Tuple, return the first error seen once the whole reply has
+	// been read
+	var retErr error
+	for _, cmd := range e.cmds {
+		if err := cmd.UnmarshalRESP(br); err != nil {
+			if !errors.As(err, new(resp.ErrDiscarded)) && !errors.As(err, new(resp2.Error)) {
+				return err
+			} else if retErr == nil {
+				retErr = err
+			}
+		}
+	}
+	return retErr
+}
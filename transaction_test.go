@@ -0,0 +1,262 @@
+package radix
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	errors "golang.org/x/xerrors"
+
+	"github.com/mediocregopher/radix/v3/resp/resp2"
+)
+
+// txStub fakes a redis instance which supports WATCH, MULTI and EXEC for GET,
+// SET and INCR.
+type txStub struct {
+	l        sync.Mutex
+	m        map[string]string
+	versions map[string]int
+	cmds     [][]string
+}
+
+func newTxStub() *txStub {
+	return &txStub{m: map[string]string{}, versions: map[string]int{}}
+}
+
+func (s *txStub) newConn() Conn {
+	var watched map[string]int
+	var queued [][]string
+	var multi, dirty bool
+	return Stub("tcp", "127.0.0.1:6379", func(args []string) interface{} {
+		s.l.Lock()
+		defer s.l.Unlock()
+		s.cmds = append(s.cmds, args)
+
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "MULTI":
+			multi = true
+			return resp2.SimpleString{S: "OK"}
+		case cmd == "EXEC":
+			multi = false
+			defer func() { watched, queued, dirty = nil, nil, false }()
+			if dirty {
+				return resp2.Error{E: errors.New("EXECABORT Transaction discarded because of previous errors.")}
+			}
+			for key, version := range watched {
+				if s.versions[key] != version {
+					return resp2.Array{}
+				}
+			}
+			replies := make([]interface{}, len(queued))
+			for i := range queued {
+				replies[i] = s.do(queued[i])
+			}
+			return replies
+		case cmd == "WATCH":
+			if watched == nil {
+				watched = map[string]int{}
+			}
+			for _, key := range args[1:] {
+				watched[key] = s.versions[key]
+			}
+			return resp2.SimpleString{S: "OK"}
+		case cmd == "UNWATCH":
+			watched = nil
+			return resp2.SimpleString{S: "OK"}
+		case multi:
+			switch cmd {
+			case "GET", "SET", "INCR":
+				queued = append(queued, args)
+				return resp2.SimpleString{S: "QUEUED"}
+			}
+			dirty = true
+			return resp2.Error{E: errors.Errorf("ERR unknown command %q", cmd)}
+		default:
+			return s.do(args)
+		}
+	})
+}
+
+// NOTE l _must_ be held to use do
+func (s *txStub) do(args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if v, ok := s.m[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		s.m[args[1]] = args[2]
+		s.versions[args[1]]++
+		return "OK"
+	case "INCR":
+		i, _ := strconv.Atoi(s.m[args[1]])
+		s.m[args[1]] = strconv.Itoa(i + 1)
+		s.versions[args[1]]++
+		return i + 1
+	default:
+		return resp2.Error{E: errors.Errorf("ERR unknown command %q", args[0])}
+	}
+}
+
+func TestTransaction(t *T) {
+	s := newTxStub()
+	conn, otherConn := s.newConn(), s.newConn()
+	require.Nil(t, otherConn.Do(Cmd(nil, "SET", "foo", "1")))
+
+	var attempts int
+	var prev string
+	var set string
+	var incr int
+	tr := Transaction([]string{"foo"}, func(tx *Tx) error {
+		attempts++
+		if err := tx.Do(Cmd(&prev, "GET", "foo")); err != nil {
+			return err
+		}
+
+		// modify the watched key on the first attempt, so that it's aborted
+		if attempts == 1 {
+			require.Nil(t, otherConn.Do(Cmd(nil, "SET", "foo", "2")))
+		}
+
+		tx.Queue(
+			Cmd(&set, "SET", "foo", prev+"0"),
+			Cmd(&incr, "INCR", "foo"),
+		)
+		return nil
+	}, TransactionBackoff(0, 0))
+	assert.Equal(t, []string{"foo"}, tr.Keys())
+	require.Nil(t, conn.Do(tr))
+
+	// the keys of the queued commands are known once they've been queued
+	assert.Equal(t, []string{"foo", "foo", "foo"}, tr.Keys())
+
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, "2", prev)
+	assert.Equal(t, "OK", set)
+	assert.Equal(t, 21, incr)
+
+	var foo string
+	require.Nil(t, conn.Do(Cmd(&foo, "GET", "foo")))
+	assert.Equal(t, "21", foo)
+}
+
+func TestTransactionAborted(t *T) {
+	s := newTxStub()
+	conn, otherConn := s.newConn(), s.newConn()
+
+	var attempts int
+	start := time.Now()
+	err := conn.Do(Transaction([]string{"foo"}, func(tx *Tx) error {
+		attempts++
+		require.Nil(t, otherConn.Do(Cmd(nil, "INCR", "foo")))
+		tx.Queue(Cmd(nil, "SET", "foo", "bar"))
+		return nil
+	}, TransactionMaxAttempts(3), TransactionBackoff(10*time.Millisecond, 20*time.Millisecond)))
+	assert.Equal(t, ErrTransactionAborted, err)
+	assert.Equal(t, 3, attempts)
+
+	// waits of at least 5ms and 10ms, due to jitter
+	assert.True(t, time.Since(start) >= 15*time.Millisecond)
+
+	// with a min of 0 the first retry is immediate, but later ones still wait
+	attempts = 0
+	start = time.Now()
+	err = conn.Do(Transaction([]string{"foo"}, func(tx *Tx) error {
+		attempts++
+		require.Nil(t, otherConn.Do(Cmd(nil, "INCR", "foo")))
+		tx.Queue(Cmd(nil, "SET", "foo", "bar"))
+		return nil
+	}, TransactionMaxAttempts(3), TransactionBackoff(0, 20*time.Millisecond)))
+	assert.Equal(t, ErrTransactionAborted, err)
+	assert.Equal(t, 3, attempts)
+	assert.True(t, time.Since(start) >= 500*time.Microsecond)
+
+	// the backoff is interrupted by the context given to DoContext
+	attempts = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = DoContext(ctx, conn, Transaction([]string{"foo"}, func(tx *Tx) error {
+		attempts++
+		require.Nil(t, otherConn.Do(Cmd(nil, "INCR", "foo")))
+		tx.Queue(Cmd(nil, "SET", "foo", "bar"))
+		return nil
+	}, TransactionBackoff(time.Hour, time.Hour)))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "err: %v", err)
+	assert.Equal(t, 1, attempts)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestTransactionErrors(t *T) {
+	s := newTxStub()
+	conn := s.newConn()
+
+	{ // an error from the callback unwatches and is returned
+		cbErr := errors.New("callback error")
+		err := conn.Do(Transaction([]string{"foo"}, func(tx *Tx) error {
+			return cbErr
+		}))
+		assert.Equal(t, cbErr, err)
+		assert.Equal(t, []string{"UNWATCH"}, s.cmds[len(s.cmds)-1])
+	}
+
+	{ // an error queueing a command is returned instead of EXECABORT
+		s.l.Lock()
+		s.cmds = nil
+		s.l.Unlock()
+
+		var foo string
+		err := conn.Do(Transaction([]string{"foo"}, func(tx *Tx) error {
+			tx.Queue(Cmd(&foo, "SET", "foo", "bar"), Cmd(nil, "BAZ"))
+			return nil
+		}))
+		assert.True(t, errors.As(err, new(resp2.Error)))
+		assert.Contains(t, err.Error(), "unknown command")
+		assert.Equal(t, [][]string{
+			{"WATCH", "foo"},
+			{"MULTI"},
+			{"SET", "foo", "bar"},
+			{"BAZ"},
+			{"EXEC"},
+		}, s.cmds)
+
+		// nothing was performed, and the conn is still usable afterwards
+		mn := MaybeNil{Rcv: &foo}
+		require.Nil(t, conn.Do(Cmd(&mn, "GET", "foo")))
+		assert.True(t, mn.Nil)
+	}
+}
+
+func ExampleTransaction() {
+	client, err := NewPool("tcp", "127.0.0.1:6379", 10) // or any other client
+	if err != nil {
+		// handle error
+	}
+
+	// This example doubles the value of `key`, retrying if another client
+	// modifies `key` while the transaction is being prepared.
+	key := "someKey"
+	var newVal int
+
+	err = client.Do(Transaction([]string{key}, func(tx *Tx) error {
+		var val int
+		if err := tx.Do(Cmd(&val, "GET", key)); err != nil {
+			return err
+		}
+		tx.Queue(FlatCmd(nil, "SET", key, val*2), Cmd(&newVal, "GET", key))
+		return nil
+	}))
+	if err != nil {
+		// handle error
+	}
+
+	fmt.Printf("the new value is %d\n", newVal)
+}